@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+func init() {
+	commands["fsck"] = command{
+		Usage:       "fsck [-repair]",
+		Description: "check (and repair) the consistency of the storage",
+		Run:         runFsck,
+	}
+}
+
+func runFsck(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("fsck")
+	repair := flagSet.Bool("repair", false, "repair problems which can be fixed")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	problems, err := fsstorage.Check(ctx, options, *repair)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if !problem.Repaired {
+			n++
+		}
+	}
+	if n >= 1 {
+		// Exit with status 1 if any problem remains.
+		return exitError(1)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+func init() {
+	commands["list"] = command{
+		Usage:       "list [PREFIX]",
+		Description: "list keys and versions of values with a prefix",
+		Run:         runList,
+	}
+	commands["dump"] = command{
+		Usage:       "dump [PREFIX]",
+		Description: "print values with a prefix",
+		Run:         runDump,
+	}
+}
+
+func runList(ctx context.Context, options fsstorage.Options, args []string) error {
+	return iterateValues(ctx, options, "list", args, false)
+}
+
+func runDump(ctx context.Context, options fsstorage.Options, args []string) error {
+	return iterateValues(ctx, options, "dump", args, true)
+}
+
+// iterateValues prints values with the prefix given in args, one per line, in ascending
+// order of keys.
+func iterateValues(ctx context.Context, options fsstorage.Options, commandName string, args []string, withValues bool) error {
+	flagSet := newFlagSet(commandName)
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() > 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	s, err := openStorage(options, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	iterator := s.Iterate(ctx, fsstorage.IterateOptions{
+		Prefix:     flagSet.Arg(0),
+		WithValues: withValues,
+	})
+	for iterator.Next() {
+		var v interface{}
+		if withValues {
+			v = valueJSON{
+				Key:     iterator.Key(),
+				Value:   iterator.Value(),
+				Version: formatVersion(iterator.Version()),
+			}
+		} else {
+			v = versionJSON{
+				Key:     iterator.Key(),
+				Version: formatVersion(iterator.Version()),
+			}
+		}
+		if err := printJSON(v); err != nil {
+			return err
+		}
+	}
+	return iterator.Err()
+}
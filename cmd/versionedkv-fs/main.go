@@ -0,0 +1,169 @@
+// Command versionedkv-fs manages storages of versionedkv-fs.
+//
+// Usage:
+//
+//	versionedkv-fs [-dir DIR] COMMAND [ARGS...]
+//
+// Run "versionedkv-fs help" for the list of commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+// Standard streams, which are replaced in tests.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:]))
+}
+
+// command represents a subcommand.
+type command struct {
+	Usage       string
+	Description string
+	Run         func(ctx context.Context, options fsstorage.Options, args []string) error
+}
+
+var commands = map[string]command{}
+
+func run(ctx context.Context, args []string) int {
+	flagSet := flag.NewFlagSet("versionedkv-fs", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	flagSet.Usage = func() { printUsage(flagSet) }
+	baseDirName := flagSet.String("dir", "versionedkv", "base directory of the storage")
+	shardDepth := flagSet.Int("shard-depth", -1, "shard depth of the storage (negative to use the one recorded)")
+	layoutName := flagSet.String("layout", fsstorage.LayoutFiles.String(), "layout of the storage (files or log)")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	args = flagSet.Args()
+	if len(args) == 0 || args[0] == "help" {
+		printUsage(flagSet)
+		return 2
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "versionedkv-fs: unknown command %q\n", args[0])
+		printUsage(flagSet)
+		return 2
+	}
+	layout, ok := parseLayout(*layoutName)
+	if !ok {
+		fmt.Fprintf(stderr, "versionedkv-fs: unknown layout %q\n", *layoutName)
+		return 2
+	}
+	options := fsstorage.Options{BaseDirName: *baseDirName, ShardDepth: *shardDepth, Layout: layout}
+	if err := command.Run(ctx, options, args[1:]); err != nil {
+		var exitError exitError
+		if errors.As(err, &exitError) {
+			return int(exitError)
+		}
+		fmt.Fprintf(stderr, "versionedkv-fs %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(flagSet *flag.FlagSet) {
+	fmt.Fprintf(stderr, "usage: versionedkv-fs [-dir DIR] COMMAND [ARGS...]\n\nflags:\n")
+	flagSet.PrintDefaults()
+	fmt.Fprintf(stderr, "\ncommands:\n")
+	commandNames := make([]string, 0, len(commands))
+	for commandName := range commands {
+		commandNames = append(commandNames, commandName)
+	}
+	sort.Strings(commandNames)
+	for _, commandName := range commandNames {
+		fmt.Fprintf(stderr, "  %-8s %s\n", commandName, commands[commandName].Description)
+	}
+}
+
+// parseLayout returns the layout with the given name.
+func parseLayout(layoutName string) (fsstorage.Layout, bool) {
+	for _, layout := range []fsstorage.Layout{fsstorage.LayoutFiles, fsstorage.LayoutLog} {
+		if layout.String() == layoutName {
+			return layout, true
+		}
+	}
+	return 0, false
+}
+
+// newFlagSet creates a flag set for the given subcommand.
+func newFlagSet(commandName string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(commandName, flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "usage: versionedkv-fs [-dir DIR] %s\n", commands[commandName].Usage)
+		flagSet.PrintDefaults()
+	}
+	return flagSet
+}
+
+// openStorage opens the storage given in options. Unless create is true, the base
+// directory should exist, so that a mistyped directory isn't created by accident.
+func openStorage(options fsstorage.Options, create bool) (fsstorage.Storage, error) {
+	if !create {
+		if _, err := os.Stat(options.BaseDirName); err != nil {
+			return nil, err
+		}
+	}
+	return fsstorage.Open(options)
+}
+
+// printJSON prints the given value as JSON in a line.
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(v)
+}
+
+// readValueArg returns the value given in the argument at the given index, or read from
+// the standard input if the argument is omitted.
+func readValueArg(args []string, i int) (string, error) {
+	if i < len(args) {
+		return args[i], nil
+	}
+	value, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// formatVersion returns the textual representation of the given version, which is empty
+// for nil.
+func formatVersion(version versionedkv.Version) string {
+	if version == nil {
+		return ""
+	}
+	return fmt.Sprint(version)
+}
+
+// parseVersion is the inverse of formatVersion.
+func parseVersion(rawVersion string) versionedkv.Version {
+	if rawVersion == "" {
+		return nil
+	}
+	return rawVersion
+}
+
+// exitError makes the command exit with the given status silently.
+type exitError int
+
+func (ee exitError) Error() string { return fmt.Sprintf("exit status %d", int(ee)) }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun_Args(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	for _, tc := range []struct {
+		Name           string
+		Args           []string
+		ExpectedStatus int
+		ExpectedStderr string
+	}{
+		{
+			Name:           "NoCommand",
+			Args:           nil,
+			ExpectedStatus: 2,
+			ExpectedStderr: "usage: versionedkv-fs",
+		},
+		{
+			Name:           "Help",
+			Args:           []string{"help"},
+			ExpectedStatus: 2,
+			ExpectedStderr: "commands:",
+		},
+		{
+			Name:           "UnknownFlag",
+			Args:           []string{"-foo", "get", "foo"},
+			ExpectedStatus: 2,
+			ExpectedStderr: "flag provided but not defined: -foo",
+		},
+		{
+			Name:           "UnknownCommand",
+			Args:           []string{"-dir", baseDirName, "foo"},
+			ExpectedStatus: 2,
+			ExpectedStderr: `unknown command "foo"`,
+		},
+		{
+			Name:           "UnknownLayout",
+			Args:           []string{"-dir", baseDirName, "-layout", "foo", "get", "foo"},
+			ExpectedStatus: 2,
+			ExpectedStderr: `unknown layout "foo"`,
+		},
+		{
+			Name:           "GetWithoutKey",
+			Args:           []string{"-dir", baseDirName, "get"},
+			ExpectedStatus: 2,
+			ExpectedStderr: "usage: versionedkv-fs [-dir DIR] get KEY",
+		},
+		{
+			Name:           "PutWithExtraArgs",
+			Args:           []string{"-dir", baseDirName, "put", "foo", "bar", "baz"},
+			ExpectedStatus: 2,
+			ExpectedStderr: "usage: versionedkv-fs [-dir DIR] put",
+		},
+		{
+			Name:           "DeleteWithUnknownFlag",
+			Args:           []string{"-dir", baseDirName, "delete", "-foo", "foo"},
+			ExpectedStatus: 2,
+			ExpectedStderr: "flag provided but not defined: -foo",
+		},
+		{
+			Name:           "MissingDir",
+			Args:           []string{"-dir", filepath.Join(baseDirName, "foo"), "get", "foo"},
+			ExpectedStatus: 1,
+			ExpectedStderr: "versionedkv-fs get: ",
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			status, stdout, stderr := runCommand("", tc.Args...)
+			assert.Equal(t, tc.ExpectedStatus, status)
+			assert.Empty(t, stdout)
+			assert.Contains(t, stderr, tc.ExpectedStderr)
+		})
+	}
+}
+
+func TestRun_Values(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	runValueCommand := func(stdin string, args ...string) (int, string, string) {
+		return runCommand(stdin, append([]string{"-dir", baseDirName}, args...)...)
+	}
+
+	// Values are created.
+	status, stdout, stderr := runValueCommand("", "put", "foo", "bar")
+	if !assert.Equal(t, 0, status, "stderr: %s", stderr) {
+		t.FailNow()
+	}
+	var version1 versionJSON
+	decodeJSON(t, stdout, &version1)
+	assert.Equal(t, "foo", version1.Key)
+	assert.NotEmpty(t, version1.Version)
+
+	// Values are read.
+	status, stdout, stderr = runValueCommand("", "get", "foo")
+	if assert.Equal(t, 0, status, "stderr: %s", stderr) {
+		var value valueJSON
+		decodeJSON(t, stdout, &value)
+		assert.Equal(t, valueJSON{Key: "foo", Value: "bar", Version: version1.Version}, value)
+	}
+
+	// Values are updated at the current version, and read from the standard input if
+	// omitted.
+	status, stdout, stderr = runValueCommand("baz", "put", "-if-version", version1.Version, "foo")
+	if !assert.Equal(t, 0, status, "stderr: %s", stderr) {
+		t.FailNow()
+	}
+	var version2 versionJSON
+	decodeJSON(t, stdout, &version2)
+	assert.Equal(t, "foo", version2.Key)
+	assert.NotEqual(t, version1.Version, version2.Version)
+	status, stdout, stderr = runValueCommand("", "get", "foo")
+	if assert.Equal(t, 0, status, "stderr: %s", stderr) {
+		var value valueJSON
+		decodeJSON(t, stdout, &value)
+		assert.Equal(t, valueJSON{Key: "foo", Value: "baz", Version: version2.Version}, value)
+	}
+
+	// Conditional writes tell a version mismatch from a missing value.
+	for _, tc := range []struct {
+		Args           []string
+		ExpectedStderr string
+	}{
+		{
+			Args:           []string{"put", "-if-version", version1.Version, "foo", "qux"},
+			ExpectedStderr: "versionedkv-fs put: version mismatch\n",
+		},
+		{
+			Args:           []string{"put", "-if-version", version1.Version, "qux", "qux"},
+			ExpectedStderr: "versionedkv-fs put: value not found\n",
+		},
+		{
+			Args:           []string{"delete", "-if-version", version1.Version, "foo"},
+			ExpectedStderr: "versionedkv-fs delete: version mismatch\n",
+		},
+		{
+			Args:           []string{"delete", "-if-version", version1.Version, "qux"},
+			ExpectedStderr: "versionedkv-fs delete: value not found\n",
+		},
+		{
+			Args:           []string{"create", "foo", "qux"},
+			ExpectedStderr: "versionedkv-fs create: value already exists\n",
+		},
+	} {
+		status, stdout, stderr = runValueCommand("", tc.Args...)
+		assert.Equal(t, 1, status, "args: %q", tc.Args)
+		assert.Empty(t, stdout, "args: %q", tc.Args)
+		assert.Equal(t, tc.ExpectedStderr, stderr, "args: %q", tc.Args)
+	}
+
+	// Values are deleted.
+	status, stdout, stderr = runValueCommand("", "delete", "-if-version", version2.Version, "foo")
+	if assert.Equal(t, 0, status, "stderr: %s", stderr) {
+		assert.Empty(t, stdout)
+	}
+	for _, args := range [][]string{{"get", "foo"}, {"delete", "foo"}} {
+		status, stdout, stderr = runValueCommand("", args...)
+		assert.Equal(t, 1, status, "args: %q", args)
+		assert.Empty(t, stdout, "args: %q", args)
+		assert.Equal(t, "versionedkv-fs "+args[0]+": value not found\n", stderr, "args: %q", args)
+	}
+}
+
+func makeBaseDir(t *testing.T) string {
+	baseDirName, err := ioutil.TempDir("", "testversionedkvfs.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return baseDirName
+}
+
+// runCommand runs the command with the given arguments and standard input, and returns
+// the exit status and outputs.
+func runCommand(input string, args ...string) (int, string, string) {
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	oldStdin, oldStdout, oldStderr := stdin, stdout, stderr
+	stdin, stdout, stderr = strings.NewReader(input), &stdoutBuffer, &stderrBuffer
+	defer func() {
+		stdin, stdout, stderr = oldStdin, oldStdout, oldStderr
+	}()
+	status := run(context.Background(), args)
+	return status, stdoutBuffer.String(), stderrBuffer.String()
+}
+
+func decodeJSON(t *testing.T, rawJSON string, v interface{}) {
+	decoder := json.NewDecoder(strings.NewReader(rawJSON))
+	decoder.DisallowUnknownFields()
+	if !assert.NoError(t, decoder.Decode(v), "json: %s", rawJSON) {
+		t.FailNow()
+	}
+	assert.False(t, decoder.More(), "json: %s", rawJSON)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+func init() {
+	commands["reshard"] = command{
+		Usage:       "reshard DEPTH",
+		Description: "migrate the storage to another shard depth, while it isn't in use",
+		Run:         runReshard,
+	}
+}
+
+func runReshard(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("reshard")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	shardDepth, err := strconv.Atoi(flagSet.Arg(0))
+	if err != nil {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	// The base directory should exist, so that a mistyped directory isn't created by
+	// accident.
+	if _, err := os.Stat(options.BaseDirName); err != nil {
+		return err
+	}
+	options.ShardDepth = shardDepth
+	return fsstorage.Reshard(ctx, options)
+}
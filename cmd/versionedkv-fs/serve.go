@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/server"
+)
+
+func init() {
+	commands["serve"] = command{
+		Usage:       "serve [-network NETWORK] ADDRESS",
+		Description: "serve the storage over HTTP until interrupted",
+		Run:         runServe,
+	}
+}
+
+func runServe(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("serve")
+	network := flagSet.String("network", "tcp", "network to listen on, tcp or unix")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	s, err := openStorage(options, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	listener, err := net.Listen(*network, flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	httpServer := http.Server{Handler: server.NewHandler(s)}
+	// Shut down on interrupt, which isn't a failure.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		select {
+		case <-signals:
+		case <-ctx.Done():
+		}
+		// Closing the storage ends long polls and watches, which would otherwise hold
+		// the shutdown.
+		s.Close()
+		httpServer.Shutdown(context.Background())
+	}()
+	if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdown
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+func init() {
+	commands["snapshot"] = command{
+		Usage:       "snapshot [FILE]",
+		Description: "write a consistent snapshot of values to a file (or the standard output)",
+		Run:         runSnapshot,
+	}
+	commands["restore"] = command{
+		Usage:       "restore [-replace] [FILE]",
+		Description: "restore values from a snapshot in a file (or the standard input)",
+		Run:         runRestore,
+	}
+}
+
+func runSnapshot(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("snapshot")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() > 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	s, err := openStorage(options, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if flagSet.NArg() == 0 {
+		return s.Snapshot(ctx, stdout)
+	}
+	// Write to a temporary file first, so that an existing snapshot isn't overwritten
+	// by an incomplete one.
+	fileName := flagSet.Arg(0)
+	tempFileName := fileName + ".tmp"
+	file, err := os.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	err = s.Snapshot(ctx, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+	return os.Rename(tempFileName, fileName)
+}
+
+func runRestore(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("restore")
+	replace := flagSet.Bool("replace", false, "delete values not in the snapshot, instead of keeping them")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() > 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	var reader io.Reader = stdin
+	if flagSet.NArg() == 1 {
+		file, err := os.Open(flagSet.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	mode := fsstorage.RestoreModeMerge
+	if *replace {
+		mode = fsstorage.RestoreModeReplace
+	}
+	s, err := openStorage(options, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Restore(ctx, reader, mode)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+func init() {
+	commands["get"] = command{
+		Usage:       "get KEY",
+		Description: "print the value for a key",
+		Run:         runGet,
+	}
+	commands["put"] = command{
+		Usage:       "put [-if-version VERSION] KEY [VALUE]",
+		Description: "create or update the value for a key",
+		Run:         runPut,
+	}
+	commands["create"] = command{
+		Usage:       "create KEY [VALUE]",
+		Description: "create the value for a key if it doesn't exist",
+		Run:         runCreate,
+	}
+	commands["delete"] = command{
+		Usage:       "delete [-if-version VERSION] KEY",
+		Description: "delete the value for a key",
+		Run:         runDelete,
+	}
+}
+
+var (
+	errValueNotFound   = errors.New("value not found")
+	errValueExists     = errors.New("value already exists")
+	errVersionMismatch = errors.New("version mismatch")
+)
+
+// valueJSON is the JSON representation of a value.
+type valueJSON struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version string `json:"version"`
+}
+
+// versionJSON is the JSON representation of a version of a value.
+type versionJSON struct {
+	Key     string `json:"key"`
+	Version string `json:"version"`
+}
+
+func runGet(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("get")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	key := flagSet.Arg(0)
+	s, err := openStorage(options, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	value, version, err := s.GetValue(ctx, key)
+	if err != nil {
+		return err
+	}
+	if version == nil {
+		return errValueNotFound
+	}
+	return printJSON(valueJSON{
+		Key:     key,
+		Value:   value,
+		Version: formatVersion(version),
+	})
+}
+
+func runPut(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("put")
+	ifVersion := flagSet.String("if-version", "", "update the value only if the current version is `VERSION`")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if n := flagSet.NArg(); n < 1 || n > 2 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	key := flagSet.Arg(0)
+	// Read the value from the standard input if omitted.
+	value, err := readValueArg(flagSet.Args(), 1)
+	if err != nil {
+		return err
+	}
+	s, err := openStorage(options, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	var version versionedkv.Version
+	if *ifVersion == "" {
+		version, err = s.CreateOrUpdateValue(ctx, key, value, nil)
+	} else {
+		version, err = s.UpdateValue(ctx, key, value, parseVersion(*ifVersion))
+	}
+	if err != nil {
+		return err
+	}
+	if version == nil {
+		return conditionError(ctx, s, key)
+	}
+	return printJSON(versionJSON{
+		Key:     key,
+		Version: formatVersion(version),
+	})
+}
+
+func runCreate(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("create")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if n := flagSet.NArg(); n < 1 || n > 2 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	key := flagSet.Arg(0)
+	// Read the value from the standard input if omitted.
+	value, err := readValueArg(flagSet.Args(), 1)
+	if err != nil {
+		return err
+	}
+	s, err := openStorage(options, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	version, err := s.CreateValue(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	if version == nil {
+		return errValueExists
+	}
+	return printJSON(versionJSON{
+		Key:     key,
+		Version: formatVersion(version),
+	})
+}
+
+func runDelete(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("delete")
+	ifVersion := flagSet.String("if-version", "", "delete the value only if the current version is `VERSION`")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	key := flagSet.Arg(0)
+	s, err := openStorage(options, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	ok, err := s.DeleteValue(ctx, key, parseVersion(*ifVersion))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if *ifVersion == "" {
+			return errValueNotFound
+		}
+		return conditionError(ctx, s, key)
+	}
+	return nil
+}
+
+// conditionError returns the error for a write conditional on the version of the value
+// for the given key, which has been refused, telling a missing value from a version
+// mismatch.
+func conditionError(ctx context.Context, s fsstorage.Storage, key string) error {
+	_, version, err := s.GetValue(ctx, key)
+	if err != nil {
+		return err
+	}
+	if version == nil {
+		return errValueNotFound
+	}
+	return errVersionMismatch
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+func init() {
+	commands["watch"] = command{
+		Usage:       "watch [-values] [PREFIX]",
+		Description: "print changes to values with a prefix until interrupted",
+		Run:         runWatch,
+	}
+}
+
+// watchEventJSON is the JSON representation of a watch event.
+type watchEventJSON struct {
+	Type       string  `json:"type"`
+	Key        string  `json:"key,omitempty"`
+	OldVersion string  `json:"old_version,omitempty"`
+	NewVersion string  `json:"new_version,omitempty"`
+	Value      *string `json:"value,omitempty"`
+}
+
+func runWatch(ctx context.Context, options fsstorage.Options, args []string) error {
+	flagSet := newFlagSet("watch")
+	withValues := flagSet.Bool("values", false, "print new values as well as versions")
+	if err := flagSet.Parse(args); err != nil {
+		return exitError(2)
+	}
+	if flagSet.NArg() > 1 {
+		flagSet.Usage()
+		return exitError(2)
+	}
+	s, err := openStorage(options, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Stop watching on interrupt, which isn't a failure.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	events, err := s.Watch(ctx, flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		eventJSON := watchEventJSON{
+			Type:       event.Type.String(),
+			Key:        event.Key,
+			OldVersion: formatVersion(event.OldVersion),
+			NewVersion: formatVersion(event.NewVersion),
+		}
+		if *withValues && event.NewVersion != nil {
+			value, ok, err := s.GetValueAt(ctx, event.Key, event.NewVersion)
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return err
+			}
+			// The new version may have been superseded and removed in the meantime.
+			if ok {
+				eventJSON.Value = &value
+			}
+		}
+		if err := printJSON(eventJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,550 @@
+package fsstorage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// ChangeType represents the type of changes.
+type ChangeType int
+
+const (
+	// ChangePut indicates a value has been created or updated.
+	ChangePut ChangeType = 1 + iota
+
+	// ChangeDelete indicates a value has been deleted, or has expired.
+	ChangeDelete
+)
+
+// String implements fmt.Stringer.
+func (ct ChangeType) String() string {
+	switch ct {
+	case ChangePut:
+		return "put"
+	case ChangeDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Change represents a change of a value recorded in the change journal.
+type Change struct {
+	// Revision is the revision of the change. Changes made by a transaction share a
+	// revision. For puts, it's the revision of the version put, except for values
+	// restored from snapshots, which keep their versions.
+	Revision int64
+
+	Type ChangeType
+	Key  string
+
+	// Version is the version put, which is nil for ChangeDelete.
+	Version versionedkv.Version
+}
+
+func (fss *fsStorage) Changes(ctx context.Context, sinceRevision int64) (*ChangeStream, error) {
+	cs, err := fss.doChanges(ctx, sinceRevision)
+	return cs, wrapError("", err)
+}
+
+func (fss *fsStorage) doChanges(ctx context.Context, sinceRevision int64) (*ChangeStream, error) {
+	if sinceRevision < 0 {
+		return nil, fmt.Errorf("fsstorage: negative revision %d", sinceRevision)
+	}
+	// Subscribe before reading the change journal, so that no change after reading is
+	// missed.
+	subscriber, err := fss.eventBus.AddSubscriber()
+	if err != nil {
+		if err == internal.ErrEventBusClosed {
+			err = versionedkv.ErrStorageClosed
+		}
+		return nil, err
+	}
+	cs := ChangeStream{
+		fss:           fss,
+		ctx:           ctx,
+		subscriber:    subscriber,
+		sinceRevision: sinceRevision,
+	}
+	// Fail early if the changes have been truncated.
+	if err := cs.readChanges(); err != nil {
+		cs.Close()
+		return nil, err
+	}
+	return &cs, nil
+}
+
+// ChangeStream streams changes recorded in the change journal, which is returned by
+// Storage.Changes. It's not safe for concurrent use.
+type ChangeStream struct {
+	fss           *fsStorage
+	ctx           context.Context
+	subscriber    internal.Subscriber
+	sinceRevision int64
+
+	// segmentFileName is the name of the segment being read, and offset is the offset
+	// of the next change in the segment.
+	segmentFileName string
+	offset          int64
+
+	changes  []changeRecord
+	change   Change
+	err      error
+	isClosed bool
+}
+
+// Next advances the stream to the next change, waiting for one to be made if all the
+// changes journaled have been read, and returns whether there is one. It returns false
+// once the context is done, the storage is closed, the stream is closed or an error
+// occurs, after which Err should be checked.
+func (cs *ChangeStream) Next() bool {
+	for {
+		if cs.err != nil || cs.isClosed {
+			return false
+		}
+		if len(cs.changes) >= 1 {
+			change := cs.changes[0]
+			cs.changes = cs.changes[1:]
+			cs.change = Change{
+				Revision: change.Revision,
+				Type:     change.Type,
+				Key:      change.Key,
+				Version:  version2OpaqueVersion(change.Version),
+			}
+			return true
+		}
+		if err := cs.readChanges(); err != nil {
+			cs.fail(wrapError("", err))
+			continue
+		}
+		if len(cs.changes) >= 1 {
+			continue
+		}
+		select {
+		case <-cs.subscriber.Event():
+			cs.subscriber.TakeEvents()
+		case <-cs.fss.closure:
+			cs.fail(versionedkv.ErrStorageClosed)
+		case <-cs.ctx.Done():
+			cs.fail(cs.ctx.Err())
+		}
+	}
+}
+
+// Change returns the current change.
+func (cs *ChangeStream) Change() Change { return cs.change }
+
+// Err returns the error occurred during streaming, if any. If changes not read yet have
+// been truncated from the change journal, ErrCompacted is returned.
+func (cs *ChangeStream) Err() error { return cs.err }
+
+// Close stops the stream.
+func (cs *ChangeStream) Close() {
+	if cs.isClosed {
+		return
+	}
+	cs.isClosed = true
+	cs.fss.eventBus.RemoveSubscriber(cs.subscriber)
+}
+
+func (cs *ChangeStream) fail(err error) {
+	cs.err = err
+	cs.Close()
+}
+
+// readChanges reads changes from the change journal, following the changes read, up to
+// a limit.
+func (cs *ChangeStream) readChanges() error {
+	fss := cs.fss
+	if cs.segmentFileName == "" {
+		// Find the segment which should contain the first change since the revision.
+		segments, err := fss.listChangeSegments()
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(segments), func(i int) bool { return segments[i].FirstRevision > cs.sinceRevision+1 }) - 1
+		if i < 0 {
+			// Changes since the revision should be in the segments, if any.
+			if len(segments) >= 1 {
+				return ErrCompacted
+			}
+			revision, err := fss.readRevision()
+			if err != nil {
+				return err
+			}
+			if revision > cs.sinceRevision {
+				return ErrCompacted
+			}
+			return nil
+		}
+		cs.segmentFileName = segments[i].FileName
+		cs.offset = 0
+	}
+	for {
+		segmentFile, err := fss.fs.OpenFile(cs.segmentFileName, os.O_RDONLY, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The segment has been removed by rotation before being read through.
+				return ErrCompacted
+			}
+			return err
+		}
+		isEOF, err := cs.readSegment(segmentFile)
+		segmentFile.Close()
+		if err != nil || !isEOF {
+			return err
+		}
+		// Segments are appended to until the next one is started, so a segment is read
+		// through once the next one exists. Segments are contiguous, as only the oldest
+		// ones are removed.
+		nextSegment, ok, err := fss.findNextChangeSegment(cs.segmentFileName)
+		if err != nil || !ok {
+			return err
+		}
+		cs.segmentFileName = nextSegment.FileName
+		cs.offset = 0
+		if len(cs.changes) >= maxChangesRead {
+			return nil
+		}
+	}
+}
+
+const maxChangesRead = 1000
+
+// findChangedKeys returns which of the given keys have changes journaled after the given
+// revision. If changes since the revision have been truncated, ErrCompacted is returned.
+func (fss *fsStorage) findChangedKeys(keys []string, sinceRevision int64) (map[string]bool, error) {
+	changedKeys := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		changedKeys[key] = false
+	}
+	cs := ChangeStream{
+		fss:           fss,
+		sinceRevision: sinceRevision,
+	}
+	for {
+		if err := cs.readChanges(); err != nil {
+			return nil, err
+		}
+		if len(cs.changes) == 0 {
+			return changedKeys, nil
+		}
+		for _, change := range cs.changes {
+			if _, ok := changedKeys[change.Key]; ok {
+				changedKeys[change.Key] = true
+			}
+		}
+		cs.changes = cs.changes[:0]
+	}
+}
+
+// readSegment reads changes from the given segment, and returns whether the end of the
+// segment has been reached.
+func (cs *ChangeStream) readSegment(segmentFile internal.File) (bool, error) {
+	if _, err := segmentFile.Seek(cs.offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(segmentFile)
+	for len(cs.changes) < maxChangesRead {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				// A change being appended is read once it's complete.
+				return true, nil
+			}
+			return false, err
+		}
+		cs.offset += int64(len(line))
+		var change changeRecord
+		if err := json.Unmarshal(line, &change); err != nil {
+			// A change torn by a crash, which is terminated by the next change appended.
+			continue
+		}
+		if change.Revision <= cs.sinceRevision {
+			continue
+		}
+		cs.changes = append(cs.changes, change)
+	}
+	return false, nil
+}
+
+// changeRecord represents a change in the change journal. The change journal is made of
+// segments, each of which is named after the first revision it covers, in hex, and is a
+// sequence of changes in JSON, one per line. Changes are appended to the last segment,
+// until it reaches a quarter of Options.ChangeJournalLimit, after which the next segment
+// is started, and the oldest ones are removed to keep the change journal within the
+// limit.
+type changeRecord struct {
+	Revision int64      `json:"revision"`
+	Type     ChangeType `json:"type"`
+	Key      string     `json:"key"`
+	Version  string     `json:"version,omitempty"`
+}
+
+// appendChanges appends the given changes to the change journal. The revision counter
+// should be locked exclusively.
+func (fss *fsStorage) appendChanges(changes []changeRecord) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	segments, err := fss.listChangeSegments()
+	if err != nil {
+		return err
+	}
+	segmentSize := fss.options.ChangeJournalLimit / 4
+	var segmentFileName string
+	if n := len(segments); n >= 1 && segments[n-1].Size < segmentSize {
+		segmentFileName = segments[n-1].FileName
+	} else {
+		segmentFileName = fss.changeSegmentFileName(changes[0].Revision)
+		totalSize := segmentSize
+		for _, segment := range segments {
+			totalSize += segment.Size
+		}
+		for _, segment := range segments {
+			if totalSize <= fss.options.ChangeJournalLimit {
+				break
+			}
+			if err := ignoreNotExist(fss.fs.Remove(segment.FileName)); err != nil {
+				return err
+			}
+			totalSize -= segment.Size
+		}
+	}
+	segmentFile, err := fss.fs.OpenFile(segmentFileName, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer segmentFile.Close()
+	size, err := segmentFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	var buffer []byte
+	if size >= 1 {
+		// Terminate a change torn by a crash, if any.
+		if _, err := segmentFile.Seek(size-1, io.SeekStart); err != nil {
+			return err
+		}
+		var lastByte [1]byte
+		if _, err := io.ReadFull(segmentFile, lastByte[:]); err != nil {
+			return err
+		}
+		if lastByte[0] != '\n' {
+			buffer = append(buffer, '\n')
+		}
+	}
+	for _, change := range changes {
+		rawChange, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, rawChange...)
+		buffer = append(buffer, '\n')
+	}
+	if _, err := segmentFile.Write(buffer); err != nil {
+		return err
+	}
+	if fss.options.Durability < DurabilityFull {
+		return nil
+	}
+	if err := segmentFile.Sync(); err != nil {
+		return err
+	}
+	if size == 0 {
+		return fss.syncDir(fss.dirNames.Changes)
+	}
+	return nil
+}
+
+// revertChange journals the actual value for the given version file, which should be
+// locked exclusively, after applying the given change journaled ahead to the version file
+// failed, unless the change took effect nonetheless, e.g. only syncing failed. Streams of
+// changes thus converge on the actual value, without the caller knowing what's been
+// written. Failures are logged only, as the failure applying the change is returned.
+func (fss *fsStorage) revertChange(change changeRecord, versionFile internal.File) {
+	version, err := fss.readActualVersion(change.Key, versionFile)
+	if err != nil {
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelError,
+			Message: "failed to read value to revert change journaled",
+			Key:     change.Key,
+			Version: change.Version,
+			Path:    versionFile.Name(),
+			Err:     err,
+		})
+		return
+	}
+	if version == change.Version {
+		return
+	}
+	fss.revertChanges([]changeRecord{makeRevertChange(change.Key, version)})
+}
+
+// readActualVersion reads the current version from the given version file, regardless
+// of the position of the version file, which is empty if the value has been deleted or
+// has expired.
+func (fss *fsStorage) readActualVersion(key string, versionFile internal.File) (string, error) {
+	if _, err := versionFile.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	rawRecord, err := readVersionFile(versionFile)
+	if err != nil {
+		return "", err
+	}
+	record, ok := parseVersionRecord(rawRecord)
+	if !ok {
+		return "", newCorruptionError(key, fmt.Errorf("malformed version %q", rawRecord))
+	}
+	expireTime, err := fss.effectiveExpireTime(record)
+	if err != nil {
+		return "", err
+	}
+	if isExpired(expireTime, time.Now()) {
+		return "", nil
+	}
+	return record.Version, nil
+}
+
+// revertChanges journals the given changes, which revert changes journaled ahead but
+// failed to be applied. Failures are logged only.
+func (fss *fsStorage) revertChanges(reverts []changeRecord) {
+	if _, err := fss.allocateRevision(reverts); err != nil {
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelError,
+			Message: "failed to revert changes journaled",
+			Path:    fss.dirNames.Changes,
+			Err:     err,
+		})
+	}
+}
+
+// makeRevertChange makes the change setting the value for the given key back to the
+// given version, which is empty if the value didn't exist.
+func makeRevertChange(key string, version string) changeRecord {
+	if version == "" {
+		return changeRecord{Type: ChangeDelete, Key: key}
+	}
+	return changeRecord{Type: ChangePut, Key: key, Version: version}
+}
+
+// startChangeJournal starts the change journal at the given revision, unless it has
+// been started, so that changes since the revision are known to be in the change
+// journal. The revision counter should be locked exclusively.
+func (fss *fsStorage) startChangeJournal(firstRevision int64) error {
+	segments, err := fss.listChangeSegments()
+	if err != nil || len(segments) >= 1 {
+		return err
+	}
+	segmentFile, err := fss.fs.OpenFile(fss.changeSegmentFileName(firstRevision), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	return segmentFile.Close()
+}
+
+// lastJournaledRevision returns the revision of the last change in the change journal,
+// or 0 if there is none.
+func (fss *fsStorage) lastJournaledRevision() (int64, error) {
+	segments, err := fss.listChangeSegments()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		segmentFile, err := fss.fs.OpenFile(segments[i].FileName, os.O_RDONLY, 0)
+		if err != nil {
+			return 0, ignoreNotExist(err)
+		}
+		var revision int64
+		scanner := bufio.NewScanner(segmentFile)
+		scanner.Buffer(nil, math.MaxInt32)
+		for scanner.Scan() {
+			var change changeRecord
+			if json.Unmarshal(scanner.Bytes(), &change) == nil && change.Revision > revision {
+				revision = change.Revision
+			}
+		}
+		err = scanner.Err()
+		segmentFile.Close()
+		if err != nil {
+			return 0, err
+		}
+		if revision >= 1 {
+			return revision, nil
+		}
+	}
+	return 0, nil
+}
+
+// changeSegment represents a segment of the change journal.
+type changeSegment struct {
+	FileName      string
+	FirstRevision int64
+	Size          int64
+}
+
+// listChangeSegments lists the segments of the change journal in order of revisions.
+func (fss *fsStorage) listChangeSegments() ([]changeSegment, error) {
+	fileInfos, err := fss.fs.ReadDir(fss.dirNames.Changes)
+	if err != nil {
+		return nil, err
+	}
+	var segments []changeSegment
+	for _, fileInfo := range fileInfos {
+		firstRevision, ok := parseChangeSegmentBaseName(fileInfo.Name())
+		if !ok || fileInfo.IsDir() {
+			continue
+		}
+		segments = append(segments, changeSegment{
+			FileName:      filepath.Join(fss.dirNames.Changes, fileInfo.Name()),
+			FirstRevision: firstRevision,
+			Size:          fileInfo.Size(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].FirstRevision < segments[j].FirstRevision })
+	return segments, nil
+}
+
+// findNextChangeSegment finds the segment following the given one.
+func (fss *fsStorage) findNextChangeSegment(segmentFileName string) (changeSegment, bool, error) {
+	firstRevision, _ := parseChangeSegmentBaseName(filepath.Base(segmentFileName))
+	segments, err := fss.listChangeSegments()
+	if err != nil {
+		return changeSegment{}, false, err
+	}
+	for _, segment := range segments {
+		if segment.FirstRevision > firstRevision {
+			return segment, true, nil
+		}
+	}
+	return changeSegment{}, false, nil
+}
+
+func (fss *fsStorage) changeSegmentFileName(firstRevision int64) string {
+	return filepath.Join(fss.dirNames.Changes, fmt.Sprintf("%0*x", revisionDigits, firstRevision))
+}
+
+func parseChangeSegmentBaseName(baseName string) (int64, bool) {
+	if len(baseName) != revisionDigits {
+		return 0, false
+	}
+	firstRevision, err := strconv.ParseInt(baseName, 16, 64)
+	if err != nil || firstRevision < 1 {
+		return 0, false
+	}
+	return firstRevision, true
+}
+
+const defaultChangeJournalLimit = 64 << 20
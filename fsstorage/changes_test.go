@@ -0,0 +1,495 @@
+package fsstorage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Changes(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	options := Options{BaseDirName: baseDirName}
+	s1, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	version1, err := s1.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version2, err := s1.UpdateValue(ctx, "foo", "baz", version1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = s1.DeleteValue(ctx, "foo", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, newVersions, err := s1.CommitTxn(ctx, Txn{
+		Puts:    []TxnPut{{Key: "qux", Value: "quux"}},
+		Deletes: []string{"foo"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision1, _ := Revision(version1)
+	revision2, _ := Revision(version2)
+	revision4, _ := Revision(newVersions[0])
+	expectedChanges := []Change{
+		{Revision: revision1, Type: ChangePut, Key: "foo", Version: version1},
+		{Revision: revision2, Type: ChangePut, Key: "foo", Version: version2},
+		{Revision: revision2 + 1, Type: ChangeDelete, Key: "foo"},
+		{Revision: revision4, Type: ChangePut, Key: "qux", Version: newVersions[0]},
+	}
+
+	// Changes journaled are replayed.
+	cs, err := s2.Changes(ctx, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	for _, expectedChange := range expectedChanges {
+		if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+			assert.Equal(t, expectedChange, cs.Change())
+		}
+	}
+
+	// Changes made afterwards follow, including ones made by other storages.
+	version5, err := s1.CreateValue(ctx, "corge", "grault")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision5, _ := Revision(version5)
+	if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+		assert.Equal(t, Change{Revision: revision5, Type: ChangePut, Key: "corge", Version: version5}, cs.Change())
+	}
+
+	// Streaming resumes from a revision.
+	cs2, err := s1.Changes(ctx, revision2)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs2.Close()
+	if assert.True(t, cs2.Next(), "err: %v", cs2.Err()) {
+		assert.Equal(t, expectedChanges[2], cs2.Change())
+	}
+
+	// Streaming stops once the context is done.
+	ctx2, cancel2 := context.WithCancel(ctx)
+	cs3, err := s1.Changes(ctx2, revision5)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cancel2()
+	assert.False(t, cs3.Next())
+	assert.Equal(t, context.Canceled, cs3.Err())
+}
+
+func TestFSStorage_Changes_Compacted(t *testing.T) {
+	s, err := makeStorageWithOptions(Options{ChangeJournalLimit: 1000})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cs, err := s.Changes(ctx, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	var lastRevision int64
+	for i := 0; i < 100; i++ {
+		version, err := s.CreateOrUpdateValue(ctx, "foo", strings.Repeat("x", i), nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		lastRevision, _ = Revision(version)
+	}
+
+	// Changes not read yet have been truncated.
+	assert.False(t, cs.Next())
+	assert.True(t, errors.Is(cs.Err(), ErrCompacted), "err: %v", cs.Err())
+	_, err = s.Changes(ctx, 0)
+	assert.True(t, errors.Is(err, ErrCompacted), "err: %v", err)
+
+	// Recent changes are kept.
+	cs2, err := s.Changes(ctx, lastRevision-2)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs2.Close()
+	for _, revision := range []int64{lastRevision - 1, lastRevision} {
+		if assert.True(t, cs2.Next(), "err: %v", cs2.Err()) {
+			assert.Equal(t, revision, cs2.Change().Revision)
+		}
+	}
+}
+
+func TestFSStorage_Changes_Restore(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cs, err := s.Changes(ctx, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	// Revisions skipped by restoring aren't taken as truncated.
+	version := fmt.Sprintf("%016x-%s", 1000, xid.New().String())
+	snapshot := `{"format":"versionedkv-fs-snapshot/1"}` + "\n" +
+		fmt.Sprintf(`{"key":"foo","value":"YmFy","version":%q}`, version) + "\n"
+	err = s.Restore(ctx, strings.NewReader(snapshot), RestoreModeMerge)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+		assert.Equal(t, Change{Revision: 1001, Type: ChangePut, Key: "foo", Version: version}, cs.Change())
+	}
+	_, err = s.Changes(ctx, 0)
+	assert.NoError(t, err)
+}
+
+func TestFSStorage_Changes_Expiration(t *testing.T) {
+	s, err := makeStorageWithOptions(Options{ReapInterval: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	version, err := s.CreateValueWithTTL(ctx, "foo", "bar", 50*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision, _ := Revision(version)
+	cs, err := s.Changes(ctx, revision)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+		assert.Equal(t, Change{Revision: revision + 1, Type: ChangeDelete, Key: "foo"}, cs.Change())
+	}
+}
+
+func TestFSStorage_Changes_Faults(t *testing.T) {
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	options := Options{
+		BaseDirName: "versionedkv",
+		Durability:  DurabilityFull,
+	}
+	s, err := OpenWithFS(options, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision, _ := Revision(version)
+	cs, err := s.Changes(ctx, revision)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	nextChange := func() Change {
+		if !assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+			t.FailNow()
+		}
+		return cs.Change()
+	}
+	errInjected := errors.New("injected")
+	injectFault := func(op internal.FaultOp, dirName string) {
+		faultDirName := filepath.Join(options.BaseDirName, dirName) + string(filepath.Separator)
+		fs.SetFault(func(op2 internal.FaultOp, name string) error {
+			if op2 == op && strings.HasPrefix(name, faultDirName) {
+				return errInjected
+			}
+			return nil
+		})
+	}
+
+	// A delete failed is reverted by putting the value back.
+	injectFault(internal.FaultOpTruncate, "versions")
+	_, err = s.DeleteValue(ctx, "foo", nil)
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+	fs.SetFault(nil)
+	change := nextChange()
+	assert.Equal(t, Change{Revision: revision + 1, Type: ChangeDelete, Key: "foo"}, change)
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 2, Type: ChangePut, Key: "foo", Version: version}, change)
+
+	// So is an update failed.
+	injectFault(internal.FaultOpWrite, "values")
+	_, err = s.UpdateValue(ctx, "foo", "baz", version)
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+	fs.SetFault(nil)
+	change = nextChange()
+	assert.Equal(t, ChangePut, change.Type)
+	assert.NotEqual(t, version, change.Version)
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 4, Type: ChangePut, Key: "foo", Version: version}, change)
+
+	// So is a transaction failed before being committed.
+	injectFault(internal.FaultOpWrite, "values")
+	_, _, err = s.CommitTxn(ctx, Txn{
+		Puts:    []TxnPut{{Key: "qux", Value: "quux"}},
+		Deletes: []string{"foo"},
+	})
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+	fs.SetFault(nil)
+	for _, expectedType := range []ChangeType{ChangePut, ChangeDelete} {
+		change = nextChange()
+		assert.Equal(t, revision+5, change.Revision)
+		assert.Equal(t, expectedType, change.Type)
+	}
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 6, Type: ChangeDelete, Key: "qux"}, change)
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 6, Type: ChangePut, Key: "foo", Version: version}, change)
+
+	// A delete taking effect despite failing isn't reverted.
+	injectFault(internal.FaultOpSync, "versions")
+	_, err = s.DeleteValue(ctx, "foo", nil)
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+	fs.SetFault(nil)
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 7, Type: ChangeDelete, Key: "foo"}, change)
+	version2, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 8, Type: ChangePut, Key: "foo", Version: version2}, change)
+
+	value, version3, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version2, version3)
+	}
+}
+
+func TestLogStorage_Changes(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	options := Options{BaseDirName: baseDirName, Layout: LayoutLog}
+	s1, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	version1, err := s1.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = s1.DeleteValue(ctx, "foo", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, newVersions, err := s1.CommitTxn(ctx, Txn{
+		Puts:    []TxnPut{{Key: "qux", Value: "quux"}},
+		Deletes: []string{"foo"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision1, _ := Revision(version1)
+	revision3, _ := Revision(newVersions[0])
+	expectedChanges := []Change{
+		{Revision: revision1, Type: ChangePut, Key: "foo", Version: version1},
+		{Revision: revision1 + 1, Type: ChangeDelete, Key: "foo"},
+		{Revision: revision3, Type: ChangePut, Key: "qux", Version: newVersions[0]},
+	}
+
+	// Changes journaled are replayed, and deletions have revisions of their own.
+	cs, err := s2.Changes(ctx, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	for _, expectedChange := range expectedChanges {
+		if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+			assert.Equal(t, expectedChange, cs.Change())
+		}
+	}
+
+	// Changes made afterwards follow, including ones made by other storages.
+	version4, err := s1.CreateValue(ctx, "corge", "grault")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision4, _ := Revision(version4)
+	assert.Equal(t, revision3+1, revision4)
+	if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+		assert.Equal(t, Change{Revision: revision4, Type: ChangePut, Key: "corge", Version: version4}, cs.Change())
+	}
+
+	// Revisions allocated keep increasing after compaction.
+	err = s2.Compact(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = s2.DeleteValue(ctx, "corge", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+		assert.Equal(t, Change{Revision: revision4 + 1, Type: ChangeDelete, Key: "corge"}, cs.Change())
+	}
+}
+
+func TestLogStorage_Changes_Upgrade(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	options := Options{BaseDirName: baseDirName, Layout: LayoutLog}
+	s, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version1, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+	// Make the storage look like one written before changes were journaled.
+	for _, baseName := range []string{"revision", "changes"} {
+		if !assert.NoError(t, os.RemoveAll(filepath.Join(baseDirName, baseName))) {
+			t.FailNow()
+		}
+	}
+
+	s, err = Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	// Changes before journaling are taken as truncated.
+	_, err = s.Changes(ctx, 0)
+	assert.True(t, errors.Is(err, ErrCompacted), "err: %v", err)
+	revision1, _ := Revision(version1)
+	cs, err := s.Changes(ctx, revision1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	// Revisions allocated afterwards follow the ones in the data log.
+	version2, err := s.UpdateValue(ctx, "foo", "baz", version1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+		assert.Equal(t, Change{Revision: revision1 + 1, Type: ChangePut, Key: "foo", Version: version2}, cs.Change())
+	}
+}
+
+func TestLogStorage_Changes_Faults(t *testing.T) {
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	options := Options{
+		BaseDirName: "versionedkv",
+		Layout:      LayoutLog,
+		Durability:  DurabilityFull,
+	}
+	s, err := OpenWithFS(options, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision, _ := Revision(version)
+	cs, err := s.Changes(ctx, revision)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	nextChange := func() Change {
+		if !assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+			t.FailNow()
+		}
+		return cs.Change()
+	}
+	errInjected := errors.New("injected")
+	dataLogFileName := filepath.Join(options.BaseDirName, "data.log")
+
+	// A write failed after the record has been written is reverted.
+	fs.SetFault(func(op internal.FaultOp, name string) error {
+		if op == internal.FaultOpSync && name == dataLogFileName {
+			return errInjected
+		}
+		return nil
+	})
+	_, _, err = s.CommitTxn(ctx, Txn{
+		Puts:    []TxnPut{{Key: "qux", Value: "quux"}},
+		Deletes: []string{"foo"},
+	})
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+	fs.SetFault(nil)
+	for _, expectedType := range []ChangeType{ChangePut, ChangeDelete} {
+		change := nextChange()
+		assert.Equal(t, revision+1, change.Revision)
+		assert.Equal(t, expectedType, change.Type)
+	}
+	change := nextChange()
+	assert.Equal(t, Change{Revision: revision + 2, Type: ChangeDelete, Key: "qux"}, change)
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 2, Type: ChangePut, Key: "foo", Version: version}, change)
+
+	// The record doesn't take effect.
+	value, version2, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+	_, version2, err = s.GetValue(ctx, "qux")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version2)
+	}
+	version3, err := s.CreateValue(ctx, "qux", "quux")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	change = nextChange()
+	assert.Equal(t, Change{Revision: revision + 3, Type: ChangePut, Key: "qux", Version: version3}, change)
+}
@@ -0,0 +1,458 @@
+package fsstorage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// Check checks the consistency of the storage in the base directory given in options,
+// and returns problems found. If repair is true, problems which can be fixed are
+// repaired along the way, otherwise nothing is modified.
+//
+// Files are locked the same way as storages do, so it's safe to check the storage while
+// the storage is being used by other processes. The storage is checked with the shard
+// depth recorded in it, rather than the one given in options, and can't be checked if
+// Reshard has been interrupted. Only storages with LayoutFiles can be checked.
+func Check(ctx context.Context, options Options, repair bool) ([]Problem, error) {
+	return doCheck(ctx, options, internal.OSFS, repair)
+}
+
+func doCheck(ctx context.Context, options Options, fs internal.FS, repair bool) ([]Problem, error) {
+	options.sanitize()
+	if _, err := fs.Stat(options.BaseDirName); err != nil {
+		return nil, err
+	}
+	if err := checkLayout(fs, options.BaseDirName, LayoutFiles); err != nil {
+		return nil, err
+	}
+	// Directories are only created when repairing, as checking mustn't mutate anything,
+	// e.g. when the base directory is wrong.
+	var missingDirBaseNames []string
+	for _, dirBaseName := range dirBaseNames {
+		if _, err := fs.Stat(filepath.Join(options.BaseDirName, dirBaseName)); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			missingDirBaseNames = append(missingDirBaseNames, dirBaseName)
+		}
+	}
+	dirNames := makeDirNames(options.BaseDirName)
+	if repair && len(missingDirBaseNames) >= 1 {
+		if _, err := createDirs(fs, options.BaseDirName); err != nil {
+			return nil, err
+		}
+	}
+	shardDepth, err := readShardDepth(fs, options.BaseDirName)
+	if err != nil {
+		return nil, err
+	}
+	options.ShardDepth = shardDepth
+	c := checker{
+		fss: &fsStorage{
+			options:  options,
+			fs:       fs,
+			dirNames: dirNames,
+		},
+		repair:      repair,
+		missingDirs: make(map[string]bool, len(missingDirBaseNames)),
+	}
+	for _, dirBaseName := range missingDirBaseNames {
+		c.missingDirs[dirBaseName] = !repair
+		c.addProblem(ProblemMissingDir, dirBaseName, "", repair)
+	}
+	// Values would be taken as orphans if their version files were misplaced.
+	if err := c.fss.checkResharding(); err != nil {
+		return nil, err
+	}
+	if err := c.Run(ctx); err != nil {
+		return nil, err
+	}
+	sort.Slice(c.problems, func(i, j int) bool { return c.problems[i].FileName < c.problems[j].FileName })
+	return c.problems, nil
+}
+
+// Problem represents a problem found by Check.
+type Problem struct {
+	Kind ProblemKind
+
+	// FileName is the name of the problematic file, relative to the base directory.
+	FileName string
+
+	// Key is the key the problematic file is for, if known.
+	Key string
+
+	// Repaired indicates whether the problem has been repaired.
+	Repaired bool
+}
+
+// String returns a textual representation of the problem.
+func (p Problem) String() string {
+	s := fmt.Sprintf("%v: %s", p.Kind, filepath.ToSlash(p.FileName))
+	if p.Key != "" {
+		s += fmt.Sprintf(" (key=%q)", p.Key)
+	}
+	if p.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// ProblemKind represents the kind of a problem.
+type ProblemKind int
+
+const (
+	// ProblemDanglingVersion means a version file points to a missing value file.
+	// It's repaired by deleting the value.
+	ProblemDanglingVersion ProblemKind = iota + 1
+
+	// ProblemOrphanValue means a value file isn't referenced by any version file.
+	// It's repaired by removing the value file.
+	ProblemOrphanValue
+
+	// ProblemMalformedVersion means a version file contains a malformed version.
+	// It's repaired by deleting the value.
+	ProblemMalformedVersion
+
+	// ProblemStaleTempFile means a temporary file has been left over by a crash.
+	// It's repaired by removing the temporary file.
+	ProblemStaleTempFile
+
+	// ProblemUnexpectedFile means a file which can't be produced by storages. It's
+	// never repaired, as the file may belong to someone else.
+	ProblemUnexpectedFile
+
+	// ProblemMisplacedFile means a file (or a shard directory) lies outside of the shard
+	// directory it belongs to at the shard depth of the storage, e.g. Reshard has been
+	// interrupted. It's never repaired by Check, but Reshard moves the file into place.
+	ProblemMisplacedFile
+
+	// ProblemStaleRevision means the revision counter is behind revisions of versions or
+	// changes journaled, e.g. it has been lost in a crash, so that revisions would be
+	// allocated again. It's repaired by advancing the revision counter.
+	ProblemStaleRevision
+
+	// ProblemMissingDir means a directory of the storage is missing, e.g. the base
+	// directory doesn't hold a storage. It's repaired by creating the directory.
+	ProblemMissingDir
+)
+
+// String returns a textual representation of the problem kind.
+func (pk ProblemKind) String() string {
+	switch pk {
+	case ProblemDanglingVersion:
+		return "dangling version"
+	case ProblemOrphanValue:
+		return "orphan value"
+	case ProblemMalformedVersion:
+		return "malformed version"
+	case ProblemStaleTempFile:
+		return "stale temporary file"
+	case ProblemUnexpectedFile:
+		return "unexpected file"
+	case ProblemMisplacedFile:
+		return "misplaced file"
+	case ProblemStaleRevision:
+		return "stale revision"
+	case ProblemMissingDir:
+		return "missing directory"
+	default:
+		return fmt.Sprintf("ProblemKind(%d)", int(pk))
+	}
+}
+
+type checker struct {
+	fss    *fsStorage
+	repair bool
+
+	// missingDirs indicates which directories are missing, by base names, which are
+	// skipped.
+	missingDirs map[string]bool
+
+	problems    []Problem
+	maxRevision int64
+}
+
+func (c *checker) Run(ctx context.Context) error {
+	if err := c.fss.forEachFile(ctx, c.fss.options.BaseDirName, c.checkBaseDirEntry); err != nil {
+		return err
+	}
+	if !c.missingDirs["versions"] {
+		if err := c.checkShardDir(ctx, "versions", "", 0, c.parseVersionBaseName, c.checkVersionFile); err != nil {
+			return err
+		}
+	}
+	if !c.missingDirs["values"] {
+		if err := c.checkShardDir(ctx, "values", "", 0, c.parseValueBaseName, c.checkValueFile); err != nil {
+			return err
+		}
+	}
+	if !c.missingDirs["keys"] {
+		if err := c.fss.forEachFile(ctx, c.fss.dirNames.Keys, c.checkKeyFile); err != nil {
+			return err
+		}
+	}
+	if !c.missingDirs["history"] {
+		if err := c.fss.forEachFile(ctx, c.fss.dirNames.History, c.checkHistoryDir); err != nil {
+			return err
+		}
+	}
+	return c.checkRevision()
+}
+
+func (c *checker) checkBaseDirEntry(fileInfo os.FileInfo) error {
+	switch fileInfo.Name() {
+	case "changes", "history", "keys", "leases", "txns", "values", "versions":
+		if fileInfo.IsDir() {
+			return nil
+		}
+	case storeLockBaseName, shardsBaseName, reshardingBaseName, revisionBaseName:
+		if !fileInfo.IsDir() {
+			return nil
+		}
+	}
+	c.addProblem(ProblemUnexpectedFile, fileInfo.Name(), "", false)
+	return nil
+}
+
+// checkShardDir checks files in the given shard directory, at the given level, of the
+// given directory (either "versions" or "values"), with the given function parsing base
+// names of files into file names encoded from keys, and the given function checking
+// files in place.
+func (c *checker) checkShardDir(ctx context.Context, relativeRootDirName string, shardDirName string, level int, parseBaseName func(string) (string, bool), checkFile func(string, os.FileInfo) error) error {
+	relativeDirName := filepath.Join(relativeRootDirName, shardDirName)
+	return c.fss.forEachFile(ctx, filepath.Join(c.fss.options.BaseDirName, relativeDirName), func(fileInfo os.FileInfo) error {
+		baseName := fileInfo.Name()
+		if fileInfo.IsDir() && internal.IsShardBaseName(baseName) {
+			if level < c.fss.options.ShardDepth {
+				return c.checkShardDir(ctx, relativeRootDirName, filepath.Join(shardDirName, baseName), level+1, parseBaseName, checkFile)
+			}
+			c.addProblem(ProblemMisplacedFile, filepath.Join(relativeDirName, baseName), "", false)
+			return nil
+		}
+		if fileName, ok := parseBaseName(baseName); ok && !fileInfo.IsDir() {
+			if internal.ShardDirName(fileName, c.fss.options.ShardDepth) != shardDirName {
+				key, err := c.fss.decodeFileName(fileName)
+				if err != nil {
+					key = ""
+				}
+				c.addProblem(ProblemMisplacedFile, filepath.Join(relativeDirName, baseName), key, false)
+				return nil
+			}
+		}
+		return checkFile(relativeDirName, fileInfo)
+	})
+}
+
+func (c *checker) parseVersionBaseName(baseName string) (string, bool) {
+	return baseName, isValidFileName(baseName)
+}
+
+func (c *checker) parseValueBaseName(baseName string) (string, bool) {
+	if tempBaseName, ok := parseTempFileName(baseName); ok {
+		baseName = tempBaseName
+	}
+	fileName, _, ok := parseValueFileName(baseName)
+	return fileName, ok
+}
+
+func (c *checker) checkVersionFile(relativeDirName string, fileInfo os.FileInfo) error {
+	fileName := fileInfo.Name()
+	relativeFileName := filepath.Join(relativeDirName, fileName)
+	key, err := c.fss.decodeFileName(fileName)
+	if err != nil || fileInfo.IsDir() {
+		c.addProblem(ProblemUnexpectedFile, relativeFileName, "", false)
+		return nil
+	}
+	flag := os.O_RDONLY
+	if c.repair {
+		flag = os.O_RDWR
+	}
+	versionFile, err := c.fss.openVersionFile(fileName, flag)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	defer versionFile.Close()
+	rawRecord, err := readVersionFile(versionFile)
+	if err != nil {
+		return err
+	}
+	if rawRecord == "" {
+		return nil
+	}
+	var problemKind ProblemKind
+	if record, ok := parseVersionRecord(rawRecord); ok {
+		_, err := c.fss.fs.Stat(c.fss.valueFileName(fileName, record.Version))
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		problemKind = ProblemDanglingVersion
+	} else {
+		problemKind = ProblemMalformedVersion
+	}
+	if c.repair {
+		// Deleting the value is a write as any other, which is journaled.
+		change := changeRecord{Type: ChangeDelete, Key: key}
+		if _, err := c.fss.allocateRevision([]changeRecord{change}); err != nil {
+			return err
+		}
+		if err := c.fss.truncateVersionFile(versionFile); err != nil {
+			c.fss.revertChange(change, versionFile)
+			return err
+		}
+	}
+	c.addProblem(problemKind, relativeFileName, key, c.repair)
+	return nil
+}
+
+func (c *checker) checkValueFile(relativeDirName string, fileInfo os.FileInfo) error {
+	valueBaseName := fileInfo.Name()
+	relativeFileName := filepath.Join(relativeDirName, valueBaseName)
+	if valueBaseName, ok := parseTempFileName(valueBaseName); ok {
+		if fileName, _, ok := parseValueFileName(valueBaseName); ok {
+			return c.checkTempFile(fileName, relativeFileName)
+		}
+	}
+	fileName, version, ok := parseValueFileName(valueBaseName)
+	if !ok || fileInfo.IsDir() {
+		c.addProblem(ProblemUnexpectedFile, relativeFileName, "", false)
+		return nil
+	}
+	c.noteVersion(version)
+	key, err := c.fss.decodeFileName(fileName)
+	if err != nil {
+		key = ""
+	}
+	versionFile, err := c.fss.openVersionFile(fileName, os.O_RDONLY)
+	if err == nil {
+		defer versionFile.Close()
+		rawRecord, err := readVersionFile(versionFile)
+		if err != nil {
+			return err
+		}
+		if record, ok := parseVersionRecord(rawRecord); ok && record.Version == version {
+			return nil
+		}
+	} else {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if c.repair {
+		if err := ignoreNotExist(c.fss.fs.Remove(c.fss.valueFileName(fileName, version))); err != nil {
+			return err
+		}
+	}
+	c.addProblem(ProblemOrphanValue, relativeFileName, key, c.repair)
+	return nil
+}
+
+func (c *checker) checkKeyFile(fileInfo os.FileInfo) error {
+	relativeFileName := filepath.Join("keys", fileInfo.Name())
+	if fileName, ok := parseTempFileName(fileInfo.Name()); ok {
+		return c.checkTempFile(fileName, relativeFileName)
+	}
+	fileName := fileInfo.Name()
+	if !internal.IsHashedFileName(fileName) || fileInfo.IsDir() {
+		c.addProblem(ProblemUnexpectedFile, relativeFileName, "", false)
+		return nil
+	}
+	if _, err := c.fss.decodeFileName(fileName); err != nil {
+		c.addProblem(ProblemUnexpectedFile, relativeFileName, "", false)
+	}
+	return nil
+}
+
+func (c *checker) checkHistoryDir(fileInfo os.FileInfo) error {
+	relativeDirName := filepath.Join("history", fileInfo.Name())
+	if !fileInfo.IsDir() || !isValidFileName(fileInfo.Name()) {
+		c.addProblem(ProblemUnexpectedFile, relativeDirName, "", false)
+		return nil
+	}
+	historyFileInfos, err := c.fss.fs.ReadDir(filepath.Join(c.fss.dirNames.History, fileInfo.Name()))
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	for _, historyFileInfo := range historyFileInfos {
+		if historyFileInfo.IsDir() || !isValidVersion(historyFileInfo.Name()) {
+			c.addProblem(ProblemUnexpectedFile, filepath.Join(relativeDirName, historyFileInfo.Name()), "", false)
+			continue
+		}
+		c.noteVersion(historyFileInfo.Name())
+	}
+	return nil
+}
+
+// noteVersion notes the revision of the given version found in a value file or a history
+// file, which the revision counter shouldn't be behind.
+func (c *checker) noteVersion(version string) {
+	if revision, _, _ := splitVersion(version); revision > c.maxRevision {
+		c.maxRevision = revision
+	}
+}
+
+func (c *checker) checkRevision() error {
+	if !c.missingDirs["changes"] {
+		// Deletions have revisions in the change journal only.
+		journaledRevision, err := c.fss.lastJournaledRevision()
+		if err != nil {
+			return err
+		}
+		if journaledRevision > c.maxRevision {
+			c.maxRevision = journaledRevision
+		}
+	}
+	revision, err := c.fss.readRevision()
+	if err != nil {
+		return err
+	}
+	if revision >= c.maxRevision {
+		return nil
+	}
+	if c.repair {
+		if err := c.fss.advanceRevision(c.maxRevision); err != nil {
+			return err
+		}
+	}
+	c.addProblem(ProblemStaleRevision, revisionBaseName, "", c.repair)
+	return nil
+}
+
+func (c *checker) checkTempFile(fileName string, relativeFileName string) error {
+	versionFile, err := c.fss.openVersionFile(fileName, os.O_RDONLY)
+	if err == nil {
+		defer versionFile.Close()
+	} else {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// As the version file is locked, no writer can be using the temporary file.
+	tempFileName := filepath.Join(c.fss.options.BaseDirName, relativeFileName)
+	if _, err := c.fss.fs.Stat(tempFileName); err != nil {
+		return ignoreNotExist(err)
+	}
+	if c.repair {
+		if err := ignoreNotExist(c.fss.fs.Remove(tempFileName)); err != nil {
+			return err
+		}
+	}
+	c.addProblem(ProblemStaleTempFile, relativeFileName, "", c.repair)
+	return nil
+}
+
+func (c *checker) addProblem(kind ProblemKind, fileName string, key string, repaired bool) {
+	c.problems = append(c.problems, Problem{
+		Kind:     kind,
+		FileName: fileName,
+		Key:      key,
+		Repaired: repaired,
+	})
+}
@@ -0,0 +1,152 @@
+package fsstorage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	fooVersion, err := s.CreateValue(ctx, "foo", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	barVersion, err := s.CreateValue(ctx, "bar", "2")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	bazVersion, err := s.CreateValue(ctx, "baz", "3")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = os.Remove(filepath.Join(baseDirName, "values", "bar."+barVersion.(string)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	orphanVersion := xid.New().String()
+	tempVersion := xid.New().String()
+	for fileName, data := range map[string]string{
+		"versions/baz":                            "???",
+		"values/foo." + orphanVersion:             "",
+		"values/.foo." + tempVersion + ".tmp-123": "",
+		"values/README":                           "",
+		"versions/Foo":                            "",
+		"README":                                  "",
+	} {
+		err := ioutil.WriteFile(filepath.Join(baseDirName, fileName), []byte(data), 0666)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	expectedProblems := []Problem{
+		{Kind: ProblemUnexpectedFile, FileName: "README"},
+		{Kind: ProblemStaleTempFile, FileName: filepath.Join("values", ".foo."+tempVersion+".tmp-123")},
+		{Kind: ProblemUnexpectedFile, FileName: filepath.Join("values", "README")},
+		{Kind: ProblemOrphanValue, FileName: filepath.Join("values", "baz."+bazVersion.(string)), Key: "baz"},
+		{Kind: ProblemOrphanValue, FileName: filepath.Join("values", "foo."+orphanVersion), Key: "foo"},
+		{Kind: ProblemUnexpectedFile, FileName: filepath.Join("versions", "Foo")},
+		{Kind: ProblemDanglingVersion, FileName: filepath.Join("versions", "bar"), Key: "bar"},
+		{Kind: ProblemMalformedVersion, FileName: filepath.Join("versions", "baz"), Key: "baz"},
+	}
+	problems, err := Check(ctx, Options{BaseDirName: baseDirName}, false)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, expectedProblems, problems)
+
+	for i := range expectedProblems {
+		expectedProblems[i].Repaired = expectedProblems[i].Kind != ProblemUnexpectedFile
+	}
+	problems, err = Check(ctx, Options{BaseDirName: baseDirName}, true)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, expectedProblems, problems)
+
+	problems, err = Check(ctx, Options{BaseDirName: baseDirName}, false)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []Problem{
+		{Kind: ProblemUnexpectedFile, FileName: "README"},
+		{Kind: ProblemUnexpectedFile, FileName: filepath.Join("values", "README")},
+		{Kind: ProblemUnexpectedFile, FileName: filepath.Join("versions", "Foo")},
+	}, problems)
+	details, err := s.Inspect(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, versionedkv.StorageDetails{
+		Values: map[string]versionedkv.ValueDetails{
+			"foo": {V: "1", Version: fooVersion},
+		},
+	}, details)
+
+	// Values deleted by repairing are journaled.
+	bazRevision, _ := Revision(bazVersion)
+	cs, err := s.Changes(ctx, bazRevision)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+	var deletedKeys []string
+	for i := 0; i < 2 && cs.Next(); i++ {
+		change := cs.Change()
+		assert.Equal(t, ChangeDelete, change.Type)
+		assert.Greater(t, change.Revision, bazRevision)
+		deletedKeys = append(deletedKeys, change.Key)
+	}
+	assert.NoError(t, cs.Err())
+	assert.ElementsMatch(t, []string{"bar", "baz"}, deletedKeys)
+}
+
+func TestCheck_MissingDirs(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	ctx := context.Background()
+	var expectedProblems []Problem
+	for _, dirBaseName := range []string{"changes", "history", "keys", "leases", "txns", "values", "versions"} {
+		expectedProblems = append(expectedProblems, Problem{Kind: ProblemMissingDir, FileName: dirBaseName})
+	}
+
+	// Checking doesn't modify anything.
+	problems, err := Check(ctx, Options{BaseDirName: baseDirName}, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expectedProblems, problems)
+	}
+	fileInfos, err := ioutil.ReadDir(baseDirName)
+	if assert.NoError(t, err) {
+		assert.Empty(t, fileInfos)
+	}
+
+	for i := range expectedProblems {
+		expectedProblems[i].Repaired = true
+	}
+	problems, err = Check(ctx, Options{BaseDirName: baseDirName}, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expectedProblems, problems)
+	}
+	problems, err = Check(ctx, Options{BaseDirName: baseDirName}, false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, problems)
+	}
+}
+
+func TestCheck_BaseDirNotExist(t *testing.T) {
+	_, err := Check(context.Background(), Options{BaseDirName: "/x/y/z"}, false)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,222 @@
+package fsstorage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+func (fss *fsStorage) Compact(ctx context.Context) error {
+	return wrapError("", fss.doCompact(ctx))
+}
+
+func (fss *fsStorage) doCompact(ctx context.Context) error {
+	if fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	if err := fss.recoverTxns(ctx); err != nil {
+		return err
+	}
+	if err := fss.forEachFile(ctx, fss.dirNames.Leases, fss.reapLeaseFile); err != nil {
+		return err
+	}
+	// Value files are compacted before version files, so that once a version file is
+	// removed, no value files can be referencing it.
+	if err := fss.forEachShardedFile(ctx, fss.dirNames.Values, fss.compactValueFile); err != nil {
+		return err
+	}
+	if err := fss.forEachFile(ctx, fss.dirNames.Keys, fss.compactKeyFile); err != nil {
+		return err
+	}
+	if err := fss.forEachFile(ctx, fss.dirNames.History, fss.compactHistoryDir); err != nil {
+		return err
+	}
+	if err := fss.forEachShardedFile(ctx, fss.dirNames.Versions, fss.compactVersionFile); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fss *fsStorage) compactValueFile(fileInfo os.FileInfo) error {
+	valueBaseName := fileInfo.Name()
+	if valueBaseName, ok := parseTempFileName(valueBaseName); ok {
+		fileName, _, ok := parseValueFileName(valueBaseName)
+		if !ok {
+			return nil
+		}
+		return fss.removeStaleFile(fileName, fileInfo.Name(), fss.valueDirName(fileName))
+	}
+	fileName, version, ok := parseValueFileName(valueBaseName)
+	if !ok {
+		return nil
+	}
+	// The value file of an expired version is kept until the version is reaped, which
+	// retires the value file.
+	versionFile, record, err := fss.openAndReadVersionRecord("", fileName, os.O_RDONLY)
+	if err == nil {
+		defer versionFile.Close()
+	} else {
+		if !os.IsNotExist(err) {
+			return ignoreCorruption(err)
+		}
+	}
+	if version == record.Version {
+		return nil
+	}
+	return ignoreNotExist(fss.fs.Remove(fss.valueFileName(fileName, version)))
+}
+
+func (fss *fsStorage) compactKeyFile(fileInfo os.FileInfo) error {
+	if fileName, ok := parseTempFileName(fileInfo.Name()); ok {
+		return fss.removeStaleFile(fileName, fileInfo.Name(), fss.dirNames.Keys)
+	}
+	fileName := fileInfo.Name()
+	if !internal.IsHashedFileName(fileName) {
+		return nil
+	}
+	if _, err := fss.fs.Stat(fss.versionFileName(fileName)); err == nil {
+		return nil
+	} else {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// The key file has no version file, create an empty one for locking so that the
+	// key file and the version file can be removed together.
+	return fss.removeDeletedValue(fileName, os.O_RDWR|os.O_CREATE)
+}
+
+func (fss *fsStorage) compactVersionFile(fileInfo os.FileInfo) error {
+	if fileInfo.Size() >= 1 {
+		return fss.reapVersionFile(fileInfo)
+	}
+	return fss.removeDeletedValue(fileInfo.Name(), os.O_RDWR)
+}
+
+// removeStaleFile removes the given temporary file if no writer of the value for the
+// given file name is in progress, i.e. the temporary file has been left over by a crash.
+func (fss *fsStorage) removeStaleFile(fileName string, tempBaseName string, dirName string) error {
+	versionFile, _, err := fss.openAndReadVersionFile("", fileName, os.O_RDONLY)
+	if err == nil {
+		defer versionFile.Close()
+	} else {
+		if !os.IsNotExist(err) {
+			return ignoreCorruption(err)
+		}
+	}
+	return ignoreNotExist(fss.fs.Remove(filepath.Join(dirName, tempBaseName)))
+}
+
+// removeDeletedValue removes the version file for the given file name, as well as the
+// key file, if the value has been deleted and isn't being waited for.
+func (fss *fsStorage) removeDeletedValue(fileName string, flag int) error {
+	if runtime.GOOS == "windows" {
+		// Files being open can't be removed on Windows.
+		return nil
+	}
+	if fss.eventBus.HasWatchers(fileName) {
+		return nil
+	}
+	// Expired values are left for reaping, which knows their keys for the change journal.
+	versionFile, record, err := fss.openAndReadVersionRecord("", fileName, flag)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return ignoreCorruption(err)
+	}
+	defer versionFile.Close()
+	if record.Version != "" || fss.eventBus.HasWatchers(fileName) {
+		return nil
+	}
+	// As the version file is locked exclusively, once it's removed, no writer can be
+	// using it, and writers waiting for the lock will reopen it.
+	if err := fss.fs.Remove(fss.versionFileName(fileName)); err != nil {
+		return ignoreNotExist(err)
+	}
+	if internal.IsHashedFileName(fileName) {
+		if err := fss.fs.Remove(fss.keyFileName(fileName)); err != nil {
+			return ignoreNotExist(err)
+		}
+	}
+	return nil
+}
+
+func (fss *fsStorage) compactPeriodically() {
+	fss.runPeriodically(fss.options.CompactInterval, func(ctx context.Context) {
+		if err := fss.doCompact(ctx); err != nil {
+			fss.logBackgroundFailure(ctx, "failed to compact storage", fss.options.BaseDirName, err)
+		}
+	})
+}
+
+// runPeriodically calls the given task at the given interval until the storage is
+// closed, with a context which is cancelled once the storage is closed.
+func (fss *fsStorage) runPeriodically(interval time.Duration, task func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-fss.closure
+		cancel()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			task(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forEachFile calls the given callback for each file in the given directory. Files are
+// read in batches, so that huge directories don't have to be loaded into memory at once.
+func (fss *fsStorage) forEachFile(ctx context.Context, dirName string, callback func(os.FileInfo) error) error {
+	dir, err := fss.fs.OpenFile(dirName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		fileInfos, err := dir.Readdir(readDirBatchSize)
+		for _, fileInfo := range fileInfos {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := callback(fileInfo); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+const readDirBatchSize = 1024
+
+func ignoreNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func ignoreCorruption(err error) error {
+	if e, ok := err.(*Error); ok && e.Kind == ErrCorrupted {
+		// Corrupted values are left as is for inspection.
+		return nil
+	}
+	return err
+}
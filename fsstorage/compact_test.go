@@ -0,0 +1,116 @@
+package fsstorage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Compact(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("version files are never removed on Windows")
+	}
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	fooVersion, err := s.CreateValue(ctx, "foo", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, key := range []string{"bar", "baz", strings.Repeat("x/", 100)} {
+		_, err := s.CreateValue(ctx, key, "2")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		ok, err := s.DeleteValue(ctx, key, nil)
+		if !assert.NoError(t, err) || !assert.True(t, ok) {
+			t.FailNow()
+		}
+	}
+	for _, fileName := range []string{
+		"values/foo." + xid.New().String(),
+		"values/qux." + xid.New().String(),
+		"values/.foo." + xid.New().String() + ".tmp-123",
+		"values/.quux." + xid.New().String() + ".tmp-456",
+		"keys/.~abc.tmp-789",
+		"keys/~def",
+	} {
+		err := ioutil.WriteFile(filepath.Join(baseDirName, fileName), nil, 0666)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	type result struct {
+		Value   string
+		Version versionedkv.Version
+		Err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		value, version, err := s.WaitForValue(ctx, "baz", nil)
+		results <- result{value, version, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	err = s.Compact(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []string{"foo." + fooVersion.(string)}, readDirNames(t, filepath.Join(baseDirName, "values")))
+	assert.Equal(t, []string{"baz", "foo"}, readDirNames(t, filepath.Join(baseDirName, "versions")))
+	assert.Empty(t, readDirNames(t, filepath.Join(baseDirName, "keys")))
+
+	bazVersion, err := s.CreateValue(ctx, "baz", "3")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	select {
+	case r := <-results:
+		assert.Equal(t, result{"3", bazVersion, nil}, r)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	details, err := s.Inspect(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, versionedkv.StorageDetails{
+		Values: map[string]versionedkv.ValueDetails{
+			"foo": {V: "1", Version: fooVersion},
+			"baz": {V: "3", Version: bazVersion},
+		},
+	}, details)
+}
+
+func TestFSStorage_CompactPeriodically(t *testing.T) {
+	versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+		return makeStorageWithOptions(Options{CompactInterval: time.Millisecond})
+	})
+}
+
+func readDirNames(t *testing.T, dirName string) []string {
+	fileInfos, err := ioutil.ReadDir(dirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,137 @@
+package fsstorage
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// Durability represents the level of durability guarantees for writes.
+type Durability int
+
+const (
+	// DurabilityNone writes files in place without flushing them to disk.
+	//
+	// It is the fastest level. After a crash (of the operating system or power, but
+	// not of the process only) a version file may point to a value file which is
+	// truncated or missing.
+	DurabilityNone Durability = iota
+
+	// DurabilityData writes value files to temporary files first, flushes them to
+	// disk and then renames them into place, before version files get updated.
+	//
+	// After a crash a version file never points to a value file which is truncated
+	// or missing, but writes which have been completed recently may be lost, i.e.
+	// values may roll back to previous versions.
+	DurabilityData
+
+	// DurabilityFull works as DurabilityData, and in addition flushes version files
+	// (and directories containing them) to disk before writes complete.
+	//
+	// After a crash all writes which have been completed are preserved.
+	DurabilityFull
+)
+
+// writeValueFile writes the given value to the value file with the given name with
+// respect to the durability level.
+func (fss *fsStorage) writeValueFile(valueFileName string, value string) error {
+	if fss.options.Durability == DurabilityNone {
+		return internal.WriteFile(fss.fs, valueFileName, []byte(value), 0666)
+	}
+	return fss.writeFileAtomically(valueFileName, []byte(value), true)
+}
+
+// syncVersionFile flushes the given version file to disk, if required by the durability
+// level. If the version file may have been created, the directory containing it is
+// flushed as well.
+func (fss *fsStorage) syncVersionFile(versionFile internal.File, mayBeCreated bool) error {
+	if fss.options.Durability < DurabilityFull {
+		return nil
+	}
+	if err := versionFile.Sync(); err != nil {
+		return err
+	}
+	if mayBeCreated {
+		if err := fss.syncDir(filepath.Dir(versionFile.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomically writes the given data to a temporary file and then renames the
+// temporary file to the given name, so that the file is never observed partially
+// written. If sync is true, the temporary file and the directory containing it are
+// flushed to disk.
+func (fss *fsStorage) writeFileAtomically(fileName string, data []byte, sync bool) error {
+	dirName, baseName := filepath.Split(fileName)
+	tempFile, err := fss.fs.TempFile(dirName, tempFileNamePrefix(baseName)+"*")
+	if err != nil {
+		return err
+	}
+	tempFileName := tempFile.Name()
+	defer func() {
+		if tempFileName != "" {
+			fss.fs.Remove(tempFileName)
+		}
+	}()
+	_, err = tempFile.Write(data)
+	if err == nil && sync {
+		err = tempFile.Sync()
+	}
+	if err2 := tempFile.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if err := fss.fs.Rename(tempFileName, fileName); err != nil {
+		return err
+	}
+	tempFileName = ""
+	if sync {
+		if err := fss.syncDir(dirName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tempFileNamePrefix returns the prefix of names of temporary files for the file with
+// the given name. As file names encoded from keys never start with '.', temporary files
+// can't be confused with them.
+func tempFileNamePrefix(baseName string) string {
+	return "." + baseName + ".tmp-"
+}
+
+// parseTempFileName returns the name of the file for which the temporary file with the
+// given name is.
+func parseTempFileName(tempBaseName string) (string, bool) {
+	if !strings.HasPrefix(tempBaseName, ".") {
+		return "", false
+	}
+	i := strings.LastIndex(tempBaseName, ".tmp-")
+	if i < 1 {
+		return "", false
+	}
+	return tempBaseName[1:i], true
+}
+
+func (fss *fsStorage) syncDir(dirName string) error {
+	if runtime.GOOS == "windows" {
+		// Directories can't be opened for flushing on Windows.
+		return nil
+	}
+	dir, err := fss.fs.OpenFile(dirName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err2 := dir.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
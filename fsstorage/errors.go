@@ -0,0 +1,130 @@
+package fsstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-tk/versionedkv"
+)
+
+var (
+	// ErrCorrupted is the kind of errors returned when files in the storage are
+	// malformed or inconsistent, e.g. a version file points to a missing value file.
+	ErrCorrupted error = errors.New("fsstorage: corrupted")
+
+	// ErrPermission is the kind of errors returned when access to files in the
+	// storage is denied.
+	ErrPermission error = errors.New("fsstorage: permission denied")
+
+	// ErrIO is the kind of errors returned when accessing files in the storage fails
+	// for any other reason.
+	ErrIO error = errors.New("fsstorage: i/o error")
+
+	// ErrInvalidCursor is returned when listing keys with a cursor not returned by
+	// ListKeys or Iterator.Cursor.
+	ErrInvalidCursor error = errors.New("fsstorage: invalid cursor")
+
+	// ErrInvalidTxn is returned when committing a transaction which puts or deletes a
+	// value more than once.
+	ErrInvalidTxn error = errors.New("fsstorage: invalid transaction")
+
+	// ErrLeaseNotFound is returned when using a lease which has expired or been
+	// revoked.
+	ErrLeaseNotFound error = errors.New("fsstorage: lease not found")
+
+	// ErrLayoutMismatch is returned when opening a storage with a layout other than the
+	// one the storage has, e.g. with another shard depth.
+	ErrLayoutMismatch error = errors.New("fsstorage: layout mismatch")
+
+	// ErrInvalidSnapshot is the kind of errors returned when restoring from a snapshot
+	// which is malformed or in an unknown format.
+	ErrInvalidSnapshot error = errors.New("fsstorage: invalid snapshot")
+
+	// ErrUnsupported is returned by methods the layout of the storage doesn't support,
+	// e.g. history with LayoutLog.
+	ErrUnsupported error = errors.New("fsstorage: unsupported")
+
+	// ErrCompacted is returned when streaming changes which have been truncated from the
+	// change journal.
+	ErrCompacted error = errors.New("fsstorage: compacted")
+)
+
+// Error represents an error occurred when accessing files for the value of a key.
+//
+// errors.Is reports whether an Error is of the given kind (ErrCorrupted, ErrPermission,
+// ErrIO or ErrInvalidSnapshot), and errors.Unwrap returns the underlying error, which
+// is usually an error returned by the os package.
+type Error struct {
+	Kind error
+	Key  string
+	Err  error
+}
+
+// Error implements error.Error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: key=%q: %v", e.Kind, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether the error is of the given kind.
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+func newCorruptionError(key string, err error) error {
+	return &Error{
+		Kind: ErrCorrupted,
+		Key:  key,
+		Err:  err,
+	}
+}
+
+func newInvalidSnapshotError(key string, err error) error {
+	return &Error{
+		Kind: ErrInvalidSnapshot,
+		Key:  key,
+		Err:  err,
+	}
+}
+
+// wrapError wraps the given error occurred when accessing files for the value of the
+// given key into an Error, unless the error is nil, is (or wraps) an Error already, or
+// isn't related to the file system.
+func wrapError(key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, passedErr := range passedErrors {
+		if errors.Is(err, passedErr) {
+			return err
+		}
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	kind := ErrIO
+	if os.IsPermission(err) {
+		kind = ErrPermission
+	}
+	return &Error{
+		Kind: kind,
+		Key:  key,
+		Err:  err,
+	}
+}
+
+// passedErrors are errors not related to the file system, which are returned as is by
+// wrapError, even if wrapped.
+var passedErrors = []error{
+	versionedkv.ErrStorageClosed,
+	context.Canceled,
+	context.DeadlineExceeded,
+	ErrInvalidCursor,
+	ErrInvalidTxn,
+	ErrLeaseNotFound,
+	ErrUnsupported,
+	ErrCompacted,
+}
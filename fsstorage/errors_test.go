@@ -0,0 +1,118 @@
+package fsstorage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-tk/testcase"
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Errors(t *testing.T) {
+	type Output struct {
+		ErrKind error
+	}
+	type Context struct {
+		BaseDirName string
+		S           versionedkv.Storage
+
+		ExpectedOutput Output
+	}
+	tc := testcase.New(func(t *testing.T) *Context {
+		return &Context{
+			BaseDirName: makeBaseDir(t),
+		}
+	}).Setup(func(t *testing.T, c *Context) {
+		s, err := Open(Options{BaseDirName: c.BaseDirName})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		c.S = s
+		_, err = s.CreateValue(context.Background(), "foo", "bar")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}).Run(func(t *testing.T, c *Context) {
+		_, _, err := c.S.GetValue(context.Background(), "foo")
+		assert.True(t, errors.Is(err, c.ExpectedOutput.ErrKind), "err: %v", err)
+		var err2 *Error
+		if assert.True(t, errors.As(err, &err2)) {
+			assert.Equal(t, "foo", err2.Key)
+			assert.NotNil(t, errors.Unwrap(err))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, _, err = c.S.WaitForValue(ctx, "foo", nil)
+		assert.True(t, errors.Is(err, c.ExpectedOutput.ErrKind), "err: %v", err)
+		_, err = c.S.Inspect(context.Background())
+		assert.True(t, errors.Is(err, c.ExpectedOutput.ErrKind), "err: %v", err)
+	}).Teardown(func(t *testing.T, c *Context) {
+		err := c.S.Close()
+		assert.NoError(t, err)
+	})
+	testcase.RunListParallel(t,
+		tc.Copy().
+			When("version file is malformed").
+			Then("should fail with error ErrCorrupted").
+			PreRun(func(t *testing.T, c *Context) {
+				err := ioutil.WriteFile(filepath.Join(c.BaseDirName, "versions", "foo"), []byte("???"), 0666)
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				c.ExpectedOutput.ErrKind = ErrCorrupted
+			}),
+		tc.Copy().
+			When("value file is missing").
+			Then("should fail with error ErrCorrupted").
+			PreRun(func(t *testing.T, c *Context) {
+				valueFileNames, err := filepath.Glob(filepath.Join(c.BaseDirName, "values", "foo.*"))
+				if !assert.NoError(t, err) || !assert.Len(t, valueFileNames, 1) {
+					t.FailNow()
+				}
+				err = os.Remove(valueFileNames[0])
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				c.ExpectedOutput.ErrKind = ErrCorrupted
+			}),
+		tc.Copy().
+			When("version file is not accessible").
+			Then("should fail with error ErrPermission").
+			PreRun(func(t *testing.T, c *Context) {
+				if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+					t.Skip("file permissions are not enforced")
+				}
+				err := os.Chmod(filepath.Join(c.BaseDirName, "versions", "foo"), 0)
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				c.ExpectedOutput.ErrKind = ErrPermission
+			}),
+	)
+}
+
+func TestWrapError(t *testing.T) {
+	// Wrapped errors not related to the file system are returned as is.
+	for _, err := range []error{
+		nil,
+		ErrCompacted,
+		fmt.Errorf("foo: %w", context.Canceled),
+		fmt.Errorf("foo: %w", versionedkv.ErrStorageClosed),
+		fmt.Errorf("foo: %w", &Error{Kind: ErrCorrupted, Key: "bar", Err: errors.New("baz")}),
+	} {
+		assert.Equal(t, err, WrapError("foo", err))
+	}
+
+	err := WrapError("foo", os.ErrNotExist)
+	assert.True(t, errors.Is(err, ErrIO), "err: %v", err)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "err: %v", err)
+}
@@ -0,0 +1,21 @@
+package fsstorage
+
+import (
+	"context"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+func OpenWithFileWatcher(options Options, newFileWatcher func() (internal.FileWatcher, error)) (Storage, error) {
+	return doOpen(options, internal.OSFS, newFileWatcher)
+}
+
+func OpenWithFS(options Options, fs internal.FS) (Storage, error) {
+	return doOpen(options, fs, nil)
+}
+
+func CheckWithFS(ctx context.Context, options Options, fs internal.FS, repair bool) ([]Problem, error) {
+	return doCheck(ctx, options, fs, repair)
+}
+
+var WrapError = wrapError
@@ -3,99 +3,380 @@ package fsstorage
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/go-tk/versionedkv"
 	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
-	"github.com/rogpeppe/go-internal/lockedfile"
-	"github.com/rs/xid"
 )
 
 // Options represents options for file system storages.
 type Options struct {
+	// BaseDirName is the name of the directory storing values, "versionedkv" by default.
 	BaseDirName string
+
+	// Durability is the level of durability guarantees for writes, DurabilityNone by
+	// default.
+	Durability Durability
+
+	// CompactInterval is the interval between background compactions. If it is zero,
+	// no background compaction is performed, and Storage.Compact should be called
+	// explicitly instead.
+	CompactInterval time.Duration
+
+	// HistoryLimit is the maximum number of previous versions retained in history for
+	// each value. If it is zero, there is no limit on the number.
+	HistoryLimit int
+
+	// HistoryRetention is the maximum duration previous versions are retained in
+	// history for, since they were superseded or deleted. If it is zero, there is no
+	// limit on the duration.
+	//
+	// If both HistoryLimit and HistoryRetention are zero, no history is retained.
+	HistoryRetention time.Duration
+
+	// WatchErrorHandler is called with errors occurred when watching for changes, e.g.
+	// the event queue of the file system overflowed. As changes may have been missed,
+	// WaitForValue calls in progress re-read values on such errors, and Watch reports
+	// gaps. It is called on the goroutine dispatching changes and shouldn't block.
+	WatchErrorHandler func(err error)
+
+	// WatchMode is the way changes to values are detected, WatchModeNotify by default.
+	WatchMode WatchMode
+
+	// PollInterval is the interval between polls for changes to values, one second
+	// by default. It's only used by WatchModePoll and WatchModeHybrid.
+	PollInterval time.Duration
+
+	// ReapInterval is the interval between background reaps of expired values and
+	// leases. If it is zero, they are reaped by compaction only. Expired values are
+	// treated as deleted whether or not they have been reaped, but WaitForValue and
+	// Watch calls in other processes only notice the expiration after reaping. So are
+	// values attached to expired leases.
+	ReapInterval time.Duration
+
+	// Observer observes operations of the storage and changes detected, e.g. for
+	// collecting metrics. If it is nil, nothing is observed.
+	Observer Observer
+
+	// Tracer starts spans for operations of the storage from contexts passed in, which
+	// carry lock wait time and file I/O time. If it is nil, nothing is traced.
+	Tracer Tracer
+
+	// ShardDepth is the number of levels of shard directories, from 0 to MaxShardDepth,
+	// into which version files and value files are fanned out by hashes of keys, so that
+	// directories don't grow too large. Each level fans files out into 16 directories,
+	// each of which is watched with WatchModeNotify. If it is zero, the flat layout is
+	// used, where all the files lie in single directories.
+	//
+	// The shard depth is recorded in the storage when it's set up, and the storage
+	// refuses to open with any other shard depth. Storages are migrated between shard
+	// depths with Reshard. If it is negative, the shard depth recorded is used, e.g. by
+	// tools opening storages set up by others.
+	ShardDepth int
+
+	// Logger logs failures which don't fail operations, e.g. failures to remove value
+	// files no longer needed, and errors occurred in the background. If it is nil,
+	// nothing is logged.
+	Logger Logger
+
+	// Layout is the way values are laid out in the base directory, LayoutFiles by
+	// default. The layout is recorded in the storage when it's set up, and the storage
+	// refuses to open with any other layout.
+	Layout Layout
+
+	// ChangeJournalLimit is the maximum size in bytes of the change journal, where every
+	// write is recorded for Storage.Changes, 64 MiB by default. Once the change journal
+	// exceeds the limit, the oldest changes are truncated, a quarter of the limit at a
+	// time.
+	ChangeJournalLimit int64
 }
 
 func (o *Options) sanitize() {
 	if o.BaseDirName == "" {
 		o.BaseDirName = "versionedkv"
 	}
+	if o.PollInterval < 1 {
+		o.PollInterval = defaultPollInterval
+	}
+	if o.Observer == nil {
+		o.Observer = nopObserver{}
+	}
+	if o.Logger == nil {
+		o.Logger = nopLogger{}
+	}
+	if o.ChangeJournalLimit < 1 {
+		o.ChangeJournalLimit = defaultChangeJournalLimit
+	}
+}
+
+// Storage represents a file system storage.
+type Storage interface {
+	versionedkv.Storage
+
+	// Compact removes files no longer needed from the storage, which are:
+	//
+	// a) version files of deleted values, unless the values are being waited for;
+	// b) value files not referenced by version files;
+	// c) previous versions beyond the limits on history;
+	// d) temporary files left over by crashes.
+	//
+	// Before that, transactions committed but not fully applied due to crashes are
+	// rolled forward. Expired values and leases are reaped as well.
+	//
+	// It's safe to compact the storage while the storage is being used, by this
+	// process or by other processes.
+	Compact(ctx context.Context) (err error)
+
+	// ListVersions lists versions of the value for the given key, from oldest to newest,
+	// including previous versions retained in history and the current version if the
+	// value exists.
+	ListVersions(ctx context.Context, key string) (versions []VersionInfo, err error)
+
+	// GetValueAt retrieves the value for the given key at the given version, which is
+	// either the current version or a previous version retained in history.
+	//
+	// If the version does not exist, false is returned.
+	GetValueAt(ctx context.Context, key string, version versionedkv.Version) (value string, ok bool, err error)
+
+	// RollbackValue rolls back the value for the given key to the given version, which
+	// is either the current version or a previous version retained in history.
+	//
+	// a) If the version does not exist, a nil new-version is returned;
+	// b) If the old-version is not given, it updates (or re-creates) the value to a new
+	// version as the value at the given version;
+	// c) If the value exists and the old-version is given and the current version of the
+	// value is equal to the old-version, it updates the value to a new version as the
+	// value at the given version;
+	// d) Otherwise a nil new-version is returned.
+	RollbackValue(ctx context.Context, key string, version versionedkv.Version, oldVersion versionedkv.Version) (newVersion versionedkv.Version, err error)
+
+	// ListKeys lists keys of values with the given prefix in ascending order, starting
+	// after the given cursor, up to the given limit (if the limit is positive).
+	//
+	// If the cursor is empty, listing starts from the first key. The next cursor to
+	// resume from is returned, which is empty if there are no more keys.
+	//
+	// Keys of expired values may be listed until the values are reaped.
+	//
+	// Each call scans keys of all the values to pick the next ones, so paging through a
+	// large number of keys with small limits is costly. Iterate lists keys in a single
+	// scan.
+	ListKeys(ctx context.Context, prefix string, cursor string, limit int) (keys []string, nextCursor string, err error)
+
+	// Iterate returns an iterator over values with the given options.
+	Iterate(ctx context.Context, options IterateOptions) (iterator *Iterator)
+
+	// CreateValueWithTTL works as CreateValue, and in addition the value expires after
+	// the given TTL (if the TTL is positive). Expired values are treated as deleted.
+	CreateValueWithTTL(ctx context.Context, key string, value string, ttl time.Duration) (version versionedkv.Version, err error)
+
+	// UpdateValueWithTTL works as UpdateValue, and in addition the new version expires
+	// after the given TTL (if the TTL is positive).
+	UpdateValueWithTTL(ctx context.Context, key string, value string, oldVersion versionedkv.Version, ttl time.Duration) (newVersion versionedkv.Version, err error)
+
+	// CreateOrUpdateValueWithTTL works as CreateOrUpdateValue, and in addition the new
+	// version expires after the given TTL (if the TTL is positive).
+	CreateOrUpdateValueWithTTL(ctx context.Context, key string, value string, oldVersion versionedkv.Version, ttl time.Duration) (newVersion versionedkv.Version, err error)
+
+	// GrantLease grants a lease which expires after the given TTL unless kept alive.
+	GrantLease(ctx context.Context, ttl time.Duration) (lease *Lease, err error)
+
+	// Watch watches values with the given prefix and returns a channel of watch events
+	// for changes to them, made by this process or by other processes. Changes happened
+	// before Watch returns are not reported.
+	//
+	// The channel is closed once the context is done or the storage is closed.
+	Watch(ctx context.Context, prefix string) (events <-chan WatchEvent, err error)
+
+	// CommitTxn commits the given transaction. If all the conditions are met, it puts
+	// and deletes values all or nothing, and returns true and new versions for the puts
+	// in order. Otherwise false is returned.
+	//
+	// Transactions are atomic against crashes: a transaction committed but not fully
+	// applied is rolled forward when the storage is opened or compacted next time.
+	CommitTxn(ctx context.Context, txn Txn) (ok bool, newVersions []versionedkv.Version, err error)
+
+	// Snapshot writes a snapshot of values to the given writer, which is consistent as
+	// writes are blocked while the snapshot is being taken. Values attached to leases
+	// are left out, and so is history.
+	Snapshot(ctx context.Context, writer io.Writer) (err error)
+
+	// Restore restores values from the snapshot read from the given reader, in the given
+	// mode. Values are restored at the versions in the snapshot, so that versions held
+	// by clients stay consistent with values.
+	//
+	// Writes are blocked while restoring, but restoring isn't atomic: reads may observe
+	// values partially restored, and if restoring fails midway, values restored so far
+	// are kept. If the snapshot is malformed, an error of kind ErrInvalidSnapshot is
+	// returned.
+	Restore(ctx context.Context, reader io.Reader, mode RestoreMode) (err error)
+
+	// Changes returns a stream of changes recorded in the change journal after the given
+	// revision, in order of revisions, which replays changes journaled and then
+	// continues with changes made afterwards, by this process or by other processes.
+	// Revisions are returned by Revision for versions, and 0 replays all the changes
+	// since the storage was set up.
+	//
+	// Changes are journaled right before they are applied, so a change may be received
+	// shortly before it takes effect. If applying a change fails, a later change sets
+	// the value back to the actual version (or deletes it). A change interrupted by a
+	// crash is never reverted though, so consumers needing certainty, e.g. before
+	// acting on a deletion, should check the value against the storage. If changes
+	// after the given revision have been truncated from the change journal,
+	// ErrCompacted is returned.
+	Changes(ctx context.Context, sinceRevision int64) (changeStream *ChangeStream, err error)
 }
 
 // Open creates a new file system storage with the given options.
-func Open(options Options) (versionedkv.Storage, error) {
+func Open(options Options) (Storage, error) {
+	return doOpen(options, internal.OSFS, nil)
+}
+
+func doOpen(options Options, fs internal.FS, newFileWatcher func() (internal.FileWatcher, error)) (Storage, error) {
 	var fss fsStorage
 	fss.options = options
 	fss.options.sanitize()
-	dirNames, err := createDirs(fss.options.BaseDirName)
+	fss.fs = fs
+	if fss.options.Layout == LayoutLog {
+		return openLogStorage(&fss, newFileWatcher)
+	}
+	if err := checkLayout(fs, fss.options.BaseDirName, LayoutFiles); err != nil {
+		return nil, err
+	}
+	dirNames, err := createDirs(fs, fss.options.BaseDirName)
 	if err != nil {
 		return nil, err
 	}
 	fss.dirNames = dirNames
-	fss.eventBus.Init(internal.EventBusOptions{
-		EventDirName: dirNames.Versions,
-	})
+	if err := fss.openShards(); err != nil {
+		return nil, err
+	}
+	if err := fss.recoverTxns(context.Background()); err != nil {
+		return nil, err
+	}
+	if newFileWatcher == nil {
+		newFileWatcher = fss.newFileWatcher
+	}
+	fss.eventBus = fss.newEventBus(dirNames.Versions, fss.shardDirNames(dirNames.Versions), newFileWatcher)
 	if err := fss.eventBus.Open(); err != nil {
 		return nil, err
 	}
 	fss.closure = make(chan struct{})
+	if fss.options.CompactInterval >= 1 {
+		go fss.compactPeriodically()
+	}
+	if fss.options.ReapInterval >= 1 {
+		go fss.reapPeriodically()
+	}
 	return &fss, nil
 }
 
+// newEventBus creates an event bus watching the given directories, which are the given
+// watched directory or the shard directories of it, with the given file watcher.
+func (fss *fsStorage) newEventBus(watchedDirName string, eventDirNames []string, newFileWatcher func() (internal.FileWatcher, error)) *internal.EventBus {
+	return new(internal.EventBus).Init(internal.EventBusOptions{
+		EventDirNames:  eventDirNames,
+		NewFileWatcher: newFileWatcher,
+		ErrorHandler: func(err error) {
+			fss.options.Logger.Log(LogEntry{
+				Level:   LogLevelWarn,
+				Message: "failed to watch for changes",
+				Path:    watchedDirName,
+				Err:     err,
+			})
+			fss.options.Observer.WatchErrorOccurred(err)
+			if fss.options.WatchErrorHandler != nil {
+				fss.options.WatchErrorHandler(err)
+			}
+		},
+		WatcherCountHandler: fss.options.Observer.WatchersChanged,
+		EventHandler:        func(string) { fss.options.Observer.EventFired() },
+	})
+}
+
 type fsStorage struct {
 	options  Options
+	fs       internal.FS
 	dirNames dirNames
-	eventBus internal.EventBus
+	eventBus *internal.EventBus
 	closure  chan struct{}
 }
 
-func (fss *fsStorage) GetValue(_ context.Context, key string) (string, versionedkv.Version, error) {
-	value, version, _, err := fss.doGetValue(key, "")
+func (fss *fsStorage) GetValue(ctx context.Context, key string) (string, versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationGetValue, key)
+	value, version, _, _, err := op.FSS.doGetValue(key, "")
+	err = wrapError(key, err)
+	op.End(readOutcome(version, err), err)
 	return value, version2OpaqueVersion(version), err
 }
 
-func (fss *fsStorage) doGetValue(key string, oldVersion string) (string, string, bool, error) {
+// doGetValue retrieves the value for the given key if its version isn't equal to the
+// given old version. The expiration time of the current version is returned as well.
+func (fss *fsStorage) doGetValue(key string, oldVersion string) (string, string, time.Time, bool, error) {
 	if fss.eventBus.IsClosed() {
-		return "", "", false, versionedkv.ErrStorageClosed
+		return "", "", time.Time{}, false, versionedkv.ErrStorageClosed
 	}
-	versionFile, newVersion, err := fss.openAndReadVersionFile(key, os.O_RDONLY)
+	fileName := internal.EncodeKey(key)
+	versionFile, record, err := fss.openAndReadVersionRecord(key, fileName, os.O_RDONLY)
 	if err == nil {
-		defer versionFile.Close()
+		defer func() {
+			// The value has been read by now, so that failures are logged only.
+			if err := versionFile.Close(); err != nil {
+				fss.logFileFailure(LogLevelWarn, "failed to close version file", fileName, record.Version, versionFile.Name(), err)
+			}
+		}()
 	} else {
 		if !os.IsNotExist(err) {
-			return "", "", false, nil
+			return "", "", time.Time{}, false, err
 		}
 	}
+	expireTime, err := fss.effectiveExpireTime(record)
+	if err != nil {
+		return "", "", time.Time{}, false, err
+	}
+	newVersion := record.Version
+	if isExpired(expireTime, time.Now()) {
+		newVersion, expireTime = "", time.Time{}
+	}
 	if newVersion == oldVersion {
-		return "", "", false, nil
+		return "", "", expireTime, false, nil
 	}
 	if newVersion == "" {
-		return "", "", true, nil
+		return "", "", time.Time{}, true, nil
 	}
-	valueFileName := fss.valueFileName(key, newVersion)
-	rawValue, err := ioutil.ReadFile(valueFileName)
+	valueFileName := fss.valueFileName(fileName, newVersion)
+	rawValue, err := internal.ReadFile(fss.fs, valueFileName)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", "", false, err
+		if os.IsNotExist(err) {
+			// The value file should exist as long as the version file is locked.
+			return "", "", time.Time{}, false, newCorruptionError(key, err)
 		}
+		return "", "", time.Time{}, false, err
 	}
-	return string(rawValue), newVersion, true, nil
+	return string(rawValue), newVersion, expireTime, true, nil
 }
 
 func (fss *fsStorage) WaitForValue(ctx context.Context, key string, oldOpaqueVersion versionedkv.Version) (string, versionedkv.Version, error) {
-	value, newVersion, err := fss.doWaitForValue(ctx, key, opaqueVersion2Version(oldOpaqueVersion))
+	op := fss.startOperation(ctx, OperationWaitForValue, key)
+	value, newVersion, err := op.FSS.doWaitForValue(ctx, key, opaqueVersion2Version(oldOpaqueVersion))
+	err = wrapError(key, err)
+	op.End(readOutcome(newVersion, err), err)
 	return value, version2OpaqueVersion(newVersion), err
 }
 
 func (fss *fsStorage) doWaitForValue(ctx context.Context, key string, oldVersion string) (string, string, error) {
+	fileName := internal.EncodeKey(key)
 	for {
 		var retry bool
 		value, newVersion, err := func() (string, string, error) {
-			watcher, err := fss.eventBus.AddWatcher(key)
+			watcher, err := fss.eventBus.AddWatcher(fileName)
 			if err != nil {
 				if err == internal.ErrEventBusClosed {
 					err = versionedkv.ErrStorageClosed
@@ -104,19 +385,28 @@ func (fss *fsStorage) doWaitForValue(ctx context.Context, key string, oldVersion
 			}
 			defer func() {
 				if watcher != (internal.Watcher{}) {
-					fss.eventBus.RemoveWatcher(key, watcher)
+					fss.eventBus.RemoveWatcher(fileName, watcher)
 				}
 			}()
-			value, newVersion, ok, err := fss.doGetValue(key, oldVersion)
+			value, newVersion, expireTime, ok, err := fss.doGetValue(key, oldVersion)
 			if err != nil {
 				return "", "", err
 			}
 			retry = !ok
 			if retry {
+				// Wake up on expiration, in case no reaper deletes the value in time.
+				var expiration <-chan time.Time
+				if !expireTime.IsZero() {
+					timer := time.NewTimer(time.Until(expireTime))
+					defer timer.Stop()
+					expiration = timer.C
+				}
 				select {
 				case <-watcher.Event():
 					watcher = internal.Watcher{}
 					return "", "", nil
+				case <-expiration:
+					return "", "", nil
 				case <-fss.closure:
 					watcher = internal.Watcher{}
 					return "", "", versionedkv.ErrStorageClosed
@@ -136,40 +426,57 @@ func (fss *fsStorage) doWaitForValue(ctx context.Context, key string, oldVersion
 	}
 }
 
-func (fss *fsStorage) CreateValue(_ context.Context, key string, value string) (versionedkv.Version, error) {
-	version, err := fss.doCreateValue(key, value)
+func (fss *fsStorage) CreateValue(ctx context.Context, key string, value string) (versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationCreateValue, key)
+	version, err := op.FSS.doCreateValue(key, value, valueOptions{})
+	err = wrapError(key, err)
+	op.End(writeOutcome(version != "", true, err), err)
 	return version2OpaqueVersion(version), err
 }
 
-func (fss *fsStorage) doCreateValue(key string, value string) (string, error) {
+func (fss *fsStorage) doCreateValue(key string, value string, options valueOptions) (string, error) {
 	if fss.eventBus.IsClosed() {
 		return "", versionedkv.ErrStorageClosed
 	}
-	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, os.O_RDWR|os.O_CREATE)
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer storeLockFile.Close()
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDWR|os.O_CREATE)
 	if err != nil {
 		return "", err
 	}
 	defer versionFile.Close()
+	if err := fss.ensureKeyFile(key, fileName); err != nil {
+		return "", err
+	}
 	if currentVersion != "" {
 		return "", nil
 	}
-	version := xid.New().String()
-	if err := fss.setValue(key, value, version, versionFile); err != nil {
-		return "", err
-	}
-	return version, nil
+	return fss.replaceValue(key, fileName, value, currentVersion, versionFile, options)
 }
 
-func (fss *fsStorage) UpdateValue(_ context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
-	newVersion, err := fss.doUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion))
+func (fss *fsStorage) UpdateValue(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationUpdateValue, key)
+	newVersion, err := op.FSS.doUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion), valueOptions{})
+	err = wrapError(key, err)
+	op.End(writeOutcome(newVersion != "", opaqueOldVersion != nil, err), err)
 	return version2OpaqueVersion(newVersion), err
 }
 
-func (fss *fsStorage) doUpdateValue(key string, value string, oldVersion string) (string, error) {
+func (fss *fsStorage) doUpdateValue(key string, value string, oldVersion string, options valueOptions) (string, error) {
 	if fss.eventBus.IsClosed() {
 		return "", versionedkv.ErrStorageClosed
 	}
-	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, os.O_RDWR)
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer storeLockFile.Close()
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDWR)
 	if err == nil {
 		defer versionFile.Close()
 	} else {
@@ -183,57 +490,66 @@ func (fss *fsStorage) doUpdateValue(key string, value string, oldVersion string)
 	if oldVersion != "" && currentVersion != oldVersion {
 		return "", nil
 	}
-	newVersion := xid.New().String()
-	if err := fss.setValue(key, value, newVersion, versionFile); err != nil {
-		return "", err
-	}
-	valueFileName := fss.valueFileName(key, currentVersion)
-	os.Remove(valueFileName)
-	return newVersion, nil
+	return fss.replaceValue(key, fileName, value, currentVersion, versionFile, options)
 }
 
-func (fss *fsStorage) CreateOrUpdateValue(_ context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
-	newVersion, err := fss.doCreateOrUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion))
+func (fss *fsStorage) CreateOrUpdateValue(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationCreateOrUpdateValue, key)
+	newVersion, err := op.FSS.doCreateOrUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion), valueOptions{})
+	err = wrapError(key, err)
+	op.End(writeOutcome(newVersion != "", opaqueOldVersion != nil, err), err)
 	return version2OpaqueVersion(newVersion), err
 }
 
-func (fss *fsStorage) doCreateOrUpdateValue(key string, value string, oldVersion string) (string, error) {
+func (fss *fsStorage) doCreateOrUpdateValue(key string, value string, oldVersion string, options valueOptions) (string, error) {
 	if fss.eventBus.IsClosed() {
 		return "", versionedkv.ErrStorageClosed
 	}
-	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, os.O_RDWR|os.O_CREATE)
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer storeLockFile.Close()
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDWR|os.O_CREATE)
 	if err != nil {
 		return "", err
 	}
 	defer versionFile.Close()
-	if currentVersion == "" {
-		version := xid.New().String()
-		if err := fss.setValue(key, value, version, versionFile); err != nil {
-			return "", err
-		}
-		return version, nil
+	if err := fss.ensureKeyFile(key, fileName); err != nil {
+		return "", err
 	}
-	if oldVersion != "" && currentVersion != oldVersion {
+	if currentVersion != "" && oldVersion != "" && currentVersion != oldVersion {
 		return "", nil
 	}
-	newVersion := xid.New().String()
-	if err := fss.setValue(key, value, newVersion, versionFile); err != nil {
-		return "", err
-	}
-	valueFileName := fss.valueFileName(key, currentVersion)
-	os.Remove(valueFileName)
-	return newVersion, nil
+	return fss.replaceValue(key, fileName, value, currentVersion, versionFile, options)
 }
 
-func (fss *fsStorage) DeleteValue(_ context.Context, key string, opaqueVersion versionedkv.Version) (bool, error) {
-	return fss.doDeleteValue(key, opaqueVersion2Version(opaqueVersion))
+func (fss *fsStorage) DeleteValue(ctx context.Context, key string, opaqueVersion versionedkv.Version) (bool, error) {
+	op := fss.startOperation(ctx, OperationDeleteValue, key)
+	ok, err := op.FSS.doDeleteValue(key, opaqueVersion2Version(opaqueVersion))
+	err = wrapError(key, err)
+	op.End(writeOutcome(ok, opaqueVersion != nil, err), err)
+	return ok, err
 }
 
 func (fss *fsStorage) doDeleteValue(key string, version string) (bool, error) {
 	if fss.eventBus.IsClosed() {
 		return false, versionedkv.ErrStorageClosed
 	}
-	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, os.O_RDWR)
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer storeLockFile.Close()
+	return fss.deleteValue(key, version)
+}
+
+// deleteValue deletes the value for the given key if its current version is equal to the
+// given version (if given). The store lock should be held.
+func (fss *fsStorage) deleteValue(key string, version string) (bool, error) {
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDWR)
 	if err == nil {
 		defer versionFile.Close()
 	} else {
@@ -247,16 +563,15 @@ func (fss *fsStorage) doDeleteValue(key string, version string) (bool, error) {
 	if version != "" && currentVersion != version {
 		return false, nil
 	}
-	if runtime.GOOS == "darwin" {
-		if _, err := versionFile.Write([]byte{0}); err != nil {
-			return false, err
-		}
+	change := changeRecord{Type: ChangeDelete, Key: key}
+	if _, err := fss.allocateRevision([]changeRecord{change}); err != nil {
+		return false, err
 	}
-	if err := versionFile.Truncate(0); err != nil {
+	if err := fss.truncateVersionFile(versionFile); err != nil {
+		fss.revertChange(change, versionFile)
 		return false, err
 	}
-	valueFileName := fss.valueFileName(key, currentVersion)
-	os.Remove(valueFileName)
+	fss.retireValue(fileName, currentVersion)
 	return true, nil
 }
 
@@ -269,23 +584,22 @@ func (fss *fsStorage) Close() error {
 	return nil
 }
 
-func (fss *fsStorage) Inspect(_ context.Context) (versionedkv.StorageDetails, error) {
+func (fss *fsStorage) Inspect(ctx context.Context) (versionedkv.StorageDetails, error) {
 	if fss.eventBus.IsClosed() {
 		return versionedkv.StorageDetails{IsClosed: true}, nil
 	}
-	fileInfos, err := ioutil.ReadDir(fss.dirNames.Versions)
-	if err != nil {
-		return versionedkv.StorageDetails{}, err
-	}
 	var valueDetails map[string]versionedkv.ValueDetails
-	for _, fileInfo := range fileInfos {
-		key := fileInfo.Name()
-		value, version, _, err := fss.doGetValue(key, "")
+	if err := fss.forEachShardedFile(ctx, fss.dirNames.Versions, func(fileInfo os.FileInfo) error {
+		key, err := fss.decodeFileName(fileInfo.Name())
+		if err != nil {
+			return nil
+		}
+		value, version, _, _, err := fss.doGetValue(key, "")
 		if err != nil {
-			return versionedkv.StorageDetails{}, err
+			return wrapError(key, err)
 		}
 		if version == "" {
-			continue
+			return nil
 		}
 		if valueDetails == nil {
 			valueDetails = make(map[string]versionedkv.ValueDetails)
@@ -294,69 +608,309 @@ func (fss *fsStorage) Inspect(_ context.Context) (versionedkv.StorageDetails, er
 			V:       value,
 			Version: version,
 		}
+		return nil
+	}); err != nil {
+		return versionedkv.StorageDetails{}, wrapError("", err)
 	}
 	return versionedkv.StorageDetails{
 		Values: valueDetails,
 	}, nil
 }
 
-func (fss *fsStorage) valueFileName(key, version string) string {
-	return filepath.Join(fss.dirNames.Values, key+"."+version)
+// ensureKeyFile makes sure the key file holding the given key exists if the given file
+// name is hashed, so that the key can be recovered from the file name later. The version
+// file for the key should be locked exclusively.
+func (fss *fsStorage) ensureKeyFile(key string, fileName string) error {
+	if !internal.IsHashedFileName(fileName) {
+		return nil
+	}
+	keyFileName := fss.keyFileName(fileName)
+	if _, err := fss.fs.Stat(keyFileName); err == nil {
+		return nil
+	} else {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	sync := fss.options.Durability != DurabilityNone
+	return fss.writeFileAtomically(keyFileName, []byte(key), sync)
+}
+
+// decodeFileName converts the given file name back to a key.
+func (fss *fsStorage) decodeFileName(fileName string) (string, error) {
+	key, err := internal.DecodeKey(fileName)
+	if err != internal.ErrHashedFileName {
+		return key, err
+	}
+	rawKey, err := internal.ReadFile(fss.fs, fss.keyFileName(fileName))
+	if err != nil {
+		return "", err
+	}
+	key = string(rawKey)
+	if internal.EncodeKey(key) != fileName {
+		return "", internal.ErrInvalidFileName
+	}
+	return key, nil
+}
+
+// isValidFileName returns whether the given file name can be encoded from a key.
+func isValidFileName(fileName string) bool {
+	_, err := internal.DecodeKey(fileName)
+	return err == nil || err == internal.ErrHashedFileName
+}
+
+func (fss *fsStorage) keyFileName(fileName string) string {
+	return filepath.Join(fss.dirNames.Keys, fileName)
+}
+
+func (fss *fsStorage) valueFileName(fileName, version string) string {
+	return filepath.Join(fss.valueDirName(fileName), fileName+"."+version)
+}
+
+// valueDirName returns the name of the shard directory of value files for the given file
+// name.
+func (fss *fsStorage) valueDirName(fileName string) string {
+	return filepath.Join(fss.dirNames.Values, internal.ShardDirName(fileName, fss.options.ShardDepth))
+}
+
+// parseValueFileName splits the name of a value file into the file name encoded from the
+// key and the version.
+func parseValueFileName(valueBaseName string) (string, string, bool) {
+	i := strings.LastIndexByte(valueBaseName, '.')
+	if i < 0 {
+		return "", "", false
+	}
+	fileName, version := valueBaseName[:i], valueBaseName[i+1:]
+	if !isValidVersion(version) {
+		return "", "", false
+	}
+	return fileName, version, true
 }
 
-func (fss *fsStorage) versionFileName(key string) string {
-	return filepath.Join(fss.dirNames.Versions, key)
+func (fss *fsStorage) versionFileName(fileName string) string {
+	return filepath.Join(fss.dirNames.Versions, internal.ShardDirName(fileName, fss.options.ShardDepth), fileName)
 }
 
-func (fss *fsStorage) openAndReadVersionFile(key string, flag int) (*lockedfile.File, string, error) {
-	versionFileName := fss.versionFileName(key)
-	versionFile, err := lockedfile.OpenFile(versionFileName, flag, 0666)
+// openAndReadVersionFile opens the version file for the given file name and reads the
+// current version. Expired values are treated as deleted, and if the version file is
+// opened for writing, they are deleted actually.
+func (fss *fsStorage) openAndReadVersionFile(key string, fileName string, flag int) (internal.File, string, error) {
+	versionFile, record, err := fss.openAndReadCurrentRecord(key, fileName, flag)
 	if err != nil {
 		return nil, "", err
 	}
-	rawVersion, err := ioutil.ReadAll(versionFile)
+	return versionFile, record.Version, nil
+}
+
+// openAndReadCurrentRecord is like openAndReadVersionFile but reads the whole record of
+// the current version, which is the zero value if there is no current version.
+func (fss *fsStorage) openAndReadCurrentRecord(key string, fileName string, flag int) (internal.File, versionRecord, error) {
+	versionFile, record, err := fss.openAndReadVersionRecord(key, fileName, flag)
+	if err != nil {
+		return nil, versionRecord{}, err
+	}
+	expireTime, err := fss.effectiveExpireTime(record)
 	if err != nil {
 		versionFile.Close()
-		return nil, "", err
+		return nil, versionRecord{}, err
+	}
+	if !isExpired(expireTime, time.Now()) {
+		return versionFile, record, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if _, err := fss.allocateRevision([]changeRecord{{Type: ChangeDelete, Key: key}}); err != nil {
+			versionFile.Close()
+			return nil, versionRecord{}, err
+		}
+		// The value is treated as deleted even if truncation fails, so that the change
+		// journaled holds.
+		if err := fss.truncateVersionFile(versionFile); err != nil {
+			versionFile.Close()
+			return nil, versionRecord{}, err
+		}
+		fss.retireValue(fileName, record.Version)
+	}
+	return versionFile, versionRecord{}, nil
+}
+
+func (fss *fsStorage) openAndReadVersionRecord(key string, fileName string, flag int) (internal.File, versionRecord, error) {
+	versionFile, err := fss.openVersionFile(fileName, flag)
+	if err != nil {
+		return nil, versionRecord{}, err
+	}
+	rawRecord, err := readVersionFile(versionFile)
+	if err != nil {
+		versionFile.Close()
+		return nil, versionRecord{}, err
+	}
+	record, ok := parseVersionRecord(rawRecord)
+	if !ok {
+		versionFile.Close()
+		return nil, versionRecord{}, newCorruptionError(key, fmt.Errorf("malformed version %q", rawRecord))
+	}
+	return versionFile, record, nil
+}
+
+func (fss *fsStorage) openVersionFile(fileName string, flag int) (internal.File, error) {
+	versionFileName := fss.versionFileName(fileName)
+	for {
+		versionFile, err := fss.fs.OpenLockedFile(versionFileName, flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		// The version file may have been removed by compaction while waiting for the
+		// lock, in which case the version file should be reopened.
+		ok, err := fss.isLinked(versionFile, versionFileName)
+		if err != nil {
+			versionFile.Close()
+			return nil, err
+		}
+		if ok {
+			return versionFile, nil
+		}
+		versionFile.Close()
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelDebug,
+			Message: "version file removed by compaction; reopening",
+			Path:    versionFileName,
+		})
+	}
+}
+
+// readVersionFile reads the raw version record from the given version file, and then
+// rewinds the version file for writing.
+func readVersionFile(versionFile internal.File) (string, error) {
+	rawVersion, err := ioutil.ReadAll(versionFile)
+	if err != nil {
+		return "", err
 	}
 	if len(rawVersion) >= 1 {
 		if _, err := versionFile.Seek(0, io.SeekStart); err != nil {
-			versionFile.Close()
-			return nil, "", err
+			return "", err
+		}
+	}
+	return string(rawVersion), nil
+}
+
+// truncateVersionFile truncates the given version file, which marks the value deleted.
+func (fss *fsStorage) truncateVersionFile(versionFile internal.File) error {
+	if runtime.GOOS == "darwin" {
+		// Truncation alone doesn't trigger a write event on macOS.
+		if _, err := versionFile.Write([]byte{0}); err != nil {
+			return err
 		}
 	}
-	return versionFile, string(rawVersion), nil
+	if err := versionFile.Truncate(0); err != nil {
+		return err
+	}
+	return fss.syncVersionFile(versionFile, false)
+}
+
+// valueOptions represents options for writing values.
+type valueOptions struct {
+	TTL     time.Duration
+	LeaseID string
+}
+
+// replaceValue sets the value for the given key and file name to a new version as the
+// given value, and then retires the current version if any. The version file should be
+// locked exclusively.
+func (fss *fsStorage) replaceValue(key, fileName, value, currentVersion string, versionFile internal.File, options valueOptions) (string, error) {
+	changes := []changeRecord{{Type: ChangePut, Key: key}}
+	if _, err := fss.allocateRevision(changes); err != nil {
+		return "", err
+	}
+	record := versionRecord{
+		Version: changes[0].Version,
+		LeaseID: options.LeaseID,
+	}
+	if options.TTL >= 1 {
+		record.ExpireTime = time.Now().Add(options.TTL)
+	}
+	if err := fss.setValue(fileName, value, record, versionFile, currentVersion == ""); err != nil {
+		fss.revertChange(changes[0], versionFile)
+		return "", err
+	}
+	if currentVersion != "" {
+		fss.retireValue(fileName, currentVersion)
+	}
+	return record.Version, nil
 }
 
-func (fss *fsStorage) setValue(key, value, version string, versionFile *lockedfile.File) error {
-	valueFileName := fss.valueFileName(key, version)
-	if err := ioutil.WriteFile(valueFileName, []byte(value), 0666); err != nil {
+func (fss *fsStorage) setValue(fileName, value string, record versionRecord, versionFile internal.File, isNew bool) error {
+	valueFileName := fss.valueFileName(fileName, record.Version)
+	if err := fss.writeValueFile(valueFileName, value); err != nil {
 		return err
 	}
-	if _, err := versionFile.WriteString(version); err != nil {
+	return fss.writeVersionFile(versionFile, record, isNew)
+}
+
+// writeVersionFile writes the given version record to the given version file, which
+// should be locked exclusively and rewound.
+func (fss *fsStorage) writeVersionFile(versionFile internal.File, record versionRecord, isNew bool) error {
+	rawRecord := record.String()
+	if _, err := io.WriteString(versionFile, rawRecord); err != nil {
 		return err
 	}
-	return nil
+	// The previous record may be longer.
+	if err := versionFile.Truncate(int64(len(rawRecord))); err != nil {
+		return err
+	}
+	return fss.syncVersionFile(versionFile, isNew)
 }
 
 type dirNames struct {
+	Changes  string
+	History  string
+	Keys     string
+	Leases   string
+	Txns     string
 	Values   string
 	Versions string
 }
 
-func createDirs(baseDirName string) (dirNames, error) {
-	valuesDirName := filepath.Join(baseDirName, "values")
-	if err := os.MkdirAll(valuesDirName, os.ModePerm); err != nil {
-		return dirNames{}, err
-	}
-	versionsDirName := filepath.Join(baseDirName, "versions")
-	if err := os.MkdirAll(versionsDirName, os.ModePerm); err != nil {
-		return dirNames{}, err
+func createDirs(fs internal.FS, baseDirName string) (dirNames, error) {
+	for _, dirBaseName := range dirBaseNames {
+		if err := fs.MkdirAll(filepath.Join(baseDirName, dirBaseName), os.ModePerm); err != nil {
+			return dirNames{}, err
+		}
 	}
+	return makeDirNames(baseDirName), nil
+}
+
+func makeDirNames(baseDirName string) dirNames {
 	return dirNames{
-		Values:   valuesDirName,
-		Versions: versionsDirName,
-	}, nil
+		Changes:  filepath.Join(baseDirName, "changes"),
+		History:  filepath.Join(baseDirName, "history"),
+		Keys:     filepath.Join(baseDirName, "keys"),
+		Leases:   filepath.Join(baseDirName, "leases"),
+		Txns:     filepath.Join(baseDirName, "txns"),
+		Values:   filepath.Join(baseDirName, "values"),
+		Versions: filepath.Join(baseDirName, "versions"),
+	}
+}
+
+// dirBaseNames are base names of the directories in the base directory.
+var dirBaseNames = []string{"changes", "history", "keys", "leases", "txns", "values", "versions"}
+
+func (fss *fsStorage) isLinked(file internal.File, fileName string) (bool, error) {
+	fileInfo1, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	fileInfo2, err := fss.fs.Stat(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fss.fs.SameFile(fileInfo1, fileInfo2), nil
+}
+
+func isValidVersion(version string) bool {
+	_, _, ok := splitVersion(version)
+	return ok
 }
 
 func version2OpaqueVersion(version string) versionedkv.Version {
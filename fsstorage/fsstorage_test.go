@@ -1,11 +1,20 @@
 package fsstorage_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-tk/versionedkv"
 	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFSStorage(t *testing.T) {
@@ -14,12 +23,287 @@ func TestFSStorage(t *testing.T) {
 	})
 }
 
-func makeStorage() (versionedkv.Storage, error) {
+func TestFSStorage_Durability(t *testing.T) {
+	for _, durability := range []Durability{DurabilityData, DurabilityFull} {
+		durability := durability
+		t.Run(fmt.Sprintf("Durability%d", durability), func(t *testing.T) {
+			t.Parallel()
+			versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+				return makeStorageWithOptions(Options{Durability: durability})
+			})
+		})
+	}
+}
+
+func TestFSStorage_WatchMode(t *testing.T) {
+	for _, watchMode := range []WatchMode{WatchModePoll, WatchModeHybrid} {
+		watchMode := watchMode
+		t.Run(fmt.Sprintf("WatchMode%d", watchMode), func(t *testing.T) {
+			t.Parallel()
+			versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+				return makeStorageWithOptions(Options{
+					WatchMode:    watchMode,
+					PollInterval: 10 * time.Millisecond,
+				})
+			})
+		})
+	}
+}
+
+func TestFSStorage_DurabilityLeavesNoTempFiles(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityData, DurabilityFull} {
+		baseDirName := makeBaseDir(t)
+		s, err := Open(Options{
+			BaseDirName: baseDirName,
+			Durability:  durability,
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		longKey := strings.Repeat("x/", 100)
+		version, err := s.CreateValue(context.Background(), longKey, "foo")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		version, err = s.UpdateValue(context.Background(), longKey, "bar", version)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_, err = s.CreateOrUpdateValue(context.Background(), "baz", "qux", nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		err = s.Close()
+		assert.NoError(t, err)
+		for _, dirName := range []string{"keys", "values", "versions"} {
+			fileInfos, err := ioutil.ReadDir(filepath.Join(baseDirName, dirName))
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			for _, fileInfo := range fileInfos {
+				assert.False(t, strings.HasPrefix(fileInfo.Name(), "."), "file name: %q", fileInfo.Name())
+			}
+		}
+		fileInfos, err := ioutil.ReadDir(filepath.Join(baseDirName, "values"))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Len(t, fileInfos, 2)
+	}
+}
+
+func makeStorage() (Storage, error) {
+	return makeStorageWithOptions(Options{})
+}
+
+func makeStorageWithOptions(options Options) (Storage, error) {
 	baseDirName, err := ioutil.TempDir("", "testfsstorage.*")
 	if err != nil {
 		return nil, err
 	}
-	return Open(Options{
-		BaseDirName: baseDirName,
+	options.BaseDirName = baseDirName
+	return Open(options)
+}
+
+func makeBaseDir(t *testing.T) string {
+	baseDirName, err := ioutil.TempDir("", "testfsstorage.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return baseDirName
+}
+
+func TestFSStorage_SpecialKeys(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	keys := []string{
+		"",
+		"svc/a/config",
+		"../../etc/passwd",
+		"foo\x00bar",
+		"Foo",
+		"foo",
+		"nul",
+		strings.Repeat("long/", 100),
+	}
+	expectedValueDetails := make(map[string]versionedkv.ValueDetails)
+	for i, key := range keys {
+		value := strconv.Itoa(i)
+		version, err := s.CreateValue(context.Background(), key, value)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NotNil(t, version, "key: %q", key) {
+			t.FailNow()
+		}
+		expectedValueDetails[key] = versionedkv.ValueDetails{
+			V:       value,
+			Version: version,
+		}
+	}
+	for key, valueDetails := range expectedValueDetails {
+		value, version, err := s.GetValue(context.Background(), key)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, valueDetails, versionedkv.ValueDetails{V: value, Version: version}, "key: %q", key)
+	}
+	details, err := s.Inspect(context.Background())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, versionedkv.StorageDetails{Values: expectedValueDetails}, details)
+}
+
+func TestFSStorage_MemFS(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityFull} {
+		durability := durability
+		t.Run(fmt.Sprintf("Durability%d", durability), func(t *testing.T) {
+			t.Parallel()
+			versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+				return OpenWithFS(Options{Durability: durability}, internal.NewMemFS())
+			})
+		})
+	}
+	t.Run("WatchModePoll", func(t *testing.T) {
+		t.Parallel()
+		versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+			return OpenWithFS(Options{
+				WatchMode:    WatchModePoll,
+				PollInterval: 10 * time.Millisecond,
+			}, internal.NewMemFS())
+		})
 	})
 }
+
+func TestFSStorage_FaultyFS(t *testing.T) {
+	versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+		return OpenWithFS(Options{}, internal.NewFaultyFS(internal.NewMemFS()))
+	})
+}
+
+func TestFSStorage_Faults(t *testing.T) {
+	errInjected := errors.New("injected")
+	for _, tc := range []struct {
+		Name       string
+		Durability Durability
+		Op         internal.FaultOp
+		DirName    string
+		Write      func(s Storage, version versionedkv.Version) error
+
+		// IsDeleted indicates whether the value has been deleted despite the fault.
+		IsDeleted bool
+	}{
+		{
+			Name:    "no space left on writing value file",
+			Op:      internal.FaultOpWrite,
+			DirName: "values",
+			Write: func(s Storage, version versionedkv.Version) error {
+				_, err := s.UpdateValue(context.Background(), "foo", "new value", version)
+				return err
+			},
+		},
+		{
+			Name:       "no space left on writing temporary value file",
+			Durability: DurabilityData,
+			Op:         internal.FaultOpWrite,
+			DirName:    "values",
+			Write: func(s Storage, version versionedkv.Version) error {
+				_, err := s.CreateOrUpdateValue(context.Background(), "foo", "new value", version)
+				return err
+			},
+		},
+		{
+			Name:       "failing rename of value file",
+			Durability: DurabilityData,
+			Op:         internal.FaultOpRename,
+			DirName:    "values",
+			Write: func(s Storage, version versionedkv.Version) error {
+				_, err := s.UpdateValue(context.Background(), "foo", "new value", version)
+				return err
+			},
+		},
+		{
+			Name:    "failing truncate of version file",
+			Op:      internal.FaultOpTruncate,
+			DirName: "versions",
+			Write: func(s Storage, version versionedkv.Version) error {
+				_, err := s.DeleteValue(context.Background(), "foo", version)
+				return err
+			},
+		},
+		{
+			Name:       "failing sync of version file",
+			Durability: DurabilityFull,
+			Op:         internal.FaultOpSync,
+			DirName:    "versions",
+			Write: func(s Storage, version versionedkv.Version) error {
+				_, err := s.DeleteValue(context.Background(), "foo", version)
+				return err
+			},
+			IsDeleted: true,
+		},
+		{
+			Name:    "partial read of version file",
+			Op:      internal.FaultOpRead,
+			DirName: "versions",
+			Write: func(s Storage, version versionedkv.Version) error {
+				_, _, err := s.GetValue(context.Background(), "foo")
+				return err
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			fs := internal.NewFaultyFS(internal.NewMemFS())
+			options := Options{
+				BaseDirName: "versionedkv",
+				Durability:  tc.Durability,
+			}
+			s, err := OpenWithFS(options, fs)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer s.Close()
+			ctx := context.Background()
+			version, err := s.CreateValue(ctx, "foo", "old value")
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			faultDirName := filepath.Join(options.BaseDirName, tc.DirName) + string(filepath.Separator)
+			fs.SetFault(func(op internal.FaultOp, name string) error {
+				if op == tc.Op && strings.HasPrefix(name, faultDirName) {
+					return errInjected
+				}
+				return nil
+			})
+			err = tc.Write(s, version)
+			assert.True(t, errors.Is(err, ErrIO), "err: %v", err)
+			assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+			fs.SetFault(nil)
+
+			value, version2, err := s.GetValue(ctx, "foo")
+			if assert.NoError(t, err) {
+				if tc.IsDeleted {
+					assert.Nil(t, version2)
+				} else {
+					assert.Equal(t, "old value", value)
+					assert.Equal(t, version, version2)
+				}
+			}
+			// Whatever has been left behind by the fault is cleaned up by compaction.
+			err = s.Compact(ctx)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			problems, err := CheckWithFS(ctx, options, fs, false)
+			if assert.NoError(t, err) {
+				assert.Empty(t, problems)
+			}
+		})
+	}
+}
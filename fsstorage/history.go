@@ -0,0 +1,275 @@
+package fsstorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// VersionInfo represents information about a version of a value.
+type VersionInfo struct {
+	Version versionedkv.Version
+
+	// CreateTime is the time when the version was created.
+	CreateTime time.Time
+
+	// RetireTime is the time when the version was superseded or deleted, or the zero
+	// time if the version is current.
+	RetireTime time.Time
+}
+
+func (fss *fsStorage) ListVersions(_ context.Context, key string) ([]VersionInfo, error) {
+	versions, err := fss.doListVersions(key)
+	return versions, wrapError(key, err)
+}
+
+func (fss *fsStorage) doListVersions(key string) ([]VersionInfo, error) {
+	if fss.eventBus.IsClosed() {
+		return nil, versionedkv.ErrStorageClosed
+	}
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDONLY)
+	if err == nil {
+		defer versionFile.Close()
+	} else {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	historyFileInfos, err := fss.readHistoryDir(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var versions []VersionInfo
+	for i := len(historyFileInfos) - 1; i >= 0; i-- {
+		historyFileInfo := historyFileInfos[i]
+		version := historyFileInfo.Name()
+		versions = append(versions, VersionInfo{
+			Version:    version,
+			CreateTime: versionTime(version),
+			RetireTime: historyFileInfo.ModTime(),
+		})
+	}
+	if currentVersion != "" {
+		versions = append(versions, VersionInfo{
+			Version:    currentVersion,
+			CreateTime: versionTime(currentVersion),
+		})
+	}
+	return versions, nil
+}
+
+func (fss *fsStorage) GetValueAt(_ context.Context, key string, opaqueVersion versionedkv.Version) (string, bool, error) {
+	value, ok, err := fss.doGetValueAt(key, opaqueVersion2Version(opaqueVersion))
+	return value, ok, wrapError(key, err)
+}
+
+func (fss *fsStorage) doGetValueAt(key string, version string) (string, bool, error) {
+	if fss.eventBus.IsClosed() {
+		return "", false, versionedkv.ErrStorageClosed
+	}
+	if !isValidVersion(version) {
+		return "", false, nil
+	}
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDONLY)
+	if err == nil {
+		defer versionFile.Close()
+	} else {
+		if !os.IsNotExist(err) {
+			return "", false, err
+		}
+	}
+	return fss.readValueAt(fileName, version, currentVersion)
+}
+
+func (fss *fsStorage) RollbackValue(_ context.Context, key string, opaqueVersion versionedkv.Version, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	newVersion, err := fss.doRollbackValue(key, opaqueVersion2Version(opaqueVersion), opaqueVersion2Version(opaqueOldVersion))
+	return version2OpaqueVersion(newVersion), wrapError(key, err)
+}
+
+func (fss *fsStorage) doRollbackValue(key string, version string, oldVersion string) (string, error) {
+	if fss.eventBus.IsClosed() {
+		return "", versionedkv.ErrStorageClosed
+	}
+	if !isValidVersion(version) {
+		return "", nil
+	}
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer storeLockFile.Close()
+	fileName := internal.EncodeKey(key)
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return "", err
+	}
+	defer versionFile.Close()
+	if err := fss.ensureKeyFile(key, fileName); err != nil {
+		return "", err
+	}
+	if oldVersion != "" && currentVersion != oldVersion {
+		return "", nil
+	}
+	value, ok, err := fss.readValueAt(fileName, version, currentVersion)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", nil
+	}
+	return fss.replaceValue(key, fileName, value, currentVersion, versionFile, valueOptions{})
+}
+
+// readValueAt reads the value for the given file name at the given version. The version
+// file should be locked.
+func (fss *fsStorage) readValueAt(fileName string, version string, currentVersion string) (string, bool, error) {
+	var valueFileName string
+	if version == currentVersion {
+		valueFileName = fss.valueFileName(fileName, version)
+	} else {
+		valueFileName = fss.historyFileName(fileName, version)
+	}
+	rawValue, err := internal.ReadFile(fss.fs, valueFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return string(rawValue), true, nil
+}
+
+func (fss *fsStorage) isHistoryEnabled() bool {
+	return fss.options.HistoryLimit >= 1 || fss.options.HistoryRetention >= 1
+}
+
+// retireValue retires the given version of the value for the given file name, which has
+// been superseded or deleted, by moving the value file into history if history is
+// enabled, or removing the value file otherwise. The version file should be locked
+// exclusively.
+//
+// As the new version has been committed already, failures are logged only and leftovers
+// are removed by compaction.
+func (fss *fsStorage) retireValue(fileName string, version string) {
+	valueFileName := fss.valueFileName(fileName, version)
+	if !fss.isHistoryEnabled() {
+		if err := fss.fs.Remove(valueFileName); err != nil {
+			fss.logFileFailure(LogLevelWarn, "failed to remove value file", fileName, version, valueFileName, err)
+		}
+		return
+	}
+	historyDirName := fss.historyDirName(fileName)
+	if err := fss.fs.MkdirAll(historyDirName, os.ModePerm); err != nil {
+		fss.logFileFailure(LogLevelWarn, "failed to create history directory", fileName, version, historyDirName, err)
+		return
+	}
+	historyFileName := fss.historyFileName(fileName, version)
+	if err := fss.fs.Rename(valueFileName, historyFileName); err != nil {
+		fss.logFileFailure(LogLevelWarn, "failed to move value file into history", fileName, version, valueFileName, err)
+		return
+	}
+	now := time.Now()
+	if err := fss.fs.Chtimes(historyFileName, now, now); err != nil {
+		fss.logFileFailure(LogLevelWarn, "failed to touch history file", fileName, version, historyFileName, err)
+		return
+	}
+	if _, err := fss.pruneHistory(fileName, now); err != nil {
+		fss.logFileFailure(LogLevelWarn, "failed to prune history", fileName, version, historyDirName, err)
+	}
+}
+
+// pruneHistory removes previous versions of the value for the given file name, which
+// are beyond the limits on history. The version file should be locked exclusively.
+func (fss *fsStorage) pruneHistory(fileName string, now time.Time) (int, error) {
+	historyFileInfos, err := fss.readHistoryDir(fileName)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i, historyFileInfo := range historyFileInfos {
+		if fss.isHistoryEnabled() &&
+			(fss.options.HistoryLimit == 0 || i < fss.options.HistoryLimit) &&
+			(fss.options.HistoryRetention == 0 || now.Sub(historyFileInfo.ModTime()) <= fss.options.HistoryRetention) {
+			n++
+			continue
+		}
+		historyFileName := fss.historyFileName(fileName, historyFileInfo.Name())
+		if err := ignoreNotExist(fss.fs.Remove(historyFileName)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// readHistoryDir reads the history directory for the given file name and returns
+// previous versions from newest to oldest.
+func (fss *fsStorage) readHistoryDir(fileName string) ([]os.FileInfo, error) {
+	fileInfos, err := fss.fs.ReadDir(fss.historyDirName(fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	historyFileInfos := fileInfos[:0]
+	for _, fileInfo := range fileInfos {
+		if isValidVersion(fileInfo.Name()) {
+			historyFileInfos = append(historyFileInfos, fileInfo)
+		}
+	}
+	sort.Slice(historyFileInfos, func(i, j int) bool {
+		fileInfo1, fileInfo2 := historyFileInfos[i], historyFileInfos[j]
+		if modTime1, modTime2 := fileInfo1.ModTime(), fileInfo2.ModTime(); !modTime1.Equal(modTime2) {
+			return modTime1.After(modTime2)
+		}
+		return fileInfo1.Name() > fileInfo2.Name()
+	})
+	return historyFileInfos, nil
+}
+
+func (fss *fsStorage) compactHistoryDir(fileInfo os.FileInfo) error {
+	fileName := fileInfo.Name()
+	if !fileInfo.IsDir() || !isValidFileName(fileName) {
+		return nil
+	}
+	// Lock the version file, creating it if needed, so that no writer can move value
+	// files into the history directory while it's being pruned and removed. The empty
+	// version file created will be removed later in compaction.
+	versionFile, err := fss.openVersionFile(fileName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer versionFile.Close()
+	n, err := fss.pruneHistory(fileName, time.Now())
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Fails if not empty, e.g. there are unexpected files.
+		fss.fs.Remove(fss.historyDirName(fileName))
+	}
+	return nil
+}
+
+func (fss *fsStorage) historyDirName(fileName string) string {
+	return filepath.Join(fss.dirNames.History, fileName)
+}
+
+func (fss *fsStorage) historyFileName(fileName string, version string) string {
+	return filepath.Join(fss.dirNames.History, fileName, version)
+}
+
+func versionTime(version string) time.Time {
+	_, id, ok := splitVersion(version)
+	if !ok {
+		return time.Time{}
+	}
+	return id.Time()
+}
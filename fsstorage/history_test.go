@@ -0,0 +1,155 @@
+package fsstorage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_History(t *testing.T) {
+	s, err := makeStorageWithOptions(Options{HistoryLimit: 2})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	var versions []versionedkv.Version
+	for _, value := range []string{"v1", "v2", "v3", "v4"} {
+		version, err := s.CreateOrUpdateValue(ctx, "foo", value, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		versions = append(versions, version)
+	}
+	assert.Equal(t, versions[1:], listVersions(t, s, "foo"))
+	_, ok, err := s.GetValueAt(ctx, "foo", versions[0])
+	if assert.NoError(t, err) {
+		assert.False(t, ok)
+	}
+	value, ok, err := s.GetValueAt(ctx, "foo", versions[1])
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "v2", value)
+	}
+	value, ok, err = s.GetValueAt(ctx, "foo", versions[3])
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "v4", value)
+	}
+
+	version, err := s.RollbackValue(ctx, "foo", versions[1], versions[2])
+	if assert.NoError(t, err) {
+		assert.Nil(t, version)
+	}
+	version, err = s.RollbackValue(ctx, "foo", versions[0], nil)
+	if assert.NoError(t, err) {
+		assert.Nil(t, version)
+	}
+	version, err = s.RollbackValue(ctx, "foo", versions[1], versions[3])
+	if !assert.NoError(t, err) || !assert.NotNil(t, version) {
+		t.FailNow()
+	}
+	versions = append(versions, version)
+	value, version, err = s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v2", value)
+		assert.Equal(t, versions[4], version)
+	}
+	assert.Equal(t, versions[2:], listVersions(t, s, "foo"))
+
+	ok, err = s.DeleteValue(ctx, "foo", nil)
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		t.FailNow()
+	}
+	assert.Equal(t, versions[3:], listVersions(t, s, "foo"))
+	version, err = s.RollbackValue(ctx, "foo", versions[3], nil)
+	if !assert.NoError(t, err) || !assert.NotNil(t, version) {
+		t.FailNow()
+	}
+	value, _, err = s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v4", value)
+	}
+}
+
+func TestFSStorage_HistoryRetention(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{
+		BaseDirName:      baseDirName,
+		HistoryRetention: 100 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	version1, err := s.CreateValue(ctx, "foo", "v1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version2, err := s.UpdateValue(ctx, "foo", "v2", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = s.Compact(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []versionedkv.Version{version1, version2}, listVersions(t, s, "foo"))
+	time.Sleep(200 * time.Millisecond)
+	err = s.Compact(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []versionedkv.Version{version2}, listVersions(t, s, "foo"))
+	assert.Empty(t, readDirNames(t, filepath.Join(baseDirName, "history")))
+}
+
+func TestFSStorage_NoHistory(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	assert.Empty(t, listVersions(t, s, "foo"))
+	version1, err := s.CreateValue(ctx, "foo", "v1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version2, err := s.UpdateValue(ctx, "foo", "v2", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []versionedkv.Version{version2}, listVersions(t, s, "foo"))
+	_, ok, err := s.GetValueAt(ctx, "foo", version1)
+	if assert.NoError(t, err) {
+		assert.False(t, ok)
+	}
+}
+
+func TestFSStorage_HistoryLimit(t *testing.T) {
+	versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+		return makeStorageWithOptions(Options{
+			HistoryLimit:    1,
+			CompactInterval: time.Millisecond,
+		})
+	})
+}
+
+func listVersions(t *testing.T, s Storage, key string) []versionedkv.Version {
+	versionInfos, err := s.ListVersions(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []versionedkv.Version
+	for i, versionInfo := range versionInfos {
+		assert.False(t, versionInfo.CreateTime.IsZero())
+		assert.Equal(t, i == len(versionInfos)-1 && versionInfo.RetireTime.IsZero(), versionInfo.RetireTime.IsZero())
+		versions = append(versions, versionInfo.Version)
+	}
+	return versions
+}
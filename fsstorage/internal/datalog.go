@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// DataLogHeader is the header data logs start with, which identifies the format.
+const DataLogHeader = "versionedkv-fs-log/1\n"
+
+// A data log is the header followed by records appended one after another. Each record
+// is the length of its payload (4 bytes, little-endian), the CRC-32C checksum of its
+// payload (4 bytes, little-endian) and then its payload, which is the number of ops
+// (uvarint) followed by the ops. An op is its type (1 byte) and its key, followed by its
+// version, its expiration time (varint, nanoseconds since the Unix epoch, or 0 for
+// none) and its value for puts, or by its revision (uvarint) for revision ops. Strings
+// are prefixed with their lengths (uvarint).
+
+const dataLogRecordHeaderSize = 8
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DataLogOpType represents the type of ops in data logs.
+type DataLogOpType byte
+
+const (
+	// DataLogOpPut sets the value for a key.
+	DataLogOpPut DataLogOpType = 1 + iota
+
+	// DataLogOpDelete deletes the value for a key.
+	DataLogOpDelete
+
+	// DataLogOpRevision records a revision allocated, which has no key, so that the
+	// revision survives compaction even if no value is at the revision anymore.
+	DataLogOpRevision
+)
+
+// DataLogOp represents an op in a record of a data log.
+type DataLogOp struct {
+	Type       DataLogOpType
+	Key        string
+	Version    string
+	ExpireTime time.Time
+	Value      string
+	Revision   int64
+
+	// ValueOffset is the offset of the value in the data log, which is set by
+	// DataLogReader, so that values can be read again without decoding records.
+	ValueOffset int64
+
+	// Size is the number of bytes the op takes in the data log, which is set by
+	// DataLogReader.
+	Size int
+}
+
+// AppendDataLogRecord appends the record of the given ops to the given buffer.
+func AppendDataLogRecord(buffer []byte, ops []DataLogOp) []byte {
+	start := len(buffer)
+	buffer = append(buffer, make([]byte, dataLogRecordHeaderSize)...)
+	buffer = appendUvarint(buffer, uint64(len(ops)))
+	for _, op := range ops {
+		buffer = append(buffer, byte(op.Type))
+		buffer = appendString(buffer, op.Key)
+		if op.Type == DataLogOpRevision {
+			buffer = appendUvarint(buffer, uint64(op.Revision))
+			continue
+		}
+		if op.Type != DataLogOpPut {
+			continue
+		}
+		buffer = appendString(buffer, op.Version)
+		var expireTime int64
+		if !op.ExpireTime.IsZero() {
+			expireTime = op.ExpireTime.UnixNano()
+		}
+		buffer = appendVarint(buffer, expireTime)
+		buffer = appendString(buffer, op.Value)
+	}
+	payload := buffer[start+dataLogRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(buffer[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buffer[start+4:], crc32.Checksum(payload, crc32cTable))
+	return buffer
+}
+
+// DataLogReader reads records from a data log.
+type DataLogReader struct {
+	reader  *bufio.Reader
+	offset  int64
+	payload bytes.Buffer
+}
+
+// NewDataLogReader creates a data log reader reading records from the given reader,
+// which is positioned at the given offset in the data log.
+func NewDataLogReader(reader io.Reader, offset int64) *DataLogReader {
+	return &DataLogReader{
+		reader: bufio.NewReader(reader),
+		offset: offset,
+	}
+}
+
+// ReadHeader reads the header, which should be at the current position. It fails with
+// error ErrInvalidDataLog if the header is missing or unknown.
+func (dlr *DataLogReader) ReadHeader() error {
+	header := make([]byte, len(DataLogHeader))
+	if _, err := io.ReadFull(dlr.reader, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidDataLog
+		}
+		return err
+	}
+	if string(header) != DataLogHeader {
+		return ErrInvalidDataLog
+	}
+	dlr.offset += int64(len(header))
+	return nil
+}
+
+// Next reads the ops in the next record. It fails with error io.EOF if there are no more
+// records, or error ErrTornDataLogRecord if the next record is incomplete or damaged,
+// e.g. it was being appended when a crash happened. On failure, the offset stays at the
+// start of the next record.
+func (dlr *DataLogReader) Next() ([]DataLogOp, error) {
+	var header [dataLogRecordHeaderSize]byte
+	if _, err := io.ReadFull(dlr.reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTornDataLogRecord
+		}
+		return nil, err
+	}
+	payloadSize := int64(binary.LittleEndian.Uint32(header[:]))
+	checksum := binary.LittleEndian.Uint32(header[4:])
+	// The payload is read gradually, so that no huge buffer is allocated for a damaged
+	// payload size.
+	dlr.payload.Reset()
+	if _, err := io.CopyN(&dlr.payload, dlr.reader, payloadSize); err != nil {
+		if err == io.EOF {
+			return nil, ErrTornDataLogRecord
+		}
+		return nil, err
+	}
+	payload := dlr.payload.Bytes()
+	if crc32.Checksum(payload, crc32cTable) != checksum {
+		return nil, ErrTornDataLogRecord
+	}
+	ops, ok := decodeDataLogOps(payload, dlr.offset+dataLogRecordHeaderSize)
+	if !ok {
+		return nil, ErrTornDataLogRecord
+	}
+	dlr.offset += dataLogRecordHeaderSize + payloadSize
+	return ops, nil
+}
+
+// Offset returns the offset of the next record in the data log.
+func (dlr *DataLogReader) Offset() int64 { return dlr.offset }
+
+func decodeDataLogOps(payload []byte, payloadOffset int64) ([]DataLogOp, bool) {
+	d := decoder{data: payload}
+	n, ok := d.Uvarint()
+	if !ok || n > uint64(len(payload)) {
+		return nil, false
+	}
+	ops := make([]DataLogOp, n)
+	for i := range ops {
+		op := &ops[i]
+		start := d.offset
+		rawType, ok := d.Byte()
+		if !ok {
+			return nil, false
+		}
+		op.Type = DataLogOpType(rawType)
+		if op.Key, ok = d.String(); !ok {
+			return nil, false
+		}
+		switch op.Type {
+		case DataLogOpPut:
+			if op.Version, ok = d.String(); !ok {
+				return nil, false
+			}
+			expireTime, ok := d.Varint()
+			if !ok {
+				return nil, false
+			}
+			if expireTime != 0 {
+				op.ExpireTime = time.Unix(0, expireTime)
+			}
+			valueSize, ok := d.Uvarint()
+			if !ok {
+				return nil, false
+			}
+			op.ValueOffset = payloadOffset + int64(d.offset)
+			if op.Value, ok = d.Bytes(valueSize); !ok {
+				return nil, false
+			}
+		case DataLogOpDelete:
+		case DataLogOpRevision:
+			revision, ok := d.Uvarint()
+			if !ok || revision > math.MaxInt64 {
+				return nil, false
+			}
+			op.Revision = int64(revision)
+		default:
+			return nil, false
+		}
+		op.Size = d.offset - start
+	}
+	if d.offset != len(payload) {
+		return nil, false
+	}
+	return ops, true
+}
+
+func appendUvarint(buffer []byte, x uint64) []byte {
+	var temp [binary.MaxVarintLen64]byte
+	return append(buffer, temp[:binary.PutUvarint(temp[:], x)]...)
+}
+
+func appendVarint(buffer []byte, x int64) []byte {
+	var temp [binary.MaxVarintLen64]byte
+	return append(buffer, temp[:binary.PutVarint(temp[:], x)]...)
+}
+
+func appendString(buffer []byte, s string) []byte {
+	buffer = appendUvarint(buffer, uint64(len(s)))
+	return append(buffer, s...)
+}
+
+type decoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *decoder) Byte() (byte, bool) {
+	if d.offset >= len(d.data) {
+		return 0, false
+	}
+	c := d.data[d.offset]
+	d.offset++
+	return c, true
+}
+
+func (d *decoder) Uvarint() (uint64, bool) {
+	x, n := binary.Uvarint(d.data[d.offset:])
+	if n <= 0 {
+		return 0, false
+	}
+	d.offset += n
+	return x, true
+}
+
+func (d *decoder) Varint() (int64, bool) {
+	x, n := binary.Varint(d.data[d.offset:])
+	if n <= 0 {
+		return 0, false
+	}
+	d.offset += n
+	return x, true
+}
+
+func (d *decoder) Bytes(n uint64) (string, bool) {
+	if n > uint64(len(d.data)-d.offset) {
+		return "", false
+	}
+	s := string(d.data[d.offset : d.offset+int(n)])
+	d.offset += int(n)
+	return s, true
+}
+
+func (d *decoder) String() (string, bool) {
+	n, ok := d.Uvarint()
+	if !ok {
+		return "", false
+	}
+	return d.Bytes(n)
+}
+
+var (
+	// ErrInvalidDataLog is returned when reading a data log with a missing or unknown
+	// header.
+	ErrInvalidDataLog error = errors.New("internal: invalid data log")
+
+	// ErrTornDataLogRecord is returned when reading a record of a data log which is
+	// incomplete or damaged.
+	ErrTornDataLogRecord error = errors.New("internal: torn data log record")
+)
@@ -0,0 +1,79 @@
+package internal_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataLogReader(t *testing.T) {
+	expireTime := time.Unix(1600000000, 123)
+	ops1 := []DataLogOp{
+		{Type: DataLogOpPut, Key: "foo", Version: "v1", Value: "bar"},
+		{Type: DataLogOpPut, Key: "", Version: "v2", ExpireTime: expireTime, Value: strings.Repeat("x", 1000)},
+	}
+	ops2 := []DataLogOp{
+		{Type: DataLogOpDelete, Key: "foo"},
+		{Type: DataLogOpRevision, Revision: 1 << 40},
+	}
+	data := []byte(DataLogHeader)
+	data = AppendDataLogRecord(data, ops1)
+	end1 := len(data)
+	data = AppendDataLogRecord(data, ops2)
+	end2 := len(data)
+
+	dlr := NewDataLogReader(bytes.NewReader(data), 0)
+	if !assert.NoError(t, dlr.ReadHeader()) {
+		t.FailNow()
+	}
+	assert.Equal(t, int64(len(DataLogHeader)), dlr.Offset())
+	ops, err := dlr.Next()
+	if assert.NoError(t, err) && assert.Len(t, ops, 2) {
+		for i, op := range ops {
+			assert.Equal(t, ops1[i].Type, op.Type)
+			assert.Equal(t, ops1[i].Key, op.Key)
+			assert.Equal(t, ops1[i].Version, op.Version)
+			assert.True(t, ops1[i].ExpireTime.Equal(op.ExpireTime))
+			assert.Equal(t, ops1[i].Value, op.Value)
+			// Values can be read at their offsets.
+			assert.Equal(t, op.Value, string(data[op.ValueOffset:op.ValueOffset+int64(len(op.Value))]))
+		}
+		assert.True(t, ops[0].ExpireTime.IsZero())
+	}
+	assert.Equal(t, int64(end1), dlr.Offset())
+	ops, err = dlr.Next()
+	if assert.NoError(t, err) && assert.Len(t, ops, 2) {
+		assert.Equal(t, ops2[0].Type, ops[0].Type)
+		assert.Equal(t, ops2[0].Key, ops[0].Key)
+		assert.Equal(t, 1+1+len("foo"), ops[0].Size)
+		assert.Equal(t, ops2[1].Type, ops[1].Type)
+		assert.Equal(t, ops2[1].Revision, ops[1].Revision)
+	}
+	assert.Equal(t, int64(end2), dlr.Offset())
+	_, err = dlr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// Torn records are reported without moving the offset.
+	for _, torn := range [][]byte{
+		data[:end2-1],
+		data[:end1+3],
+		append(append([]byte(nil), data[:end2-1]...), data[end2-1]^1),
+	} {
+		dlr := NewDataLogReader(bytes.NewReader(torn[end1:]), int64(end1))
+		_, err := dlr.Next()
+		assert.Equal(t, ErrTornDataLogRecord, err)
+		assert.Equal(t, int64(end1), dlr.Offset())
+	}
+}
+
+func TestDataLogReader_ReadHeader(t *testing.T) {
+	for _, data := range []string{"", DataLogHeader[:5], "versionedkv-fs-log/2\n"} {
+		dlr := NewDataLogReader(strings.NewReader(data), 0)
+		assert.Equal(t, ErrInvalidDataLog, dlr.ReadHeader(), "data: %q", data)
+	}
+}
@@ -11,19 +11,47 @@ import (
 
 type EventBus struct {
 	options      EventBusOptions
-	superWatcher *fsnotify.Watcher
+	superWatcher FileWatcher
 	watcherSets  sync.Map
+	subscribers  subscriberSet
 	isClosed     int32
 }
 
 type EventBusOptions struct {
-	EventDirName string
-	Go           func(func())
+	// EventDirNames are the names of the directories to watch. Events are named after
+	// base names of files, which should be unique across the directories.
+	EventDirNames    []string
+	MaxPendingEvents int
+	NewFileWatcher   func() (FileWatcher, error)
+	ErrorHandler     func(error)
+	Go               func(func())
+
+	// WatcherCountHandler is called with changes in the number of watchers and
+	// subscribers.
+	WatcherCountHandler func(delta int)
+
+	// EventHandler is called with names of events fired.
+	EventHandler func(eventName string)
 }
 
 func (ebo *EventBusOptions) sanitize() {
-	if ebo.EventDirName == "" {
-		ebo.EventDirName = "."
+	if len(ebo.EventDirNames) == 0 {
+		ebo.EventDirNames = []string{"."}
+	}
+	if ebo.MaxPendingEvents == 0 {
+		ebo.MaxPendingEvents = 10000
+	}
+	if ebo.NewFileWatcher == nil {
+		ebo.NewFileWatcher = NewNotifyWatcher
+	}
+	if ebo.ErrorHandler == nil {
+		ebo.ErrorHandler = func(error) {}
+	}
+	if ebo.WatcherCountHandler == nil {
+		ebo.WatcherCountHandler = func(int) {}
+	}
+	if ebo.EventHandler == nil {
+		ebo.EventHandler = func(string) {}
 	}
 	if ebo.Go == nil {
 		ebo.Go = func(routine func()) { go routine() }
@@ -33,11 +61,12 @@ func (ebo *EventBusOptions) sanitize() {
 func (eb *EventBus) Init(options EventBusOptions) *EventBus {
 	eb.options = options
 	eb.options.sanitize()
+	eb.subscribers.Init()
 	return eb
 }
 
 func (eb *EventBus) Open() error {
-	superWatcher, err := fsnotify.NewWatcher()
+	superWatcher, err := eb.options.NewFileWatcher()
 	if err != nil {
 		return err
 	}
@@ -46,8 +75,10 @@ func (eb *EventBus) Open() error {
 			superWatcher.Close()
 		}
 	}()
-	if err := superWatcher.Add(eb.options.EventDirName); err != nil {
-		return err
+	for _, eventDirName := range eb.options.EventDirNames {
+		if err := superWatcher.Add(eventDirName); err != nil {
+			return err
+		}
 	}
 	eb.superWatcher = superWatcher
 	superWatcher = nil
@@ -61,30 +92,53 @@ func (eb *EventBus) handleEvents() {
 			return
 		}
 		select {
-		case event, ok := <-eb.superWatcher.Events:
+		case event, ok := <-eb.superWatcher.Events():
 			if !ok {
 				return
 			}
 			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
 				continue
 			}
-			eb.fireEvent(event.Name)
-		case _, ok := <-eb.superWatcher.Errors:
+			eventName := filepath.Base(event.Name)
+			eb.fireEvent(eventName)
+			eb.subscribers.FireEvent(eventName)
+			eb.options.EventHandler(eventName)
+		case err, ok := <-eb.superWatcher.Errors():
 			if !ok {
 				return
 			}
+			// Events may have been lost, e.g. the event queue overflowed, so wake all
+			// watchers and subscribers up to check for changes by themselves.
+			eb.fireWatchLoss(err.Error())
+			eb.options.ErrorHandler(err)
 		}
 	}
 }
 
-func (eb *EventBus) fireEvent(eventFileName string) {
-	eventName := filepath.Base(eventFileName)
+func (eb *EventBus) fireEvent(eventName string) {
 	opaqueWatcherSet, ok := eb.watcherSets.Load(eventName)
 	if !ok {
 		return
 	}
 	watcherSet := opaqueWatcherSet.(*watcherSet)
-	watcherSet.FireEvent(func() { eb.watcherSets.Delete(eventName) })
+	if n := watcherSet.FireEvent(func() { eb.watcherSets.Delete(eventName) }, EventArgs{}); n >= 1 {
+		eb.options.WatcherCountHandler(-n)
+	}
+}
+
+func (eb *EventBus) fireWatchLoss(message string) {
+	eventArgs := EventArgs{
+		WatchLoss: true,
+		Message:   message,
+	}
+	eb.watcherSets.Range(func(opaqueEventName, opaqueWatcherSet interface{}) bool {
+		watcherSet := opaqueWatcherSet.(*watcherSet)
+		if n := watcherSet.FireEvent(func() { eb.watcherSets.Delete(opaqueEventName) }, eventArgs); n >= 1 {
+			eb.options.WatcherCountHandler(-n)
+		}
+		return true
+	})
+	eb.subscribers.FireWatchLoss()
 }
 
 func (eb *EventBus) AddWatcher(eventName string) (Watcher, error) {
@@ -101,6 +155,7 @@ func (eb *EventBus) AddWatcher(eventName string) (Watcher, error) {
 		if !watcherSet.AddItem(watcher) {
 			continue
 		}
+		eb.options.WatcherCountHandler(1)
 		wrappedWatcher := Watcher{watcher}
 		return wrappedWatcher, nil
 	}
@@ -116,10 +171,34 @@ func (eb *EventBus) RemoveWatcher(eventName string, wrappedWatcher Watcher) erro
 	}
 	watcherSet := opaqueWatcherSet.(*watcherSet)
 	watcher := wrappedWatcher.w
-	watcherSet.RemoveItem(watcher, func() { eb.watcherSets.Delete(eventName) })
+	if watcherSet.RemoveItem(watcher, func() { eb.watcherSets.Delete(eventName) }) {
+		eb.options.WatcherCountHandler(-1)
+	}
 	return nil
 }
 
+func (eb *EventBus) AddSubscriber() (Subscriber, error) {
+	if eb.IsClosed() {
+		return Subscriber{}, ErrEventBusClosed
+	}
+	subscriber := new(subscriber).Init(eb.options.MaxPendingEvents)
+	eb.subscribers.AddItem(subscriber)
+	eb.options.WatcherCountHandler(1)
+	wrappedSubscriber := Subscriber{subscriber}
+	return wrappedSubscriber, nil
+}
+
+func (eb *EventBus) RemoveSubscriber(wrappedSubscriber Subscriber) {
+	if eb.subscribers.RemoveItem(wrappedSubscriber.s) {
+		eb.options.WatcherCountHandler(-1)
+	}
+}
+
+func (eb *EventBus) HasWatchers(eventName string) bool {
+	_, ok := eb.watcherSets.Load(eventName)
+	return ok
+}
+
 func (eb *EventBus) Close() error {
 	if atomic.SwapInt32(&eb.isClosed, 1) != 0 {
 		return ErrEventBusClosed
@@ -135,6 +214,14 @@ type Watcher struct{ w *watcher }
 
 func (w Watcher) Event() <-chan struct{} { return w.w.Event() }
 
+func (w Watcher) EventArgs() EventArgs { return w.w.EventArgs() }
+
+type Subscriber struct{ s *subscriber }
+
+func (s Subscriber) Event() <-chan struct{} { return s.s.Event() }
+
+func (s Subscriber) TakeEvents() ([]string, bool) { return s.s.TakeEvents() }
+
 type EventArgs struct {
 	WatchLoss bool
 	Message   string
@@ -163,23 +250,26 @@ func (ws *watcherSet) AddItem(item *watcher) bool {
 	return true
 }
 
-func (ws *watcherSet) RemoveItem(item *watcher, remover watcherSetRemover) {
+func (ws *watcherSet) RemoveItem(item *watcher, remover watcherSetRemover) bool {
 	ws.mu.Lock()
 	defer ws.mu.Unlock()
 	if ws.isRemoved {
-		return
+		return false
 	}
 	if _, ok := ws.items[item]; !ok {
-		return
+		return false
 	}
 	delete(ws.items, item)
 	if n := len(ws.items); n >= 1 {
-		return
+		return true
 	}
 	ws.remove(remover)
+	return true
 }
 
-func (ws *watcherSet) FireEvent(remover watcherSetRemover) {
+// FireEvent fires the given event to all watchers and removes the watcher set. The number
+// of watchers fired is returned.
+func (ws *watcherSet) FireEvent(remover watcherSetRemover, eventArgs EventArgs) int {
 	mu := &ws.mu
 	mu.Lock()
 	defer func() {
@@ -188,14 +278,15 @@ func (ws *watcherSet) FireEvent(remover watcherSetRemover) {
 		}
 	}()
 	if ws.isRemoved {
-		return
+		return 0
 	}
 	ws.remove(remover)
 	mu.Unlock()
 	mu = nil
 	for item := range ws.items {
-		item.FireEvent()
+		item.FireEvent(eventArgs)
 	}
+	return len(ws.items)
 }
 
 func (ws *watcherSet) remove(remover watcherSetRemover) {
@@ -206,7 +297,8 @@ func (ws *watcherSet) remove(remover watcherSetRemover) {
 type watcherSetRemover func()
 
 type watcher struct {
-	event chan struct{}
+	event     chan struct{}
+	eventArgs EventArgs
 }
 
 func (w *watcher) Init() *watcher {
@@ -214,10 +306,125 @@ func (w *watcher) Init() *watcher {
 	return w
 }
 
-func (w *watcher) FireEvent() {
+func (w *watcher) FireEvent(eventArgs EventArgs) {
+	w.eventArgs = eventArgs
 	close(w.event)
 }
 
 func (w *watcher) Event() <-chan struct{} {
 	return w.event
 }
+
+func (w *watcher) EventArgs() EventArgs {
+	<-w.event
+	return w.eventArgs
+}
+
+type subscriberSet struct {
+	mu    sync.Mutex
+	items map[*subscriber]struct{}
+}
+
+func (ss *subscriberSet) Init() *subscriberSet {
+	ss.items = make(map[*subscriber]struct{})
+	return ss
+}
+
+func (ss *subscriberSet) AddItem(item *subscriber) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.items[item] = struct{}{}
+}
+
+func (ss *subscriberSet) RemoveItem(item *subscriber) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.items[item]; !ok {
+		return false
+	}
+	delete(ss.items, item)
+	return true
+}
+
+func (ss *subscriberSet) FireEvent(eventName string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for item := range ss.items {
+		item.FireEvent(eventName)
+	}
+}
+
+func (ss *subscriberSet) FireWatchLoss() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for item := range ss.items {
+		item.FireWatchLoss()
+	}
+}
+
+// subscriber receives all events. Pending events are coalesced by names, and when there
+// are too many pending events, they are dropped and a watch loss is reported instead, so
+// that slow subscribers never block the event bus.
+type subscriber struct {
+	maxPendingEvents int
+	event            chan struct{}
+
+	mu            sync.Mutex
+	pendingEvents map[string]struct{}
+	watchLoss     bool
+}
+
+func (s *subscriber) Init(maxPendingEvents int) *subscriber {
+	s.maxPendingEvents = maxPendingEvents
+	s.event = make(chan struct{}, 1)
+	s.pendingEvents = make(map[string]struct{})
+	return s
+}
+
+func (s *subscriber) FireEvent(eventName string) {
+	s.mu.Lock()
+	if !s.watchLoss {
+		if _, ok := s.pendingEvents[eventName]; !ok {
+			if len(s.pendingEvents) < s.maxPendingEvents {
+				s.pendingEvents[eventName] = struct{}{}
+			} else {
+				s.pendingEvents = make(map[string]struct{})
+				s.watchLoss = true
+			}
+		}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *subscriber) FireWatchLoss() {
+	s.mu.Lock()
+	s.pendingEvents = make(map[string]struct{})
+	s.watchLoss = true
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *subscriber) notify() {
+	select {
+	case s.event <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) Event() <-chan struct{} {
+	return s.event
+}
+
+func (s *subscriber) TakeEvents() ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	eventNames := make([]string, 0, len(s.pendingEvents))
+	for eventName := range s.pendingEvents {
+		eventNames = append(eventNames, eventName)
+	}
+	watchLoss := s.watchLoss
+	s.pendingEvents = make(map[string]struct{})
+	s.watchLoss = false
+	return eventNames, watchLoss
+}
@@ -4,10 +4,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-tk/testcase"
 	. "github.com/go-tk/versionedkv-fs/fsstorage/internal"
 	"github.com/stretchr/testify/assert"
@@ -32,7 +34,7 @@ func TestEventBus_Open(t *testing.T) {
 		return &Context{
 			Init: Init{
 				Options: EventBusOptions{
-					EventDirName: makeEventDir(t),
+					EventDirNames: []string{makeEventDir(t)},
 				},
 			},
 		}
@@ -54,13 +56,13 @@ func TestEventBus_Open(t *testing.T) {
 		tc.Copy().
 			Then("should succeed").
 			PreSetup(func(t *testing.T, c *Context) {
-				c.Init.Options.EventDirName = "."
+				c.Init.Options.EventDirNames = []string{"."}
 			}),
 		tc.Copy().
 			When("given event dir does not exist").
 			Then("should fail").
 			PreSetup(func(t *testing.T, c *Context) {
-				c.Init.Options.EventDirName = "/x/y/z"
+				c.Init.Options.EventDirNames = []string{"/x/y/z"}
 			}).
 			PreRun(func(t *testing.T, c *Context) {
 				c.ExpectedOutput.ErrIsNotNil = true
@@ -91,7 +93,7 @@ func TestEventBus_AddWatcher(t *testing.T) {
 		return &Context{
 			Init: Init{
 				Options: EventBusOptions{
-					EventDirName: makeEventDir(t),
+					EventDirNames: []string{makeEventDir(t)},
 				},
 			},
 		}
@@ -194,7 +196,7 @@ func TestEventBus_RemoveWatcher(t *testing.T) {
 		return &Context{
 			Init: Init{
 				Options: EventBusOptions{
-					EventDirName: makeEventDir(t),
+					EventDirNames: []string{makeEventDir(t)},
 				},
 			},
 		}
@@ -335,7 +337,7 @@ func TestEventBus_handleEvents(t *testing.T) {
 		return &Context{
 			Init: Init{
 				Options: EventBusOptions{
-					EventDirName: makeEventDir(t),
+					EventDirNames: []string{makeEventDir(t)},
 				},
 			},
 		}
@@ -363,7 +365,7 @@ func TestEventBus_handleEvents(t *testing.T) {
 					t.FailNow()
 				}
 				time.AfterFunc(100*time.Millisecond, func() {
-					f, err := os.Create(filepath.Join(c.Init.Options.EventDirName, "foo"))
+					f, err := os.Create(filepath.Join(c.Init.Options.EventDirNames[0], "foo"))
 					if !assert.NoError(t, err) {
 						return
 					}
@@ -391,7 +393,7 @@ func TestEventBus_handleEvents(t *testing.T) {
 				if !assert.NoError(t, err) {
 					t.FailNow()
 				}
-				f, err := os.Create(filepath.Join(c.Init.Options.EventDirName, "bar"))
+				f, err := os.Create(filepath.Join(c.Init.Options.EventDirNames[0], "bar"))
 				if !assert.NoError(t, err) {
 					t.FailNow()
 				}
@@ -437,7 +439,7 @@ func TestEventBus_handleEvents(t *testing.T) {
 				if !assert.NoError(t, err) {
 					t.FailNow()
 				}
-				f, err := os.Create(filepath.Join(c.Init.Options.EventDirName, "baz"))
+				f, err := os.Create(filepath.Join(c.Init.Options.EventDirNames[0], "baz"))
 				if !assert.NoError(t, err) {
 					t.FailNow()
 				}
@@ -456,7 +458,7 @@ func TestEventBus_handleEvents(t *testing.T) {
 					t.FailNow()
 				}
 				time.AfterFunc(100*time.Millisecond, func() {
-					f, err := os.Create(filepath.Join(c.Init.Options.EventDirName, "baz-2"))
+					f, err := os.Create(filepath.Join(c.Init.Options.EventDirNames[0], "baz-2"))
 					if !assert.NoError(t, err) {
 						return
 					}
@@ -466,8 +468,8 @@ func TestEventBus_handleEvents(t *testing.T) {
 					}
 					f.Close()
 					err = os.Rename(
-						filepath.Join(c.Init.Options.EventDirName, "baz-2"),
-						filepath.Join(c.Init.Options.EventDirName, "baz"),
+						filepath.Join(c.Init.Options.EventDirNames[0], "baz-2"),
+						filepath.Join(c.Init.Options.EventDirNames[0], "baz"),
 					)
 					if !assert.NoError(t, err) {
 						return
@@ -490,6 +492,127 @@ func TestEventBus_handleEvents(t *testing.T) {
 	)
 }
 
+func TestEventBus_AddSubscriber(t *testing.T) {
+	eventDirName := makeEventDir(t)
+	eb := new(EventBus).Init(EventBusOptions{
+		EventDirNames:    []string{eventDirName},
+		MaxPendingEvents: 2,
+	})
+	err := eb.Open()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer eb.Close()
+	s, err := eb.AddSubscriber()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer eb.RemoveSubscriber(s)
+	writeFile := func(eventName string) {
+		err := ioutil.WriteFile(filepath.Join(eventDirName, eventName), []byte("hello world"), 0644)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	takeEvents := func(n int) ([]string, bool) {
+		eventNameSet := make(map[string]struct{})
+		for len(eventNameSet) < n {
+			select {
+			case <-s.Event():
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out")
+			}
+			eventNames, watchLoss := s.TakeEvents()
+			if watchLoss {
+				return nil, true
+			}
+			for _, eventName := range eventNames {
+				eventNameSet[eventName] = struct{}{}
+			}
+		}
+		var eventNames []string
+		for eventName := range eventNameSet {
+			eventNames = append(eventNames, eventName)
+		}
+		sort.Strings(eventNames)
+		return eventNames, false
+	}
+
+	writeFile("foo")
+	writeFile("bar")
+	eventNames, watchLoss := takeEvents(2)
+	assert.Equal(t, []string{"bar", "foo"}, eventNames)
+	assert.False(t, watchLoss)
+
+	writeFile("foo")
+	writeFile("bar")
+	writeFile("baz")
+	time.Sleep(100 * time.Millisecond)
+	_, watchLoss = takeEvents(3)
+	assert.True(t, watchLoss)
+	eventNames, watchLoss = s.TakeEvents()
+	assert.Empty(t, eventNames)
+	assert.False(t, watchLoss)
+
+	err = eb.Close()
+	assert.NoError(t, err)
+	_, err = eb.AddSubscriber()
+	assert.Equal(t, ErrEventBusClosed, err)
+}
+
+func TestEventBus_handleErrors(t *testing.T) {
+	fw := fakeFileWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+	errs := make(chan error, 1)
+	eb := new(EventBus).Init(EventBusOptions{
+		NewFileWatcher: func() (FileWatcher, error) { return fw, nil },
+		ErrorHandler:   func(err error) { errs <- err },
+	})
+	err := eb.Open()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer eb.Close()
+	w1, err := eb.AddWatcher("foo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	w2, err := eb.AddWatcher("bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s, err := eb.AddSubscriber()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	fw.events <- fsnotify.Event{Name: "baz", Op: fsnotify.Write}
+	fw.errors <- fsnotify.ErrEventOverflow
+	select {
+	case err := <-errs:
+		assert.Equal(t, fsnotify.ErrEventOverflow, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	for _, w := range []Watcher{w1, w2} {
+		select {
+		case <-w.Event():
+			assert.Equal(t, EventArgs{
+				WatchLoss: true,
+				Message:   fsnotify.ErrEventOverflow.Error(),
+			}, w.EventArgs())
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	<-s.Event()
+	eventNames, watchLoss := s.TakeEvents()
+	assert.Empty(t, eventNames)
+	assert.True(t, watchLoss)
+	assert.Equal(t, EventBusDetails{}, eb.Inspect())
+}
+
 func TestEventBus_Close(t *testing.T) {
 	var wg sync.WaitGroup
 	eb := new(EventBus).Init(EventBusOptions{
@@ -519,3 +642,13 @@ func makeEventDir(t *testing.T) string {
 	}
 	return eventDirName
 }
+
+type fakeFileWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func (ffw fakeFileWatcher) Add(string) error              { return nil }
+func (ffw fakeFileWatcher) Events() <-chan fsnotify.Event { return ffw.events }
+func (ffw fakeFileWatcher) Errors() <-chan error          { return ffw.errors }
+func (ffw fakeFileWatcher) Close() error                  { close(ffw.events); return nil }
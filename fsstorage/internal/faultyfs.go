@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// FaultOp represents an operation of file systems, into which faults can be injected.
+type FaultOp int
+
+const (
+	// FaultOpOpen is opening files, including creating temporary files.
+	FaultOpOpen FaultOp = iota + 1
+
+	// FaultOpLock is opening and locking files.
+	FaultOpLock
+
+	FaultOpStat
+	FaultOpRemove
+	FaultOpRename
+	FaultOpMkdir
+	FaultOpChtimes
+
+	// FaultOpReadDir is reading directories, either by name or through opened files.
+	FaultOpReadDir
+
+	FaultOpRead
+	FaultOpWrite
+	FaultOpSeek
+	FaultOpTruncate
+	FaultOpSync
+)
+
+// FaultyFS is a file system which wraps another file system and injects faults into
+// operations, so that failure paths can be tested.
+type FaultyFS struct {
+	fs FS
+
+	mu    sync.RWMutex
+	fault func(op FaultOp, name string) error
+}
+
+var _ FS = (*FaultyFS)(nil)
+
+// NewFaultyFS creates a faulty file system wrapping the given file system, which injects
+// no faults until SetFault is called.
+func NewFaultyFS(fs FS) *FaultyFS {
+	return &FaultyFS{fs: fs}
+}
+
+// SetFault sets the function deciding faults to inject, which is called before each
+// operation with the operation and the name of the file involved (the new name for
+// renaming). If it returns an error, the operation fails with the error. Faults injected
+// into reads and writes take effect midway: half of the data is transferred before the
+// error is returned, as with disks getting full.
+//
+// The function may be called concurrently. If it is nil, no faults are injected.
+func (ffs *FaultyFS) SetFault(fault func(op FaultOp, name string) error) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	ffs.fault = fault
+}
+
+func (ffs *FaultyFS) inject(op FaultOp, name string) error {
+	ffs.mu.RLock()
+	fault := ffs.fault
+	ffs.mu.RUnlock()
+	if fault == nil {
+		return nil
+	}
+	return fault(op, name)
+}
+
+func (ffs *FaultyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := ffs.inject(FaultOpOpen, name); err != nil {
+		return nil, err
+	}
+	return ffs.wrapFile(ffs.fs.OpenFile(name, flag, perm))
+}
+
+func (ffs *FaultyFS) OpenLockedFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := ffs.inject(FaultOpLock, name); err != nil {
+		return nil, err
+	}
+	return ffs.wrapFile(ffs.fs.OpenLockedFile(name, flag, perm))
+}
+
+func (ffs *FaultyFS) TempFile(dirName string, pattern string) (File, error) {
+	if err := ffs.inject(FaultOpOpen, dirName); err != nil {
+		return nil, err
+	}
+	return ffs.wrapFile(ffs.fs.TempFile(dirName, pattern))
+}
+
+func (ffs *FaultyFS) wrapFile(file File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file, ffs}, nil
+}
+
+func (ffs *FaultyFS) Stat(name string) (os.FileInfo, error) {
+	if err := ffs.inject(FaultOpStat, name); err != nil {
+		return nil, err
+	}
+	return ffs.fs.Stat(name)
+}
+
+func (ffs *FaultyFS) Remove(name string) error {
+	if err := ffs.inject(FaultOpRemove, name); err != nil {
+		return err
+	}
+	return ffs.fs.Remove(name)
+}
+
+func (ffs *FaultyFS) Rename(oldName string, newName string) error {
+	if err := ffs.inject(FaultOpRename, newName); err != nil {
+		return err
+	}
+	return ffs.fs.Rename(oldName, newName)
+}
+
+func (ffs *FaultyFS) MkdirAll(name string, perm os.FileMode) error {
+	if err := ffs.inject(FaultOpMkdir, name); err != nil {
+		return err
+	}
+	return ffs.fs.MkdirAll(name, perm)
+}
+
+func (ffs *FaultyFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := ffs.inject(FaultOpChtimes, name); err != nil {
+		return err
+	}
+	return ffs.fs.Chtimes(name, atime, mtime)
+}
+
+func (ffs *FaultyFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := ffs.inject(FaultOpReadDir, name); err != nil {
+		return nil, err
+	}
+	return ffs.fs.ReadDir(name)
+}
+
+func (ffs *FaultyFS) SameFile(fileInfo1 os.FileInfo, fileInfo2 os.FileInfo) bool {
+	return ffs.fs.SameFile(fileInfo1, fileInfo2)
+}
+
+func (ffs *FaultyFS) NewWatcher() (FileWatcher, error) {
+	return ffs.fs.NewWatcher()
+}
+
+type faultyFile struct {
+	File
+
+	ffs *FaultyFS
+}
+
+func (ff *faultyFile) Read(p []byte) (int, error) {
+	if err := ff.ffs.inject(FaultOpRead, ff.Name()); err != nil {
+		n, _ := ff.File.Read(p[:len(p)/2])
+		return n, err
+	}
+	return ff.File.Read(p)
+}
+
+func (ff *faultyFile) Write(p []byte) (int, error) {
+	if err := ff.ffs.inject(FaultOpWrite, ff.Name()); err != nil {
+		n, _ := ff.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return ff.File.Write(p)
+}
+
+func (ff *faultyFile) Seek(offset int64, whence int) (int64, error) {
+	if err := ff.ffs.inject(FaultOpSeek, ff.Name()); err != nil {
+		return 0, err
+	}
+	return ff.File.Seek(offset, whence)
+}
+
+func (ff *faultyFile) Truncate(size int64) error {
+	if err := ff.ffs.inject(FaultOpTruncate, ff.Name()); err != nil {
+		return err
+	}
+	return ff.File.Truncate(size)
+}
+
+func (ff *faultyFile) Sync() error {
+	if err := ff.ffs.inject(FaultOpSync, ff.Name()); err != nil {
+		return err
+	}
+	return ff.File.Sync()
+}
+
+func (ff *faultyFile) Stat() (os.FileInfo, error) {
+	if err := ff.ffs.inject(FaultOpStat, ff.Name()); err != nil {
+		return nil, err
+	}
+	return ff.File.Stat()
+}
+
+func (ff *faultyFile) Readdir(n int) ([]os.FileInfo, error) {
+	if err := ff.ffs.inject(FaultOpReadDir, ff.Name()); err != nil {
+		return nil, err
+	}
+	return ff.File.Readdir(n)
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// MaxEncodedKeyLength is the maximum length of file names produced by EncodeKey.
+// Keys whose escaped forms exceed the limit are hashed instead, which leaves enough
+// room for suffixes (versions, temporary file marks) within the common limit of 255
+// bytes per file name.
+const MaxEncodedKeyLength = 160
+
+const (
+	emptyKeyFileName = "%"
+	hashedKeyPrefix  = "~"
+)
+
+// EncodeKey converts the given key to a file name.
+//
+// Lower-case letters, digits, '-', '_' and '.' are kept as is; any other byte is
+// escaped as '%' followed by two lower-case hex digits. Upper-case letters are escaped
+// as well so that distinct keys never collide on case-insensitive file systems. A
+// leading or trailing '.' is escaped, so that file names never start with '.' (which
+// are reserved for temporary files) and never end with '.' (which is stripped on
+// Windows). Names reserved by Windows (e.g. "con", "nul") get the first byte escaped.
+//
+// If the escaped form is longer than MaxEncodedKeyLength, the file name is '~'
+// followed by the SHA-256 hash of the key instead, and the key can't be recovered
+// from the file name; see IsHashedFileName.
+func EncodeKey(key string) string {
+	if key == "" {
+		return emptyKeyFileName
+	}
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isPlainByte(c) && !(c == '.' && (i == 0 || i == len(key)-1)) {
+			b.WriteByte(c)
+		} else {
+			writeEscapedByte(&b, c)
+		}
+	}
+	fileName := b.String()
+	if isReservedFileName(fileName) {
+		b.Reset()
+		writeEscapedByte(&b, fileName[0])
+		b.WriteString(fileName[1:])
+		fileName = b.String()
+	}
+	if len(fileName) > MaxEncodedKeyLength {
+		hash := sha256.Sum256([]byte(key))
+		fileName = hashedKeyPrefix + hex.EncodeToString(hash[:])
+	}
+	return fileName
+}
+
+// DecodeKey converts the given file name back to a key.
+//
+// It fails with error ErrHashedFileName if the file name is hashed, or error
+// ErrInvalidFileName if the file name is not produced by EncodeKey.
+func DecodeKey(fileName string) (string, error) {
+	if fileName == emptyKeyFileName {
+		return "", nil
+	}
+	if IsHashedFileName(fileName) {
+		return "", ErrHashedFileName
+	}
+	var b strings.Builder
+	for i := 0; i < len(fileName); i++ {
+		c := fileName[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(fileName) {
+			return "", ErrInvalidFileName
+		}
+		hi, ok1 := unhex(fileName[i+1])
+		lo, ok2 := unhex(fileName[i+2])
+		if !ok1 || !ok2 {
+			return "", ErrInvalidFileName
+		}
+		b.WriteByte(hi<<4 | lo)
+		i += 2
+	}
+	key := b.String()
+	if EncodeKey(key) != fileName {
+		return "", ErrInvalidFileName
+	}
+	return key, nil
+}
+
+// IsHashedFileName returns whether the given file name is the hashed form of a key.
+func IsHashedFileName(fileName string) bool {
+	return strings.HasPrefix(fileName, hashedKeyPrefix)
+}
+
+var (
+	// ErrHashedFileName is returned when decoding a hashed file name.
+	ErrHashedFileName error = errors.New("internal: hashed file name")
+
+	// ErrInvalidFileName is returned when decoding a file name not produced by EncodeKey.
+	ErrInvalidFileName error = errors.New("internal: invalid file name")
+)
+
+func isPlainByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.'
+}
+
+const hexDigits = "0123456789abcdef"
+
+func writeEscapedByte(b *strings.Builder, c byte) {
+	b.WriteByte('%')
+	b.WriteByte(hexDigits[c>>4])
+	b.WriteByte(hexDigits[c&0xf])
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	default:
+		return 0, false
+	}
+}
+
+func isReservedFileName(fileName string) bool {
+	if i := strings.IndexByte(fileName, '.'); i >= 0 {
+		fileName = fileName[:i]
+	}
+	switch fileName {
+	case "con", "prn", "aux", "nul":
+		return true
+	}
+	if len(fileName) == 4 && (strings.HasPrefix(fileName, "com") || strings.HasPrefix(fileName, "lpt")) {
+		c := fileName[3]
+		return c >= '1' && c <= '9'
+	}
+	return false
+}
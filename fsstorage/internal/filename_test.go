@@ -0,0 +1,117 @@
+package internal_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-tk/testcase"
+	. "github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeKey(t *testing.T) {
+	type Input struct {
+		Key string
+	}
+	type Output struct {
+		FileName string
+	}
+	type Context struct {
+		Input          Input
+		ExpectedOutput Output
+	}
+	tc := testcase.New(func(t *testing.T) *Context {
+		return &Context{}
+	}).Run(func(t *testing.T, c *Context) {
+		fileName := EncodeKey(c.Input.Key)
+		var output Output
+		output.FileName = fileName
+		assert.Equal(t, c.ExpectedOutput, output)
+		key, err := DecodeKey(fileName)
+		if IsHashedFileName(fileName) {
+			assert.Equal(t, ErrHashedFileName, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, c.Input.Key, key)
+		}
+	})
+	testcase.RunListParallel(t,
+		tc.Copy().
+			When("key is empty").
+			Then("should return special file name").
+			PreRun(func(t *testing.T, c *Context) {
+				c.ExpectedOutput.FileName = "%"
+			}),
+		tc.Copy().
+			When("key consists of plain bytes").
+			Then("should keep key as is").
+			PreRun(func(t *testing.T, c *Context) {
+				c.Input.Key = "foo.bar-baz_123"
+				c.ExpectedOutput.FileName = "foo.bar-baz_123"
+			}),
+		tc.Copy().
+			When("key contains path separators").
+			Then("should escape path separators").
+			PreRun(func(t *testing.T, c *Context) {
+				c.Input.Key = "svc/a/config"
+				c.ExpectedOutput.FileName = "svc%2fa%2fconfig"
+			}),
+		tc.Copy().
+			When("key is parent directory").
+			Then("should escape leading and trailing dots").
+			PreRun(func(t *testing.T, c *Context) {
+				c.Input.Key = ".."
+				c.ExpectedOutput.FileName = "%2e%2e"
+			}),
+		tc.Copy().
+			When("key contains NUL and upper-case letters").
+			Then("should escape them").
+			PreRun(func(t *testing.T, c *Context) {
+				c.Input.Key = "Foo\x00"
+				c.ExpectedOutput.FileName = "%46oo%00"
+			}),
+		tc.Copy().
+			When("key is reserved on Windows").
+			Then("should escape first byte").
+			PreRun(func(t *testing.T, c *Context) {
+				c.Input.Key = "com1.txt"
+				c.ExpectedOutput.FileName = "%63om1.txt"
+			}),
+		tc.Copy().
+			When("key is too long").
+			Then("should hash key").
+			PreRun(func(t *testing.T, c *Context) {
+				c.Input.Key = strings.Repeat("/", MaxEncodedKeyLength)
+				c.ExpectedOutput.FileName = "~239a8180276ae66d195c9a81bf0a3e8e2582d6c3eac1cb71824a5568ce9b862d"
+			}),
+	)
+}
+
+func TestDecodeKey(t *testing.T) {
+	for _, fileName := range []string{
+		"",
+		"%2",
+		"%zz",
+		"%2F",
+		"%61",
+		".foo",
+		"foo.",
+		"con",
+		"Foo",
+		"foo/bar",
+	} {
+		_, err := DecodeKey(fileName)
+		assert.Equal(t, ErrInvalidFileName, err, "file name: %q", fileName)
+	}
+}
+
+func TestEncodeKey_CaseInsensitive(t *testing.T) {
+	fileNames := make(map[string]string)
+	for _, key := range []string{"abc", "ABC", "Abc", "aBc", "abC", "%41bc", "%61bc"} {
+		fileName := strings.ToLower(EncodeKey(key))
+		if key2, ok := fileNames[fileName]; ok {
+			t.Fatalf("keys %q and %q collide", key, key2)
+		}
+		fileNames[fileName] = key
+	}
+}
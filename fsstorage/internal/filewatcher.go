@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type FileWatcher interface {
+	Add(dirName string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+type notifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+var _ FileWatcher = notifyWatcher{}
+
+func NewNotifyWatcher() (FileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return notifyWatcher{w}, nil
+}
+
+func (nw notifyWatcher) Add(dirName string) error      { return nw.w.Add(dirName) }
+func (nw notifyWatcher) Events() <-chan fsnotify.Event { return nw.w.Events }
+func (nw notifyWatcher) Errors() <-chan error          { return nw.w.Errors }
+func (nw notifyWatcher) Close() error                  { return nw.w.Close() }
+
+// pollWatcher detects changes by reading files in directories periodically and comparing
+// their contents, which works for file systems without change notifications, e.g. network
+// file systems. Only small files should be watched. Removal of files is not reported.
+type pollWatcher struct {
+	fs       FS
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	closure  chan struct{}
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	snapshots map[string]map[string][]byte
+}
+
+var _ FileWatcher = (*pollWatcher)(nil)
+
+func NewPollWatcher(fs FS, interval time.Duration) (FileWatcher, error) {
+	var pw pollWatcher
+	pw.fs = fs
+	pw.interval = interval
+	pw.events = make(chan fsnotify.Event)
+	pw.errors = make(chan error)
+	pw.closure = make(chan struct{})
+	pw.snapshots = make(map[string]map[string][]byte)
+	pw.wg.Add(1)
+	go pw.poll()
+	return &pw, nil
+}
+
+func (pw *pollWatcher) Add(dirName string) error {
+	snapshot, err := takeSnapshot(pw.fs, dirName)
+	if err != nil {
+		return err
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if _, ok := pw.snapshots[dirName]; !ok {
+		pw.snapshots[dirName] = snapshot
+	}
+	return nil
+}
+
+func (pw *pollWatcher) poll() {
+	defer func() {
+		close(pw.events)
+		close(pw.errors)
+		pw.wg.Done()
+	}()
+	ticker := time.NewTicker(pw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-pw.closure:
+			return
+		}
+		pw.mu.Lock()
+		dirNames := make([]string, 0, len(pw.snapshots))
+		for dirName := range pw.snapshots {
+			dirNames = append(dirNames, dirName)
+		}
+		pw.mu.Unlock()
+		for _, dirName := range dirNames {
+			if !pw.pollDir(dirName) {
+				return
+			}
+		}
+	}
+}
+
+func (pw *pollWatcher) pollDir(dirName string) bool {
+	snapshot, err := takeSnapshot(pw.fs, dirName)
+	if err != nil {
+		select {
+		case pw.errors <- err:
+			return true
+		case <-pw.closure:
+			return false
+		}
+	}
+	pw.mu.Lock()
+	oldSnapshot := pw.snapshots[dirName]
+	pw.snapshots[dirName] = snapshot
+	pw.mu.Unlock()
+	for fileName, data := range snapshot {
+		event := fsnotify.Event{Name: filepath.Join(dirName, fileName)}
+		if oldData, ok := oldSnapshot[fileName]; !ok {
+			event.Op = fsnotify.Create
+		} else if !bytes.Equal(data, oldData) {
+			event.Op = fsnotify.Write
+		} else {
+			continue
+		}
+		select {
+		case pw.events <- event:
+		case <-pw.closure:
+			return false
+		}
+	}
+	return true
+}
+
+func (pw *pollWatcher) Events() <-chan fsnotify.Event { return pw.events }
+func (pw *pollWatcher) Errors() <-chan error          { return pw.errors }
+
+func (pw *pollWatcher) Close() error {
+	close(pw.closure)
+	pw.wg.Wait()
+	return nil
+}
+
+func takeSnapshot(fs FS, dirName string) (map[string][]byte, error) {
+	fileInfos, err := fs.ReadDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string][]byte, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		data, err := ReadFile(fs, filepath.Join(dirName, fileInfo.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		snapshot[fileInfo.Name()] = data
+	}
+	return snapshot, nil
+}
+
+// hybridWatcher merges changes detected by change notifications and by polling, so that
+// changes made locally are detected immediately, and changes made remotely are detected
+// eventually.
+type hybridWatcher struct {
+	watchers []FileWatcher
+	events   chan fsnotify.Event
+	errors   chan error
+	closure  chan struct{}
+	wg       sync.WaitGroup
+}
+
+var _ FileWatcher = (*hybridWatcher)(nil)
+
+func NewHybridWatcher(fs FS, pollInterval time.Duration) (FileWatcher, error) {
+	notifyWatcher, err := fs.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	pollWatcher, err := NewPollWatcher(fs, pollInterval)
+	if err != nil {
+		notifyWatcher.Close()
+		return nil, err
+	}
+	var hw hybridWatcher
+	hw.watchers = []FileWatcher{notifyWatcher, pollWatcher}
+	hw.events = make(chan fsnotify.Event)
+	hw.errors = make(chan error)
+	hw.closure = make(chan struct{})
+	for _, watcher := range hw.watchers {
+		hw.wg.Add(1)
+		go hw.forward(watcher)
+	}
+	go func() {
+		hw.wg.Wait()
+		close(hw.events)
+		close(hw.errors)
+	}()
+	return &hw, nil
+}
+
+func (hw *hybridWatcher) forward(watcher FileWatcher) {
+	defer hw.wg.Done()
+	for {
+		select {
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return
+			}
+			select {
+			case hw.events <- event:
+			case <-hw.closure:
+				return
+			}
+		case err, ok := <-watcher.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case hw.errors <- err:
+			case <-hw.closure:
+				return
+			}
+		}
+	}
+}
+
+func (hw *hybridWatcher) Add(dirName string) error {
+	for _, watcher := range hw.watchers {
+		if err := watcher.Add(dirName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hw *hybridWatcher) Events() <-chan fsnotify.Event { return hw.events }
+func (hw *hybridWatcher) Errors() <-chan error          { return hw.errors }
+
+func (hw *hybridWatcher) Close() error {
+	close(hw.closure)
+	var err error
+	for _, watcher := range hw.watchers {
+		if err2 := watcher.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
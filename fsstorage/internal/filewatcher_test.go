@@ -0,0 +1,55 @@
+package internal_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	. "github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dirName := makeEventDir(t)
+	err := ioutil.WriteFile(filepath.Join(dirName, "foo"), []byte("1"), 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	pw, err := NewPollWatcher(OSFS, 10*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = pw.Add(dirName)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	nextEvent := func() fsnotify.Event {
+		select {
+		case event := <-pw.Events():
+			return event
+		case err := <-pw.Errors():
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out")
+		}
+		return fsnotify.Event{}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dirName, "bar"), []byte("1"), 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, fsnotify.Event{Name: filepath.Join(dirName, "bar"), Op: fsnotify.Create}, nextEvent())
+	err = ioutil.WriteFile(filepath.Join(dirName, "foo"), []byte("2"), 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, fsnotify.Event{Name: filepath.Join(dirName, "foo"), Op: fsnotify.Write}, nextEvent())
+
+	err = pw.Close()
+	assert.NoError(t, err)
+	_, ok := <-pw.Events()
+	assert.False(t, ok)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+// FS is a file system storages are built on, which covers what storages need from the
+// operating system, so that alternative file systems can be plugged in, e.g. for testing.
+type FS interface {
+	// OpenFile opens the named file (or directory) as os.OpenFile does.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// OpenLockedFile opens the named file as OpenFile does, and then locks the file
+	// until it's closed, shared if the file is opened read-only, or exclusively
+	// otherwise, as lockedfile.OpenFile does.
+	OpenLockedFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// TempFile creates a new temporary file in the given directory, as ioutil.TempFile
+	// does.
+	TempFile(dirName string, pattern string) (File, error)
+
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldName string, newName string) error
+	MkdirAll(name string, perm os.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+
+	// ReadDir reads the named directory and returns entries sorted by names, as
+	// ioutil.ReadDir does.
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// SameFile reports whether the given file infos describe the same file, as
+	// os.SameFile does.
+	SameFile(fileInfo1 os.FileInfo, fileInfo2 os.FileInfo) bool
+
+	// NewWatcher creates a file watcher based on change notifications of the file
+	// system.
+	NewWatcher() (FileWatcher, error)
+}
+
+// File is a file opened in a FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Readdir(n int) ([]os.FileInfo, error)
+}
+
+// OSFS is the file system of the operating system.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) OpenLockedFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := lockedfile.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) TempFile(dirName string, pattern string) (File, error) {
+	file, err := ioutil.TempFile(dirName, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)             { return os.Stat(name) }
+func (osFS) Remove(name string) error                          { return os.Remove(name) }
+func (osFS) Rename(oldName string, newName string) error       { return os.Rename(oldName, newName) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error      { return os.MkdirAll(name, perm) }
+func (osFS) Chtimes(name string, atime, mtime time.Time) error { return os.Chtimes(name, atime, mtime) }
+func (osFS) ReadDir(name string) ([]os.FileInfo, error)        { return ioutil.ReadDir(name) }
+func (osFS) SameFile(fileInfo1, fileInfo2 os.FileInfo) bool    { return os.SameFile(fileInfo1, fileInfo2) }
+func (osFS) NewWatcher() (FileWatcher, error)                  { return NewNotifyWatcher() }
+
+// ReadFile reads the named file in the given file system, as ioutil.ReadFile does.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// WriteFile writes the given data to the named file in the given file system, as
+// ioutil.WriteFile does.
+func WriteFile(fs FS, name string, data []byte, perm os.FileMode) error {
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func sortFileInfos(fileInfos []os.FileInfo) {
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
+}
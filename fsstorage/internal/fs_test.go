@@ -0,0 +1,241 @@
+package internal_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	. "github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFS(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		FS      FS
+		MakeDir func(t *testing.T) string
+	}{
+		{
+			Name:    "OSFS",
+			FS:      OSFS,
+			MakeDir: makeEventDir,
+		},
+		{
+			Name:    "MemFS",
+			FS:      NewMemFS(),
+			MakeDir: func(*testing.T) string { return "test" },
+		},
+		{
+			Name:    "FaultyFS",
+			FS:      NewFaultyFS(NewMemFS()),
+			MakeDir: func(*testing.T) string { return filepath.Join("test", "faulty") },
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := tc.FS
+			dirName := tc.MakeDir(t)
+			err := fs.MkdirAll(dirName, os.ModePerm)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			watcher, err := fs.NewWatcher()
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer watcher.Close()
+			err = watcher.Add(dirName)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			fooFileName := filepath.Join(dirName, "foo")
+
+			// Creating, writing and reading.
+			err = WriteFile(fs, fooFileName, []byte("hello"), 0666)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			_, err = fs.OpenFile(fooFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+			assert.True(t, os.IsExist(err), "err: %v", err)
+			file, err := fs.OpenFile(fooFileName, os.O_RDWR, 0)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			_, err = file.Seek(1, io.SeekStart)
+			assert.NoError(t, err)
+			_, err = file.Write([]byte("ELLO, WORLD"))
+			assert.NoError(t, err)
+			err = file.Truncate(5)
+			assert.NoError(t, err)
+			err = file.Sync()
+			assert.NoError(t, err)
+			err = file.Close()
+			assert.NoError(t, err)
+			data, err := ReadFile(fs, fooFileName)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "hELLO", string(data))
+			}
+			event := nextFSEvent(t, watcher)
+			assert.Equal(t, fsnotify.Event{Name: fooFileName, Op: fsnotify.Create}, event)
+
+			// Renaming and removing.
+			file, err = fs.OpenFile(fooFileName, os.O_RDONLY, 0)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer file.Close()
+			fileInfo1, err := file.Stat()
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			tempFile, err := fs.TempFile(dirName, ".foo.tmp-*")
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			_, err = tempFile.Write([]byte("bye"))
+			assert.NoError(t, err)
+			err = tempFile.Close()
+			assert.NoError(t, err)
+			err = fs.Rename(tempFile.Name(), fooFileName)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			fileInfo2, err := fs.Stat(fooFileName)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			assert.False(t, fs.SameFile(fileInfo1, fileInfo2))
+			fileInfo3, err := file.Stat()
+			if assert.NoError(t, err) {
+				assert.True(t, fs.SameFile(fileInfo1, fileInfo3))
+			}
+			// The file replaced remains readable.
+			data, err = ioutil.ReadAll(file)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "hELLO", string(data))
+			}
+			err = fs.Remove(fooFileName)
+			assert.NoError(t, err)
+			err = fs.Remove(fooFileName)
+			assert.True(t, os.IsNotExist(err), "err: %v", err)
+			_, err = fs.Stat(fooFileName)
+			assert.True(t, os.IsNotExist(err), "err: %v", err)
+
+			// Reading directories.
+			for _, baseName := range []string{"c", "a", "b"} {
+				err := WriteFile(fs, filepath.Join(dirName, baseName), nil, 0666)
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+			}
+			fileInfos, err := fs.ReadDir(dirName)
+			if assert.NoError(t, err) {
+				var baseNames []string
+				for _, fileInfo := range fileInfos {
+					baseNames = append(baseNames, fileInfo.Name())
+				}
+				assert.Equal(t, []string{"a", "b", "c"}, baseNames)
+			}
+			dir, err := fs.OpenFile(dirName, os.O_RDONLY, 0)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer dir.Close()
+			n := 0
+			for {
+				fileInfos, err := dir.Readdir(2)
+				n += len(fileInfos)
+				if err != nil {
+					assert.Equal(t, io.EOF, err)
+					break
+				}
+			}
+			assert.Equal(t, 3, n)
+			err = fs.Remove(dirName)
+			assert.Error(t, err)
+
+			// Locking.
+			lockFileName := filepath.Join(dirName, "lock")
+			lockFile1, err := fs.OpenLockedFile(lockFileName, os.O_RDONLY|os.O_CREATE, 0666)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			lockFile2, err := fs.OpenLockedFile(lockFileName, os.O_RDONLY, 0666)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			locked := make(chan struct{})
+			go func() {
+				defer close(locked)
+				lockFile3, err := fs.OpenLockedFile(lockFileName, os.O_RDWR, 0666)
+				if assert.NoError(t, err) {
+					lockFile3.Close()
+				}
+			}()
+			err = lockFile1.Close()
+			assert.NoError(t, err)
+			select {
+			case <-locked:
+				t.Fatal("locked exclusively while locked shared")
+			case <-time.After(100 * time.Millisecond):
+			}
+			err = lockFile2.Close()
+			assert.NoError(t, err)
+			select {
+			case <-locked:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out")
+			}
+		})
+	}
+}
+
+func TestFaultyFS(t *testing.T) {
+	fs := NewFaultyFS(NewMemFS())
+	errInjected := errors.New("injected")
+	fs.SetFault(func(op FaultOp, name string) error {
+		if op == FaultOpWrite || op == FaultOpRead {
+			return errInjected
+		}
+		return nil
+	})
+	file, err := fs.OpenFile("foo", os.O_RDWR|os.O_CREATE, 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer file.Close()
+	n, err := file.Write([]byte("hello"))
+	assert.Equal(t, 2, n)
+	assert.Equal(t, errInjected, err)
+	_, err = file.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	p := make([]byte, 2)
+	n, err = file.Read(p)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, errInjected, err)
+
+	fs.SetFault(nil)
+	_, err = file.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "he", string(data))
+	}
+}
+
+func nextFSEvent(t *testing.T, watcher FileWatcher) fsnotify.Event {
+	select {
+	case event := <-watcher.Events():
+		return event
+	case err := <-watcher.Errors():
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	return fsnotify.Event{}
+}
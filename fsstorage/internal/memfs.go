@@ -0,0 +1,667 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// memFS is an in-memory file system. It behaves as file systems of Unix-like operating
+// systems do as far as storages are concerned: files stay usable after being removed or
+// replaced while open, locks are held per open file, and changes to files in watched
+// directories are notified.
+type memFS struct {
+	mu       sync.Mutex
+	root     *memNode
+	watchers map[*memWatcher]struct{}
+	tempSeq  uint64
+}
+
+var _ FS = (*memFS)(nil)
+
+// NewMemFS creates an empty in-memory file system.
+func NewMemFS() FS {
+	return &memFS{
+		root:     newMemNode("", true),
+		watchers: make(map[*memWatcher]struct{}),
+	}
+}
+
+func (mfs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	return mfs.openFile(name, flag)
+}
+
+func (mfs *memFS) openFile(name string, flag int) (*memFile, error) {
+	node, err := mfs.lookup("open", name)
+	if err == nil {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if node.IsDir && isWritable(flag) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+	} else {
+		if !os.IsNotExist(err) || flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		parent, baseName, err := mfs.lookupParent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		node = newMemNode(baseName, false)
+		parent.Link(node)
+		mfs.notify(node, fsnotify.Create)
+	}
+	file := memFile{
+		mfs:  mfs,
+		node: node,
+		name: name,
+		flag: flag,
+	}
+	if flag&os.O_TRUNC != 0 && isWritable(flag) {
+		file.truncate(0)
+	}
+	return &file, nil
+}
+
+func (mfs *memFS) OpenLockedFile(name string, flag int, perm os.FileMode) (File, error) {
+	mfs.mu.Lock()
+	file, err := mfs.openFile(name, flag&^os.O_TRUNC)
+	mfs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// Locks are acquired without holding the lock of the file system, as they may block.
+	file.node.Lock.Lock(!isWritable(flag))
+	file.isLocked = true
+	if flag&os.O_TRUNC != 0 {
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (mfs *memFS) TempFile(dirName string, pattern string) (File, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndexByte(pattern, '*'); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	for {
+		mfs.tempSeq++
+		name := filepath.Join(dirName, prefix+strconv.FormatUint(mfs.tempSeq, 10)+suffix)
+		file, err := mfs.openFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+}
+
+func (mfs *memFS) Stat(name string) (os.FileInfo, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	node, err := mfs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.Stat(filepath.Base(name)), nil
+}
+
+func (mfs *memFS) Remove(name string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	node, err := mfs.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if node.Parent == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if node.IsDir && len(node.Children) >= 1 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	mfs.notify(node, fsnotify.Remove)
+	node.Parent.Unlink(node)
+	return nil
+}
+
+func (mfs *memFS) Rename(oldName string, newName string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	node, err := mfs.lookup("rename", oldName)
+	if err != nil {
+		return err
+	}
+	parent, baseName, err := mfs.lookupParent("rename", newName)
+	if err != nil {
+		return err
+	}
+	if oldNode, ok := parent.Children[baseName]; ok {
+		if oldNode == node {
+			return nil
+		}
+		if oldNode.IsDir != node.IsDir || (oldNode.IsDir && len(oldNode.Children) >= 1) {
+			return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.EEXIST}
+		}
+		parent.Unlink(oldNode)
+	}
+	mfs.notify(node, fsnotify.Rename)
+	node.Parent.Unlink(node)
+	node.Name = baseName
+	parent.Link(node)
+	mfs.notify(node, fsnotify.Create)
+	return nil
+}
+
+func (mfs *memFS) MkdirAll(name string, perm os.FileMode) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	node := mfs.root
+	for _, elem := range splitPath(name) {
+		child, ok := node.Children[elem]
+		if !ok {
+			child = newMemNode(elem, true)
+			node.Link(child)
+			mfs.notify(child, fsnotify.Create)
+		} else {
+			if !child.IsDir {
+				return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+			}
+		}
+		node = child
+	}
+	return nil
+}
+
+func (mfs *memFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	node, err := mfs.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	node.ModTime = mtime
+	mfs.notify(node, fsnotify.Chmod)
+	return nil
+}
+
+func (mfs *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	node, err := mfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+	return node.ReadDir(), nil
+}
+
+func (mfs *memFS) SameFile(fileInfo1 os.FileInfo, fileInfo2 os.FileInfo) bool {
+	node1, ok1 := fileInfo1.Sys().(*memNode)
+	node2, ok2 := fileInfo2.Sys().(*memNode)
+	return ok1 && ok2 && node1 == node2
+}
+
+func (mfs *memFS) NewWatcher() (FileWatcher, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	mw := new(memWatcher).Init(mfs)
+	mfs.watchers[mw] = struct{}{}
+	return mw, nil
+}
+
+// lookup returns the node for the given name. The file system should be locked.
+func (mfs *memFS) lookup(op string, name string) (*memNode, error) {
+	node := mfs.root
+	for _, elem := range splitPath(name) {
+		if !node.IsDir {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		child, ok := node.Children[elem]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// lookupParent returns the node for the directory containing the given name, and the
+// base name. The file system should be locked.
+func (mfs *memFS) lookupParent(op string, name string) (*memNode, string, error) {
+	elems := splitPath(name)
+	if len(elems) == 0 {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	parent, err := mfs.lookup(op, strings.Join(elems[:len(elems)-1], "/"))
+	if err != nil {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: err.(*os.PathError).Err}
+	}
+	if !parent.IsDir {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return parent, elems[len(elems)-1], nil
+}
+
+// notify notifies watchers watching the directory containing the given node of the
+// given change. The file system should be locked.
+func (mfs *memFS) notify(node *memNode, op fsnotify.Op) {
+	if node.Parent == nil {
+		return
+	}
+	for mw := range mfs.watchers {
+		if dirName, ok := mw.DirNames[node.Parent]; ok {
+			mw.Push(fsnotify.Event{Name: filepath.Join(dirName, node.Name), Op: op})
+		}
+	}
+}
+
+func splitPath(name string) []string {
+	var elems []string
+	for _, elem := range strings.Split(filepath.ToSlash(filepath.Clean(name)), "/") {
+		if elem != "" && elem != "." {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+func isWritable(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// memNode represents a file or a directory in a memFS. Nodes are guarded by the lock of
+// the file system, except Lock.
+type memNode struct {
+	Name     string
+	Parent   *memNode
+	IsDir    bool
+	Data     []byte
+	ModTime  time.Time
+	Children map[string]*memNode
+	Lock     memLock
+}
+
+func newMemNode(name string, isDir bool) *memNode {
+	var mn memNode
+	mn.Name = name
+	mn.IsDir = isDir
+	mn.ModTime = time.Now()
+	if isDir {
+		mn.Children = make(map[string]*memNode)
+	}
+	mn.Lock.Init()
+	return &mn
+}
+
+func (mn *memNode) Link(child *memNode) {
+	child.Parent = mn
+	mn.Children[child.Name] = child
+	mn.ModTime = time.Now()
+}
+
+func (mn *memNode) Unlink(child *memNode) {
+	delete(mn.Children, child.Name)
+	child.Parent = nil
+	mn.ModTime = time.Now()
+}
+
+func (mn *memNode) Stat(name string) os.FileInfo {
+	fileInfo := memFileInfo{
+		name:    name,
+		size:    int64(len(mn.Data)),
+		mode:    0666,
+		modTime: mn.ModTime,
+		node:    mn,
+	}
+	if mn.IsDir {
+		fileInfo.mode = os.ModeDir | 0777
+	}
+	return fileInfo
+}
+
+func (mn *memNode) ReadDir() []os.FileInfo {
+	fileInfos := make([]os.FileInfo, 0, len(mn.Children))
+	for name, child := range mn.Children {
+		fileInfos = append(fileInfos, child.Stat(name))
+	}
+	sortFileInfos(fileInfos)
+	return fileInfos
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	node    *memNode
+}
+
+var _ os.FileInfo = memFileInfo{}
+
+func (mfi memFileInfo) Name() string       { return mfi.name }
+func (mfi memFileInfo) Size() int64        { return mfi.size }
+func (mfi memFileInfo) Mode() os.FileMode  { return mfi.mode }
+func (mfi memFileInfo) ModTime() time.Time { return mfi.modTime }
+func (mfi memFileInfo) IsDir() bool        { return mfi.mode.IsDir() }
+func (mfi memFileInfo) Sys() interface{}   { return mfi.node }
+
+// memLock is a readers-writer lock of a file. Unlike sync.RWMutex, pending writers don't
+// block readers, as with file locks, so that a file can be locked shared more than once
+// by the same goroutine.
+type memLock struct {
+	mu          sync.Mutex
+	cond        sync.Cond
+	readerCount int
+	hasWriter   bool
+}
+
+func (ml *memLock) Init() *memLock {
+	ml.cond.L = &ml.mu
+	return ml
+}
+
+func (ml *memLock) Lock(shared bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	for ml.hasWriter || (!shared && ml.readerCount >= 1) {
+		ml.cond.Wait()
+	}
+	if shared {
+		ml.readerCount++
+	} else {
+		ml.hasWriter = true
+	}
+}
+
+func (ml *memLock) Unlock(shared bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if shared {
+		ml.readerCount--
+	} else {
+		ml.hasWriter = false
+	}
+	ml.cond.Broadcast()
+}
+
+// memFile is a file opened in a memFS.
+type memFile struct {
+	mfs        *memFS
+	node       *memNode
+	name       string
+	flag       int
+	offset     int64
+	isLocked   bool
+	isClosed   bool
+	dirEntries []os.FileInfo
+}
+
+var _ File = (*memFile)(nil)
+
+func (mf *memFile) Read(p []byte) (int, error) {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	if err := mf.check("read", mf.flag&os.O_WRONLY == 0); err != nil {
+		return 0, err
+	}
+	if mf.node.IsDir {
+		return 0, &os.PathError{Op: "read", Path: mf.name, Err: syscall.EISDIR}
+	}
+	if mf.offset >= int64(len(mf.node.Data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, mf.node.Data[mf.offset:])
+	mf.offset += int64(n)
+	return n, nil
+}
+
+func (mf *memFile) Write(p []byte) (int, error) {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	if err := mf.check("write", isWritable(mf.flag)); err != nil {
+		return 0, err
+	}
+	if mf.flag&os.O_APPEND != 0 {
+		mf.offset = int64(len(mf.node.Data))
+	}
+	if end := mf.offset + int64(len(p)); end > int64(len(mf.node.Data)) {
+		data := make([]byte, end)
+		copy(data, mf.node.Data)
+		mf.node.Data = data
+	}
+	copy(mf.node.Data[mf.offset:], p)
+	mf.offset += int64(len(p))
+	mf.node.ModTime = time.Now()
+	mf.mfs.notify(mf.node, fsnotify.Write)
+	return len(p), nil
+}
+
+func (mf *memFile) Seek(offset int64, whence int) (int64, error) {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	if err := mf.check("seek", true); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += mf.offset
+	case io.SeekEnd:
+		offset += int64(len(mf.node.Data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: mf.name, Err: syscall.EINVAL}
+	}
+	mf.offset = offset
+	return offset, nil
+}
+
+func (mf *memFile) Truncate(size int64) error {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	if err := mf.check("truncate", isWritable(mf.flag)); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: mf.name, Err: syscall.EINVAL}
+	}
+	mf.truncate(size)
+	return nil
+}
+
+func (mf *memFile) truncate(size int64) {
+	data := make([]byte, size)
+	copy(data, mf.node.Data)
+	mf.node.Data = data
+	mf.node.ModTime = time.Now()
+	mf.mfs.notify(mf.node, fsnotify.Write)
+}
+
+func (mf *memFile) Sync() error {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	return mf.check("sync", true)
+}
+
+func (mf *memFile) Stat() (os.FileInfo, error) {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	if err := mf.check("stat", true); err != nil {
+		return nil, err
+	}
+	return mf.node.Stat(filepath.Base(mf.name)), nil
+}
+
+func (mf *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	mf.mfs.mu.Lock()
+	defer mf.mfs.mu.Unlock()
+	if err := mf.check("readdirent", true); err != nil {
+		return nil, err
+	}
+	if !mf.node.IsDir {
+		return nil, &os.PathError{Op: "readdirent", Path: mf.name, Err: syscall.ENOTDIR}
+	}
+	if mf.dirEntries == nil {
+		mf.dirEntries = mf.node.ReadDir()
+	}
+	if n >= 1 && len(mf.dirEntries) == 0 {
+		return nil, io.EOF
+	}
+	if n < 1 || n > len(mf.dirEntries) {
+		n = len(mf.dirEntries)
+	}
+	fileInfos := mf.dirEntries[:n:n]
+	mf.dirEntries = mf.dirEntries[n:]
+	return fileInfos, nil
+}
+
+func (mf *memFile) Name() string { return mf.name }
+
+func (mf *memFile) Close() error {
+	mf.mfs.mu.Lock()
+	if err := mf.check("close", true); err != nil {
+		mf.mfs.mu.Unlock()
+		return err
+	}
+	mf.isClosed = true
+	mf.mfs.mu.Unlock()
+	if mf.isLocked {
+		mf.node.Lock.Unlock(!isWritable(mf.flag))
+	}
+	return nil
+}
+
+// check returns an error if the file is closed, or the operation isn't allowed. The file
+// system should be locked.
+func (mf *memFile) check(op string, isAllowed bool) error {
+	if mf.isClosed {
+		return &os.PathError{Op: op, Path: mf.name, Err: os.ErrClosed}
+	}
+	if !isAllowed {
+		return &os.PathError{Op: op, Path: mf.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// memWatcher is a file watcher for a memFS, which delivers changes to files in watched
+// directories.
+type memWatcher struct {
+	mfs     *memFS
+	events  chan fsnotify.Event
+	errors  chan error
+	closure chan struct{}
+	wg      sync.WaitGroup
+
+	// DirNames are names of watched directories indexed by nodes, guarded by the lock of
+	// the file system.
+	DirNames map[*memNode]string
+
+	mu          sync.Mutex
+	queue       []fsnotify.Event
+	queueUpdate chan struct{}
+}
+
+var _ FileWatcher = (*memWatcher)(nil)
+
+func (mw *memWatcher) Init(mfs *memFS) *memWatcher {
+	mw.mfs = mfs
+	mw.events = make(chan fsnotify.Event)
+	mw.errors = make(chan error)
+	mw.closure = make(chan struct{})
+	mw.DirNames = make(map[*memNode]string)
+	mw.queueUpdate = make(chan struct{}, 1)
+	mw.wg.Add(1)
+	go mw.deliver()
+	return mw
+}
+
+func (mw *memWatcher) Add(dirName string) error {
+	mw.mfs.mu.Lock()
+	defer mw.mfs.mu.Unlock()
+	node, err := mw.mfs.lookup("watch", dirName)
+	if err != nil {
+		return err
+	}
+	if !node.IsDir {
+		return &os.PathError{Op: "watch", Path: dirName, Err: syscall.ENOTDIR}
+	}
+	if _, ok := mw.DirNames[node]; !ok {
+		mw.DirNames[node] = dirName
+	}
+	return nil
+}
+
+// Push queues the given event for delivery. Events are queued without limits, so that
+// changes to files never block on watchers.
+func (mw *memWatcher) Push(event fsnotify.Event) {
+	mw.mu.Lock()
+	mw.queue = append(mw.queue, event)
+	mw.mu.Unlock()
+	select {
+	case mw.queueUpdate <- struct{}{}:
+	default:
+	}
+}
+
+func (mw *memWatcher) deliver() {
+	defer func() {
+		close(mw.events)
+		close(mw.errors)
+		mw.wg.Done()
+	}()
+	for {
+		mw.mu.Lock()
+		events := mw.queue
+		mw.queue = nil
+		mw.mu.Unlock()
+		if len(events) == 0 {
+			select {
+			case <-mw.queueUpdate:
+				continue
+			case <-mw.closure:
+				return
+			}
+		}
+		for _, event := range events {
+			select {
+			case mw.events <- event:
+			case <-mw.closure:
+				return
+			}
+		}
+	}
+}
+
+func (mw *memWatcher) Events() <-chan fsnotify.Event { return mw.events }
+func (mw *memWatcher) Errors() <-chan error          { return mw.errors }
+
+func (mw *memWatcher) Close() error {
+	mw.mfs.mu.Lock()
+	_, ok := mw.mfs.watchers[mw]
+	delete(mw.mfs.watchers, mw)
+	mw.mfs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	close(mw.closure)
+	mw.wg.Wait()
+	return nil
+}
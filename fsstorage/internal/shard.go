@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+)
+
+// MaxShardDepth is the maximum number of levels of shard directories. Each level fans
+// files out into 16 directories, so that the deepest layout has 4096 shard directories,
+// each of which has to be watched.
+const MaxShardDepth = 3
+
+// shardDirPrefix is the prefix of base names of shard directories, which are followed by
+// a lower-case hex digit. As file names encoded from keys never start with '@', shard
+// directories can't be confused with files.
+const shardDirPrefix = "@"
+
+// ShardDirName returns the name of the shard directory for the given file name at the
+// given depth, relative to the sharded directory, e.g. "@3/@f" for depth 2. It's empty
+// for depth 0.
+func ShardDirName(fileName string, depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(fileName))
+	sum := hash.Sum32()
+	shardBaseNames := make([]string, depth)
+	for i := range shardBaseNames {
+		shardBaseNames[i] = shardDirPrefix + string(hexDigits[sum>>(28-4*i)&0xf])
+	}
+	return filepath.Join(shardBaseNames...)
+}
+
+// ShardDirNames returns the names of all the shard directories at the given depth,
+// relative to the sharded directory, in ascending order. For depth 0, the only name is
+// empty, which stands for the sharded directory itself.
+func ShardDirNames(depth int) []string {
+	shardDirNames := []string{""}
+	for i := 0; i < depth; i++ {
+		parentDirNames := shardDirNames
+		shardDirNames = make([]string, 0, len(parentDirNames)*len(hexDigits))
+		for _, parentDirName := range parentDirNames {
+			for _, c := range hexDigits {
+				shardDirNames = append(shardDirNames, filepath.Join(parentDirName, shardDirPrefix+string(c)))
+			}
+		}
+	}
+	return shardDirNames
+}
+
+// IsShardBaseName returns whether the given base name can be of a shard directory.
+func IsShardBaseName(baseName string) bool {
+	return len(baseName) == len(shardDirPrefix)+1 &&
+		strings.HasPrefix(baseName, shardDirPrefix) &&
+		strings.IndexByte(hexDigits, baseName[len(shardDirPrefix)]) >= 0
+}
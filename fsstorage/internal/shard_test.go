@@ -0,0 +1,42 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardDirName(t *testing.T) {
+	assert.Equal(t, "", ShardDirName("foo", 0))
+	for depth := 1; depth <= MaxShardDepth; depth++ {
+		shardDirNames := ShardDirNames(depth)
+		assert.True(t, sort.StringsAreSorted(shardDirNames))
+		assert.Len(t, shardDirNames, 1<<(4*depth))
+		for _, fileName := range []string{"foo", "bar", EncodeKey(strings.Repeat("x", 200))} {
+			shardDirName := ShardDirName(fileName, depth)
+			i := sort.SearchStrings(shardDirNames, shardDirName)
+			if assert.Less(t, i, len(shardDirNames)) {
+				assert.Equal(t, shardDirName, shardDirNames[i])
+			}
+			// Shard directories at a depth are nested in the ones at shallower depths.
+			assert.True(t, strings.HasPrefix(shardDirName, ShardDirName(fileName, depth-1)))
+			for _, baseName := range strings.Split(shardDirName, string(filepath.Separator)) {
+				assert.True(t, IsShardBaseName(baseName), "base name: %q", baseName)
+			}
+		}
+	}
+	assert.Equal(t, []string{""}, ShardDirNames(0))
+}
+
+func TestIsShardBaseName(t *testing.T) {
+	for _, baseName := range []string{"", "@", "@g", "@A", "@00", "a", "%40a"} {
+		assert.False(t, IsShardBaseName(baseName), "base name: %q", baseName)
+	}
+	for _, baseName := range []string{"@0", "@9", "@a", "@f"} {
+		assert.True(t, IsShardBaseName(baseName), "base name: %q", baseName)
+	}
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// FSTimes accumulates time spent on operations of a file system.
+type FSTimes struct {
+	lockWaitTime int64
+	ioTime       int64
+}
+
+// LockWaitTime returns the time spent on opening and locking files.
+func (ft *FSTimes) LockWaitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ft.lockWaitTime))
+}
+
+// IOTime returns the time spent on operations other than opening and locking files.
+func (ft *FSTimes) IOTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ft.ioTime))
+}
+
+func (ft *FSTimes) addLockWaitTime(startTime time.Time) {
+	atomic.AddInt64(&ft.lockWaitTime, int64(time.Since(startTime)))
+}
+
+func (ft *FSTimes) addIOTime(startTime time.Time) {
+	atomic.AddInt64(&ft.ioTime, int64(time.Since(startTime)))
+}
+
+// TimingFS is a file system which wraps another file system and adds time spent on
+// operations to FSTimes, including operations of files opened through it.
+type TimingFS struct {
+	fs    FS
+	times *FSTimes
+}
+
+var _ FS = TimingFS{}
+
+// NewTimingFS creates a timing file system wrapping the given file system, which adds
+// time spent on operations to the given times.
+func NewTimingFS(fs FS, times *FSTimes) TimingFS {
+	return TimingFS{fs, times}
+}
+
+func (tfs TimingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.wrapFile(tfs.fs.OpenFile(name, flag, perm))
+}
+
+func (tfs TimingFS) OpenLockedFile(name string, flag int, perm os.FileMode) (File, error) {
+	defer tfs.times.addLockWaitTime(time.Now())
+	return tfs.wrapFile(tfs.fs.OpenLockedFile(name, flag, perm))
+}
+
+func (tfs TimingFS) TempFile(dirName string, pattern string) (File, error) {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.wrapFile(tfs.fs.TempFile(dirName, pattern))
+}
+
+func (tfs TimingFS) wrapFile(file File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return timingFile{file, tfs.times}, nil
+}
+
+func (tfs TimingFS) Stat(name string) (os.FileInfo, error) {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.fs.Stat(name)
+}
+
+func (tfs TimingFS) Remove(name string) error {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.fs.Remove(name)
+}
+
+func (tfs TimingFS) Rename(oldName string, newName string) error {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.fs.Rename(oldName, newName)
+}
+
+func (tfs TimingFS) MkdirAll(name string, perm os.FileMode) error {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.fs.MkdirAll(name, perm)
+}
+
+func (tfs TimingFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.fs.Chtimes(name, atime, mtime)
+}
+
+func (tfs TimingFS) ReadDir(name string) ([]os.FileInfo, error) {
+	defer tfs.times.addIOTime(time.Now())
+	return tfs.fs.ReadDir(name)
+}
+
+func (tfs TimingFS) SameFile(fileInfo1 os.FileInfo, fileInfo2 os.FileInfo) bool {
+	return tfs.fs.SameFile(fileInfo1, fileInfo2)
+}
+
+func (tfs TimingFS) NewWatcher() (FileWatcher, error) {
+	return tfs.fs.NewWatcher()
+}
+
+type timingFile struct {
+	File
+
+	times *FSTimes
+}
+
+func (tf timingFile) Read(p []byte) (int, error) {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Read(p)
+}
+
+func (tf timingFile) Write(p []byte) (int, error) {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Write(p)
+}
+
+func (tf timingFile) Seek(offset int64, whence int) (int64, error) {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Seek(offset, whence)
+}
+
+func (tf timingFile) Close() error {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Close()
+}
+
+func (tf timingFile) Stat() (os.FileInfo, error) {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Stat()
+}
+
+func (tf timingFile) Truncate(size int64) error {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Truncate(size)
+}
+
+func (tf timingFile) Sync() error {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Sync()
+}
+
+func (tf timingFile) Readdir(n int) ([]os.FileInfo, error) {
+	defer tf.times.addIOTime(time.Now())
+	return tf.File.Readdir(n)
+}
@@ -0,0 +1,78 @@
+package fsstorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// Layout represents the way values are laid out in the base directory.
+type Layout int
+
+const (
+	// LayoutFiles stores each value in files of its own: a version file per key,
+	// pointing to a value file per version.
+	//
+	// It supports all the features, and values can be checked and repaired file by
+	// file, but each value takes at least two inodes, and durable writes flush several
+	// files and directories.
+	LayoutFiles Layout = iota
+
+	// LayoutLog stores values in a single data log, where writes are appended as
+	// records. Each process indexes the data log in memory, and catches up with records
+	// appended by others whenever it locks the data log. Compaction rewrites the data
+	// log without records superseded, deleted or expired.
+	//
+	// It suits many small values, as writes take no inodes and flush one file at most,
+	// but the index grows with the number of keys, and opening the storage reads the
+	// whole data log. Changes are journaled as with LayoutFiles, but history and leases
+	// aren't supported (ErrUnsupported is returned), so that options on them are
+	// ignored, and so is Options.ShardDepth. Check and Reshard don't apply.
+	LayoutLog
+)
+
+// String returns a textual representation of the layout.
+func (l Layout) String() string {
+	switch l {
+	case LayoutFiles:
+		return "files"
+	case LayoutLog:
+		return "log"
+	default:
+		return fmt.Sprintf("Layout(%d)", int(l))
+	}
+}
+
+// readLayout reads the layout recorded in the given base directory. No layout is recorded
+// for LayoutFiles, as before layouts were introduced.
+func readLayout(fs internal.FS, baseDirName string) (Layout, error) {
+	rawLayout, err := internal.ReadFile(fs, filepath.Join(baseDirName, layoutBaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return LayoutFiles, nil
+		}
+		return 0, err
+	}
+	if strings.TrimSpace(string(rawLayout)) != LayoutLog.String() {
+		return 0, fmt.Errorf("%w: malformed layout %q", ErrCorrupted, rawLayout)
+	}
+	return LayoutLog, nil
+}
+
+// checkLayout fails if the storage in the given base directory has a layout other than
+// the given one.
+func checkLayout(fs internal.FS, baseDirName string, layout Layout) error {
+	actualLayout, err := readLayout(fs, baseDirName)
+	if err != nil {
+		return err
+	}
+	if actualLayout != layout {
+		return fmt.Errorf("%w: storage has layout %v but %v is given", ErrLayoutMismatch, actualLayout, layout)
+	}
+	return nil
+}
+
+const layoutBaseName = "layout"
@@ -0,0 +1,339 @@
+package fsstorage
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/rs/xid"
+)
+
+// Lease represents a lease, which keeps values attached to it alive as long as it's kept
+// alive. Once the lease expires or is revoked, the values are deleted, so that values
+// written by a process go away if the process dies.
+//
+// Values attached to an expired lease are treated as deleted at once, as values whose
+// TTLs have elapsed are, even if no reaper is running. The lease itself is revoked by
+// the next reap.
+type Lease struct {
+	fss *fsStorage
+	id  string
+	ttl time.Duration
+}
+
+func (fss *fsStorage) GrantLease(_ context.Context, ttl time.Duration) (*Lease, error) {
+	lease, err := fss.doGrantLease(ttl)
+	return lease, wrapError("", err)
+}
+
+func (fss *fsStorage) doGrantLease(ttl time.Duration) (*Lease, error) {
+	if fss.eventBus.IsClosed() {
+		return nil, versionedkv.ErrStorageClosed
+	}
+	id := xid.New().String()
+	leaseFile, err := fss.fs.OpenLockedFile(fss.leaseFileName(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer leaseFile.Close()
+	if err := fss.writeLeaseFile(leaseFile, time.Now().Add(ttl), true); err != nil {
+		return nil, err
+	}
+	return &Lease{
+		fss: fss,
+		id:  id,
+		ttl: ttl,
+	}, nil
+}
+
+// ID returns the ID of the lease.
+func (l *Lease) ID() string { return l.id }
+
+// TTL returns the TTL of the lease.
+func (l *Lease) TTL() time.Duration { return l.ttl }
+
+// KeepAlive renews the lease to expire after another TTL from now. It should be called
+// periodically, well within the TTL.
+//
+// If the lease has expired or been revoked, ErrLeaseNotFound is returned.
+func (l *Lease) KeepAlive(_ context.Context) error {
+	return wrapError("", l.fss.doKeepAliveLease(l.id, l.ttl))
+}
+
+func (fss *fsStorage) doKeepAliveLease(id string, ttl time.Duration) error {
+	if fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	leaseFile, expireTime, err := fss.openAndReadLeaseFile(id, os.O_RDWR)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrLeaseNotFound
+		}
+		return err
+	}
+	defer leaseFile.Close()
+	now := time.Now()
+	if isLeaseExpired(expireTime, now) {
+		return ErrLeaseNotFound
+	}
+	return fss.writeLeaseFile(leaseFile, now.Add(ttl), false)
+}
+
+// Revoke revokes the lease and deletes values attached to it. Revoking a lease which
+// has expired or been revoked is not a failure.
+func (l *Lease) Revoke(_ context.Context) error {
+	if l.fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	return wrapError("", l.fss.revokeLease(l.id, false))
+}
+
+// CreateValue works as Storage.CreateValue, and in addition attaches the value to the
+// lease. If the lease has expired or been revoked, ErrLeaseNotFound is returned.
+func (l *Lease) CreateValue(_ context.Context, key string, value string) (versionedkv.Version, error) {
+	version, err := l.fss.attachValue(l.id, key, func(options valueOptions) (string, error) {
+		return l.fss.doCreateValue(key, value, options)
+	})
+	return version2OpaqueVersion(version), wrapError(key, err)
+}
+
+// UpdateValue works as Storage.UpdateValue, and in addition attaches the new version to
+// the lease. If the lease has expired or been revoked, ErrLeaseNotFound is returned.
+func (l *Lease) UpdateValue(_ context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	newVersion, err := l.fss.attachValue(l.id, key, func(options valueOptions) (string, error) {
+		return l.fss.doUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion), options)
+	})
+	return version2OpaqueVersion(newVersion), wrapError(key, err)
+}
+
+// CreateOrUpdateValue works as Storage.CreateOrUpdateValue, and in addition attaches the
+// new version to the lease. If the lease has expired or been revoked, ErrLeaseNotFound
+// is returned.
+func (l *Lease) CreateOrUpdateValue(_ context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	newVersion, err := l.fss.attachValue(l.id, key, func(options valueOptions) (string, error) {
+		return l.fss.doCreateOrUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion), options)
+	})
+	return version2OpaqueVersion(newVersion), wrapError(key, err)
+}
+
+// attachValue writes the value for the given key with the given writer, attaching it to
+// the lease with the given ID.
+func (fss *fsStorage) attachValue(id string, key string, writer func(valueOptions) (string, error)) (string, error) {
+	if fss.eventBus.IsClosed() {
+		return "", versionedkv.ErrStorageClosed
+	}
+	// Hold the lease file locked shared, so that the lease can't be revoked until the
+	// value is written.
+	leaseFile, expireTime, err := fss.openAndReadLeaseFile(id, os.O_RDONLY)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrLeaseNotFound
+		}
+		return "", err
+	}
+	defer leaseFile.Close()
+	if isLeaseExpired(expireTime, time.Now()) {
+		return "", ErrLeaseNotFound
+	}
+	// The key is recorded before the value is written, so that the value can always be
+	// found for deletion on revocation, even after a crash.
+	if err := fss.addLeaseKey(id, key); err != nil {
+		return "", err
+	}
+	return writer(valueOptions{LeaseID: id})
+}
+
+func (fss *fsStorage) addLeaseKey(id string, key string) error {
+	leaseKeysFile, err := fss.fs.OpenFile(fss.leaseKeysFileName(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(leaseKeysFile, strconv.Quote(key)+"\n")
+	if err == nil && fss.options.Durability == DurabilityFull {
+		err = leaseKeysFile.Sync()
+	}
+	if err2 := leaseKeysFile.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// revokeLease deletes values attached to the lease with the given ID, and then removes
+// the lease. If onlyIfExpired is true, the lease is revoked only if it has expired.
+func (fss *fsStorage) revokeLease(id string, onlyIfExpired bool) error {
+	// Deleting values is a write as any other.
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer storeLockFile.Close()
+	leaseFile, expireTime, err := fss.openAndReadLeaseFile(id, os.O_RDWR)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	defer leaseFile.Close()
+	if onlyIfExpired && !isLeaseExpired(expireTime, time.Now()) {
+		return nil
+	}
+	keys, err := fss.readLeaseKeys(id)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := fss.detachValue(id, key); err != nil {
+			return err
+		}
+	}
+	// As the lease file is locked exclusively, once it's removed, no value can be
+	// attached to the lease any more.
+	if err := ignoreNotExist(fss.fs.Remove(fss.leaseKeysFileName(id))); err != nil {
+		return err
+	}
+	return ignoreNotExist(fss.fs.Remove(fss.leaseFileName(id)))
+}
+
+// detachValue deletes the value for the given key if it's attached to the lease with the
+// given ID.
+func (fss *fsStorage) detachValue(id string, key string) error {
+	fileName := internal.EncodeKey(key)
+	versionFile, record, err := fss.openAndReadVersionRecord(key, fileName, os.O_RDWR)
+	if err != nil {
+		return ignoreCorruption(ignoreNotExist(err))
+	}
+	defer versionFile.Close()
+	if record.Version == "" || record.LeaseID != id {
+		// The value has been deleted, or overwritten without the lease since.
+		return nil
+	}
+	change := changeRecord{Type: ChangeDelete, Key: key}
+	if _, err := fss.allocateRevision([]changeRecord{change}); err != nil {
+		return err
+	}
+	if err := fss.truncateVersionFile(versionFile); err != nil {
+		fss.revertChange(change, versionFile)
+		return err
+	}
+	fss.retireValue(fileName, record.Version)
+	return nil
+}
+
+func (fss *fsStorage) readLeaseKeys(id string) ([]string, error) {
+	leaseKeysFile, err := fss.fs.OpenFile(fss.leaseKeysFileName(id), os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer leaseKeysFile.Close()
+	var keys []string
+	keySet := make(map[string]struct{})
+	reader := bufio.NewReader(leaseKeysFile)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				// The last line may be incomplete due to a crash.
+				return keys, nil
+			}
+			return nil, err
+		}
+		key, err := strconv.Unquote(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			continue
+		}
+		if _, ok := keySet[key]; ok {
+			continue
+		}
+		keySet[key] = struct{}{}
+		keys = append(keys, key)
+	}
+}
+
+// reapLeaseFile revokes the lease for the given lease file if it has expired.
+func (fss *fsStorage) reapLeaseFile(fileInfo os.FileInfo) error {
+	id := fileInfo.Name()
+	if _, err := xid.FromString(id); err != nil {
+		return nil
+	}
+	// Peek at the lease file without locking, as most leases are kept alive.
+	rawExpireTime, err := internal.ReadFile(fss.fs, fss.leaseFileName(id))
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	if expireTime, ok := parseLeaseExpireTime(string(rawExpireTime)); ok && !isLeaseExpired(expireTime, time.Now()) {
+		return nil
+	}
+	return fss.revokeLease(id, true)
+}
+
+func (fss *fsStorage) openAndReadLeaseFile(id string, flag int) (internal.File, time.Time, error) {
+	leaseFileName := fss.leaseFileName(id)
+	leaseFile, err := fss.fs.OpenLockedFile(leaseFileName, flag, 0666)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// The lease file may have been removed by revocation while waiting for the lock, in
+	// which case the lease no longer exists.
+	ok, err := fss.isLinked(leaseFile, leaseFileName)
+	if err != nil {
+		leaseFile.Close()
+		return nil, time.Time{}, err
+	}
+	if !ok {
+		leaseFile.Close()
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	rawExpireTime, err := ioutil.ReadAll(leaseFile)
+	if err != nil {
+		leaseFile.Close()
+		return nil, time.Time{}, err
+	}
+	// A malformed lease file (e.g. a crash happened while granting) is treated as
+	// expired.
+	expireTime, _ := parseLeaseExpireTime(string(rawExpireTime))
+	if _, err := leaseFile.Seek(0, io.SeekStart); err != nil {
+		leaseFile.Close()
+		return nil, time.Time{}, err
+	}
+	return leaseFile, expireTime, nil
+}
+
+func (fss *fsStorage) writeLeaseFile(leaseFile internal.File, expireTime time.Time, isNew bool) error {
+	rawExpireTime := strconv.FormatInt(expireTime.UnixNano(), 10)
+	if _, err := io.WriteString(leaseFile, rawExpireTime); err != nil {
+		return err
+	}
+	if err := leaseFile.Truncate(int64(len(rawExpireTime))); err != nil {
+		return err
+	}
+	return fss.syncVersionFile(leaseFile, isNew)
+}
+
+func parseLeaseExpireTime(rawExpireTime string) (time.Time, bool) {
+	unixNano, err := strconv.ParseInt(rawExpireTime, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, unixNano), true
+}
+
+func isLeaseExpired(expireTime time.Time, now time.Time) bool {
+	return !now.Before(expireTime)
+}
+
+func (fss *fsStorage) leaseFileName(id string) string {
+	return filepath.Join(fss.dirNames.Leases, id)
+}
+
+func (fss *fsStorage) leaseKeysFileName(id string) string {
+	return filepath.Join(fss.dirNames.Leases, id+".keys")
+}
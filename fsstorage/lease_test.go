@@ -0,0 +1,175 @@
+package fsstorage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Lease(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	lease, err := s.GrantLease(ctx, time.Hour)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = lease.CreateValue(ctx, "svc/a", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version, err := lease.CreateOrUpdateValue(ctx, "svc/b", "2", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version, err = lease.UpdateValue(ctx, "svc/b", "3", version)
+	if !assert.NoError(t, err) || !assert.NotNil(t, version) {
+		t.FailNow()
+	}
+	_, err = lease.CreateValue(ctx, "svc/c", "4")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Overwriting a value without the lease detaches it from the lease.
+	version, err = s.UpdateValue(ctx, "svc/c", "5", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = lease.KeepAlive(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	err = lease.Revoke(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	details, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Len(t, details.Values, 1)
+		assert.Equal(t, "5", details.Values["svc/c"].V)
+		assert.Equal(t, version, details.Values["svc/c"].Version)
+	}
+	err = lease.Revoke(ctx)
+	assert.NoError(t, err)
+	err = lease.KeepAlive(ctx)
+	assert.Equal(t, ErrLeaseNotFound, err)
+	_, err = lease.CreateValue(ctx, "svc/d", "6")
+	assert.Equal(t, ErrLeaseNotFound, err)
+}
+
+func TestFSStorage_LeaseExpiration(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s1, err := Open(Options{
+		BaseDirName:  baseDirName,
+		ReapInterval: 10 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx := context.Background()
+	lease, err := s2.GrantLease(ctx, 200*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version, err := lease.CreateValue(ctx, "svc/a", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		err := lease.KeepAlive(ctx)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	// Stop renewing the lease, as if the process died.
+	startTime := time.Now()
+	value, version2, err := s2.WaitForValue(ctx, "svc/a", version)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", value)
+		assert.Nil(t, version2)
+		assert.GreaterOrEqual(t, int64(time.Since(startTime)), int64(100*time.Millisecond))
+	}
+	err = lease.KeepAlive(ctx)
+	assert.Equal(t, ErrLeaseNotFound, err)
+}
+
+func TestFSStorage_LeaseExpiration_NoReaper(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lease, err := s.GrantLease(ctx, 100*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version, err := lease.CreateValue(ctx, "svc/a", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = lease.KeepAlive(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Stop renewing the lease, as if the process died. Values attached to the lease
+	// are gone, even though no reaper is running.
+	value, version2, err := s.WaitForValue(ctx, "svc/a", version)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", value)
+		assert.Nil(t, version2)
+	}
+	_, version2, err = s.GetValue(ctx, "svc/a")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version2)
+	}
+	details, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Empty(t, details.Values)
+	}
+	_, err = s.CreateValue(ctx, "svc/a", "2")
+	assert.NoError(t, err)
+	err = lease.KeepAlive(ctx)
+	assert.Equal(t, ErrLeaseNotFound, err)
+}
+
+func TestFSStorage_LeaseRevocationDuringSnapshot(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	lease, err := s.GrantLease(ctx, time.Hour)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = lease.CreateValue(ctx, "svc/a", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Revoking deletes values, which waits for snapshots to be taken.
+	assertBlockedBySnapshot(t, s, func() error { return lease.Revoke(ctx) })
+	_, version, err := s.GetValue(ctx, "svc/a")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version)
+	}
+}
@@ -0,0 +1,248 @@
+package fsstorage
+
+import (
+	"container/heap"
+	"context"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+func (fss *fsStorage) ListKeys(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	keys, nextCursor, err := fss.doListKeys(ctx, prefix, cursor, limit)
+	return keys, nextCursor, wrapError("", err)
+}
+
+func (fss *fsStorage) doListKeys(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	if fss.eventBus.IsClosed() {
+		return nil, "", versionedkv.ErrStorageClosed
+	}
+	lastKey, hasLastKey, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	var kl keyList
+	kl.Init(limit)
+	if err := fss.forEachShardedFile(ctx, fss.dirNames.Versions, func(fileInfo os.FileInfo) error {
+		if fileInfo.Size() == 0 {
+			// The value has been deleted.
+			return nil
+		}
+		key, err := fss.decodeFileName(fileInfo.Name())
+		if err != nil {
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || (hasLastKey && key <= lastKey) {
+			return nil
+		}
+		kl.Add(key)
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	keys, hasMore := kl.Keys()
+	var nextCursor string
+	if hasMore {
+		nextCursor = makeCursor(keys[len(keys)-1])
+	}
+	return keys, nextCursor, nil
+}
+
+func (fss *fsStorage) Iterate(ctx context.Context, options IterateOptions) *Iterator {
+	return newIterator(ctx, fss, options)
+}
+
+func (fss *fsStorage) getVersion(_ context.Context, key string, withValue bool) (string, string, error) {
+	if withValue {
+		value, version, _, _, err := fss.doGetValue(key, "")
+		return value, version, wrapError(key, err)
+	}
+	if fss.eventBus.IsClosed() {
+		return "", "", versionedkv.ErrStorageClosed
+	}
+	fileName := internal.EncodeKey(key)
+	versionFile, version, err := fss.openAndReadVersionFile(key, fileName, os.O_RDONLY)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", wrapError(key, err)
+	}
+	versionFile.Close()
+	return "", version, nil
+}
+
+// IterateOptions represents options for iterating over values.
+type IterateOptions struct {
+	// Prefix is the prefix of keys of values to iterate over.
+	Prefix string
+
+	// Cursor is the cursor to resume from, which is either returned by ListKeys or
+	// Iterator.Cursor. If it is empty, iteration starts from the first key.
+	Cursor string
+
+	// PageSize is the number of keys listed at a time. Each listing scans keys of all
+	// the values, like ListKeys, so iterating over N values costs N/PageSize scans. If
+	// it is 0, keys are listed in a single scan and kept in memory during iteration.
+	PageSize int
+
+	// WithValues indicates whether values are retrieved as well as versions.
+	WithValues bool
+}
+
+// Iterator iterates over values in ascending order of keys. Values are retrieved one at
+// a time, so that a large number of values can be iterated over without loading all of
+// them into memory.
+//
+// Values created, updated or deleted during iteration may or may not be observed.
+type Iterator struct {
+	ctx     context.Context
+	s       iterable
+	options IterateOptions
+	keys    []string
+	cursor  string
+	key     string
+	value   string
+	version string
+	err     error
+	isDone  bool
+}
+
+type iterable interface {
+	ListKeys(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error)
+	getVersion(ctx context.Context, key string, withValue bool) (string, string, error)
+}
+
+func newIterator(ctx context.Context, s iterable, options IterateOptions) *Iterator {
+	var i Iterator
+	i.ctx = ctx
+	i.s = s
+	i.options = options
+	i.cursor = options.Cursor
+	return &i
+}
+
+// Next advances the iterator to the next value, and returns whether there is one.
+// After Next returns false, Err should be checked.
+func (i *Iterator) Next() bool {
+	for {
+		if i.err != nil {
+			return false
+		}
+		if len(i.keys) == 0 {
+			if i.isDone {
+				return false
+			}
+			keys, nextCursor, err := i.s.ListKeys(i.ctx, i.options.Prefix, i.cursor, i.options.PageSize)
+			if err != nil {
+				i.err = err
+				return false
+			}
+			i.keys = keys
+			i.isDone = nextCursor == ""
+			continue
+		}
+		key := i.keys[0]
+		i.keys = i.keys[1:]
+		i.cursor = makeCursor(key)
+		value, version, err := i.s.getVersion(i.ctx, key, i.options.WithValues)
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if version == "" {
+			// The value has been deleted since being listed.
+			continue
+		}
+		i.key = key
+		i.value = value
+		i.version = version
+		return true
+	}
+}
+
+// Key returns the key of the current value.
+func (i *Iterator) Key() string { return i.key }
+
+// Value returns the current value, which is empty if IterateOptions.WithValues is false.
+func (i *Iterator) Value() string { return i.value }
+
+// Version returns the version of the current value.
+func (i *Iterator) Version() versionedkv.Version { return version2OpaqueVersion(i.version) }
+
+// Cursor returns the cursor to resume from after the current value.
+func (i *Iterator) Cursor() string { return i.cursor }
+
+// Err returns the error occurred during iteration, if any.
+func (i *Iterator) Err() error { return i.err }
+
+// keyList keeps the smallest keys added, up to the limit, with one more key to tell
+// whether there are more keys.
+type keyList struct {
+	limit int
+	keys  keyHeap
+}
+
+func (kl *keyList) Init(limit int) *keyList {
+	kl.limit = limit
+	return kl
+}
+
+func (kl *keyList) Add(key string) {
+	if kl.limit < 1 {
+		kl.keys = append(kl.keys, key)
+		return
+	}
+	if len(kl.keys) <= kl.limit {
+		heap.Push(&kl.keys, key)
+		return
+	}
+	if key < kl.keys[0] {
+		kl.keys[0] = key
+		heap.Fix(&kl.keys, 0)
+	}
+}
+
+func (kl *keyList) Keys() ([]string, bool) {
+	keys := []string(kl.keys)
+	sort.Strings(keys)
+	if kl.limit >= 1 && len(keys) > kl.limit {
+		return keys[:kl.limit], true
+	}
+	return keys, false
+}
+
+// keyHeap is a max-heap of keys.
+type keyHeap []string
+
+func (kh keyHeap) Len() int            { return len(kh) }
+func (kh keyHeap) Less(i, j int) bool  { return kh[i] > kh[j] }
+func (kh keyHeap) Swap(i, j int)       { kh[i], kh[j] = kh[j], kh[i] }
+func (kh *keyHeap) Push(x interface{}) { *kh = append(*kh, x.(string)) }
+
+func (kh *keyHeap) Pop() interface{} {
+	n := len(*kh)
+	x := (*kh)[n-1]
+	*kh = (*kh)[:n-1]
+	return x
+}
+
+// Cursors are the last keys listed, with a mark to tell an empty key from no key.
+const cursorMark = ">"
+
+func makeCursor(lastKey string) string {
+	return cursorMark + lastKey
+}
+
+func parseCursor(cursor string) (string, bool, error) {
+	if cursor == "" {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(cursor, cursorMark) {
+		return "", false, ErrInvalidCursor
+	}
+	return cursor[len(cursorMark):], true, nil
+}
@@ -0,0 +1,176 @@
+package fsstorage_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_ListKeys(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	var expectedKeys []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("app/%02d", i)
+		_, err := s.CreateValue(ctx, key, "x")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		expectedKeys = append(expectedKeys, key)
+	}
+	for _, key := range []string{"", "db/a", "db/b", "App/x", "app"} {
+		_, err := s.CreateValue(ctx, key, "y")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	ok, err := s.DeleteValue(ctx, "app/07", nil)
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		t.FailNow()
+	}
+	expectedKeys = append(expectedKeys[:7], expectedKeys[8:]...)
+
+	var keys []string
+	var cursor string
+	for n := 0; ; n++ {
+		if !assert.Less(t, n, 3) {
+			t.FailNow()
+		}
+		keys2, nextCursor, err := s.ListKeys(ctx, "app/", cursor, 10)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.LessOrEqual(t, len(keys2), 10)
+		keys = append(keys, keys2...)
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	assert.Equal(t, expectedKeys, keys)
+
+	keys, nextCursor, err := s.ListKeys(ctx, "", "", 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", nextCursor)
+		assert.Len(t, keys, 29)
+		assert.True(t, sort.StringsAreSorted(keys))
+		assert.Equal(t, "", keys[0])
+	}
+	keys, nextCursor, err = s.ListKeys(ctx, "", "", 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{""}, keys)
+		keys, _, err = s.ListKeys(ctx, "", nextCursor, 1)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"App/x"}, keys)
+		}
+	}
+	_, _, err = s.ListKeys(ctx, "", "foo", 1)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestFSStorage_Iterate(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	expectedValueDetails := make(map[string]versionedkv.ValueDetails)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("app/%02d", i)
+		value := fmt.Sprintf("value%d", i)
+		version, err := s.CreateValue(ctx, key, value)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		expectedValueDetails[key] = versionedkv.ValueDetails{V: value, Version: version}
+	}
+	_, err = s.CreateValue(ctx, "db", "x")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	it := s.Iterate(ctx, IterateOptions{Prefix: "app/", PageSize: 7, WithValues: true})
+	valueDetails := make(map[string]versionedkv.ValueDetails)
+	var lastKey string
+	var cursor string
+	for it.Next() {
+		assert.Greater(t, it.Key(), lastKey)
+		lastKey = it.Key()
+		valueDetails[it.Key()] = versionedkv.ValueDetails{V: it.Value(), Version: it.Version()}
+		if it.Key() == "app/09" {
+			cursor = it.Cursor()
+		}
+	}
+	if assert.NoError(t, it.Err()) {
+		assert.Equal(t, expectedValueDetails, valueDetails)
+	}
+
+	it = s.Iterate(ctx, IterateOptions{Prefix: "app/", Cursor: cursor})
+	var keys []string
+	for it.Next() {
+		assert.Empty(t, it.Value())
+		assert.Equal(t, expectedValueDetails[it.Key()].Version, it.Version())
+		keys = append(keys, it.Key())
+	}
+	if assert.NoError(t, it.Err()) {
+		assert.Len(t, keys, 10)
+		assert.Equal(t, "app/10", keys[0])
+	}
+}
+
+func TestFSStorage_Iterate_Scans(t *testing.T) {
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	options := Options{BaseDirName: "versionedkv"}
+	s, err := OpenWithFS(options, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err := s.CreateValue(ctx, fmt.Sprintf("app/%02d", i), "value")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	var scans int32
+	versionsDirName := filepath.Join(options.BaseDirName, "versions")
+	fs.SetFault(func(op internal.FaultOp, name string) error {
+		if op == internal.FaultOpOpen && name == versionsDirName {
+			atomic.AddInt32(&scans, 1)
+		}
+		return nil
+	})
+
+	for _, tc := range []struct {
+		PageSize      int
+		ExpectedScans int32
+	}{
+		{PageSize: 0, ExpectedScans: 1},
+		{PageSize: 7, ExpectedScans: 3},
+	} {
+		atomic.StoreInt32(&scans, 0)
+		it := s.Iterate(ctx, IterateOptions{PageSize: tc.PageSize})
+		n := 0
+		for it.Next() {
+			n++
+		}
+		if assert.NoError(t, it.Err()) {
+			assert.Equal(t, 20, n)
+		}
+		assert.Equal(t, tc.ExpectedScans, atomic.LoadInt32(&scans), "page size: %d", tc.PageSize)
+	}
+}
@@ -0,0 +1,105 @@
+package fsstorage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-tk/versionedkv"
+)
+
+// Logger logs failures which don't fail operations of storages, e.g. failures to clean
+// up files, which are left for compaction, and errors occurred in the background.
+// NewSlogLogger adapts a log/slog logger.
+//
+// Methods are called synchronously, possibly concurrently, and shouldn't block.
+type Logger interface {
+	// Log logs the given entry.
+	Log(entry LogEntry)
+}
+
+// LogEntry represents an entry logged.
+type LogEntry struct {
+	Level   LogLevel
+	Message string
+
+	// Key is the key of the value involved, if any.
+	Key string
+
+	// Version is the version of the value involved, if any.
+	Version string
+
+	// Path is the name of the file (or directory) involved, if any.
+	Path string
+
+	// Err is the error occurred, if any.
+	Err error
+}
+
+// LogLevel represents the importance of an entry logged. Levels have the same values as
+// log/slog levels.
+type LogLevel int
+
+const (
+	// LogLevelDebug is for events of no concern, which may help debugging.
+	LogLevelDebug LogLevel = -4
+
+	// LogLevelInfo is for events of interest.
+	LogLevelInfo LogLevel = 0
+
+	// LogLevelWarn is for failures the storage recovers from by itself, e.g. files left
+	// over, which compaction removes later.
+	LogLevelWarn LogLevel = 4
+
+	// LogLevelError is for failures which need attention, e.g. background compaction
+	// failed.
+	LogLevelError LogLevel = 8
+)
+
+// String returns a textual representation of the level.
+func (ll LogLevel) String() string {
+	switch ll {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(ll))
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogEntry) {}
+
+// logFileFailure logs the failure of an operation on the file with the given name, which
+// belongs to the given version of the value for the given file name.
+func (fss *fsStorage) logFileFailure(level LogLevel, message string, fileName string, version string, path string, err error) {
+	// The key is only used for logging, so that failures to decode it are ignored.
+	key, _ := fss.decodeFileName(fileName)
+	fss.options.Logger.Log(LogEntry{
+		Level:   level,
+		Message: message,
+		Key:     key,
+		Version: version,
+		Path:    path,
+		Err:     err,
+	})
+}
+
+// logBackgroundFailure logs the failure of a background task on the file (or directory)
+// with the given name, unless the task has been cancelled by closing the storage.
+func (fss *fsStorage) logBackgroundFailure(ctx context.Context, message string, path string, err error) {
+	if ctx.Err() != nil || err == versionedkv.ErrStorageClosed {
+		return
+	}
+	fss.options.Logger.Log(LogEntry{
+		Level:   LogLevelError,
+		Message: message,
+		Path:    path,
+		Err:     err,
+	})
+}
@@ -0,0 +1,76 @@
+package fsstorage_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Logger(t *testing.T) {
+	var tl testLogger
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	s, err := OpenWithFS(Options{Logger: &tl}, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// The value file of the version superseded can't be removed, which doesn't fail the
+	// update but is logged.
+	errInjected := errors.New("injected")
+	fs.SetFault(func(op internal.FaultOp, name string) error {
+		if op == internal.FaultOpRemove && filepath.Base(filepath.Dir(name)) == "values" {
+			return errInjected
+		}
+		return nil
+	})
+	_, err = s.UpdateValue(ctx, "foo", "baz", version)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	entries := tl.Entries(LogLevelWarn)
+	if assert.Len(t, entries, 1) {
+		entry := entries[0]
+		assert.Equal(t, "failed to remove value file", entry.Message)
+		assert.Equal(t, "foo", entry.Key)
+		assert.Equal(t, version, entry.Version)
+		assert.True(t, strings.Contains(entry.Path, version.(string)), "path: %v", entry.Path)
+		assert.Equal(t, errInjected, entry.Err)
+	}
+}
+
+type testLogger struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (tl *testLogger) Log(entry LogEntry) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.entries = append(tl.entries, entry)
+}
+
+// Entries returns entries logged at or above the given level.
+func (tl *testLogger) Entries(minLevel LogLevel) []LogEntry {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var entries []LogEntry
+	for _, entry := range tl.entries {
+		if entry.Level >= minLevel {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
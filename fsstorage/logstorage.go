@@ -0,0 +1,1361 @@
+package fsstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// openLogStorage opens the storage with LayoutLog, where the given storage provides the
+// options and the file system.
+func openLogStorage(fss *fsStorage, newFileWatcher func() (internal.FileWatcher, error)) (Storage, error) {
+	ls := logStorage{
+		fss: fss,
+		log: new(dataLog).Init(),
+	}
+	if err := ls.setUp(); err != nil {
+		return nil, err
+	}
+	if err := ls.setUpChangeJournal(); err != nil {
+		return nil, err
+	}
+	if newFileWatcher == nil {
+		newFileWatcher = fss.fs.NewWatcher
+	}
+	baseDirName := fss.options.BaseDirName
+	fss.eventBus = fss.newEventBus(baseDirName, []string{baseDirName}, func() (internal.FileWatcher, error) {
+		return ls.newLogWatcher(newFileWatcher)
+	})
+	if err := fss.eventBus.Open(); err != nil {
+		return nil, err
+	}
+	fss.closure = make(chan struct{})
+	if fss.options.CompactInterval >= 1 {
+		go fss.runPeriodically(fss.options.CompactInterval, func(ctx context.Context) {
+			if err := ls.doCompact(ctx, minDataLogGarbageRatio); err != nil {
+				fss.logBackgroundFailure(ctx, "failed to compact storage", ls.dataLogFileName(), err)
+			}
+		})
+	}
+	if fss.options.ReapInterval >= 1 {
+		go fss.runPeriodically(fss.options.ReapInterval, func(ctx context.Context) {
+			if err := ls.reap(); err != nil {
+				fss.logBackgroundFailure(ctx, "failed to reap expired values", ls.dataLogFileName(), err)
+			}
+		})
+	}
+	return &ls, nil
+}
+
+// logStorage is a storage with LayoutLog.
+type logStorage struct {
+	// fss provides the options, the file system, the event bus, the closure, the
+	// revision counter and the change journal. The rest of its file-based state is
+	// unused.
+	fss *fsStorage
+
+	log *dataLog
+}
+
+// setUp records the layout in a new storage, and creates the data log if missing.
+func (ls *logStorage) setUp() error {
+	fss := ls.fss
+	baseDirName := fss.options.BaseDirName
+	if err := fss.fs.MkdirAll(baseDirName, os.ModePerm); err != nil {
+		return err
+	}
+	layout, err := readLayout(fss.fs, baseDirName)
+	if err != nil {
+		return err
+	}
+	sync := fss.options.Durability != DurabilityNone
+	if layout != LayoutLog {
+		// Storages with LayoutFiles have no layout recorded, so that they may be new
+		// storages as well.
+		if _, err := fss.fs.Stat(filepath.Join(baseDirName, "versions")); err == nil {
+			return checkLayout(fss.fs, baseDirName, LayoutLog)
+		} else {
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := fss.writeFileAtomically(filepath.Join(baseDirName, layoutBaseName), []byte(LayoutLog.String()+"\n"), sync); err != nil {
+			return err
+		}
+	}
+	dataLogFile, err := ls.openDataLog(os.O_RDWR | os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer dataLogFile.Close()
+	fileInfo, err := dataLogFile.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() >= 1 {
+		return nil
+	}
+	if _, err := io.WriteString(dataLogFile, internal.DataLogHeader); err != nil {
+		return err
+	}
+	if sync {
+		if err := dataLogFile.Sync(); err != nil {
+			return err
+		}
+		return fss.syncDir(baseDirName)
+	}
+	return nil
+}
+
+// setUpChangeJournal creates the directory of the change journal if missing, and catches
+// the revision counter up with the data log, where revisions were allocated before
+// changes were journaled in this layout. Changes at those revisions are thus taken as
+// truncated.
+func (ls *logStorage) setUpChangeJournal() error {
+	fss := ls.fss
+	fss.dirNames.Changes = makeDirNames(fss.options.BaseDirName).Changes
+	if err := fss.fs.MkdirAll(fss.dirNames.Changes, os.ModePerm); err != nil {
+		return err
+	}
+	// Writes lock the data log exclusively before the revision counter.
+	dataLogFile, err := ls.lockDataLog(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer dataLogFile.Close()
+	revisionFile, currentRevision, err := fss.lockRevision()
+	if err != nil {
+		return err
+	}
+	defer revisionFile.Close()
+	if revision := ls.log.NextRevision() - 1; revision > currentRevision {
+		return fss.writeRevision(revisionFile, revision)
+	}
+	return nil
+}
+
+func (ls *logStorage) GetValue(ctx context.Context, key string) (string, versionedkv.Version, error) {
+	op, ls := ls.startOperation(ctx, OperationGetValue, key)
+	value, version, _, _, err := ls.doGetValue(key, "")
+	err = wrapError(key, err)
+	op.End(readOutcome(version, err), err)
+	return value, version2OpaqueVersion(version), err
+}
+
+// doGetValue works as fsStorage.doGetValue does.
+func (ls *logStorage) doGetValue(key string, oldVersion string) (string, string, time.Time, bool, error) {
+	if ls.fss.eventBus.IsClosed() {
+		return "", "", time.Time{}, false, versionedkv.ErrStorageClosed
+	}
+	dataLogFile, err := ls.lockDataLog(os.O_RDONLY)
+	if err != nil {
+		return "", "", time.Time{}, false, err
+	}
+	defer dataLogFile.Close()
+	entry, _ := ls.log.GetEntry(key, time.Now())
+	if entry.Version == oldVersion {
+		return "", "", entry.ExpireTime, false, nil
+	}
+	if entry.Version == "" {
+		return "", "", time.Time{}, true, nil
+	}
+	value, err := readDataLogValue(dataLogFile, entry)
+	if err != nil {
+		return "", "", time.Time{}, false, err
+	}
+	return value, entry.Version, entry.ExpireTime, true, nil
+}
+
+func (ls *logStorage) WaitForValue(ctx context.Context, key string, oldOpaqueVersion versionedkv.Version) (string, versionedkv.Version, error) {
+	op, ls := ls.startOperation(ctx, OperationWaitForValue, key)
+	value, newVersion, err := ls.doWaitForValue(ctx, key, opaqueVersion2Version(oldOpaqueVersion))
+	err = wrapError(key, err)
+	op.End(readOutcome(newVersion, err), err)
+	return value, version2OpaqueVersion(newVersion), err
+}
+
+func (ls *logStorage) doWaitForValue(ctx context.Context, key string, oldVersion string) (string, string, error) {
+	eventBus := ls.fss.eventBus
+	eventName := keyEventName(key)
+	for {
+		var retry bool
+		value, newVersion, err := func() (string, string, error) {
+			watcher, err := eventBus.AddWatcher(eventName)
+			if err != nil {
+				if err == internal.ErrEventBusClosed {
+					err = versionedkv.ErrStorageClosed
+				}
+				return "", "", err
+			}
+			defer func() {
+				if watcher != (internal.Watcher{}) {
+					eventBus.RemoveWatcher(eventName, watcher)
+				}
+			}()
+			value, newVersion, expireTime, ok, err := ls.doGetValue(key, oldVersion)
+			if err != nil {
+				return "", "", err
+			}
+			retry = !ok
+			if retry {
+				// Wake up on expiration, as expired values aren't deleted until reaped.
+				var expiration <-chan time.Time
+				if !expireTime.IsZero() {
+					timer := time.NewTimer(time.Until(expireTime))
+					defer timer.Stop()
+					expiration = timer.C
+				}
+				select {
+				case <-watcher.Event():
+					watcher = internal.Watcher{}
+					return "", "", nil
+				case <-expiration:
+					return "", "", nil
+				case <-ls.fss.closure:
+					watcher = internal.Watcher{}
+					return "", "", versionedkv.ErrStorageClosed
+				case <-ctx.Done():
+					return "", "", ctx.Err()
+				}
+			}
+			return value, newVersion, nil
+		}()
+		if err != nil {
+			return "", "", err
+		}
+		if retry {
+			continue
+		}
+		return value, newVersion, nil
+	}
+}
+
+func (ls *logStorage) CreateValue(ctx context.Context, key string, value string) (versionedkv.Version, error) {
+	return ls.CreateValueWithTTL(ctx, key, value, 0)
+}
+
+func (ls *logStorage) CreateValueWithTTL(ctx context.Context, key string, value string, ttl time.Duration) (versionedkv.Version, error) {
+	op, ls := ls.startOperation(ctx, OperationCreateValue, key)
+	ops, err := ls.write(func(now time.Time) ([]internal.DataLogOp, error) {
+		if entry, _ := ls.log.GetEntry(key, now); entry.Version != "" {
+			return nil, nil
+		}
+		return []internal.DataLogOp{newPutOp(key, value, now, ttl)}, nil
+	})
+	var version string
+	if len(ops) == 1 {
+		version = ops[0].Version
+	}
+	err = wrapError(key, err)
+	op.End(writeOutcome(version != "", true, err), err)
+	return version2OpaqueVersion(version), err
+}
+
+func (ls *logStorage) UpdateValue(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	return ls.UpdateValueWithTTL(ctx, key, value, opaqueOldVersion, 0)
+}
+
+func (ls *logStorage) UpdateValueWithTTL(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version, ttl time.Duration) (versionedkv.Version, error) {
+	op, ls := ls.startOperation(ctx, OperationUpdateValue, key)
+	oldVersion := opaqueVersion2Version(opaqueOldVersion)
+	ops, err := ls.write(func(now time.Time) ([]internal.DataLogOp, error) {
+		entry, _ := ls.log.GetEntry(key, now)
+		if entry.Version == "" {
+			return nil, nil
+		}
+		if oldVersion != "" && entry.Version != oldVersion {
+			return nil, nil
+		}
+		return []internal.DataLogOp{newPutOp(key, value, now, ttl)}, nil
+	})
+	var newVersion string
+	if len(ops) == 1 {
+		newVersion = ops[0].Version
+	}
+	err = wrapError(key, err)
+	op.End(writeOutcome(newVersion != "", opaqueOldVersion != nil, err), err)
+	return version2OpaqueVersion(newVersion), err
+}
+
+func (ls *logStorage) CreateOrUpdateValue(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version) (versionedkv.Version, error) {
+	return ls.CreateOrUpdateValueWithTTL(ctx, key, value, opaqueOldVersion, 0)
+}
+
+func (ls *logStorage) CreateOrUpdateValueWithTTL(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version, ttl time.Duration) (versionedkv.Version, error) {
+	op, ls := ls.startOperation(ctx, OperationCreateOrUpdateValue, key)
+	oldVersion := opaqueVersion2Version(opaqueOldVersion)
+	ops, err := ls.write(func(now time.Time) ([]internal.DataLogOp, error) {
+		entry, _ := ls.log.GetEntry(key, now)
+		if entry.Version != "" && oldVersion != "" && entry.Version != oldVersion {
+			return nil, nil
+		}
+		return []internal.DataLogOp{newPutOp(key, value, now, ttl)}, nil
+	})
+	var newVersion string
+	if len(ops) == 1 {
+		newVersion = ops[0].Version
+	}
+	err = wrapError(key, err)
+	op.End(writeOutcome(newVersion != "", opaqueOldVersion != nil, err), err)
+	return version2OpaqueVersion(newVersion), err
+}
+
+func (ls *logStorage) DeleteValue(ctx context.Context, key string, opaqueVersion versionedkv.Version) (bool, error) {
+	op, ls := ls.startOperation(ctx, OperationDeleteValue, key)
+	version := opaqueVersion2Version(opaqueVersion)
+	ops, err := ls.write(func(now time.Time) ([]internal.DataLogOp, error) {
+		entry, _ := ls.log.GetEntry(key, now)
+		if entry.Version == "" {
+			return nil, nil
+		}
+		if version != "" && entry.Version != version {
+			return nil, nil
+		}
+		return []internal.DataLogOp{{Type: internal.DataLogOpDelete, Key: key}}, nil
+	})
+	ok := len(ops) == 1
+	err = wrapError(key, err)
+	op.End(writeOutcome(ok, opaqueVersion != nil, err), err)
+	return ok, err
+}
+
+func (ls *logStorage) Close() error {
+	err := ls.fss.eventBus.Close()
+	if err == internal.ErrEventBusClosed {
+		return versionedkv.ErrStorageClosed
+	}
+	close(ls.fss.closure)
+	return nil
+}
+
+func (ls *logStorage) Inspect(ctx context.Context) (versionedkv.StorageDetails, error) {
+	if ls.fss.eventBus.IsClosed() {
+		return versionedkv.StorageDetails{IsClosed: true}, nil
+	}
+	var valueDetails map[string]versionedkv.ValueDetails
+	if err := ls.forEachValue(ctx, "", func(key string, value string, entry dataLogEntry) error {
+		if valueDetails == nil {
+			valueDetails = make(map[string]versionedkv.ValueDetails)
+		}
+		valueDetails[key] = versionedkv.ValueDetails{
+			V:       value,
+			Version: entry.Version,
+		}
+		return nil
+	}); err != nil {
+		return versionedkv.StorageDetails{}, wrapError("", err)
+	}
+	return versionedkv.StorageDetails{
+		Values: valueDetails,
+	}, nil
+}
+
+// Compact appends deletions of expired values to the data log, and then rewrites the data
+// log without records superseded or deleted, if there are any.
+func (ls *logStorage) Compact(ctx context.Context) error {
+	return wrapError("", ls.doCompact(ctx, 0))
+}
+
+// minDataLogGarbageRatio is the minimum ratio of records superseded or deleted to the
+// data log, for background compaction to rewrite the data log.
+const minDataLogGarbageRatio = 0.5
+
+// doCompact compacts the data log if records superseded or deleted take at least the
+// given ratio of the data log.
+func (ls *logStorage) doCompact(ctx context.Context, minGarbageRatio float64) error {
+	if ls.fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	if err := ls.reap(); err != nil {
+		return err
+	}
+	dataLogFile, err := ls.lockDataLog(os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer dataLogFile.Close()
+	garbageSize, size := ls.log.GarbageSize()
+	if garbageSize == 0 || float64(garbageSize) < minGarbageRatio*float64(size) {
+		return nil
+	}
+	return ls.rewriteDataLog(ctx, dataLogFile)
+}
+
+// rewriteDataLog rewrites the given data log, which should be locked exclusively, with
+// records of current values only, and then replaces the data log with the new one.
+// Processes waiting for the lock of the old data log reopen the new one, and re-index it
+// as they find it replaced.
+func (ls *logStorage) rewriteDataLog(ctx context.Context, dataLogFile internal.File) error {
+	fss := ls.fss
+	dataLogFileName := ls.dataLogFileName()
+	// Temporary files are left over by crashes, as the data log is locked exclusively.
+	if err := fss.forEachFile(ctx, fss.options.BaseDirName, func(fileInfo os.FileInfo) error {
+		if baseName, ok := parseTempFileName(fileInfo.Name()); ok && baseName == dataLogBaseName {
+			return ignoreNotExist(fss.fs.Remove(filepath.Join(fss.options.BaseDirName, fileInfo.Name())))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	tempFile, err := fss.fs.TempFile(fss.options.BaseDirName, tempFileNamePrefix(dataLogBaseName)+"*")
+	if err != nil {
+		return err
+	}
+	tempFileName := tempFile.Name()
+	defer func() {
+		if tempFile != nil {
+			tempFile.Close()
+		}
+		if tempFileName != "" {
+			fss.fs.Remove(tempFileName)
+		}
+	}()
+	newLog := new(dataLog).Init()
+	newLog.end = int64(len(internal.DataLogHeader))
+	buffer := []byte(internal.DataLogHeader)
+	// The latest revision is kept, as the value at it may be gone.
+	if revision := ls.log.NextRevision() - 1; revision >= 1 {
+		record := internal.AppendDataLogRecord(nil, []internal.DataLogOp{{
+			Type:     internal.DataLogOpRevision,
+			Revision: revision,
+		}})
+		if err := newLog.ApplyRecord(record, false); err != nil {
+			return err
+		}
+		buffer = append(buffer, record...)
+	}
+	for _, key := range ls.log.Keys() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, ok := ls.log.GetEntry(key, time.Time{})
+		if !ok {
+			continue
+		}
+		value, err := readDataLogValue(dataLogFile, entry)
+		if err != nil {
+			return err
+		}
+		record := internal.AppendDataLogRecord(nil, []internal.DataLogOp{{
+			Type:       internal.DataLogOpPut,
+			Key:        key,
+			Version:    entry.Version,
+			ExpireTime: entry.ExpireTime,
+			Value:      value,
+		}})
+		if err := newLog.ApplyRecord(record, false); err != nil {
+			return err
+		}
+		buffer = append(buffer, record...)
+		if len(buffer) >= dataLogWriteBufferSize {
+			if _, err := tempFile.Write(buffer); err != nil {
+				return err
+			}
+			buffer = buffer[:0]
+		}
+	}
+	if _, err := tempFile.Write(buffer); err != nil {
+		return err
+	}
+	sync := fss.options.Durability != DurabilityNone
+	if sync {
+		if err := tempFile.Sync(); err != nil {
+			return err
+		}
+	}
+	err = tempFile.Close()
+	tempFile = nil
+	if err != nil {
+		return err
+	}
+	if err := fss.fs.Rename(tempFileName, dataLogFileName); err != nil {
+		return err
+	}
+	tempFileName = ""
+	fileInfo, err := fss.fs.Stat(dataLogFileName)
+	if err != nil {
+		return err
+	}
+	newLog.fileInfo = fileInfo
+	ls.log.Replace(newLog)
+	if sync {
+		return fss.syncDir(fss.options.BaseDirName)
+	}
+	return nil
+}
+
+const dataLogWriteBufferSize = 1 << 20
+
+// reap appends deletions of expired values to the data log, so that other processes
+// notice the expiration.
+func (ls *logStorage) reap() error {
+	_, err := ls.write(func(now time.Time) ([]internal.DataLogOp, error) {
+		var ops []internal.DataLogOp
+		for _, key := range ls.log.Keys() {
+			if entry, ok := ls.log.GetEntry(key, time.Time{}); ok && entry.IsExpired(now) {
+				ops = append(ops, internal.DataLogOp{Type: internal.DataLogOpDelete, Key: key})
+			}
+		}
+		return ops, nil
+	})
+	return err
+}
+
+func (ls *logStorage) ListKeys(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	keys, nextCursor, err := ls.doListKeys(prefix, cursor, limit)
+	return keys, nextCursor, wrapError("", err)
+}
+
+func (ls *logStorage) doListKeys(prefix string, cursor string, limit int) ([]string, string, error) {
+	if ls.fss.eventBus.IsClosed() {
+		return nil, "", versionedkv.ErrStorageClosed
+	}
+	lastKey, hasLastKey, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	dataLogFile, err := ls.lockDataLog(os.O_RDONLY)
+	if err != nil {
+		return nil, "", err
+	}
+	dataLogFile.Close()
+	var kl keyList
+	kl.Init(limit)
+	now := time.Now()
+	for _, key := range ls.log.Keys() {
+		if !strings.HasPrefix(key, prefix) || (hasLastKey && key <= lastKey) {
+			continue
+		}
+		if _, ok := ls.log.GetEntry(key, now); ok {
+			kl.Add(key)
+		}
+	}
+	keys, hasMore := kl.Keys()
+	var nextCursor string
+	if hasMore {
+		nextCursor = makeCursor(keys[len(keys)-1])
+	}
+	return keys, nextCursor, nil
+}
+
+func (ls *logStorage) Iterate(ctx context.Context, options IterateOptions) *Iterator {
+	return newIterator(ctx, ls, options)
+}
+
+func (ls *logStorage) getVersion(_ context.Context, key string, withValue bool) (string, string, error) {
+	if withValue {
+		value, version, _, _, err := ls.doGetValue(key, "")
+		return value, version, wrapError(key, err)
+	}
+	if ls.fss.eventBus.IsClosed() {
+		return "", "", versionedkv.ErrStorageClosed
+	}
+	dataLogFile, err := ls.lockDataLog(os.O_RDONLY)
+	if err != nil {
+		return "", "", wrapError(key, err)
+	}
+	dataLogFile.Close()
+	entry, _ := ls.log.GetEntry(key, time.Now())
+	return "", entry.Version, nil
+}
+
+func (ls *logStorage) Watch(ctx context.Context, prefix string) (<-chan WatchEvent, error) {
+	events, err := startWatch(ctx, ls, ls.fss.eventBus, ls.fss.closure, prefix)
+	return events, wrapError("", err)
+}
+
+// decodeFileName converts the given event name back to a key. It's named after
+// fsStorage.decodeFileName for watchable.
+func (ls *logStorage) decodeFileName(eventName string) (string, error) {
+	return parseKeyEventName(eventName)
+}
+
+func (ls *logStorage) CommitTxn(ctx context.Context, txn Txn) (bool, []versionedkv.Version, error) {
+	// Validate the transaction as LayoutFiles does.
+	if _, err := makeTxnFiles(txn); err != nil {
+		return false, nil, err
+	}
+	if ls.fss.eventBus.IsClosed() {
+		return false, nil, versionedkv.ErrStorageClosed
+	}
+	var ok bool
+	// The ops of the transaction are appended as one record, which is atomic, and share
+	// a revision.
+	ops, err := ls.write(func(now time.Time) ([]internal.DataLogOp, error) {
+		for _, condition := range txn.Conditions {
+			if entry, _ := ls.log.GetEntry(condition.Key, now); entry.Version != opaqueVersion2Version(condition.Version) {
+				return nil, nil
+			}
+		}
+		ok = true
+		var ops []internal.DataLogOp
+		for _, put := range txn.Puts {
+			ops = append(ops, newPutOp(put.Key, put.Value, now, 0))
+		}
+		for _, key := range txn.Deletes {
+			if entry, _ := ls.log.GetEntry(key, now); entry.Version != "" {
+				ops = append(ops, internal.DataLogOp{Type: internal.DataLogOpDelete, Key: key})
+			}
+		}
+		return ops, nil
+	})
+	if err != nil || !ok {
+		return false, nil, wrapError("", err)
+	}
+	// Puts come first.
+	var newOpaqueVersions []versionedkv.Version
+	if len(txn.Puts) >= 1 {
+		newOpaqueVersions = make([]versionedkv.Version, len(txn.Puts))
+		for i := range txn.Puts {
+			newOpaqueVersions[i] = ops[i].Version
+		}
+	}
+	return true, newOpaqueVersions, nil
+}
+
+func (ls *logStorage) Snapshot(ctx context.Context, writer io.Writer) error {
+	return wrapError("", ls.doSnapshot(ctx, writer))
+}
+
+func (ls *logStorage) doSnapshot(ctx context.Context, writer io.Writer) error {
+	if ls.fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	encoder := json.NewEncoder(writer)
+	if err := encoder.Encode(snapshotHeader{
+		Format: snapshotFormat,
+		Time:   time.Now(),
+	}); err != nil {
+		return err
+	}
+	// Writes are blocked while the data log is locked, so that the snapshot is
+	// consistent.
+	return ls.forEachValue(ctx, "", func(key string, value string, entry dataLogEntry) error {
+		snapshotEntry := snapshotEntry{
+			Key:     key,
+			Value:   []byte(value),
+			Version: entry.Version,
+		}
+		if !entry.ExpireTime.IsZero() {
+			expireTime := entry.ExpireTime
+			snapshotEntry.ExpireTime = &expireTime
+		}
+		return encoder.Encode(snapshotEntry)
+	})
+}
+
+func (ls *logStorage) Restore(ctx context.Context, reader io.Reader, mode RestoreMode) error {
+	return wrapError("", ls.doRestore(ctx, reader, mode))
+}
+
+func (ls *logStorage) doRestore(ctx context.Context, reader io.Reader, mode RestoreMode) error {
+	if ls.fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	decoder := json.NewDecoder(reader)
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return newInvalidSnapshotError("", err)
+	}
+	if header.Format != snapshotFormat {
+		return newInvalidSnapshotError("", fmt.Errorf("unknown format %q", header.Format))
+	}
+	// Other writes are blocked until restoring is done, so that they don't interleave.
+	dataLogFile, err := ls.lockDataLog(os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer dataLogFile.Close()
+	now := time.Now()
+	restoredKeys := make(map[string]struct{})
+	var ops []internal.DataLogOp
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var entry snapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return newInvalidSnapshotError("", err)
+		}
+		if !isValidVersion(entry.Version) {
+			return newInvalidSnapshotError(entry.Key, fmt.Errorf("invalid version %q", entry.Version))
+		}
+		putOp := internal.DataLogOp{
+			Type:    internal.DataLogOpPut,
+			Key:     entry.Key,
+			Version: entry.Version,
+			Value:   string(entry.Value),
+		}
+		if entry.ExpireTime != nil {
+			putOp.ExpireTime = *entry.ExpireTime
+			if !putOp.ExpireTime.After(now) {
+				continue
+			}
+		}
+		restoredKeys[entry.Key] = struct{}{}
+		if currentEntry, _ := ls.log.GetEntry(entry.Key, now); currentEntry.Version == entry.Version {
+			continue
+		}
+		// Values are restored in batches, each of which is a record.
+		ops = append(ops, putOp)
+		if len(ops) >= restoreBatchSize {
+			if err := ls.appendRecord(dataLogFile, ops); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	if mode == RestoreModeReplace {
+		for _, key := range ls.log.Keys() {
+			if _, ok := restoredKeys[key]; ok {
+				continue
+			}
+			if _, ok := ls.log.GetEntry(key, now); ok {
+				ops = append(ops, internal.DataLogOp{Type: internal.DataLogOpDelete, Key: key})
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return ls.appendRecord(dataLogFile, ops)
+}
+
+const restoreBatchSize = 1000
+
+func (ls *logStorage) ListVersions(context.Context, string) ([]VersionInfo, error) {
+	return nil, ErrUnsupported
+}
+
+func (ls *logStorage) GetValueAt(context.Context, string, versionedkv.Version) (string, bool, error) {
+	return "", false, ErrUnsupported
+}
+
+func (ls *logStorage) RollbackValue(context.Context, string, versionedkv.Version, versionedkv.Version) (versionedkv.Version, error) {
+	return nil, ErrUnsupported
+}
+
+func (ls *logStorage) Changes(ctx context.Context, sinceRevision int64) (*ChangeStream, error) {
+	return ls.fss.Changes(ctx, sinceRevision)
+}
+
+func (ls *logStorage) GrantLease(context.Context, time.Duration) (*Lease, error) {
+	return nil, ErrUnsupported
+}
+
+// startOperation starts an operation as fsStorage.startOperation does, and returns the
+// storage to perform the operation with as well.
+func (ls *logStorage) startOperation(ctx context.Context, kind Operation, key string) (*operation, *logStorage) {
+	op := ls.fss.startOperation(ctx, kind, key)
+	return op, &logStorage{
+		fss: op.FSS,
+		log: ls.log,
+	}
+}
+
+// write locks the data log exclusively, and then appends a record of the ops returned by
+// the given function, which is called with the index up to date, unless there are no
+// ops. The ops appended are returned, with versions of puts made.
+func (ls *logStorage) write(makeOps func(now time.Time) ([]internal.DataLogOp, error)) ([]internal.DataLogOp, error) {
+	if ls.fss.eventBus.IsClosed() {
+		return nil, versionedkv.ErrStorageClosed
+	}
+	dataLogFile, err := ls.lockDataLog(os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	defer dataLogFile.Close()
+	ops, err := makeOps(time.Now())
+	if err != nil || len(ops) == 0 {
+		return nil, err
+	}
+	if err := ls.appendRecord(dataLogFile, ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// appendRecord journals the changes made by the given ops, appends a record of the ops to
+// the given data log, which should be locked exclusively, and then applies the record to
+// the index. Versions of puts are made of the revision allocated, unless given.
+func (ls *logStorage) appendRecord(dataLogFile internal.File, ops []internal.DataLogOp) error {
+	fss := ls.fss
+	changes := make([]changeRecord, len(ops))
+	var maxRevision int64
+	for i, op := range ops {
+		if op.Type == internal.DataLogOpDelete {
+			changes[i] = changeRecord{Type: ChangeDelete, Key: op.Key}
+			continue
+		}
+		changes[i] = changeRecord{Type: ChangePut, Key: op.Key, Version: op.Version}
+		if revision, _, _ := splitVersion(op.Version); revision > maxRevision {
+			maxRevision = revision
+		}
+	}
+	// Revisions allocated afterwards are greater than the ones of versions given, e.g.
+	// restored from snapshots.
+	if maxRevision >= 1 {
+		if err := fss.advanceRevision(maxRevision); err != nil {
+			return err
+		}
+	}
+	if _, err := fss.allocateRevision(changes); err != nil {
+		return err
+	}
+	for i := range ops {
+		ops[i].Version = changes[i].Version
+	}
+	record := internal.AppendDataLogRecord(nil, ops)
+	if err := ls.writeRecord(dataLogFile, record); err != nil {
+		ls.revertRecord(dataLogFile, ops)
+		return err
+	}
+	return ls.log.ApplyRecord(record, true)
+}
+
+func (ls *logStorage) writeRecord(dataLogFile internal.File, record []byte) error {
+	if _, err := dataLogFile.Seek(ls.log.End(), io.SeekStart); err != nil {
+		return err
+	}
+	// If the record is written partially, it's truncated by the next write.
+	if _, err := dataLogFile.Write(record); err != nil {
+		return err
+	}
+	if ls.fss.options.Durability == DurabilityFull {
+		return dataLogFile.Sync()
+	}
+	return nil
+}
+
+// revertRecord truncates the record of the given ops from the given data log, after
+// writing the record failed, and then journals changes setting the values back, as
+// revertChange does for LayoutFiles. Failures are logged only, as the failure writing
+// the record is returned.
+func (ls *logStorage) revertRecord(dataLogFile internal.File, ops []internal.DataLogOp) {
+	fss := ls.fss
+	// The record may have been written fully, e.g. only syncing failed, in which case
+	// it would take effect unless truncated.
+	if err := dataLogFile.Truncate(ls.log.End()); err != nil {
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelError,
+			Message: "failed to truncate data log to revert changes journaled",
+			Path:    dataLogFile.Name(),
+			Err:     err,
+		})
+		return
+	}
+	now := time.Now()
+	reverts := make([]changeRecord, len(ops))
+	for i, op := range ops {
+		entry, _ := ls.log.GetEntry(op.Key, now)
+		reverts[i] = makeRevertChange(op.Key, entry.Version)
+	}
+	fss.revertChanges(reverts)
+}
+
+// lockDataLog opens and locks the data log, shared if it's opened read-only, or
+// exclusively otherwise, and then brings the index up to date with it.
+func (ls *logStorage) lockDataLog(flag int) (internal.File, error) {
+	dataLogFile, err := ls.openDataLog(flag)
+	if err != nil {
+		return nil, err
+	}
+	size, err := ls.log.Sync(ls.fss.fs, dataLogFile)
+	if err != nil {
+		dataLogFile.Close()
+		if err == internal.ErrInvalidDataLog {
+			err = newCorruptionError("", fmt.Errorf("%v: %v", err, dataLogFile.Name()))
+		}
+		return nil, err
+	}
+	if end := ls.log.End(); flag&(os.O_WRONLY|os.O_RDWR) != 0 && size > end {
+		// A record was being appended when a crash happened, or appending failed.
+		ls.fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelWarn,
+			Message: "truncating torn record of data log",
+			Path:    dataLogFile.Name(),
+		})
+		if err := dataLogFile.Truncate(end); err != nil {
+			dataLogFile.Close()
+			return nil, err
+		}
+	}
+	return dataLogFile, nil
+}
+
+func (ls *logStorage) openDataLog(flag int) (internal.File, error) {
+	fss := ls.fss
+	dataLogFileName := ls.dataLogFileName()
+	for {
+		dataLogFile, err := fss.fs.OpenLockedFile(dataLogFileName, flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		// The data log may have been replaced by compaction while waiting for the lock,
+		// in which case the data log should be reopened.
+		ok, err := fss.isLinked(dataLogFile, dataLogFileName)
+		if err != nil {
+			dataLogFile.Close()
+			return nil, err
+		}
+		if ok {
+			return dataLogFile, nil
+		}
+		dataLogFile.Close()
+	}
+}
+
+// forEachValue calls the given callback for each value with the given prefix in
+// ascending order of keys, with the data log locked shared.
+func (ls *logStorage) forEachValue(ctx context.Context, prefix string, callback func(key string, value string, entry dataLogEntry) error) error {
+	dataLogFile, err := ls.lockDataLog(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer dataLogFile.Close()
+	now := time.Now()
+	for _, key := range ls.log.Keys() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry, ok := ls.log.GetEntry(key, now)
+		if !ok {
+			continue
+		}
+		value, err := readDataLogValue(dataLogFile, entry)
+		if err != nil {
+			return wrapError(key, err)
+		}
+		if err := callback(key, value, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refresh brings the index up to date with the data log, so that changes made by other
+// processes are notified.
+func (ls *logStorage) refresh() error {
+	dataLogFile, err := ls.lockDataLog(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	return dataLogFile.Close()
+}
+
+func (ls *logStorage) dataLogFileName() string {
+	return filepath.Join(ls.fss.options.BaseDirName, dataLogBaseName)
+}
+
+const dataLogBaseName = "data.log"
+
+// newPutOp makes an op putting the given value, whose version is made once a revision is
+// allocated for the op by appendRecord.
+func newPutOp(key string, value string, now time.Time, ttl time.Duration) internal.DataLogOp {
+	op := internal.DataLogOp{
+		Type:  internal.DataLogOpPut,
+		Key:   key,
+		Value: value,
+	}
+	if ttl >= 1 {
+		op.ExpireTime = now.Add(ttl)
+	}
+	return op
+}
+
+// readDataLogValue reads the value for the given entry from the given data log.
+func readDataLogValue(dataLogFile internal.File, entry dataLogEntry) (string, error) {
+	if _, err := dataLogFile.Seek(entry.ValueOffset, io.SeekStart); err != nil {
+		return "", err
+	}
+	value := make([]byte, entry.ValueSize)
+	if _, err := io.ReadFull(dataLogFile, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// Events are named after keys in hex, so that they are valid base names of files as the
+// event bus expects, with a prefix so that the empty key has a name as well.
+const keyEventNamePrefix = "k"
+
+func keyEventName(key string) string {
+	return keyEventNamePrefix + hex.EncodeToString([]byte(key))
+}
+
+func parseKeyEventName(eventName string) (string, error) {
+	if !strings.HasPrefix(eventName, keyEventNamePrefix) {
+		return "", internal.ErrInvalidFileName
+	}
+	rawKey, err := hex.DecodeString(eventName[len(keyEventNamePrefix):])
+	if err != nil {
+		return "", internal.ErrInvalidFileName
+	}
+	return string(rawKey), nil
+}
+
+// dataLog is the index of values in the data log, shared by operations. Whenever the
+// data log is locked, the index is brought up to date with it: records appended since
+// are applied, and if the data log has been replaced by compaction, it's re-indexed.
+type dataLog struct {
+	mu          sync.Mutex
+	fileInfo    os.FileInfo
+	end         int64
+	entries     map[string]dataLogEntry
+	garbageSize int64
+
+	// revision is the latest revision allocated.
+	revision int64
+
+	// eventNames are names of events pending for the log watcher, for values changed.
+	eventNames []string
+	newEvents  chan struct{}
+}
+
+// dataLogEntry represents the current version of a value in the data log.
+type dataLogEntry struct {
+	Version     string
+	ExpireTime  time.Time
+	ValueOffset int64
+	ValueSize   int
+
+	// Size is the number of bytes the op putting the value takes in the data log.
+	Size int
+}
+
+// IsExpired returns whether the version has expired by the given time.
+func (dle dataLogEntry) IsExpired(now time.Time) bool {
+	return !dle.ExpireTime.IsZero() && !now.Before(dle.ExpireTime)
+}
+
+func (dl *dataLog) Init() *dataLog {
+	dl.entries = make(map[string]dataLogEntry)
+	dl.newEvents = make(chan struct{}, 1)
+	return dl
+}
+
+// Sync brings the index up to date with the given data log, which should be locked, and
+// returns the size of the data log. The index may end before the data log, if a record
+// at the end is torn.
+func (dl *dataLog) Sync(fs internal.FS, dataLogFile internal.File) (int64, error) {
+	fileInfo, err := dataLogFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.fileInfo != nil && fs.SameFile(dl.fileInfo, fileInfo) {
+		if fileInfo.Size() == dl.end {
+			return fileInfo.Size(), nil
+		}
+		return fileInfo.Size(), dl.readRecords(dataLogFile, true)
+	}
+	// The data log is new or has been replaced, re-index it from the start.
+	newLog := new(dataLog).Init()
+	newLog.fileInfo = fileInfo
+	if _, err := dataLogFile.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := internal.NewDataLogReader(dataLogFile, 0)
+	if err := reader.ReadHeader(); err != nil {
+		return 0, err
+	}
+	newLog.end = reader.Offset()
+	if err := newLog.readRecordsFrom(reader, false); err != nil {
+		return 0, err
+	}
+	dl.replace(newLog)
+	return fileInfo.Size(), nil
+}
+
+func (dl *dataLog) readRecords(dataLogFile internal.File, fireEvents bool) error {
+	if _, err := dataLogFile.Seek(dl.end, io.SeekStart); err != nil {
+		return err
+	}
+	return dl.readRecordsFrom(internal.NewDataLogReader(dataLogFile, dl.end), fireEvents)
+}
+
+func (dl *dataLog) readRecordsFrom(reader *internal.DataLogReader, fireEvents bool) error {
+	for {
+		ops, err := reader.Next()
+		if err != nil {
+			if err == io.EOF || err == internal.ErrTornDataLogRecord {
+				return nil
+			}
+			return err
+		}
+		dl.applyOps(ops, fireEvents)
+		dl.end = reader.Offset()
+	}
+}
+
+// ApplyRecord applies the given record, which has been appended to the data log at the
+// end of the index.
+func (dl *dataLog) ApplyRecord(record []byte, fireEvents bool) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	reader := internal.NewDataLogReader(bytes.NewReader(record), dl.end)
+	ops, err := reader.Next()
+	if err != nil {
+		return err
+	}
+	dl.applyOps(ops, fireEvents)
+	dl.end = reader.Offset()
+	return nil
+}
+
+func (dl *dataLog) applyOps(ops []internal.DataLogOp, fireEvents bool) {
+	for _, op := range ops {
+		if op.Type == internal.DataLogOpRevision {
+			if op.Revision > dl.revision {
+				dl.revision = op.Revision
+			}
+			continue
+		}
+		if entry, ok := dl.entries[op.Key]; ok {
+			dl.garbageSize += int64(entry.Size)
+		}
+		switch op.Type {
+		case internal.DataLogOpPut:
+			if revision, _, _ := splitVersion(op.Version); revision > dl.revision {
+				dl.revision = revision
+			}
+			dl.entries[op.Key] = dataLogEntry{
+				Version:     op.Version,
+				ExpireTime:  op.ExpireTime,
+				ValueOffset: op.ValueOffset,
+				ValueSize:   len(op.Value),
+				Size:        op.Size,
+			}
+		case internal.DataLogOpDelete:
+			delete(dl.entries, op.Key)
+			dl.garbageSize += int64(op.Size)
+		}
+		if fireEvents {
+			dl.addEvent(op.Key)
+		}
+	}
+}
+
+// Replace replaces the index with the given one, of the data log replacing the current
+// one.
+func (dl *dataLog) Replace(newLog *dataLog) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.replace(newLog)
+}
+
+func (dl *dataLog) replace(newLog *dataLog) {
+	if dl.fileInfo != nil {
+		// Values may have been changed by other processes before the data log was
+		// replaced.
+		for key, entry := range dl.entries {
+			if newEntry, ok := newLog.entries[key]; !ok || newEntry.Version != entry.Version {
+				dl.addEvent(key)
+			}
+		}
+		for key := range newLog.entries {
+			if _, ok := dl.entries[key]; !ok {
+				dl.addEvent(key)
+			}
+		}
+	}
+	dl.fileInfo = newLog.fileInfo
+	dl.end = newLog.end
+	dl.entries = newLog.entries
+	dl.garbageSize = newLog.garbageSize
+	dl.revision = newLog.revision
+}
+
+func (dl *dataLog) addEvent(key string) {
+	dl.eventNames = append(dl.eventNames, keyEventName(key))
+	select {
+	case dl.newEvents <- struct{}{}:
+	default:
+	}
+}
+
+// TakeEventNames takes the names of events pending.
+func (dl *dataLog) TakeEventNames() []string {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	eventNames := dl.eventNames
+	dl.eventNames = nil
+	return eventNames
+}
+
+// GetEntry returns the entry for the given key, unless it doesn't exist or has expired by
+// the given time (if the time isn't zero).
+func (dl *dataLog) GetEntry(key string, now time.Time) (dataLogEntry, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	entry, ok := dl.entries[key]
+	if !ok || (!now.IsZero() && entry.IsExpired(now)) {
+		return dataLogEntry{}, false
+	}
+	return entry, true
+}
+
+// Keys returns the keys of values in ascending order.
+func (dl *dataLog) Keys() []string {
+	dl.mu.Lock()
+	keys := make([]string, 0, len(dl.entries))
+	for key := range dl.entries {
+		keys = append(keys, key)
+	}
+	dl.mu.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// End returns the offset up to which the data log has been indexed.
+func (dl *dataLog) End() int64 {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.end
+}
+
+// NextRevision returns the revision to allocate next, which is only allocated once a
+// record carrying it is appended, so the data log should be locked exclusively.
+func (dl *dataLog) NextRevision() int64 {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.revision + 1
+}
+
+// GarbageSize returns the number of bytes taken by records superseded or deleted, along
+// with the size of the data log.
+func (dl *dataLog) GarbageSize() (int64, int64) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.garbageSize, dl.end
+}
+
+// logWatcher is the file watcher for the event bus of a storage with LayoutLog, which
+// fires events for values changed, as the index is brought up to date with the data log.
+// It brings the index up to date when the data log is found changed, by the given file
+// watcher, or by polling at Options.PollInterval, depending on Options.WatchMode.
+type logWatcher struct {
+	ls          *logStorage
+	fileWatcher internal.FileWatcher
+	events      chan fsnotify.Event
+	errors      chan error
+	closure     chan struct{}
+	wg          sync.WaitGroup
+}
+
+var _ internal.FileWatcher = (*logWatcher)(nil)
+
+func (ls *logStorage) newLogWatcher(newFileWatcher func() (internal.FileWatcher, error)) (internal.FileWatcher, error) {
+	lw := logWatcher{
+		ls:      ls,
+		events:  make(chan fsnotify.Event),
+		errors:  make(chan error),
+		closure: make(chan struct{}),
+	}
+	if ls.fss.options.WatchMode != WatchModePoll {
+		fileWatcher, err := newFileWatcher()
+		if err != nil {
+			return nil, err
+		}
+		lw.fileWatcher = fileWatcher
+	}
+	lw.wg.Add(1)
+	go lw.run()
+	return &lw, nil
+}
+
+func (lw *logWatcher) Add(dirName string) error {
+	if lw.fileWatcher == nil {
+		return nil
+	}
+	return lw.fileWatcher.Add(dirName)
+}
+
+func (lw *logWatcher) Events() <-chan fsnotify.Event { return lw.events }
+func (lw *logWatcher) Errors() <-chan error          { return lw.errors }
+
+func (lw *logWatcher) Close() error {
+	close(lw.closure)
+	var err error
+	if lw.fileWatcher != nil {
+		err = lw.fileWatcher.Close()
+	}
+	lw.wg.Wait()
+	return err
+}
+
+func (lw *logWatcher) run() {
+	defer func() {
+		close(lw.events)
+		close(lw.errors)
+		lw.wg.Done()
+	}()
+	var fileEvents <-chan fsnotify.Event
+	var fileErrors <-chan error
+	if lw.fileWatcher != nil {
+		fileEvents, fileErrors = lw.fileWatcher.Events(), lw.fileWatcher.Errors()
+	}
+	var polls <-chan time.Time
+	if options := lw.ls.fss.options; options.WatchMode != WatchModeNotify {
+		ticker := time.NewTicker(options.PollInterval)
+		defer ticker.Stop()
+		polls = ticker.C
+	}
+	for {
+		var err error
+		select {
+		case event, ok := <-fileEvents:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != dataLogBaseName || event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			err = lw.ls.refresh()
+		case fileErr, ok := <-fileErrors:
+			if !ok {
+				return
+			}
+			err = fileErr
+		case <-polls:
+			err = lw.ls.refresh()
+		case <-lw.ls.log.newEvents:
+			for _, eventName := range lw.ls.log.TakeEventNames() {
+				select {
+				case lw.events <- fsnotify.Event{Name: eventName, Op: fsnotify.Write}:
+				case <-lw.closure:
+					return
+				}
+			}
+		case <-lw.closure:
+			return
+		}
+		if err != nil {
+			select {
+			case lw.errors <- err:
+			case <-lw.closure:
+				return
+			}
+		}
+	}
+}
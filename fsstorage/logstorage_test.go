@@ -0,0 +1,298 @@
+package fsstorage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStorage(t *testing.T) {
+	t.Run("OSFS", func(t *testing.T) {
+		t.Parallel()
+		versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+			return makeStorageWithOptions(Options{Layout: LayoutLog})
+		})
+	})
+	t.Run("MemFS", func(t *testing.T) {
+		t.Parallel()
+		versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+			return OpenWithFS(Options{Layout: LayoutLog}, internal.NewMemFS())
+		})
+	})
+	t.Run("WatchModePoll", func(t *testing.T) {
+		t.Parallel()
+		versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+			return makeStorageWithOptions(Options{
+				Layout:       LayoutLog,
+				WatchMode:    WatchModePoll,
+				PollInterval: 10 * time.Millisecond,
+			})
+		})
+	})
+}
+
+func TestLogStorage_MultipleProcesses(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	options := Options{BaseDirName: baseDirName, Layout: LayoutLog}
+	s1, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx := context.Background()
+
+	version, err := s1.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	value, version2, err := s2.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+
+	// Changes made by the other storage are notified.
+	ctx2, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		value, _, err := s2.WaitForValue(ctx2, "foo", version)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "baz", value)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, err = s1.UpdateValue(ctx, "foo", "baz", version)
+	assert.NoError(t, err)
+	<-done
+
+	// Compaction by the other storage replaces the data log, which is re-indexed.
+	for i := 0; i < 10; i++ {
+		_, err := s1.CreateOrUpdateValue(ctx, "qux", "quux", nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	ok, err := s1.DeleteValue(ctx, "qux", nil)
+	if assert.NoError(t, err) {
+		assert.True(t, ok)
+	}
+	fileInfo, err := os.Stat(filepath.Join(baseDirName, "data.log"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = s2.Compact(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	fileInfo2, err := os.Stat(filepath.Join(baseDirName, "data.log"))
+	if assert.NoError(t, err) {
+		assert.Less(t, fileInfo2.Size(), fileInfo.Size())
+	}
+	value, _, err = s1.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "baz", value)
+	}
+	_, version, err = s1.GetValue(ctx, "qux")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version)
+	}
+	_, err = s1.CreateValue(ctx, "corge", "grault")
+	assert.NoError(t, err)
+	value, _, err = s2.GetValue(ctx, "corge")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "grault", value)
+	}
+}
+
+func TestLogStorage_TornRecord(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	options := Options{BaseDirName: baseDirName, Layout: LayoutLog}
+	s, err := Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+
+	// Simulate a crash while appending a record.
+	dataLogFileName := filepath.Join(baseDirName, "data.log")
+	file, err := os.OpenFile(dataLogFileName, os.O_WRONLY|os.O_APPEND, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = file.Write([]byte{100, 0, 0, 0, 1, 2, 3})
+	file.Close()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	s, err = Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	value, version2, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+	// The torn record is truncated by the next write.
+	version, err = s.UpdateValue(ctx, "foo", "baz", version)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+	s, err = Open(options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	value, version2, err = s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "baz", value)
+		assert.Equal(t, version, version2)
+	}
+}
+
+func TestLogStorage_LayoutMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+	_, err = Open(Options{BaseDirName: baseDirName, Layout: LayoutLog})
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+
+	baseDirName = makeBaseDir(t)
+	s, err = Open(Options{BaseDirName: baseDirName, Layout: LayoutLog})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+	_, err = Open(Options{BaseDirName: baseDirName})
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+	_, err = Check(ctx, Options{BaseDirName: baseDirName}, false)
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+	err = Reshard(ctx, Options{BaseDirName: baseDirName, ShardDepth: 1})
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+}
+
+func TestLogStorage_Unsupported(t *testing.T) {
+	s, err := makeStorageWithOptions(Options{Layout: LayoutLog, HistoryLimit: 10})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = s.ListVersions(ctx, "foo")
+	assert.Equal(t, ErrUnsupported, err)
+	_, _, err = s.GetValueAt(ctx, "foo", version)
+	assert.Equal(t, ErrUnsupported, err)
+	_, err = s.RollbackValue(ctx, "foo", version, nil)
+	assert.Equal(t, ErrUnsupported, err)
+	_, err = s.GrantLease(ctx, time.Minute)
+	assert.Equal(t, ErrUnsupported, err)
+}
+
+func TestLogStorage_Features(t *testing.T) {
+	s, err := makeStorageWithOptions(Options{Layout: LayoutLog})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := s.Watch(ctx, "a/")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ok, newVersions, err := s.CommitTxn(ctx, Txn{
+		Puts: []TxnPut{{Key: "a/1", Value: "x"}, {Key: "a/2", Value: "y"}, {Key: "b", Value: "z"}},
+	})
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Len(t, newVersions, 3)
+	}
+	keys := make(map[string]struct{})
+	for len(keys) < 2 {
+		event := <-events
+		assert.NotEqual(t, WatchEventGap, event.Type)
+		keys[event.Key] = struct{}{}
+	}
+	assert.Equal(t, map[string]struct{}{"a/1": {}, "a/2": {}}, keys)
+
+	ok, _, err = s.CommitTxn(ctx, Txn{
+		Conditions: []TxnCondition{{Key: "a/1", Version: nil}},
+		Deletes:    []string{"a/1"},
+	})
+	if assert.NoError(t, err) {
+		assert.False(t, ok)
+	}
+
+	_, err = s.CreateValueWithTTL(ctx, "c", "expiring", 50*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	keyList, _, err := s.ListKeys(ctx, "", "", 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a/1", "a/2", "b", "c"}, keyList)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, version, err := s.GetValue(ctx, "c")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version)
+	}
+
+	var snapshot bytes.Buffer
+	err = s.Snapshot(ctx, &snapshot)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s2, err := makeStorageWithOptions(Options{Layout: LayoutLog})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	_, err = s2.CreateValue(ctx, "d", "removed")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = s2.Restore(ctx, &snapshot, RestoreModeReplace)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	details, err := s.Inspect(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	details2, err := s2.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, details, details2)
+	}
+}
@@ -0,0 +1,158 @@
+package fsstorage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Observer observes operations of storages and changes detected, e.g. for collecting
+// metrics. Package metrics provides an implementation.
+//
+// Methods are called synchronously, possibly concurrently, and shouldn't block.
+type Observer interface {
+	// OperationDone is called when an operation is done, with the outcome and the time
+	// taken.
+	OperationDone(operation Operation, outcome Outcome, duration time.Duration)
+
+	// WatchersChanged is called when watchers are added or removed, with the change in
+	// the number of watchers. Watchers are added by WaitForValue calls waiting for
+	// changes and by Watch calls.
+	WatchersChanged(delta int)
+
+	// EventFired is called when a change to a value is detected.
+	EventFired()
+
+	// WatchErrorOccurred is called with errors occurred when watching for changes, as
+	// Options.WatchErrorHandler is.
+	WatchErrorOccurred(err error)
+}
+
+// Operation represents the kind of an operation observed.
+type Operation int
+
+const (
+	// OperationGetValue is Storage.GetValue.
+	OperationGetValue Operation = iota + 1
+
+	// OperationWaitForValue is Storage.WaitForValue.
+	OperationWaitForValue
+
+	// OperationCreateValue is Storage.CreateValue or Storage.CreateValueWithTTL.
+	OperationCreateValue
+
+	// OperationUpdateValue is Storage.UpdateValue or Storage.UpdateValueWithTTL.
+	OperationUpdateValue
+
+	// OperationCreateOrUpdateValue is Storage.CreateOrUpdateValue or
+	// Storage.CreateOrUpdateValueWithTTL.
+	OperationCreateOrUpdateValue
+
+	// OperationDeleteValue is Storage.DeleteValue.
+	OperationDeleteValue
+)
+
+// Operations are all the kinds of operations observed.
+var Operations = []Operation{
+	OperationGetValue,
+	OperationWaitForValue,
+	OperationCreateValue,
+	OperationUpdateValue,
+	OperationCreateOrUpdateValue,
+	OperationDeleteValue,
+}
+
+// String returns a textual representation of the operation.
+func (o Operation) String() string {
+	switch o {
+	case OperationGetValue:
+		return "GetValue"
+	case OperationWaitForValue:
+		return "WaitForValue"
+	case OperationCreateValue:
+		return "CreateValue"
+	case OperationUpdateValue:
+		return "UpdateValue"
+	case OperationCreateOrUpdateValue:
+		return "CreateOrUpdateValue"
+	case OperationDeleteValue:
+		return "DeleteValue"
+	default:
+		return fmt.Sprintf("Operation(%d)", int(o))
+	}
+}
+
+// Outcome represents the outcome of an operation.
+type Outcome int
+
+const (
+	// OutcomeHit means the value was read or written.
+	OutcomeHit Outcome = iota + 1
+
+	// OutcomeMiss means the value didn't exist, for reads, or for writes not conditioned
+	// on a version.
+	OutcomeMiss
+
+	// OutcomeConflict means a write was conditioned on a version (or the absence of the
+	// value for CreateValue), and the condition wasn't met.
+	OutcomeConflict
+
+	// OutcomeError means the operation failed, including the context being done.
+	OutcomeError
+)
+
+// Outcomes are all the outcomes of operations.
+var Outcomes = []Outcome{
+	OutcomeHit,
+	OutcomeMiss,
+	OutcomeConflict,
+	OutcomeError,
+}
+
+// String returns a textual representation of the outcome.
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeHit:
+		return "hit"
+	case OutcomeMiss:
+		return "miss"
+	case OutcomeConflict:
+		return "conflict"
+	case OutcomeError:
+		return "error"
+	default:
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+}
+
+type nopObserver struct{}
+
+func (nopObserver) OperationDone(Operation, Outcome, time.Duration) {}
+func (nopObserver) WatchersChanged(int)                             {}
+func (nopObserver) EventFired()                                     {}
+func (nopObserver) WatchErrorOccurred(error)                        {}
+
+// readOutcome returns the outcome of a read, which has resulted in the given version.
+func readOutcome(version string, err error) Outcome {
+	if err != nil {
+		return OutcomeError
+	}
+	if version == "" {
+		return OutcomeMiss
+	}
+	return OutcomeHit
+}
+
+// writeOutcome returns the outcome of a write, which has succeeded if ok is true. A
+// write is conditional if it's conditioned on a version (or the absence of the value).
+func writeOutcome(ok bool, isConditional bool, err error) Outcome {
+	if err != nil {
+		return OutcomeError
+	}
+	if ok {
+		return OutcomeHit
+	}
+	if isConditional {
+		return OutcomeConflict
+	}
+	return OutcomeMiss
+}
@@ -0,0 +1,126 @@
+package fsstorage_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Observer(t *testing.T) {
+	var o testObserver
+	s, err := makeStorageWithOptions(Options{Observer: &o})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	_, _, err = s.GetValue(ctx, "foo")
+	assert.NoError(t, err)
+	version, err := s.CreateValue(ctx, "foo", "1")
+	assert.NoError(t, err)
+	_, err = s.CreateValue(ctx, "foo", "1")
+	assert.NoError(t, err)
+	_, _, err = s.GetValue(ctx, "foo")
+	assert.NoError(t, err)
+	version, err = s.UpdateValue(ctx, "foo", "2", version)
+	assert.NoError(t, err)
+	_, err = s.UpdateValue(ctx, "bar", "2", nil)
+	assert.NoError(t, err)
+	_, err = s.CreateOrUpdateValueWithTTL(ctx, "foo", "3", "bad", time.Hour)
+	assert.NoError(t, err)
+	_, err = s.DeleteValue(ctx, "foo", "bad")
+	assert.NoError(t, err)
+	_, err = s.DeleteValue(ctx, "foo", version)
+	assert.NoError(t, err)
+	ctx2, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = s.WaitForValue(ctx2, "foo", nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []testOperation{
+		{OperationGetValue, OutcomeMiss},
+		{OperationCreateValue, OutcomeHit},
+		{OperationCreateValue, OutcomeConflict},
+		{OperationGetValue, OutcomeHit},
+		{OperationUpdateValue, OutcomeHit},
+		{OperationUpdateValue, OutcomeMiss},
+		{OperationCreateOrUpdateValue, OutcomeConflict},
+		{OperationDeleteValue, OutcomeConflict},
+		{OperationDeleteValue, OutcomeHit},
+		{OperationWaitForValue, OutcomeError},
+	}, o.Operations())
+
+	// Watchers are counted while waiting, and changes detected wake them up.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, err := s.WaitForValue(ctx, "foo", nil)
+		assert.NoError(t, err)
+	}()
+	for o.WatcherCount() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = s.CreateValue(ctx, "foo", "1")
+	assert.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	assert.Equal(t, 0, o.WatcherCount())
+	assert.GreaterOrEqual(t, o.EventCount(), 1)
+}
+
+type testOperation struct {
+	Operation Operation
+	Outcome   Outcome
+}
+
+type testObserver struct {
+	mu           sync.Mutex
+	operations   []testOperation
+	watcherCount int
+	eventCount   int
+}
+
+func (to *testObserver) OperationDone(operation Operation, outcome Outcome, _ time.Duration) {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	to.operations = append(to.operations, testOperation{operation, outcome})
+}
+
+func (to *testObserver) WatchersChanged(delta int) {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	to.watcherCount += delta
+}
+
+func (to *testObserver) EventFired() {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	to.eventCount++
+}
+
+func (to *testObserver) WatchErrorOccurred(error) {}
+
+func (to *testObserver) Operations() []testOperation {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	return append([]testOperation(nil), to.operations...)
+}
+
+func (to *testObserver) WatcherCount() int {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	return to.watcherCount
+}
+
+func (to *testObserver) EventCount() int {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	return to.eventCount
+}
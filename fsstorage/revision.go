@@ -0,0 +1,185 @@
+package fsstorage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/rs/xid"
+)
+
+// Revision returns the revision of the given version returned by a storage. Revisions
+// are store-wide numbers, which increase with each write, deletions included, so that
+// versions can be ordered across keys: a version with a greater revision was put later.
+// Changes made by a transaction share a revision.
+//
+// If the version carries no revision, e.g. it was put before revisions were introduced,
+// false is returned.
+func Revision(version versionedkv.Version) (int64, bool) {
+	rawVersion, ok := version.(string)
+	if !ok {
+		return 0, false
+	}
+	revision, _, ok := splitVersion(rawVersion)
+	if !ok || revision == 0 {
+		return 0, false
+	}
+	return revision, true
+}
+
+// A version is the revision in hex (16 digits, so that versions sort by revision)
+// followed by a dash and an xid, which keeps versions unique should revisions repeat,
+// e.g. after the revision counter has been lost. Versions put before revisions were
+// introduced are xids alone.
+
+const revisionDigits = 16
+
+func makeVersion(revision int64) string {
+	return fmt.Sprintf("%0*x-%s", revisionDigits, revision, xid.New().String())
+}
+
+// splitVersion splits the given version into the revision, which is 0 if the version
+// carries none, and the xid.
+func splitVersion(version string) (int64, xid.ID, bool) {
+	var revision int64
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		if i != revisionDigits {
+			return 0, xid.ID{}, false
+		}
+		var err error
+		revision, err = strconv.ParseInt(version[:i], 16, 64)
+		if err != nil || revision < 1 || version[:i] != fmt.Sprintf("%0*x", revisionDigits, revision) {
+			return 0, xid.ID{}, false
+		}
+		version = version[i+1:]
+	}
+	id, err := xid.FromString(version)
+	if err != nil {
+		return 0, xid.ID{}, false
+	}
+	return revision, id, true
+}
+
+// allocateRevision increments the revision counter, and records the given changes in the
+// change journal at the new revision. Versions of puts are made of the revision, unless
+// given. The counter is locked exclusively meanwhile, so that revisions are allocated
+// one at a time across processes, and changes are journaled in order of revisions.
+//
+// Changes are journaled before they are applied, as versions are made of revisions.
+// Callers failing to apply the changes should revert them with revertChange.
+func (fss *fsStorage) allocateRevision(changes []changeRecord) (int64, error) {
+	revisionFile, currentRevision, err := fss.lockRevision()
+	if err != nil {
+		return 0, err
+	}
+	defer revisionFile.Close()
+	revision := currentRevision + 1
+	// The counter is updated first, so that the revision is never allocated again once
+	// the changes are journaled.
+	if err := fss.writeRevision(revisionFile, revision); err != nil {
+		return 0, err
+	}
+	for i := range changes {
+		change := &changes[i]
+		change.Revision = revision
+		if change.Type == ChangePut && change.Version == "" {
+			change.Version = makeVersion(revision)
+		}
+	}
+	if err := fss.appendChanges(changes); err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+// advanceRevision advances the revision counter to the given revision, unless it's
+// there already, so that revisions allocated afterwards are greater, e.g. than the ones
+// of versions restored.
+func (fss *fsStorage) advanceRevision(revision int64) error {
+	revisionFile, currentRevision, err := fss.lockRevision()
+	if err != nil {
+		return err
+	}
+	defer revisionFile.Close()
+	if currentRevision >= revision {
+		return nil
+	}
+	// Revisions skipped have no changes, which shouldn't be taken as truncated.
+	if err := fss.startChangeJournal(currentRevision + 1); err != nil {
+		return err
+	}
+	return fss.writeRevision(revisionFile, revision)
+}
+
+// lockRevision opens and locks the revision counter exclusively, and reads it.
+func (fss *fsStorage) lockRevision() (internal.File, int64, error) {
+	revisionFile, err := fss.fs.OpenLockedFile(fss.revisionFileName(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, err := readRevisionFile(revisionFile)
+	if err != nil {
+		revisionFile.Close()
+		return nil, 0, err
+	}
+	return revisionFile, revision, nil
+}
+
+func (fss *fsStorage) writeRevision(revisionFile internal.File, revision int64) error {
+	if _, err := revisionFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	rawRevision := strconv.FormatInt(revision, 10) + "\n"
+	if _, err := io.WriteString(revisionFile, rawRevision); err != nil {
+		return err
+	}
+	if err := revisionFile.Truncate(int64(len(rawRevision))); err != nil {
+		return err
+	}
+	// The counter is flushed before any file carrying the revision, otherwise revisions
+	// might be allocated again after a crash.
+	if fss.options.Durability == DurabilityNone {
+		return nil
+	}
+	return revisionFile.Sync()
+}
+
+// readRevision reads the revision counter, which is 0 if no revision has been allocated.
+func (fss *fsStorage) readRevision() (int64, error) {
+	revisionFile, err := fss.fs.OpenLockedFile(fss.revisionFileName(), os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer revisionFile.Close()
+	return readRevisionFile(revisionFile)
+}
+
+func readRevisionFile(revisionFile io.Reader) (int64, error) {
+	rawRevision, err := ioutil.ReadAll(revisionFile)
+	if err != nil {
+		return 0, err
+	}
+	if len(rawRevision) == 0 {
+		return 0, nil
+	}
+	revision, err := strconv.ParseInt(strings.TrimSpace(string(rawRevision)), 10, 64)
+	if err != nil || revision < 0 {
+		return 0, newCorruptionError("", fmt.Errorf("malformed revision %q", rawRevision))
+	}
+	return revision, nil
+}
+
+const revisionBaseName = "revision"
+
+func (fss *fsStorage) revisionFileName() string {
+	return filepath.Join(fss.options.BaseDirName, revisionBaseName)
+}
@@ -0,0 +1,183 @@
+package fsstorage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevision(t *testing.T) {
+	for _, layout := range []Layout{LayoutFiles, LayoutLog} {
+		layout := layout
+		t.Run(layout.String(), func(t *testing.T) {
+			t.Parallel()
+			baseDirName := makeBaseDir(t)
+			options := Options{BaseDirName: baseDirName, Layout: layout}
+			s1, err := Open(options)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer s1.Close()
+			s2, err := Open(options)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer s2.Close()
+			ctx := context.Background()
+
+			// Revisions increase across keys and storages.
+			var lastRevision int64
+			for i := 0; i < 6; i++ {
+				s := s1
+				if i%2 == 1 {
+					s = s2
+				}
+				version, err := s.CreateValue(ctx, fmt.Sprintf("key%d", i), "value")
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				revision, ok := Revision(version)
+				if assert.True(t, ok) {
+					assert.Greater(t, revision, lastRevision)
+					lastRevision = revision
+				}
+			}
+
+			// Values put by a transaction share a revision.
+			ok, newVersions, err := s1.CommitTxn(ctx, Txn{
+				Puts: []TxnPut{{Key: "key0", Value: "x"}, {Key: "key9", Value: "y"}},
+			})
+			if assert.NoError(t, err) && assert.True(t, ok) {
+				revision1, ok1 := Revision(newVersions[0])
+				revision2, ok2 := Revision(newVersions[1])
+				if assert.True(t, ok1) && assert.True(t, ok2) {
+					assert.Greater(t, revision1, lastRevision)
+					assert.Equal(t, revision1, revision2)
+					lastRevision = revision1
+				}
+			}
+
+			// Revisions don't go backwards once the values at them are gone.
+			_, err = s2.DeleteValue(ctx, "key9", nil)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			_, err = s2.DeleteValue(ctx, "key0", nil)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			err = s2.Compact(ctx)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			version, err := s1.CreateValue(ctx, "key0", "z")
+			if assert.NoError(t, err) {
+				revision, ok := Revision(version)
+				if assert.True(t, ok) {
+					assert.Greater(t, revision, lastRevision)
+				}
+			}
+		})
+	}
+}
+
+func TestRevision_Legacy(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// Versions put before revisions were introduced are xids alone, which stay valid.
+	legacyVersion := xid.New().String()
+	revisionVersion := fmt.Sprintf("%016x-%s", 1000, xid.New().String())
+	snapshot := `{"format":"versionedkv-fs-snapshot/1"}` + "\n" +
+		fmt.Sprintf(`{"key":"foo","value":"YmFy","version":%q}`, legacyVersion) + "\n" +
+		fmt.Sprintf(`{"key":"qux","value":"YmFy","version":%q}`, revisionVersion) + "\n"
+	err = s.Restore(ctx, strings.NewReader(snapshot), RestoreModeMerge)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	value, version, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, legacyVersion, version)
+		_, ok := Revision(version)
+		assert.False(t, ok)
+	}
+	newVersion, err := s.UpdateValue(ctx, "foo", "baz", version)
+	if assert.NoError(t, err) {
+		// Restoring advances the revision counter past revisions restored.
+		revision, ok := Revision(newVersion)
+		if assert.True(t, ok) {
+			assert.Greater(t, revision, int64(1000))
+		}
+	}
+
+	for _, version := range []versionedkv.Version{
+		nil,
+		"",
+		"foo",
+		"0000000000000001",
+		"1-" + legacyVersion,
+		fmt.Sprintf("%016X-%s", 10, legacyVersion),
+		fmt.Sprintf("%016x-%s", 0, legacyVersion),
+		fmt.Sprintf("%016x-", 1),
+	} {
+		_, ok := Revision(version)
+		assert.False(t, ok, "version: %q", version)
+	}
+}
+
+func TestCheck_StaleRevision(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+
+	// Simulate the loss of the revision counter.
+	err = os.Remove(filepath.Join(baseDirName, "revision"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	problems, err := Check(ctx, Options{BaseDirName: baseDirName}, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Problem{
+			{Kind: ProblemStaleRevision, FileName: "revision", Repaired: true},
+		}, problems)
+	}
+	problems, err = Check(ctx, Options{BaseDirName: baseDirName}, false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, problems)
+	}
+
+	s, err = Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	newVersion, err := s.UpdateValue(ctx, "foo", "baz", version)
+	if assert.NoError(t, err) {
+		revision, _ := Revision(version)
+		newRevision, ok := Revision(newVersion)
+		if assert.True(t, ok) {
+			assert.Greater(t, newRevision, revision)
+		}
+	}
+}
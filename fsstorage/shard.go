@@ -0,0 +1,307 @@
+package fsstorage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// MaxShardDepth is the maximum of Options.ShardDepth.
+const MaxShardDepth = internal.MaxShardDepth
+
+// Reshard migrates the storage in the base directory given in options to the shard depth
+// given in options, e.g. from the flat layout (shard depth 0), by moving version files
+// and value files into their shard directories. Storages must be opened with the new
+// shard depth afterwards.
+//
+// Reshard should be called while the storage isn't open in any process. It blocks writes
+// during the migration, but storages opened with the old shard depth fail to find values
+// afterwards. If Reshard is interrupted, e.g. by a crash, storages refuse to open until
+// Reshard is called again and completes. Only storages with LayoutFiles can be resharded.
+func Reshard(ctx context.Context, options Options) error {
+	return doReshard(ctx, options, internal.OSFS)
+}
+
+func doReshard(ctx context.Context, options Options, fs internal.FS) error {
+	options.sanitize()
+	if err := checkShardDepth(options.ShardDepth); err != nil {
+		return err
+	}
+	if err := checkLayout(fs, options.BaseDirName, LayoutFiles); err != nil {
+		return err
+	}
+	dirNames, err := createDirs(fs, options.BaseDirName)
+	if err != nil {
+		return err
+	}
+	r := resharder{
+		fss: &fsStorage{
+			options:  options,
+			fs:       fs,
+			dirNames: dirNames,
+		},
+		touchedDirNames: make(map[string]struct{}),
+	}
+	return r.Run(ctx)
+}
+
+type resharder struct {
+	fss             *fsStorage
+	touchedDirNames map[string]struct{}
+}
+
+func (r *resharder) Run(ctx context.Context) error {
+	fss := r.fss
+	storeLockFile, err := fss.lockStore(os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer storeLockFile.Close()
+	// The marker stays until all files are in place, so that storages refuse to open
+	// a storage resharded partially.
+	if err := fss.writeFileAtomically(fss.reshardingFileName(), nil, true); err != nil {
+		return err
+	}
+	if err := fss.createShardDirs(); err != nil {
+		return err
+	}
+	if err := r.moveFiles(ctx, fss.dirNames.Versions, 0, r.moveVersionFile); err != nil {
+		return err
+	}
+	if err := r.moveFiles(ctx, fss.dirNames.Values, 0, r.moveValueFile); err != nil {
+		return err
+	}
+	for dirName := range r.touchedDirNames {
+		if err := fss.syncDir(dirName); err != nil {
+			return err
+		}
+	}
+	if err := fss.writeShardDepth(); err != nil {
+		return err
+	}
+	if err := fss.fs.Remove(fss.reshardingFileName()); err != nil {
+		return err
+	}
+	return fss.syncDir(fss.options.BaseDirName)
+}
+
+// moveFiles moves files in the given directory, which is at the given level below the
+// sharded directory, and in its subdirectories which can be shard directories of any
+// depth, with the given function. Shard directories not used at the new shard depth are
+// removed once emptied.
+func (r *resharder) moveFiles(ctx context.Context, dirName string, level int, move func(dirName string, baseName string) error) error {
+	return r.fss.forEachFile(ctx, dirName, func(fileInfo os.FileInfo) error {
+		baseName := fileInfo.Name()
+		if !fileInfo.IsDir() {
+			return move(dirName, baseName)
+		}
+		if level == MaxShardDepth || !internal.IsShardBaseName(baseName) {
+			return nil
+		}
+		subdirName := filepath.Join(dirName, baseName)
+		if err := r.moveFiles(ctx, subdirName, level+1, move); err != nil {
+			return err
+		}
+		if level+1 > r.fss.options.ShardDepth {
+			// Directories not empty, e.g. containing unexpected files, are left as is.
+			if err := r.fss.fs.Remove(subdirName); err == nil {
+				delete(r.touchedDirNames, subdirName)
+				r.touchedDirNames[dirName] = struct{}{}
+			}
+		}
+		return nil
+	})
+}
+
+func (r *resharder) moveVersionFile(dirName string, baseName string) error {
+	if !isValidFileName(baseName) {
+		return nil
+	}
+	return r.moveFile(filepath.Join(dirName, baseName), r.fss.versionFileName(baseName))
+}
+
+func (r *resharder) moveValueFile(dirName string, baseName string) error {
+	if _, ok := parseTempFileName(baseName); ok {
+		// As writes are blocked, temporary files must have been left over by crashes.
+		return ignoreNotExist(r.fss.fs.Remove(filepath.Join(dirName, baseName)))
+	}
+	fileName, version, ok := parseValueFileName(baseName)
+	if !ok {
+		return nil
+	}
+	return r.moveFile(filepath.Join(dirName, baseName), r.fss.valueFileName(fileName, version))
+}
+
+func (r *resharder) moveFile(oldFileName string, newFileName string) error {
+	if oldFileName == newFileName {
+		return nil
+	}
+	if err := r.fss.fs.Rename(oldFileName, newFileName); err != nil {
+		return err
+	}
+	r.touchedDirNames[filepath.Dir(oldFileName)] = struct{}{}
+	r.touchedDirNames[filepath.Dir(newFileName)] = struct{}{}
+	return nil
+}
+
+// openShards checks the shard depth of the storage against the one given in options. A
+// new storage is set up with the shard depth given in options.
+func (fss *fsStorage) openShards() error {
+	if fss.options.ShardDepth >= 0 {
+		if err := checkShardDepth(fss.options.ShardDepth); err != nil {
+			return err
+		}
+	}
+	if err := fss.checkResharding(); err != nil {
+		return err
+	}
+	shardDepth, err := readShardDepth(fss.fs, fss.options.BaseDirName)
+	if err != nil {
+		return err
+	}
+	if fss.options.ShardDepth < 0 {
+		fss.options.ShardDepth = shardDepth
+	}
+	if shardDepth == fss.options.ShardDepth {
+		return nil
+	}
+	if shardDepth == 0 {
+		// Storages with the flat layout have no shard depth recorded, as before sharding
+		// was introduced, so they may be new storages as well.
+		storeLockFile, err := fss.lockStore(os.O_RDWR)
+		if err != nil {
+			return err
+		}
+		defer storeLockFile.Close()
+		// Another process may have set the storage up meanwhile.
+		shardDepth, err = readShardDepth(fss.fs, fss.options.BaseDirName)
+		if err != nil {
+			return err
+		}
+		if shardDepth == fss.options.ShardDepth {
+			return nil
+		}
+		ok, err := fss.isFlatLayoutEmpty()
+		if err != nil {
+			return err
+		}
+		if ok && shardDepth == 0 {
+			if err := fss.createShardDirs(); err != nil {
+				return err
+			}
+			return fss.writeShardDepth()
+		}
+	}
+	return fmt.Errorf("%w: storage has shard depth %d but %d is given; call Reshard to migrate",
+		ErrLayoutMismatch, shardDepth, fss.options.ShardDepth)
+}
+
+// checkResharding fails if resharding has been interrupted, in which case files may lie
+// outside of their shard directories.
+func (fss *fsStorage) checkResharding() error {
+	if _, err := fss.fs.Stat(fss.reshardingFileName()); err != nil {
+		return ignoreNotExist(err)
+	}
+	return fmt.Errorf("%w: resharding interrupted; call Reshard to complete it", ErrLayoutMismatch)
+}
+
+func checkShardDepth(shardDepth int) error {
+	if shardDepth < 0 || shardDepth > MaxShardDepth {
+		return fmt.Errorf("fsstorage: shard depth %d out of range [0, %d]", shardDepth, MaxShardDepth)
+	}
+	return nil
+}
+
+// isFlatLayoutEmpty returns whether the directories of version files and value files
+// have no entries, i.e. no value has ever been written with the flat layout.
+func (fss *fsStorage) isFlatLayoutEmpty() (bool, error) {
+	for _, dirName := range []string{fss.dirNames.Versions, fss.dirNames.Values} {
+		dir, err := fss.fs.OpenFile(dirName, os.O_RDONLY, 0)
+		if err != nil {
+			return false, err
+		}
+		fileInfos, err := dir.Readdir(1)
+		dir.Close()
+		if len(fileInfos) >= 1 {
+			return false, nil
+		}
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (fss *fsStorage) createShardDirs() error {
+	for _, shardDirName := range internal.ShardDirNames(fss.options.ShardDepth) {
+		for _, dirName := range []string{fss.dirNames.Versions, fss.dirNames.Values} {
+			if err := fss.fs.MkdirAll(filepath.Join(dirName, shardDirName), os.ModePerm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readShardDepth reads the shard depth recorded in the given base directory, which is
+// 0 if none is recorded.
+func readShardDepth(fs internal.FS, baseDirName string) (int, error) {
+	rawShardDepth, err := internal.ReadFile(fs, filepath.Join(baseDirName, shardsBaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	shardDepth, err := strconv.Atoi(strings.TrimSpace(string(rawShardDepth)))
+	if err != nil || checkShardDepth(shardDepth) != nil {
+		return 0, fmt.Errorf("%w: malformed shard depth %q", ErrCorrupted, rawShardDepth)
+	}
+	return shardDepth, nil
+}
+
+// writeShardDepth records the shard depth given in options. For the flat layout, the
+// record is removed instead, so that versions without sharding can open the storage.
+func (fss *fsStorage) writeShardDepth() error {
+	shardsFileName := filepath.Join(fss.options.BaseDirName, shardsBaseName)
+	if fss.options.ShardDepth == 0 {
+		return ignoreNotExist(fss.fs.Remove(shardsFileName))
+	}
+	return fss.writeFileAtomically(shardsFileName, []byte(strconv.Itoa(fss.options.ShardDepth)+"\n"), true)
+}
+
+const (
+	shardsBaseName     = "shards"
+	reshardingBaseName = "resharding"
+)
+
+func (fss *fsStorage) reshardingFileName() string {
+	return filepath.Join(fss.options.BaseDirName, reshardingBaseName)
+}
+
+// forEachShardedFile calls the given callback for each file in the shard directories of
+// the given directory, which is either the directory of version files or the directory
+// of value files.
+func (fss *fsStorage) forEachShardedFile(ctx context.Context, dirName string, callback func(os.FileInfo) error) error {
+	for _, shardDirName := range internal.ShardDirNames(fss.options.ShardDepth) {
+		if err := fss.forEachFile(ctx, filepath.Join(dirName, shardDirName), callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardDirNames returns the names of the shard directories of the given directory.
+func (fss *fsStorage) shardDirNames(dirName string) []string {
+	shardDirNames := internal.ShardDirNames(fss.options.ShardDepth)
+	for i, shardDirName := range shardDirNames {
+		shardDirNames[i] = filepath.Join(dirName, shardDirName)
+	}
+	return shardDirNames
+}
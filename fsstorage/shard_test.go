@@ -0,0 +1,189 @@
+package fsstorage_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_ShardDepth(t *testing.T) {
+	t.Run("ShardDepth1", func(t *testing.T) {
+		t.Parallel()
+		versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+			return makeStorageWithOptions(Options{ShardDepth: 1})
+		})
+	})
+	t.Run("ShardDepth2", func(t *testing.T) {
+		t.Parallel()
+		versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+			return OpenWithFS(Options{ShardDepth: 2}, internal.NewMemFS())
+		})
+	})
+}
+
+func TestReshard(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	keys := []string{"foo", "bar", "baz", strings.Repeat("x", 200)}
+	versions := make(map[string]versionedkv.Version, len(keys))
+	for _, key := range keys {
+		version, err := s.CreateValue(ctx, key, key+"-value")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		versions[key] = version
+	}
+	s.Close()
+
+	assertValues := func(t *testing.T, shardDepth int) {
+		t.Helper()
+		s, err := Open(Options{BaseDirName: baseDirName, ShardDepth: shardDepth})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer s.Close()
+		for _, key := range keys {
+			value, version, err := s.GetValue(ctx, key)
+			if assert.NoError(t, err) {
+				assert.Equal(t, key+"-value", value)
+				assert.Equal(t, versions[key], version)
+			}
+			fileName := internal.EncodeKey(key)
+			shardDirName := internal.ShardDirName(fileName, shardDepth)
+			_, err = os.Stat(filepath.Join(baseDirName, "versions", shardDirName, fileName))
+			assert.NoError(t, err)
+			_, err = os.Stat(filepath.Join(baseDirName, "values", shardDirName, fileName+"."+versions[key].(string)))
+			assert.NoError(t, err)
+		}
+		problems, err := Check(ctx, Options{BaseDirName: baseDirName}, false)
+		if assert.NoError(t, err) {
+			assert.Empty(t, problems)
+		}
+	}
+
+	// Storages refuse to open with a shard depth other than the one they have.
+	_, err = Open(Options{BaseDirName: baseDirName, ShardDepth: 1})
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+
+	err = Reshard(ctx, Options{BaseDirName: baseDirName, ShardDepth: 2})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assertValues(t, 2)
+	_, err = Open(Options{BaseDirName: baseDirName})
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+	s, err = Open(Options{BaseDirName: baseDirName, ShardDepth: -1})
+	if assert.NoError(t, err) {
+		_, version, err := s.GetValue(ctx, "foo")
+		assert.NoError(t, err)
+		assert.Equal(t, versions["foo"], version)
+		s.Close()
+	}
+
+	err = Reshard(ctx, Options{BaseDirName: baseDirName, ShardDepth: 1})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assertValues(t, 1)
+
+	// Shard directories are removed when going back to the flat layout.
+	err = Reshard(ctx, Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assertValues(t, 0)
+	for _, dirName := range []string{"versions", "values"} {
+		fileInfos, err := ioutil.ReadDir(filepath.Join(baseDirName, dirName))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		for _, fileInfo := range fileInfos {
+			assert.False(t, fileInfo.IsDir(), "file name: %q", fileInfo.Name())
+		}
+	}
+	_, err = os.Stat(filepath.Join(baseDirName, "shards"))
+	assert.True(t, os.IsNotExist(err), "err: %v", err)
+}
+
+func TestReshard_Interrupted(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName, ShardDepth: 1})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+
+	// Simulate a crash while resharding to the flat layout, after the version file has
+	// been moved.
+	fileName := internal.EncodeKey("foo")
+	shardDirName := internal.ShardDirName(fileName, 1)
+	err = os.Rename(
+		filepath.Join(baseDirName, "versions", shardDirName, fileName),
+		filepath.Join(baseDirName, "versions", fileName),
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = ioutil.WriteFile(filepath.Join(baseDirName, "resharding"), nil, 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, err = Open(Options{BaseDirName: baseDirName, ShardDepth: 1})
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+	_, err = Check(ctx, Options{BaseDirName: baseDirName}, true)
+	assert.True(t, errors.Is(err, ErrLayoutMismatch), "err: %v", err)
+	err = os.Remove(filepath.Join(baseDirName, "resharding"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	problems, err := Check(ctx, Options{BaseDirName: baseDirName}, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Problem{
+			{Kind: ProblemOrphanValue, FileName: filepath.Join("values", shardDirName, fileName+"."+version.(string)), Key: "foo"},
+			{Kind: ProblemMisplacedFile, FileName: filepath.Join("versions", fileName), Key: "foo"},
+		}, problems)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(baseDirName, "resharding"), nil, 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = Reshard(ctx, Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s, err = Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	value, version2, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+}
+
+func TestOpen_InvalidShardDepth(t *testing.T) {
+	_, err := makeStorageWithOptions(Options{ShardDepth: MaxShardDepth + 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+//go:build go1.21
+// +build go1.21
+
+package fsstorage
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogLogger creates a logger which logs entries to the given log/slog logger, at the
+// corresponding levels and with fields as the "key", "version", "path" and "error"
+// attributes, which are omitted if empty.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (sl slogLogger) Log(entry LogEntry) {
+	level := slog.Level(entry.Level)
+	ctx := context.Background()
+	if !sl.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 4)
+	if entry.Key != "" {
+		attrs = append(attrs, slog.String("key", entry.Key))
+	}
+	if entry.Version != "" {
+		attrs = append(attrs, slog.String("version", entry.Version))
+	}
+	if entry.Path != "" {
+		attrs = append(attrs, slog.String("path", entry.Path))
+	}
+	if entry.Err != nil {
+		attrs = append(attrs, slog.Any("error", entry.Err))
+	}
+	sl.logger.LogAttrs(ctx, level, entry.Message, attrs...)
+}
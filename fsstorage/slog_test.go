@@ -0,0 +1,50 @@
+//go:build go1.21
+// +build go1.21
+
+package fsstorage_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	handler := slog.NewTextHandler(&buffer, &slog.HandlerOptions{
+		Level: slog.LevelWarn,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	})
+	logger := NewSlogLogger(slog.New(handler))
+	logger.Log(LogEntry{
+		Level:   LogLevelDebug,
+		Message: "filtered out",
+		Path:    "versionedkv/versions/foo",
+	})
+	logger.Log(LogEntry{
+		Level:   LogLevelWarn,
+		Message: "failed to remove value file",
+		Key:     "foo",
+		Version: "c5u0d5s9g5l9q8e1n0dg",
+		Path:    "versionedkv/values/foo/c5u0d5s9g5l9q8e1n0dg",
+		Err:     errors.New("injected"),
+	})
+	logger.Log(LogEntry{
+		Level:   LogLevelError,
+		Message: "failed to compact storage",
+		Path:    "versionedkv",
+		Err:     errors.New("injected"),
+	})
+	assert.Equal(t, `level=WARN msg="failed to remove value file" key=foo version=c5u0d5s9g5l9q8e1n0dg path=versionedkv/values/foo/c5u0d5s9g5l9q8e1n0dg error=injected
+level=ERROR msg="failed to compact storage" path=versionedkv error=injected
+`, buffer.String())
+}
@@ -0,0 +1,234 @@
+package fsstorage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// RestoreMode represents the way values are restored from a snapshot.
+type RestoreMode int
+
+const (
+	// RestoreModeMerge restores values in the snapshot, overwriting the current ones,
+	// and keeps values not in the snapshot.
+	RestoreModeMerge RestoreMode = iota
+
+	// RestoreModeReplace restores values in the snapshot, overwriting the current ones,
+	// and deletes values not in the snapshot, so that the storage ends up with exactly
+	// the values in the snapshot.
+	RestoreModeReplace
+)
+
+// A snapshot is a stream of JSON values, one per line, which starts with a header,
+// followed by the values in the snapshot.
+
+const snapshotFormat = "versionedkv-fs-snapshot/1"
+
+type snapshotHeader struct {
+	Format string    `json:"format"`
+	Time   time.Time `json:"time"`
+}
+
+type snapshotEntry struct {
+	Key        string     `json:"key"`
+	Value      []byte     `json:"value"`
+	Version    string     `json:"version"`
+	ExpireTime *time.Time `json:"expire_time,omitempty"`
+}
+
+func (fss *fsStorage) Snapshot(ctx context.Context, writer io.Writer) error {
+	return wrapError("", fss.doSnapshot(ctx, writer))
+}
+
+func (fss *fsStorage) doSnapshot(ctx context.Context, writer io.Writer) error {
+	if fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	// Writes are blocked until the snapshot is taken, so that the snapshot is
+	// consistent.
+	storeLockFile, err := fss.lockStore(os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer storeLockFile.Close()
+	bufferedWriter := bufio.NewWriter(writer)
+	encoder := json.NewEncoder(bufferedWriter)
+	now := time.Now()
+	if err := encoder.Encode(snapshotHeader{
+		Format: snapshotFormat,
+		Time:   now,
+	}); err != nil {
+		return err
+	}
+	if err := fss.forEachShardedFile(ctx, fss.dirNames.Versions, func(fileInfo os.FileInfo) error {
+		entry, ok, err := fss.readSnapshotEntry(fileInfo.Name(), now)
+		if err != nil || !ok {
+			return err
+		}
+		return encoder.Encode(entry)
+	}); err != nil {
+		return err
+	}
+	return bufferedWriter.Flush()
+}
+
+// readSnapshotEntry reads the value for the given file name for snapshots. Deleted and
+// expired values, and values attached to leases, are skipped.
+func (fss *fsStorage) readSnapshotEntry(fileName string, now time.Time) (snapshotEntry, bool, error) {
+	key, err := fss.decodeFileName(fileName)
+	if err != nil {
+		return snapshotEntry{}, false, nil
+	}
+	versionFile, record, err := fss.openAndReadVersionRecord(key, fileName, os.O_RDONLY)
+	if err != nil {
+		return snapshotEntry{}, false, ignoreNotExist(err)
+	}
+	defer versionFile.Close()
+	if record.Version == "" || record.IsExpired(now) || record.LeaseID != "" {
+		return snapshotEntry{}, false, nil
+	}
+	value, err := internal.ReadFile(fss.fs, fss.valueFileName(fileName, record.Version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snapshotEntry{}, false, newCorruptionError(key, err)
+		}
+		return snapshotEntry{}, false, err
+	}
+	entry := snapshotEntry{
+		Key:     key,
+		Value:   value,
+		Version: record.Version,
+	}
+	if !record.ExpireTime.IsZero() {
+		expireTime := record.ExpireTime
+		entry.ExpireTime = &expireTime
+	}
+	return entry, true, nil
+}
+
+func (fss *fsStorage) Restore(ctx context.Context, reader io.Reader, mode RestoreMode) error {
+	return wrapError("", fss.doRestore(ctx, reader, mode))
+}
+
+func (fss *fsStorage) doRestore(ctx context.Context, reader io.Reader, mode RestoreMode) error {
+	if fss.eventBus.IsClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	decoder := json.NewDecoder(reader)
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return newInvalidSnapshotError("", err)
+	}
+	if header.Format != snapshotFormat {
+		return newInvalidSnapshotError("", fmt.Errorf("unknown format %q", header.Format))
+	}
+	// Other writes are blocked until restoring is done, so that they don't interleave.
+	storeLockFile, err := fss.lockStore(os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer storeLockFile.Close()
+	now := time.Now()
+	restoredFileNames := make(map[string]struct{})
+	var maxRevision int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var entry snapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return newInvalidSnapshotError("", err)
+		}
+		if !isValidVersion(entry.Version) {
+			return newInvalidSnapshotError(entry.Key, fmt.Errorf("invalid version %q", entry.Version))
+		}
+		record := versionRecord{Version: entry.Version}
+		if entry.ExpireTime != nil {
+			record.ExpireTime = *entry.ExpireTime
+			if record.IsExpired(now) {
+				continue
+			}
+		}
+		// The revision counter is advanced before the value is restored, so that
+		// revisions allocated afterwards are greater, even if restoring fails midway.
+		if revision, _, _ := splitVersion(entry.Version); revision > maxRevision {
+			if err := fss.advanceRevision(revision); err != nil {
+				return err
+			}
+			maxRevision = revision
+		}
+		fileName := internal.EncodeKey(entry.Key)
+		if err := fss.restoreValue(entry.Key, fileName, string(entry.Value), record); err != nil {
+			return wrapError(entry.Key, err)
+		}
+		restoredFileNames[fileName] = struct{}{}
+	}
+	if mode != RestoreModeReplace {
+		return nil
+	}
+	return fss.forEachShardedFile(ctx, fss.dirNames.Versions, func(fileInfo os.FileInfo) error {
+		fileName := fileInfo.Name()
+		if _, ok := restoredFileNames[fileName]; ok || fileInfo.Size() == 0 {
+			return nil
+		}
+		key, err := fss.decodeFileName(fileName)
+		if err != nil {
+			return nil
+		}
+		_, err = fss.deleteValue(key, "")
+		return wrapError(key, err)
+	})
+}
+
+// restoreValue sets the value for the given key to the given version record as the
+// given value, unless the value is at the version already.
+func (fss *fsStorage) restoreValue(key string, fileName string, value string, record versionRecord) error {
+	versionFile, currentVersion, err := fss.openAndReadVersionFile(key, fileName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer versionFile.Close()
+	if err := fss.ensureKeyFile(key, fileName); err != nil {
+		return err
+	}
+	if currentVersion == record.Version {
+		return nil
+	}
+	change := changeRecord{Type: ChangePut, Key: key, Version: record.Version}
+	if _, err := fss.allocateRevision([]changeRecord{change}); err != nil {
+		return err
+	}
+	if err := fss.setValue(fileName, value, record, versionFile, currentVersion == ""); err != nil {
+		fss.revertChange(change, versionFile)
+		return err
+	}
+	if currentVersion != "" {
+		fss.retireValue(fileName, currentVersion)
+	}
+	return nil
+}
+
+// lockStore opens and locks the store lock file. Writes lock it shared (O_RDONLY), and
+// snapshotting and restoring lock it exclusively (O_RDWR), so that they don't interleave
+// with writes.
+func (fss *fsStorage) lockStore(flag int) (internal.File, error) {
+	return fss.fs.OpenLockedFile(fss.storeLockFileName(), flag|os.O_CREATE, 0666)
+}
+
+const storeLockBaseName = "lock"
+
+func (fss *fsStorage) storeLockFileName() string {
+	return filepath.Join(fss.options.BaseDirName, storeLockBaseName)
+}
@@ -0,0 +1,216 @@
+package fsstorage_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Snapshot(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	fooVersion, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	binaryVersion, err := s.CreateValue(ctx, "binary", "\x00\xff")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ttlVersion, err := s.CreateValueWithTTL(ctx, "ttl", "1", time.Hour)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	lease, err := s.GrantLease(ctx, time.Hour)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = lease.CreateValue(ctx, "ephemeral", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var snapshot bytes.Buffer
+	err = s.Snapshot(ctx, &snapshot)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	expectedValues := map[string]versionedkv.ValueDetails{
+		"foo":    {V: "bar", Version: fooVersion},
+		"binary": {V: "\x00\xff", Version: binaryVersion},
+		"ttl":    {V: "1", Version: ttlVersion},
+	}
+
+	for _, mode := range []RestoreMode{RestoreModeMerge, RestoreModeReplace} {
+		s2, err := makeStorage()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer s2.Close()
+		_, err = s2.CreateValue(ctx, "foo", "old")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		otherVersion, err := s2.CreateValue(ctx, "other", "1")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		err = s2.Restore(ctx, bytes.NewReader(snapshot.Bytes()), mode)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		details, err := s2.Inspect(ctx)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if mode == RestoreModeMerge {
+			expectedValues2 := map[string]versionedkv.ValueDetails{"other": {V: "1", Version: otherVersion}}
+			for key, valueDetails := range expectedValues {
+				expectedValues2[key] = valueDetails
+			}
+			assert.Equal(t, expectedValues2, details.Values)
+		} else {
+			assert.Equal(t, expectedValues, details.Values)
+		}
+		// Versions are preserved, so versions held by clients keep working.
+		newVersion, err := s2.UpdateValue(ctx, "foo", "baz", fooVersion)
+		if assert.NoError(t, err) {
+			assert.NotNil(t, newVersion)
+		}
+	}
+}
+
+func TestFSStorage_SnapshotConsistency(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	const n = 50
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%02d", i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Keys are always written in order, which snapshots should reflect.
+		for i := 1; ctx.Err() == nil; i++ {
+			for _, key := range keys {
+				_, err := s.CreateOrUpdateValue(ctx, key, strconv.Itoa(i), nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+		var snapshot bytes.Buffer
+		err := s.Snapshot(ctx, &snapshot)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		values := readSnapshotValues(t, &snapshot)
+		first, _ := strconv.Atoi(values[keys[0]])
+		for _, key := range keys[1:] {
+			value, _ := strconv.Atoi(values[key])
+			if !assert.True(t, value == first || value == first-1, "key: %q, first: %d, value: %d", key, first, value) {
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestFSStorage_RestoreInvalidSnapshot(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	for _, snapshot := range []string{
+		"",
+		`{"format":"foo"}`,
+		`{"format":"versionedkv-fs-snapshot/1"}` + "\n" + `{"key":"foo","version":"bad"}`,
+		`{"format":"versionedkv-fs-snapshot/1"}` + "\n" + `{"key":`,
+	} {
+		err := s.Restore(ctx, strings.NewReader(snapshot), RestoreModeReplace)
+		assert.True(t, errors.Is(err, ErrInvalidSnapshot), "err: %v", err)
+	}
+}
+
+func readSnapshotValues(t *testing.T, snapshot *bytes.Buffer) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(snapshot)
+	for i := 0; scanner.Scan(); i++ {
+		if i == 0 {
+			// Skip the header.
+			continue
+		}
+		var entry struct {
+			Key   string
+			Value []byte
+		}
+		if !assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry)) {
+			t.FailNow()
+		}
+		values[entry.Key] = string(entry.Value)
+	}
+	return values
+}
+
+// assertBlockedBySnapshot asserts that the given write is blocked until the snapshot being
+// taken is written.
+func assertBlockedBySnapshot(t *testing.T, s Storage, write func() error) {
+	bw := blockingWriter{
+		IsBlocked: make(chan struct{}),
+		Unblock:   make(chan struct{}),
+	}
+	snapshotErrs := make(chan error, 1)
+	go func() { snapshotErrs <- s.Snapshot(context.Background(), &bw) }()
+	<-bw.IsBlocked
+	writeErrs := make(chan error, 1)
+	go func() { writeErrs <- write() }()
+	select {
+	case err := <-writeErrs:
+		t.Fatalf("write not blocked; err: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(bw.Unblock)
+	assert.NoError(t, <-snapshotErrs)
+	assert.NoError(t, <-writeErrs)
+}
+
+type blockingWriter struct {
+	IsBlocked chan struct{}
+	Unblock   chan struct{}
+	once      sync.Once
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	bw.once.Do(func() { close(bw.IsBlocked) })
+	<-bw.Unblock
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package fsstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// Tracer starts spans for operations of storages. It's modeled on OpenTelemetry, so that
+// an OpenTelemetry tracer can be adapted with a few lines, e.g.:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (ot otelTracer) StartSpan(ctx context.Context, operation fsstorage.Operation, key string) fsstorage.Span {
+//		_, span := ot.Start(ctx, "fsstorage."+operation.String(),
+//			trace.WithAttributes(attribute.String("versionedkv.key", key)))
+//		return otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) End(info fsstorage.SpanInfo) {
+//		s.SetAttributes(
+//			attribute.String("versionedkv.outcome", info.Outcome.String()),
+//			attribute.Int64("versionedkv.lock_wait_us", info.LockWaitTime.Microseconds()),
+//			attribute.Int64("versionedkv.file_io_us", info.FileIOTime.Microseconds()),
+//		)
+//		if info.Err != nil {
+//			s.RecordError(info.Err)
+//			s.SetStatus(codes.Error, info.Err.Error())
+//		}
+//		s.Span.End()
+//	}
+//
+// Methods are called synchronously, possibly concurrently, and shouldn't block.
+type Tracer interface {
+	// StartSpan starts a span for the given operation on the value for the given key,
+	// as a child of the span carried by the given context if any.
+	StartSpan(ctx context.Context, operation Operation, key string) Span
+}
+
+// Span represents a span of an operation started by a Tracer.
+type Span interface {
+	// End ends the span when the operation is done, with information about the
+	// operation.
+	End(info SpanInfo)
+}
+
+// SpanInfo represents information about an operation traced.
+type SpanInfo struct {
+	// Outcome is the outcome of the operation.
+	Outcome Outcome
+
+	// Err is the error the operation failed with, if any.
+	Err error
+
+	// LockWaitTime is the time spent on opening and locking files, including waiting
+	// for locks held by others, e.g. by other processes.
+	LockWaitTime time.Duration
+
+	// FileIOTime is the time spent on other operations of the file system, e.g.
+	// reading, writing and flushing files.
+	FileIOTime time.Duration
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(SpanInfo) {}
+
+// operation represents an operation in progress, which is reported to the observer and
+// the tracer when it ends.
+type operation struct {
+	// FSS is the storage to perform the operation with, whose file system accounts
+	// time spent on it if the operation is traced.
+	FSS *fsStorage
+
+	kind      Operation
+	startTime time.Time
+	span      Span
+	fsTimes   *internal.FSTimes
+}
+
+// startOperation starts an operation of the given kind on the value for the given key.
+func (fss *fsStorage) startOperation(ctx context.Context, kind Operation, key string) *operation {
+	o := operation{
+		FSS:       fss,
+		kind:      kind,
+		startTime: time.Now(),
+		span:      nopSpan{},
+	}
+	if fss.options.Tracer != nil {
+		o.span = fss.options.Tracer.StartSpan(ctx, kind, key)
+		o.fsTimes = new(internal.FSTimes)
+		tracedFSS := *fss
+		tracedFSS.fs = internal.NewTimingFS(fss.fs, o.fsTimes)
+		o.FSS = &tracedFSS
+	}
+	return &o
+}
+
+// End ends the operation with the given outcome and error.
+func (o *operation) End(outcome Outcome, err error) {
+	o.FSS.options.Observer.OperationDone(o.kind, outcome, time.Since(o.startTime))
+	info := SpanInfo{
+		Outcome: outcome,
+		Err:     err,
+	}
+	if o.fsTimes != nil {
+		info.LockWaitTime = o.fsTimes.LockWaitTime()
+		info.FileIOTime = o.fsTimes.IOTime()
+	}
+	o.span.End(info)
+}
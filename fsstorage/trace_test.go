@@ -0,0 +1,106 @@
+package fsstorage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Tracer(t *testing.T) {
+	var tt testTracer
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	s, err := OpenWithFS(Options{Tracer: &tt}, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.WithValue(context.Background(), testContextKey{}, "parent")
+
+	// Slow locks and writes show up as lock wait time and file I/O time respectively.
+	const delay = 20 * time.Millisecond
+	fs.SetFault(func(op internal.FaultOp, _ string) error {
+		if op == internal.FaultOpLock || op == internal.FaultOpWrite {
+			time.Sleep(delay)
+		}
+		return nil
+	})
+	_, err = s.CreateValue(ctx, "foo", "bar")
+	assert.NoError(t, err)
+	fs.SetFault(nil)
+	_, _, err = s.GetValue(ctx, "baz")
+	assert.NoError(t, err)
+	errInjected := errors.New("injected")
+	fs.SetFault(func(op internal.FaultOp, _ string) error {
+		if op == internal.FaultOpRead {
+			return errInjected
+		}
+		return nil
+	})
+	_, _, err = s.GetValue(ctx, "foo")
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+
+	spans := tt.Spans()
+	if !assert.Len(t, spans, 3) {
+		t.FailNow()
+	}
+	for _, span := range spans {
+		assert.Equal(t, "parent", span.Context.Value(testContextKey{}))
+	}
+	assert.Equal(t, OperationCreateValue, spans[0].Operation)
+	assert.Equal(t, "foo", spans[0].Key)
+	assert.Equal(t, OutcomeHit, spans[0].Info.Outcome)
+	assert.NoError(t, spans[0].Info.Err)
+	assert.GreaterOrEqual(t, int64(spans[0].Info.LockWaitTime), int64(2*delay))
+	assert.GreaterOrEqual(t, int64(spans[0].Info.FileIOTime), int64(2*delay))
+	assert.Equal(t, OperationGetValue, spans[1].Operation)
+	assert.Equal(t, "baz", spans[1].Key)
+	assert.Equal(t, OutcomeMiss, spans[1].Info.Outcome)
+	assert.Equal(t, OperationGetValue, spans[2].Operation)
+	assert.Equal(t, OutcomeError, spans[2].Info.Outcome)
+	assert.True(t, errors.Is(spans[2].Info.Err, ErrIO), "err: %v", spans[2].Info.Err)
+	assert.True(t, errors.Is(spans[2].Info.Err, errInjected), "err: %v", spans[2].Info.Err)
+}
+
+type testContextKey struct{}
+
+type testSpan struct {
+	Context   context.Context
+	Operation Operation
+	Key       string
+	Info      SpanInfo
+
+	tt *testTracer
+}
+
+func (ts *testSpan) End(info SpanInfo) {
+	ts.Info = info
+	ts.tt.mu.Lock()
+	defer ts.tt.mu.Unlock()
+	ts.tt.spans = append(ts.tt.spans, *ts)
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []testSpan
+}
+
+func (tt *testTracer) StartSpan(ctx context.Context, operation Operation, key string) Span {
+	return &testSpan{
+		Context:   ctx,
+		Operation: operation,
+		Key:       key,
+		tt:        tt,
+	}
+}
+
+func (tt *testTracer) Spans() []testSpan {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return append([]testSpan(nil), tt.spans...)
+}
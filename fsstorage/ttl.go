@@ -0,0 +1,179 @@
+package fsstorage
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+func (fss *fsStorage) CreateValueWithTTL(ctx context.Context, key string, value string, ttl time.Duration) (versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationCreateValue, key)
+	version, err := op.FSS.doCreateValue(key, value, valueOptions{TTL: ttl})
+	err = wrapError(key, err)
+	op.End(writeOutcome(version != "", true, err), err)
+	return version2OpaqueVersion(version), err
+}
+
+func (fss *fsStorage) UpdateValueWithTTL(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version, ttl time.Duration) (versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationUpdateValue, key)
+	newVersion, err := op.FSS.doUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion), valueOptions{TTL: ttl})
+	err = wrapError(key, err)
+	op.End(writeOutcome(newVersion != "", opaqueOldVersion != nil, err), err)
+	return version2OpaqueVersion(newVersion), err
+}
+
+func (fss *fsStorage) CreateOrUpdateValueWithTTL(ctx context.Context, key string, value string, opaqueOldVersion versionedkv.Version, ttl time.Duration) (versionedkv.Version, error) {
+	op := fss.startOperation(ctx, OperationCreateOrUpdateValue, key)
+	newVersion, err := op.FSS.doCreateOrUpdateValue(key, value, opaqueVersion2Version(opaqueOldVersion), valueOptions{TTL: ttl})
+	err = wrapError(key, err)
+	op.End(writeOutcome(newVersion != "", opaqueOldVersion != nil, err), err)
+	return version2OpaqueVersion(newVersion), err
+}
+
+func (fss *fsStorage) reapPeriodically() {
+	fss.runPeriodically(fss.options.ReapInterval, func(ctx context.Context) {
+		if err := fss.forEachFile(ctx, fss.dirNames.Leases, fss.reapLeaseFile); err != nil {
+			fss.logBackgroundFailure(ctx, "failed to reap expired leases", fss.dirNames.Leases, err)
+		}
+		if err := fss.forEachShardedFile(ctx, fss.dirNames.Versions, fss.reapVersionFile); err != nil {
+			fss.logBackgroundFailure(ctx, "failed to reap expired values", fss.dirNames.Versions, err)
+		}
+	})
+}
+
+// reapVersionFile deletes the value for the given version file if it has expired.
+func (fss *fsStorage) reapVersionFile(fileInfo os.FileInfo) error {
+	if fileInfo.Size() == 0 || !isValidFileName(fileInfo.Name()) {
+		return nil
+	}
+	// Peek at the version file without locking, as most values don't expire.
+	rawRecord, err := internal.ReadFile(fss.fs, fss.versionFileName(fileInfo.Name()))
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	record, ok := parseVersionRecord(string(rawRecord))
+	if !ok {
+		return nil
+	}
+	expireTime, err := fss.effectiveExpireTime(record)
+	if err != nil || !isExpired(expireTime, time.Now()) {
+		return err
+	}
+	key, err := fss.decodeFileName(fileInfo.Name())
+	if err != nil {
+		return nil
+	}
+	// Opening the version file for writing deletes the expired value, which is a write
+	// as any other.
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer storeLockFile.Close()
+	versionFile, _, err := fss.openAndReadVersionFile(key, fileInfo.Name(), os.O_RDWR)
+	if err != nil {
+		return ignoreCorruption(ignoreNotExist(err))
+	}
+	versionFile.Close()
+	return nil
+}
+
+// versionRecord represents the content of a version file, which is the current version,
+// optionally followed by attributes of the version, one per line, as name=value.
+type versionRecord struct {
+	Version string
+
+	// ExpireTime is the time when the version expires, or the zero time if the version
+	// never expires.
+	ExpireTime time.Time
+
+	// LeaseID is the ID of the lease the version is attached to, if any.
+	LeaseID string
+}
+
+const (
+	expireTimeAttrName = "expires"
+	leaseIDAttrName    = "lease"
+)
+
+func parseVersionRecord(rawRecord string) (versionRecord, bool) {
+	if rawRecord == "" {
+		return versionRecord{}, true
+	}
+	lines := strings.Split(rawRecord, "\n")
+	var record versionRecord
+	record.Version = lines[0]
+	if !isValidVersion(record.Version) {
+		return versionRecord{}, false
+	}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return versionRecord{}, false
+		}
+		name, value := line[:i], line[i+1:]
+		switch name {
+		case expireTimeAttrName:
+			unixNano, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return versionRecord{}, false
+			}
+			record.ExpireTime = time.Unix(0, unixNano)
+		case leaseIDAttrName:
+			record.LeaseID = value
+		default:
+			// Unknown attributes are ignored for forward compatibility.
+		}
+	}
+	return record, true
+}
+
+func (vr versionRecord) String() string {
+	rawRecord := vr.Version
+	if !vr.ExpireTime.IsZero() {
+		rawRecord += "\n" + expireTimeAttrName + "=" + strconv.FormatInt(vr.ExpireTime.UnixNano(), 10)
+	}
+	if vr.LeaseID != "" {
+		rawRecord += "\n" + leaseIDAttrName + "=" + vr.LeaseID
+	}
+	return rawRecord
+}
+
+func (vr versionRecord) IsExpired(now time.Time) bool {
+	return isExpired(vr.ExpireTime, now)
+}
+
+// effectiveExpireTime returns the time when the given version expires, which is the
+// earlier of the expire time of the version and the one of the lease the version is
+// attached to, or the zero time if the version never expires. Versions attached to
+// leases revoked have expired.
+func (fss *fsStorage) effectiveExpireTime(record versionRecord) (time.Time, error) {
+	if record.LeaseID == "" {
+		return record.ExpireTime, nil
+	}
+	// Read the lease file without locking, as the version file may be locked already
+	// and revocation locks files the other way around. Expire times are rewritten in
+	// place at the same length, so they are never read torn.
+	rawLeaseExpireTime, err := internal.ReadFile(fss.fs, fss.leaseFileName(record.LeaseID))
+	if err != nil && !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+	leaseExpireTime, ok := parseLeaseExpireTime(string(rawLeaseExpireTime))
+	if !ok {
+		// The lease has been revoked, or is malformed, which is treated as expired.
+		leaseExpireTime = time.Unix(0, 0)
+	}
+	if record.ExpireTime.IsZero() || leaseExpireTime.Before(record.ExpireTime) {
+		return leaseExpireTime, nil
+	}
+	return record.ExpireTime, nil
+}
+
+func isExpired(expireTime time.Time, now time.Time) bool {
+	return !expireTime.IsZero() && !now.Before(expireTime)
+}
@@ -0,0 +1,145 @@
+package fsstorage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_TTL(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	version, err := s.CreateValueWithTTL(ctx, "foo", "bar", 100*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	value, version2, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+	startTime := time.Now()
+	value, version2, err = s.WaitForValue(ctx, "foo", version)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", value)
+		assert.Nil(t, version2)
+		assert.GreaterOrEqual(t, int64(time.Since(startTime)), int64(50*time.Millisecond))
+	}
+	_, version2, err = s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version2)
+	}
+	details, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Empty(t, details.Values)
+	}
+	version2, err = s.UpdateValue(ctx, "foo", "baz", nil)
+	if assert.NoError(t, err) {
+		assert.Nil(t, version2)
+	}
+	version2, err = s.CreateValue(ctx, "foo", "baz")
+	if assert.NoError(t, err) {
+		assert.NotNil(t, version2)
+	}
+
+	version, err = s.UpdateValueWithTTL(ctx, "foo", "qux", version2, time.Hour)
+	if !assert.NoError(t, err) || !assert.NotNil(t, version) {
+		t.FailNow()
+	}
+	version2, err = s.CreateOrUpdateValueWithTTL(ctx, "foo", "quux", version, 0)
+	if !assert.NoError(t, err) || !assert.NotNil(t, version2) {
+		t.FailNow()
+	}
+	value, _, err = s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "quux", value)
+	}
+}
+
+func TestFSStorage_Reap(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s1, err := Open(Options{
+		BaseDirName:  baseDirName,
+		ReapInterval: 10 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx := context.Background()
+	events, err := s2.Watch(ctx, "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version, err := s1.CreateValueWithTTL(ctx, "foo", "bar", 100*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, expectedEvent := range []WatchEvent{
+		{Type: WatchEventCreate, Key: "foo", NewVersion: version},
+		{Type: WatchEventDelete, Key: "foo", OldVersion: version},
+	} {
+		select {
+		case event := <-events:
+			assert.Equal(t, expectedEvent, event)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	keys, _, err := s2.ListKeys(ctx, "", "", 0)
+	if assert.NoError(t, err) {
+		assert.Empty(t, keys)
+	}
+}
+
+func TestFSStorage_ReapDuringSnapshot(t *testing.T) {
+	s, err := makeStorageWithOptions(Options{ReapInterval: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	events, err := s.Watch(ctx, "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version, err := s.CreateValueWithTTL(ctx, "foo", "bar", 50*time.Millisecond)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, WatchEvent{Type: WatchEventCreate, Key: "foo", NewVersion: version}, <-events)
+
+	// Reaping deletes values, which waits for snapshots to be taken.
+	bw := blockingWriter{
+		IsBlocked: make(chan struct{}),
+		Unblock:   make(chan struct{}),
+	}
+	snapshotErrs := make(chan error, 1)
+	go func() { snapshotErrs <- s.Snapshot(ctx, &bw) }()
+	<-bw.IsBlocked
+	select {
+	case event := <-events:
+		t.Fatalf("value reaped during snapshot; event: %v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(bw.Unblock)
+	assert.NoError(t, <-snapshotErrs)
+	select {
+	case event := <-events:
+		assert.Equal(t, WatchEvent{Type: WatchEventDelete, Key: "foo", OldVersion: version}, event)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+}
@@ -0,0 +1,465 @@
+package fsstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/rs/xid"
+)
+
+// Txn represents a transaction, which puts and deletes values all or nothing if all the
+// conditions are met.
+type Txn struct {
+	Conditions []TxnCondition
+	Puts       []TxnPut
+
+	// Deletes are keys of values to delete. Deleting a value that doesn't exist is
+	// not a failure.
+	Deletes []string
+}
+
+// TxnCondition represents a condition on the current version of a value.
+type TxnCondition struct {
+	Key string
+
+	// Version is the expected current version of the value. If it is nil, the value
+	// is expected not to exist.
+	Version versionedkv.Version
+}
+
+// TxnPut represents creating or updating a value in a transaction.
+type TxnPut struct {
+	Key   string
+	Value string
+}
+
+func (fss *fsStorage) CommitTxn(_ context.Context, txn Txn) (bool, []versionedkv.Version, error) {
+	ok, newVersions, err := fss.doCommitTxn(txn)
+	var newOpaqueVersions []versionedkv.Version
+	if ok {
+		newOpaqueVersions = make([]versionedkv.Version, len(newVersions))
+		for i, newVersion := range newVersions {
+			newOpaqueVersions[i] = version2OpaqueVersion(newVersion)
+		}
+	}
+	return ok, newOpaqueVersions, wrapError("", err)
+}
+
+func (fss *fsStorage) doCommitTxn(txn Txn) (bool, []string, error) {
+	if fss.eventBus.IsClosed() {
+		return false, nil, versionedkv.ErrStorageClosed
+	}
+	txnFiles, err := makeTxnFiles(txn)
+	if err != nil {
+		return false, nil, err
+	}
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return false, nil, err
+	}
+	defer storeLockFile.Close()
+	// Transactions run concurrently with each other, but not with recovery.
+	txnLockFile, err := fss.fs.OpenLockedFile(fss.txnLockFileName(), os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return false, nil, err
+	}
+	defer txnLockFile.Close()
+	if err := fss.lockTxnFiles(txnFiles); err != nil {
+		return false, nil, err
+	}
+	defer unlockTxnFiles(txnFiles)
+	for _, condition := range txn.Conditions {
+		txnFile := txnFiles[internal.EncodeKey(condition.Key)]
+		if txnFile.CurrentRecord.Version != opaqueVersion2Version(condition.Version) {
+			return false, nil, nil
+		}
+	}
+	var journal txnJournal
+	var changes []changeRecord
+	for _, put := range txn.Puts {
+		fileName := internal.EncodeKey(put.Key)
+		journal.Ops = append(journal.Ops, txnOp{
+			Key:        put.Key,
+			Value:      []byte(put.Value),
+			OldVersion: txnFiles[fileName].CurrentRecord.Version,
+		})
+		changes = append(changes, changeRecord{Type: ChangePut, Key: put.Key})
+	}
+	for _, key := range txn.Deletes {
+		fileName := internal.EncodeKey(key)
+		currentVersion := txnFiles[fileName].CurrentRecord.Version
+		if currentVersion == "" {
+			continue
+		}
+		journal.Ops = append(journal.Ops, txnOp{
+			Key:        key,
+			OldVersion: currentVersion,
+		})
+		changes = append(changes, changeRecord{Type: ChangeDelete, Key: key})
+	}
+	if len(journal.Ops) == 0 {
+		return true, nil, nil
+	}
+	// Changes made by the transaction share a revision.
+	revision, err := fss.allocateRevision(changes)
+	if err != nil {
+		return false, nil, err
+	}
+	journal.Revision = revision
+	newVersions := make([]string, len(txn.Puts))
+	for i := range txn.Puts {
+		journal.Ops[i].NewVersion = changes[i].Version
+		newVersions[i] = changes[i].Version
+	}
+	journalFileName, err := fss.commitTxnJournal(journal)
+	if err != nil {
+		// No value has been changed. Should the journal have been written nonetheless,
+		// recovery skips the values reverted.
+		reverts := make([]changeRecord, len(journal.Ops))
+		for i, op := range journal.Ops {
+			reverts[i] = makeRevertChange(op.Key, op.OldVersion)
+		}
+		fss.revertChanges(reverts)
+		return false, nil, err
+	}
+	// Old versions are retired only once all the ops have been applied, so that the ops
+	// applied can be undone should any op fail.
+	for i, op := range journal.Ops {
+		fileName := internal.EncodeKey(op.Key)
+		if err := fss.applyTxnOp(op, txnFiles[fileName].VersionFile); err != nil {
+			fss.undoTxnOps(journal.Ops[:i+1], txnFiles, journalFileName)
+			return false, nil, err
+		}
+	}
+	for _, op := range journal.Ops {
+		if op.OldVersion != "" {
+			fss.retireValue(internal.EncodeKey(op.Key), op.OldVersion)
+		}
+	}
+	// The transaction has been committed by now, so that failures are logged only. The
+	// journal left over is removed by recovery.
+	if err := fss.fs.Remove(journalFileName); err != nil {
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelWarn,
+			Message: "failed to remove transaction journal",
+			Path:    journalFileName,
+			Err:     err,
+		})
+	}
+	return true, newVersions, nil
+}
+
+// commitTxnJournal writes value files put by the given transaction, and then the journal,
+// which is the commit point, and returns the name of the journal file. If a crash happens
+// afterwards, the transaction is rolled forward by recovery.
+func (fss *fsStorage) commitTxnJournal(journal txnJournal) (string, error) {
+	// Value files are written before the journal, so that they are never missing once
+	// the transaction is committed.
+	for _, op := range journal.Ops {
+		if op.NewVersion == "" {
+			continue
+		}
+		valueFileName := fss.valueFileName(internal.EncodeKey(op.Key), op.NewVersion)
+		if err := fss.writeValueFile(valueFileName, string(op.Value)); err != nil {
+			return "", err
+		}
+	}
+	rawJournal, err := json.Marshal(journal)
+	if err != nil {
+		return "", err
+	}
+	journalFileName := fss.journalFileName(xid.New().String())
+	sync := fss.options.Durability != DurabilityNone
+	if err := fss.writeFileAtomically(journalFileName, rawJournal, sync); err != nil {
+		return "", err
+	}
+	return journalFileName, nil
+}
+
+// txnFile represents a version file involved in a transaction.
+type txnFile struct {
+	Key         string
+	Flag        int
+	VersionFile internal.File
+
+	// CurrentRecord is the version record read when locking the version file, which is
+	// the zero value if the value doesn't exist.
+	CurrentRecord versionRecord
+}
+
+// makeTxnFiles returns version files involved in the given transaction, indexed by file
+// names.
+func makeTxnFiles(txn Txn) (map[string]*txnFile, error) {
+	txnFiles := make(map[string]*txnFile)
+	addTxnFile := func(key string, flag int, isWrite bool) error {
+		fileName := internal.EncodeKey(key)
+		file, ok := txnFiles[fileName]
+		if !ok {
+			file = &txnFile{Key: key}
+			txnFiles[fileName] = file
+		} else {
+			if isWrite && file.Flag != os.O_RDONLY {
+				// The key is put or deleted more than once.
+				return ErrInvalidTxn
+			}
+		}
+		file.Flag |= flag
+		return nil
+	}
+	for _, condition := range txn.Conditions {
+		if err := addTxnFile(condition.Key, os.O_RDONLY, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, put := range txn.Puts {
+		if err := addTxnFile(put.Key, os.O_RDWR|os.O_CREATE, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range txn.Deletes {
+		if err := addTxnFile(key, os.O_RDWR, true); err != nil {
+			return nil, err
+		}
+	}
+	return txnFiles, nil
+}
+
+// lockTxnFiles locks the given version files in ascending order of file names, so that
+// transactions involving the same values never deadlock.
+func (fss *fsStorage) lockTxnFiles(txnFiles map[string]*txnFile) error {
+	fileNames := make([]string, 0, len(txnFiles))
+	for fileName := range txnFiles {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		txnFile := txnFiles[fileName]
+		versionFile, currentRecord, err := fss.openAndReadCurrentRecord(txnFile.Key, fileName, txnFile.Flag)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			unlockTxnFiles(txnFiles)
+			return err
+		}
+		txnFile.VersionFile = versionFile
+		txnFile.CurrentRecord = currentRecord
+		if txnFile.Flag&os.O_CREATE != 0 {
+			if err := fss.ensureKeyFile(txnFile.Key, fileName); err != nil {
+				unlockTxnFiles(txnFiles)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unlockTxnFiles(txnFiles map[string]*txnFile) {
+	for _, txnFile := range txnFiles {
+		if txnFile.VersionFile != nil {
+			txnFile.VersionFile.Close()
+			txnFile.VersionFile = nil
+		}
+	}
+}
+
+// txnJournal represents the intent of a committed transaction, which is persisted until
+// the transaction is fully applied.
+type txnJournal struct {
+	// Revision is the revision of the transaction, which is 0 for transactions committed
+	// before revisions were introduced.
+	Revision int64   `json:"revision,omitempty"`
+	Ops      []txnOp `json:"ops"`
+}
+
+// txnOp represents a change of a value in a transaction. If the new version is empty, the
+// value is deleted.
+type txnOp struct {
+	Key        string `json:"key"`
+	Value      []byte `json:"value,omitempty"`
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+}
+
+// applyTxnOp applies the given change to the value for the given version file, which
+// should be locked exclusively and at the old version. The old version is left to be
+// retired.
+func (fss *fsStorage) applyTxnOp(op txnOp, versionFile internal.File) error {
+	if op.NewVersion == "" {
+		return fss.truncateVersionFile(versionFile)
+	}
+	record := versionRecord{Version: op.NewVersion}
+	return fss.writeVersionFile(versionFile, record, op.OldVersion == "")
+}
+
+// undoTxnOps sets the values changed by the given ops back to the records read when
+// locking the version files, which are still locked, so that readers never see a
+// transaction applied partially. The reverts are journaled and then the journal of the
+// transaction is removed. Should any step fail, the journal is left for recovery, which
+// rolls the transaction forward instead. Failures are logged only.
+func (fss *fsStorage) undoTxnOps(ops []txnOp, txnFiles map[string]*txnFile, journalFileName string) {
+	reverts := make([]changeRecord, len(ops))
+	for i, op := range ops {
+		txnFile := txnFiles[internal.EncodeKey(op.Key)]
+		if err := fss.restoreVersionFile(txnFile.VersionFile, txnFile.CurrentRecord); err != nil {
+			fss.options.Logger.Log(LogEntry{
+				Level:   LogLevelError,
+				Message: "failed to undo transaction op; transaction left for recovery",
+				Key:     op.Key,
+				Version: op.OldVersion,
+				Path:    txnFile.VersionFile.Name(),
+				Err:     err,
+			})
+			return
+		}
+		reverts[i] = makeRevertChange(op.Key, op.OldVersion)
+	}
+	if _, err := fss.allocateRevision(reverts); err != nil {
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelError,
+			Message: "failed to revert changes journaled; transaction left for recovery",
+			Path:    journalFileName,
+			Err:     err,
+		})
+		return
+	}
+	if err := fss.fs.Remove(journalFileName); err != nil {
+		fss.options.Logger.Log(LogEntry{
+			Level:   LogLevelWarn,
+			Message: "failed to remove transaction journal",
+			Path:    journalFileName,
+			Err:     err,
+		})
+	}
+}
+
+// restoreVersionFile writes the given version record back to the given version file,
+// which should be locked exclusively, regardless of the position of the version file.
+// If the version record is the zero value, the version file is truncated.
+func (fss *fsStorage) restoreVersionFile(versionFile internal.File, record versionRecord) error {
+	if _, err := versionFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if record.Version == "" {
+		return fss.truncateVersionFile(versionFile)
+	}
+	return fss.writeVersionFile(versionFile, record, false)
+}
+
+// recoverTxns rolls forward transactions which have been committed but not fully applied
+// due to crashes, and removes journals being written by crashes.
+func (fss *fsStorage) recoverTxns(ctx context.Context) error {
+	storeLockFile, err := fss.lockStore(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer storeLockFile.Close()
+	txnLockFile, err := fss.fs.OpenLockedFile(fss.txnLockFileName(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer txnLockFile.Close()
+	// No transaction is in progress as the lock is held exclusively.
+	return fss.forEachFile(ctx, fss.dirNames.Txns, func(fileInfo os.FileInfo) error {
+		baseName := fileInfo.Name()
+		if baseName == txnLockBaseName {
+			return nil
+		}
+		journalFileName := filepath.Join(fss.dirNames.Txns, baseName)
+		if _, ok := parseTempFileName(baseName); ok {
+			return ignoreNotExist(fss.fs.Remove(journalFileName))
+		}
+		if _, err := xid.FromString(baseName); err != nil {
+			return nil
+		}
+		return fss.recoverTxn(journalFileName)
+	})
+}
+
+func (fss *fsStorage) recoverTxn(journalFileName string) error {
+	rawJournal, err := internal.ReadFile(fss.fs, journalFileName)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	var journal txnJournal
+	if err := json.Unmarshal(rawJournal, &journal); err != nil {
+		return newCorruptionError("", fmt.Errorf("malformed journal %q: %v", filepath.Base(journalFileName), err))
+	}
+	txnFiles := make(map[string]*txnFile, len(journal.Ops))
+	for _, op := range journal.Ops {
+		// Create the version file if needed, as an empty version file may have been
+		// removed by compaction since the crash.
+		txnFiles[internal.EncodeKey(op.Key)] = &txnFile{
+			Key:  op.Key,
+			Flag: os.O_RDWR | os.O_CREATE,
+		}
+	}
+	if err := fss.lockTxnFiles(txnFiles); err != nil {
+		return err
+	}
+	defer unlockTxnFiles(txnFiles)
+	// A value may be back at the old version after the transaction has been applied,
+	// e.g. deleted again after being created by the transaction, in which case values
+	// would be resurrected by rolling forward. Values changed since the transaction are
+	// told by the change journal, as other writers may have changed them since the crash.
+	var changedKeys map[string]bool
+	if journal.Revision >= 1 {
+		keys := make([]string, len(journal.Ops))
+		for i, op := range journal.Ops {
+			keys[i] = op.Key
+		}
+		changedKeys, err = fss.findChangedKeys(keys, journal.Revision)
+		if err != nil {
+			if err != ErrCompacted {
+				return err
+			}
+			// The journal has been left over long after the transaction, which should
+			// have been applied or superseded.
+			fss.options.Logger.Log(LogEntry{
+				Level:   LogLevelWarn,
+				Message: "changes since transaction truncated; transaction not rolled forward",
+				Path:    journalFileName,
+			})
+			return ignoreNotExist(fss.fs.Remove(journalFileName))
+		}
+	}
+	for _, op := range journal.Ops {
+		fileName := internal.EncodeKey(op.Key)
+		txnFile := txnFiles[fileName]
+		if txnFile.CurrentRecord.Version != op.OldVersion || changedKeys[op.Key] {
+			// Either applied already, or superseded since the crash.
+			continue
+		}
+		if op.NewVersion != "" {
+			// The value file may have been removed by compaction since the crash.
+			valueFileName := fss.valueFileName(fileName, op.NewVersion)
+			if err := fss.writeValueFile(valueFileName, string(op.Value)); err != nil {
+				return err
+			}
+		}
+		if err := fss.applyTxnOp(op, txnFile.VersionFile); err != nil {
+			return err
+		}
+		if op.OldVersion != "" {
+			fss.retireValue(fileName, op.OldVersion)
+		}
+	}
+	return ignoreNotExist(fss.fs.Remove(journalFileName))
+}
+
+const txnLockBaseName = "lock"
+
+func (fss *fsStorage) txnLockFileName() string {
+	return filepath.Join(fss.dirNames.Txns, txnLockBaseName)
+}
+
+func (fss *fsStorage) journalFileName(txnID string) string {
+	return filepath.Join(fss.dirNames.Txns, txnID)
+}
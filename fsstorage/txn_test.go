@@ -0,0 +1,354 @@
+package fsstorage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_CommitTxn(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	schemaVersion, err := s.CreateValue(ctx, "schema", "v1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = s.CreateValue(ctx, "old-data", "x")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	ok, newVersions, err := s.CommitTxn(ctx, Txn{
+		Conditions: []TxnCondition{{Key: "schema", Version: schemaVersion}, {Key: "data"}},
+		Puts:       []TxnPut{{Key: "schema", Value: "v2"}, {Key: "data", Value: "y"}},
+		Deletes:    []string{"old-data", "no-data"},
+	})
+	if !assert.NoError(t, err) || !assert.True(t, ok) || !assert.Len(t, newVersions, 2) {
+		t.FailNow()
+	}
+	details, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]versionedkv.ValueDetails{
+			"schema": {V: "v2", Version: newVersions[0]},
+			"data":   {V: "y", Version: newVersions[1]},
+		}, details.Values)
+	}
+
+	ok, newVersions, err = s.CommitTxn(ctx, Txn{
+		Conditions: []TxnCondition{{Key: "schema", Version: schemaVersion}},
+		Puts:       []TxnPut{{Key: "schema", Value: "v3"}},
+		Deletes:    []string{"data"},
+	})
+	if assert.NoError(t, err) {
+		assert.False(t, ok)
+		assert.Nil(t, newVersions)
+	}
+	details2, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, details, details2)
+	}
+
+	_, _, err = s.CommitTxn(ctx, Txn{
+		Puts:    []TxnPut{{Key: "schema", Value: "v3"}},
+		Deletes: []string{"schema"},
+	})
+	assert.Equal(t, ErrInvalidTxn, err)
+}
+
+func TestFSStorage_CommitTxnConcurrently(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		_, err := s.CreateValue(ctx, key, "100")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	// Move amounts between values in different orders.
+	transfer := func(from, to string) error {
+		for {
+			fromValue, fromVersion, err := s.GetValue(ctx, from)
+			if err != nil {
+				return err
+			}
+			toValue, toVersion, err := s.GetValue(ctx, to)
+			if err != nil {
+				return err
+			}
+			fromAmount, _ := strconv.Atoi(fromValue)
+			toAmount, _ := strconv.Atoi(toValue)
+			ok, _, err := s.CommitTxn(ctx, Txn{
+				Conditions: []TxnCondition{{Key: from, Version: fromVersion}, {Key: to, Version: toVersion}},
+				Puts: []TxnPut{
+					{Key: from, Value: strconv.Itoa(fromAmount - 1)},
+					{Key: to, Value: strconv.Itoa(toAmount + 1)},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if ok {
+				return nil
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		from, to := keys[i%3], keys[(i+1+i/3)%3]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := transfer(from, to); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	total := 0
+	for _, key := range keys {
+		value, _, err := s.GetValue(ctx, key)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		amount, _ := strconv.Atoi(value)
+		total += amount
+	}
+	assert.Equal(t, 300, total)
+}
+
+func TestFSStorage_RecoverTxn(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	fooVersion, err := s.CreateValue(ctx, "foo", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	barVersion, err := s.CreateValue(ctx, "bar", "2")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+
+	// Simulate a crash after the commit point of a transaction, which updated "foo"
+	// already but neither "bar" nor "baz".
+	newBarVersion := xid.New().String()
+	newBazVersion := xid.New().String()
+	rawJournal, err := json.Marshal(map[string]interface{}{
+		"ops": []map[string]interface{}{
+			{"key": "foo", "old_version": xid.New().String(), "new_version": fooVersion},
+			{"key": "bar", "value": []byte("3"), "old_version": barVersion, "new_version": newBarVersion},
+			{"key": "baz", "value": []byte("4"), "new_version": newBazVersion},
+		},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	txnsDirName := filepath.Join(baseDirName, "txns")
+	err = ioutil.WriteFile(filepath.Join(txnsDirName, xid.New().String()), rawJournal, 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = ioutil.WriteFile(filepath.Join(txnsDirName, fmt.Sprintf(".%s.tmp-123", xid.New())), []byte("{"), 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	s, err = Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	details, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]versionedkv.ValueDetails{
+			"foo": {V: "1", Version: fooVersion},
+			"bar": {V: "3", Version: newBarVersion},
+			"baz": {V: "4", Version: newBazVersion},
+		}, details.Values)
+	}
+	assert.Equal(t, []string{"lock"}, readDirNames(t, txnsDirName))
+}
+
+func TestFSStorage_RecoverTxn_Superseded(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	barVersion, err := s.CreateValue(ctx, "bar", "2")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ok, newVersions, err := s.CommitTxn(ctx, Txn{
+		Puts:    []TxnPut{{Key: "baz", Value: "4"}},
+		Deletes: []string{"bar"},
+	})
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		t.FailNow()
+	}
+
+	// Simulate a crash after the transaction has been applied but before the journal
+	// is removed.
+	revision, _ := Revision(newVersions[0])
+	rawJournal, err := json.Marshal(map[string]interface{}{
+		"revision": revision,
+		"ops": []map[string]interface{}{
+			{"key": "baz", "value": []byte("4"), "new_version": newVersions[0]},
+			{"key": "bar", "old_version": barVersion},
+		},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	txnsDirName := filepath.Join(baseDirName, "txns")
+	err = ioutil.WriteFile(filepath.Join(txnsDirName, xid.New().String()), rawJournal, 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Both values are changed back to the old versions since the crash.
+	_, err = s.DeleteValue(ctx, "baz", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	snapshot := `{"format":"versionedkv-fs-snapshot/1"}` + "\n" +
+		fmt.Sprintf(`{"key":"bar","value":"Mg==","version":%q}`, barVersion) + "\n"
+	err = s.Restore(ctx, strings.NewReader(snapshot), RestoreModeMerge)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+
+	// Recovery doesn't roll the transaction forward again.
+	s, err = Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	details, err := s.Inspect(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]versionedkv.ValueDetails{
+			"bar": {V: "2", Version: barVersion},
+		}, details.Values)
+	}
+	assert.Equal(t, []string{"lock"}, readDirNames(t, txnsDirName))
+}
+
+func TestFSStorage_CommitTxn_Faults(t *testing.T) {
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	options := Options{BaseDirName: "versionedkv"}
+	s, err := OpenWithFS(options, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := s.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	revision, _ := Revision(version)
+	cs, err := s.Changes(ctx, revision)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer cs.Close()
+
+	// The second op fails to be applied after the first op has been applied.
+	errInjected := errors.New("injected")
+	versionsDirName := filepath.Join(options.BaseDirName, "versions") + string(filepath.Separator)
+	n := 0
+	fs.SetFault(func(op internal.FaultOp, name string) error {
+		if op == internal.FaultOpWrite && strings.HasPrefix(name, versionsDirName) {
+			n++
+			if n == 2 {
+				return errInjected
+			}
+		}
+		return nil
+	})
+	ok, _, err := s.CommitTxn(ctx, Txn{
+		Puts: []TxnPut{{Key: "foo", Value: "baz"}, {Key: "qux", Value: "quux"}},
+	})
+	assert.False(t, ok)
+	assert.True(t, errors.Is(err, errInjected), "err: %v", err)
+	fs.SetFault(nil)
+
+	// The op applied has been undone.
+	value, version2, err := s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+	_, version2, err = s.GetValue(ctx, "qux")
+	if assert.NoError(t, err) {
+		assert.Nil(t, version2)
+	}
+	// And so have the changes journaled.
+	for _, key := range []string{"foo", "qux"} {
+		if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+			assert.Equal(t, revision+1, cs.Change().Revision)
+			assert.Equal(t, ChangePut, cs.Change().Type)
+			assert.Equal(t, key, cs.Change().Key)
+		}
+	}
+	expectedChanges := []Change{
+		{Revision: revision + 2, Type: ChangePut, Key: "foo", Version: version},
+		{Revision: revision + 2, Type: ChangeDelete, Key: "qux"},
+	}
+	for _, expectedChange := range expectedChanges {
+		if assert.True(t, cs.Next(), "err: %v", cs.Err()) {
+			assert.Equal(t, expectedChange, cs.Change())
+		}
+	}
+	// The journal has been removed, so that the transaction isn't rolled forward.
+	fileInfos, err := fs.ReadDir(filepath.Join(options.BaseDirName, "txns"))
+	if assert.NoError(t, err) && assert.Len(t, fileInfos, 1) {
+		assert.Equal(t, "lock", fileInfos[0].Name())
+	}
+	err = s.Compact(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	value, version2, err = s.GetValue(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bar", value)
+		assert.Equal(t, version, version2)
+	}
+	problems, err := CheckWithFS(ctx, options, fs, false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, problems)
+	}
+}
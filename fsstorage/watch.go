@@ -0,0 +1,295 @@
+package fsstorage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// WatchEventType represents the type of watch events.
+type WatchEventType int
+
+const (
+	// WatchEventCreate indicates a value has been created.
+	WatchEventCreate WatchEventType = 1 + iota
+
+	// WatchEventUpdate indicates a value has been updated.
+	WatchEventUpdate
+
+	// WatchEventDelete indicates a value has been deleted.
+	WatchEventDelete
+
+	// WatchEventGap indicates changes may have been missed, e.g. because the watcher
+	// couldn't keep up with changes. Watch events following a gap are derived from
+	// rescanning values, so that they bring the watcher up to date.
+	WatchEventGap
+)
+
+// String implements fmt.Stringer.
+func (wet WatchEventType) String() string {
+	switch wet {
+	case WatchEventCreate:
+		return "create"
+	case WatchEventUpdate:
+		return "update"
+	case WatchEventDelete:
+		return "delete"
+	case WatchEventGap:
+		return "gap"
+	default:
+		return "unknown"
+	}
+}
+
+// WatchEvent represents a change of a value.
+//
+// Changes happened in quick succession may be coalesced into one watch event, from the
+// first old version to the last new version.
+type WatchEvent struct {
+	Type WatchEventType
+
+	// Key is the key of the value, which is empty for WatchEventGap.
+	Key string
+
+	// OldVersion is the version before the change, which is nil for WatchEventCreate.
+	OldVersion versionedkv.Version
+
+	// NewVersion is the version after the change, which is nil for WatchEventDelete.
+	NewVersion versionedkv.Version
+}
+
+func (fss *fsStorage) Watch(ctx context.Context, prefix string) (<-chan WatchEvent, error) {
+	events, err := fss.doWatch(ctx, prefix)
+	return events, wrapError("", err)
+}
+
+func (fss *fsStorage) doWatch(ctx context.Context, prefix string) (<-chan WatchEvent, error) {
+	return startWatch(ctx, fss, fss.eventBus, fss.closure, prefix)
+}
+
+// watchable is a storage which can be watched, whose event bus fires events named
+// after file names encoded from keys.
+type watchable interface {
+	iterable
+	decodeFileName(fileName string) (string, error)
+}
+
+// startWatch starts watching values with the given prefix in the given storage, which
+// has the given event bus and is closed once the given closure is closed.
+func startWatch(ctx context.Context, s watchable, eventBus *internal.EventBus, closure <-chan struct{}, prefix string) (<-chan WatchEvent, error) {
+	// Subscribe before scanning values, so that no change after scanning is missed.
+	subscriber, err := eventBus.AddSubscriber()
+	if err != nil {
+		if err == internal.ErrEventBusClosed {
+			err = versionedkv.ErrStorageClosed
+		}
+		return nil, err
+	}
+	defer func() {
+		if subscriber != (internal.Subscriber{}) {
+			eventBus.RemoveSubscriber(subscriber)
+		}
+	}()
+	w := watch{
+		s:        s,
+		eventBus: eventBus,
+		closure:  closure,
+		ctx:      ctx,
+		prefix:   prefix,
+		events:   make(chan WatchEvent),
+	}
+	versions, err := w.scanVersions()
+	if err != nil {
+		return nil, err
+	}
+	w.versions = versions
+	w.subscriber = subscriber
+	subscriber = internal.Subscriber{}
+	go w.run()
+	return w.events, nil
+}
+
+type watch struct {
+	s          watchable
+	eventBus   *internal.EventBus
+	closure    <-chan struct{}
+	ctx        context.Context
+	prefix     string
+	subscriber internal.Subscriber
+	versions   map[string]string
+	events     chan WatchEvent
+}
+
+func (w *watch) run() {
+	var resyncTimer *time.Timer
+	defer func() {
+		if resyncTimer != nil {
+			resyncTimer.Stop()
+		}
+		w.eventBus.RemoveSubscriber(w.subscriber)
+		close(w.events)
+	}()
+	var isOutOfSync bool
+	var resyncBackoff time.Duration
+	for {
+		var resyncRetry <-chan time.Time
+		if resyncTimer != nil {
+			resyncRetry = resyncTimer.C
+		}
+		select {
+		case <-w.subscriber.Event():
+		case <-resyncRetry:
+			resyncTimer = nil
+		case <-w.closure:
+			return
+		case <-w.ctx.Done():
+			return
+		}
+		fileNames, watchLoss := w.subscriber.TakeEvents()
+		if watchLoss && !isOutOfSync {
+			if !w.emitEvent(WatchEvent{Type: WatchEventGap}) {
+				return
+			}
+			isOutOfSync = true
+		}
+		var err error
+		if isOutOfSync {
+			err = w.resync()
+		} else {
+			err = w.handleFileNames(fileNames)
+		}
+		if err != nil {
+			if !isOutOfSync {
+				// Unable to tell what has been changed, resync instead.
+				if !w.emitEvent(WatchEvent{Type: WatchEventGap}) {
+					return
+				}
+				isOutOfSync = true
+			}
+			// Retry on a backoff timer rather than waiting for the next event, which
+			// may never come.
+			resyncBackoff *= 2
+			if resyncBackoff < minResyncBackoff {
+				resyncBackoff = minResyncBackoff
+			} else if resyncBackoff > maxResyncBackoff {
+				resyncBackoff = maxResyncBackoff
+			}
+			if resyncTimer != nil {
+				resyncTimer.Stop()
+			}
+			resyncTimer = time.NewTimer(resyncBackoff)
+			continue
+		}
+		isOutOfSync = false
+		resyncBackoff = 0
+		if resyncTimer != nil {
+			resyncTimer.Stop()
+			resyncTimer = nil
+		}
+	}
+}
+
+const (
+	minResyncBackoff = 100 * time.Millisecond
+	maxResyncBackoff = 10 * time.Second
+)
+
+func (w *watch) handleFileNames(fileNames []string) error {
+	for _, fileName := range fileNames {
+		key, err := w.s.decodeFileName(fileName)
+		if err != nil {
+			continue
+		}
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		_, version, err := w.s.getVersion(w.ctx, key, false)
+		if err != nil {
+			return err
+		}
+		if !w.updateVersion(key, version) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// resync rescans values and emits watch events for differences from the known
+// versions.
+func (w *watch) resync() error {
+	versions, err := w.scanVersions()
+	if err != nil {
+		return err
+	}
+	for key := range w.versions {
+		if _, ok := versions[key]; !ok {
+			if !w.updateVersion(key, "") {
+				return nil
+			}
+		}
+	}
+	for key, version := range versions {
+		if !w.updateVersion(key, version) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (w *watch) scanVersions() (map[string]string, error) {
+	versions := make(map[string]string)
+	it := newIterator(w.ctx, w.s, IterateOptions{Prefix: w.prefix})
+	for it.Next() {
+		versions[it.Key()] = opaqueVersion2Version(it.Version())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// updateVersion updates the known version of the value for the given key and emits
+// a watch event if the version has been changed. It returns false if the watch has
+// been stopped.
+func (w *watch) updateVersion(key string, newVersion string) bool {
+	oldVersion := w.versions[key]
+	if newVersion == oldVersion {
+		return true
+	}
+	event := WatchEvent{
+		Key:        key,
+		OldVersion: version2OpaqueVersion(oldVersion),
+		NewVersion: version2OpaqueVersion(newVersion),
+	}
+	switch {
+	case oldVersion == "":
+		event.Type = WatchEventCreate
+	case newVersion == "":
+		event.Type = WatchEventDelete
+	default:
+		event.Type = WatchEventUpdate
+	}
+	if !w.emitEvent(event) {
+		return false
+	}
+	if newVersion == "" {
+		delete(w.versions, key)
+	} else {
+		w.versions[key] = newVersion
+	}
+	return true
+}
+
+func (w *watch) emitEvent(event WatchEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.closure:
+		return false
+	case <-w.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,259 @@
+package fsstorage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	. "github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStorage_Watch(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	s1, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx := context.Background()
+	version0, err := s2.CreateValue(ctx, "app/foo", "v0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	ctx2, cancel := context.WithCancel(ctx)
+	events, err := s1.Watch(ctx2, "app/")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	nextEvent := func() WatchEvent {
+		select {
+		case event, ok := <-events:
+			if !assert.True(t, ok) {
+				t.FailNow()
+			}
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out")
+			return WatchEvent{}
+		}
+	}
+
+	version1, err := s2.UpdateValue(ctx, "app/foo", "v1", nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, WatchEvent{
+		Type:       WatchEventUpdate,
+		Key:        "app/foo",
+		OldVersion: version0,
+		NewVersion: version1,
+	}, nextEvent())
+
+	_, err = s2.CreateValue(ctx, "db/foo", "v0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	version2, err := s2.CreateValue(ctx, "app/bar", "v0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, WatchEvent{
+		Type:       WatchEventCreate,
+		Key:        "app/bar",
+		NewVersion: version2,
+	}, nextEvent())
+
+	ok, err := s2.DeleteValue(ctx, "app/foo", nil)
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		t.FailNow()
+	}
+	assert.Equal(t, WatchEvent{
+		Type:       WatchEventDelete,
+		Key:        "app/foo",
+		OldVersion: version1,
+	}, nextEvent())
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestFSStorage_WatchAfterClose(t *testing.T) {
+	s, err := makeStorage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	events, err := s.Watch(context.Background(), "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.Close()
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	_, err = s.Watch(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestFSStorage_WatchError(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	fw := fakeFileWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+	watchErrors := make(chan error, 1)
+	var tl testLogger
+	s1, err := OpenWithFileWatcher(Options{
+		BaseDirName:       baseDirName,
+		WatchErrorHandler: func(err error) { watchErrors <- err },
+		Logger:            &tl,
+	}, func() (internal.FileWatcher, error) { return fw, nil })
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s1.Close()
+	s2, err := Open(Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s2.Close()
+	ctx := context.Background()
+	events, err := s1.Watch(ctx, "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	type result struct {
+		Value string
+		Err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		value, _, err := s1.WaitForValue(ctx, "foo", nil)
+		results <- result{value, err}
+	}()
+
+	// The fake file watcher never reports the change, so only the error can wake the
+	// waiter and the watch up.
+	time.Sleep(100 * time.Millisecond)
+	version, err := s2.CreateValue(ctx, "foo", "bar")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	fw.errors <- fsnotify.ErrEventOverflow
+	select {
+	case err := <-watchErrors:
+		assert.Equal(t, fsnotify.ErrEventOverflow, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	if entries := tl.Entries(LogLevelWarn); assert.Len(t, entries, 1) {
+		assert.Equal(t, fsnotify.ErrEventOverflow, entries[0].Err)
+		assert.Equal(t, filepath.Join(baseDirName, "versions"), entries[0].Path)
+	}
+	select {
+	case result := <-results:
+		assert.Equal(t, "bar", result.Value)
+		assert.NoError(t, result.Err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	for _, expectedEvent := range []WatchEvent{
+		{Type: WatchEventGap},
+		{Type: WatchEventCreate, Key: "foo", NewVersion: version},
+	} {
+		select {
+		case event := <-events:
+			assert.Equal(t, expectedEvent, event)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+}
+
+type fakeFileWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func (ffw fakeFileWatcher) Add(string) error              { return nil }
+func (ffw fakeFileWatcher) Events() <-chan fsnotify.Event { return ffw.events }
+func (ffw fakeFileWatcher) Errors() <-chan error          { return ffw.errors }
+func (ffw fakeFileWatcher) Close() error                  { close(ffw.events); return nil }
+
+func TestFSStorage_WatchResyncRetry(t *testing.T) {
+	fs := internal.NewFaultyFS(internal.NewMemFS())
+	options := Options{BaseDirName: "versionedkv"}
+	s, err := OpenWithFS(options, fs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events, err := s.Watch(ctx, "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	nextEvent := func() WatchEvent {
+		select {
+		case event, ok := <-events:
+			if !assert.True(t, ok) {
+				t.FailNow()
+			}
+			return event
+		case <-ctx.Done():
+			t.Fatal("timed out")
+			return WatchEvent{}
+		}
+	}
+
+	// Version files can be neither read nor scanned, so that the watch falls out of sync
+	// and fails to resync.
+	errInjected := errors.New("injected")
+	versionsDirName := filepath.Join(options.BaseDirName, "versions")
+	fs.SetFault(func(op internal.FaultOp, name string) error {
+		if (op == internal.FaultOpLock || op == internal.FaultOpReadDir) && strings.HasPrefix(name, versionsDirName) {
+			return errInjected
+		}
+		return nil
+	})
+	// Write the version file behind the storage, as writing is faulty as well.
+	version := fmt.Sprintf("%016x-%s", 1, xid.New().String())
+	versionFile, err := fs.OpenFile(filepath.Join(versionsDirName, internal.EncodeKey("foo")), os.O_WRONLY|os.O_CREATE, 0666)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = versionFile.Write([]byte(version))
+	versionFile.Close()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, WatchEvent{Type: WatchEventGap}, nextEvent())
+
+	// The resync is retried without further changes, once events pending have been
+	// taken.
+	time.Sleep(300 * time.Millisecond)
+	fs.SetFault(nil)
+	event := nextEvent()
+	assert.Equal(t, WatchEventCreate, event.Type)
+	assert.Equal(t, "foo", event.Key)
+	assert.Equal(t, version, fmt.Sprint(event.NewVersion))
+}
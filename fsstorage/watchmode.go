@@ -0,0 +1,46 @@
+package fsstorage
+
+import (
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage/internal"
+)
+
+// WatchMode represents the way changes to values are detected, which WaitForValue and
+// Watch depend on.
+type WatchMode int
+
+const (
+	// WatchModeNotify detects changes through change notifications of the file system
+	// (e.g. inotify on Linux).
+	//
+	// It detects changes immediately, but doesn't work on file systems which don't
+	// support change notifications, or only notify changes made locally, e.g. NFS, SMB,
+	// many FUSE file systems and some container overlay setups.
+	WatchModeNotify WatchMode = iota
+
+	// WatchModePoll detects changes by reading version files periodically, at
+	// Options.PollInterval.
+	//
+	// It works on any file system, but detects changes with a delay of up to the poll
+	// interval, and costs more as the number of values grows.
+	WatchModePoll
+
+	// WatchModeHybrid detects changes both through change notifications and by
+	// polling, so that changes made locally are detected immediately, and changes
+	// made remotely are detected eventually.
+	WatchModeHybrid
+)
+
+const defaultPollInterval = time.Second
+
+func (fss *fsStorage) newFileWatcher() (internal.FileWatcher, error) {
+	switch fss.options.WatchMode {
+	case WatchModePoll:
+		return internal.NewPollWatcher(fss.fs, fss.options.PollInterval)
+	case WatchModeHybrid:
+		return internal.NewHybridWatcher(fss.fs, fss.options.PollInterval)
+	default:
+		return fss.fs.NewWatcher()
+	}
+}
@@ -0,0 +1,243 @@
+// Package metrics provides an observer of file system storages, which records metrics of
+// operations and changes detected, and exports them in the Prometheus text format,
+// without depending on any Prometheus library.
+//
+// Metrics are passed to storages as the observer, and served over HTTP for Prometheus to
+// scrape:
+//
+//	m := metrics.New(metrics.Options{})
+//	s, err := fsstorage.Open(fsstorage.Options{Observer: m})
+//	...
+//	http.Handle("/metrics", m)
+//
+// The metrics exported are:
+//
+//	versionedkv_fs_operation_duration_seconds{operation, outcome}  histogram
+//	versionedkv_fs_watchers                                        gauge
+//	versionedkv_fs_events_total                                    counter
+//	versionedkv_fs_watch_errors_total                              counter
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+// Options represents options for metrics.
+type Options struct {
+	// Namespace is the prefix of names of metrics, "versionedkv_fs" by default.
+	Namespace string
+
+	// Buckets are upper bounds of buckets of the histogram of operation durations, in
+	// seconds and in ascending order, DefaultBuckets by default. The +Inf bucket is
+	// always implied.
+	Buckets []float64
+}
+
+func (o *Options) sanitize() {
+	if o.Namespace == "" {
+		o.Namespace = "versionedkv_fs"
+	}
+	if len(o.Buckets) == 0 {
+		o.Buckets = DefaultBuckets
+	}
+}
+
+// DefaultBuckets are the default upper bounds of buckets of the histogram of operation
+// durations, from 100 microseconds to 10 seconds.
+var DefaultBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics records metrics of storages it observes. It's safe for concurrent use, and may
+// observe more than one storage, in which case metrics are aggregated.
+type Metrics struct {
+	options     Options
+	histograms  map[histogramKey]*histogram
+	watchers    int64
+	events      uint64
+	watchErrors uint64
+}
+
+var _ fsstorage.Observer = (*Metrics)(nil)
+var _ http.Handler = (*Metrics)(nil)
+
+type histogramKey struct {
+	Operation fsstorage.Operation
+	Outcome   fsstorage.Outcome
+}
+
+// New creates metrics with the given options.
+func New(options Options) *Metrics {
+	var m Metrics
+	m.options = options
+	m.options.sanitize()
+	// Histograms are created up front, so that all series are exported from the start.
+	m.histograms = make(map[histogramKey]*histogram, len(fsstorage.Operations)*len(fsstorage.Outcomes))
+	for _, operation := range fsstorage.Operations {
+		for _, outcome := range fsstorage.Outcomes {
+			m.histograms[histogramKey{operation, outcome}] = new(histogram).Init(len(m.options.Buckets))
+		}
+	}
+	return &m
+}
+
+// OperationDone implements fsstorage.Observer.OperationDone.
+func (m *Metrics) OperationDone(operation fsstorage.Operation, outcome fsstorage.Outcome, duration time.Duration) {
+	histogram, ok := m.histograms[histogramKey{operation, outcome}]
+	if !ok {
+		return
+	}
+	histogram.Observe(m.options.Buckets, duration)
+}
+
+// WatchersChanged implements fsstorage.Observer.WatchersChanged.
+func (m *Metrics) WatchersChanged(delta int) { atomic.AddInt64(&m.watchers, int64(delta)) }
+
+// EventFired implements fsstorage.Observer.EventFired.
+func (m *Metrics) EventFired() { atomic.AddUint64(&m.events, 1) }
+
+// WatchErrorOccurred implements fsstorage.Observer.WatchErrorOccurred.
+func (m *Metrics) WatchErrorOccurred(error) { atomic.AddUint64(&m.watchErrors, 1) }
+
+// Snapshot represents values of metrics at a point in time.
+type Snapshot struct {
+	// Operations are metrics of operations for each combination of the operation and the
+	// outcome, ordered by operations and then outcomes.
+	Operations []OperationSnapshot
+
+	// Watchers is the number of watchers, i.e. WaitForValue calls waiting for changes
+	// and Watch calls in progress.
+	Watchers int
+
+	// Events is the number of changes to values detected.
+	Events uint64
+
+	// WatchErrors is the number of errors occurred when watching for changes.
+	WatchErrors uint64
+}
+
+// OperationSnapshot represents metrics of operations of a kind with an outcome.
+type OperationSnapshot struct {
+	Operation fsstorage.Operation
+	Outcome   fsstorage.Outcome
+
+	// Count is the number of operations.
+	Count uint64
+
+	// Sum is the total duration of operations.
+	Sum time.Duration
+
+	// BucketCounts are cumulative counts of operations for buckets, i.e. the numbers of
+	// operations which took no longer than upper bounds of buckets respectively.
+	BucketCounts []uint64
+}
+
+// Snapshot returns the current values of metrics.
+func (m *Metrics) Snapshot() Snapshot {
+	var snapshot Snapshot
+	for _, operation := range fsstorage.Operations {
+		for _, outcome := range fsstorage.Outcomes {
+			operationSnapshot := m.histograms[histogramKey{operation, outcome}].Snapshot()
+			operationSnapshot.Operation = operation
+			operationSnapshot.Outcome = outcome
+			snapshot.Operations = append(snapshot.Operations, operationSnapshot)
+		}
+	}
+	snapshot.Watchers = int(atomic.LoadInt64(&m.watchers))
+	snapshot.Events = atomic.LoadUint64(&m.events)
+	snapshot.WatchErrors = atomic.LoadUint64(&m.watchErrors)
+	return snapshot
+}
+
+// WriteTo writes the current values of metrics to the given writer in the Prometheus text
+// format.
+func (m *Metrics) WriteTo(writer io.Writer) (int64, error) {
+	snapshot := m.Snapshot()
+	var buffer bytes.Buffer
+	name := m.options.Namespace + "_operation_duration_seconds"
+	fmt.Fprintf(&buffer, "# HELP %s Durations of storage operations by outcome.\n", name)
+	fmt.Fprintf(&buffer, "# TYPE %s histogram\n", name)
+	for _, operationSnapshot := range snapshot.Operations {
+		labels := fmt.Sprintf("operation=%q,outcome=%q", operationSnapshot.Operation, operationSnapshot.Outcome)
+		for i, bucket := range m.options.Buckets {
+			fmt.Fprintf(&buffer, "%s_bucket{%s,le=%q} %d\n", name, labels, formatFloat(bucket), operationSnapshot.BucketCounts[i])
+		}
+		fmt.Fprintf(&buffer, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, operationSnapshot.Count)
+		fmt.Fprintf(&buffer, "%s_sum{%s} %s\n", name, labels, formatFloat(operationSnapshot.Sum.Seconds()))
+		fmt.Fprintf(&buffer, "%s_count{%s} %d\n", name, labels, operationSnapshot.Count)
+	}
+	writeMetric(&buffer, m.options.Namespace+"_watchers", "gauge", "Number of watchers waiting for changes.", int64(snapshot.Watchers))
+	writeMetric(&buffer, m.options.Namespace+"_events_total", "counter", "Number of changes to values detected.", int64(snapshot.Events))
+	writeMetric(&buffer, m.options.Namespace+"_watch_errors_total", "counter", "Number of errors occurred when watching for changes.", int64(snapshot.WatchErrors))
+	return buffer.WriteTo(writer)
+}
+
+// ServeHTTP serves the current values of metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func writeMetric(buffer *bytes.Buffer, name string, typ string, help string, value int64) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(buffer, "%s %d\n", name, value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type histogram struct {
+	mu           sync.Mutex
+	bucketCounts []uint64
+	count        uint64
+	sum          time.Duration
+}
+
+func (h *histogram) Init(numberOfBuckets int) *histogram {
+	h.bucketCounts = make([]uint64, numberOfBuckets)
+	return h
+}
+
+func (h *histogram) Observe(buckets []float64, duration time.Duration) {
+	seconds := duration.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bucket := range buckets {
+		if seconds <= bucket {
+			h.bucketCounts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += duration
+}
+
+func (h *histogram) Snapshot() OperationSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucketCounts := make([]uint64, len(h.bucketCounts))
+	var n uint64
+	for i, bucketCount := range h.bucketCounts {
+		n += bucketCount
+		bucketCounts[i] = n
+	}
+	return OperationSnapshot{
+		Count:        h.count,
+		Sum:          h.sum,
+		BucketCounts: bucketCounts,
+	}
+}
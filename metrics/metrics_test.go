@@ -0,0 +1,104 @@
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	. "github.com/go-tk/versionedkv-fs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New(Options{Buckets: []float64{0, 3600}})
+	baseDirName, err := ioutil.TempDir("", "versionedkv-fs-metrics-")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(baseDirName)
+	s, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName, Observer: m})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	_, _, err = s.GetValue(ctx, "foo")
+	assert.NoError(t, err)
+	_, err = s.CreateValue(ctx, "foo", "1")
+	assert.NoError(t, err)
+	_, err = s.CreateValue(ctx, "foo", "1")
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, err := s.WaitForValue(ctx, "bar", nil)
+		assert.NoError(t, err)
+	}()
+	for m.Snapshot().Watchers == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = s.CreateValue(ctx, "bar", "1")
+	assert.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	snapshot := m.Snapshot()
+	counts := make(map[string]uint64)
+	for _, operationSnapshot := range snapshot.Operations {
+		if assert.Len(t, operationSnapshot.BucketCounts, 2) {
+			assert.LessOrEqual(t, operationSnapshot.BucketCounts[0], operationSnapshot.BucketCounts[1])
+			assert.Equal(t, operationSnapshot.Count, operationSnapshot.BucketCounts[1])
+		}
+		if operationSnapshot.Count >= 1 {
+			counts[operationSnapshot.Operation.String()+"/"+operationSnapshot.Outcome.String()] = operationSnapshot.Count
+		}
+	}
+	assert.Equal(t, map[string]uint64{
+		"GetValue/miss":        1,
+		"CreateValue/hit":      2,
+		"CreateValue/conflict": 1,
+		"WaitForValue/hit":     1,
+	}, counts)
+	assert.Equal(t, 0, snapshot.Watchers)
+	assert.GreaterOrEqual(t, snapshot.Events, uint64(1))
+	assert.Equal(t, uint64(0), snapshot.WatchErrors)
+
+	var buffer bytes.Buffer
+	_, err = m.WriteTo(&buffer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	text := buffer.String()
+	for _, line := range []string{
+		"# TYPE versionedkv_fs_operation_duration_seconds histogram",
+		`versionedkv_fs_operation_duration_seconds_bucket{operation="CreateValue",outcome="hit",le="3600"} 2`,
+		`versionedkv_fs_operation_duration_seconds_bucket{operation="CreateValue",outcome="hit",le="+Inf"} 2`,
+		`versionedkv_fs_operation_duration_seconds_count{operation="CreateValue",outcome="hit"} 2`,
+		`versionedkv_fs_operation_duration_seconds_count{operation="DeleteValue",outcome="error"} 0`,
+		"# TYPE versionedkv_fs_watchers gauge",
+		"versionedkv_fs_watchers 0",
+		"# TYPE versionedkv_fs_events_total counter",
+		"versionedkv_fs_watch_errors_total 0",
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(t, w.Body.String(), "versionedkv_fs_watchers 0\n")
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	assert.Equal(t, 405, w.Code)
+}
@@ -0,0 +1,89 @@
+package recipes
+
+import (
+	"context"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+// Election represents a leader election among processes, where at most one candidate
+// with the same key is the leader at a time.
+type Election struct {
+	holder holder
+}
+
+// NewElection creates a new election for the given key.
+func NewElection(storage fsstorage.Storage, key string, options Options) *Election {
+	var e Election
+	e.holder.Init(storage, key, options)
+	return &e
+}
+
+// Campaign puts the candidate up for election with the given value, blocking until it's
+// elected as the leader. The value is stored for the key while it's the leader, and
+// reported to observers. If it's the leader already, ErrHeld is returned.
+func (e *Election) Campaign(ctx context.Context, value string) error {
+	return e.holder.Acquire(ctx, value)
+}
+
+// Resign gives up the leadership, so that another candidate can be elected. If it isn't
+// the leader, or the leadership has been lost, ErrNotHeld is returned.
+func (e *Election) Resign(ctx context.Context) error {
+	return e.holder.Release(ctx)
+}
+
+// Lost returns a channel which is closed once the leadership is given up or lost, e.g.
+// the TTL couldn't be renewed in time and another candidate was elected. It returns nil
+// if it has never been the leader.
+func (e *Election) Lost() <-chan struct{} {
+	return e.holder.Lost()
+}
+
+// Leader returns the value of the current leader. If there is no leader, false is
+// returned.
+func (e *Election) Leader(ctx context.Context) (string, bool, error) {
+	value, version, err := e.holder.storage.GetValue(ctx, e.holder.key)
+	if err != nil {
+		return "", false, err
+	}
+	return value, version != nil, nil
+}
+
+// Observe returns a channel of leader changes. The value of the current leader is sent
+// first if there is a leader, then the value of each newly elected leader is sent in
+// order. Consecutive leaders with the same value may be reported only once. The channel
+// is closed once the given context is done or an error occurs.
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	leaders := make(chan string)
+	go func() {
+		defer close(leaders)
+		storage, key := e.holder.storage, e.holder.key
+		var version versionedkv.Version
+		var lastValue string
+		var hasLastValue bool
+		for {
+			value, newVersion, err := storage.WaitForValue(ctx, key, version)
+			if err != nil {
+				return
+			}
+			version = newVersion
+			if newVersion == nil {
+				// No leader for the moment, the next leader is reported anyway.
+				hasLastValue = false
+				continue
+			}
+			if hasLastValue && value == lastValue {
+				// The TTL of the leader was renewed.
+				continue
+			}
+			select {
+			case leaders <- value:
+			case <-ctx.Done():
+				return
+			}
+			lastValue, hasLastValue = value, true
+		}
+	}()
+	return leaders
+}
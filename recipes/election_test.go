@@ -0,0 +1,143 @@
+package recipes_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	. "github.com/go-tk/versionedkv-fs/recipes"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	helpers["election"] = func(baseDirName string) error {
+		s, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName})
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		ctx := context.Background()
+		e := NewElection(s, "election", Options{TTL: 5 * time.Second})
+		for i := 0; i < 5; i++ {
+			if err := e.Campaign(ctx, strconv.Itoa(os.Getpid())); err != nil {
+				return err
+			}
+			// Mark the term, which fails if another leader is in office.
+			version, err := s.CreateValue(ctx, "term", "")
+			if err != nil {
+				return err
+			}
+			if version == nil {
+				return errors.New("more than one leader")
+			}
+			time.Sleep(10 * time.Millisecond)
+			if _, err := s.DeleteValue(ctx, "term", version); err != nil {
+				return err
+			}
+			value, _, err := s.GetValue(ctx, "terms")
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(value)
+			if _, err := s.CreateOrUpdateValue(ctx, "terms", strconv.Itoa(n+1), nil); err != nil {
+				return err
+			}
+			if err := e.Resign(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestElection(t *testing.T) {
+	s := openStorage(t, makeBaseDir(t))
+	defer s.Close()
+	ctx := context.Background()
+	e1 := NewElection(s, "election", Options{TTL: 300 * time.Millisecond})
+	e2 := NewElection(s, "election", Options{TTL: 300 * time.Millisecond})
+	ctx2, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaders := e1.Observe(ctx2)
+	nextLeader := func() string {
+		select {
+		case leader, ok := <-leaders:
+			if !assert.True(t, ok) {
+				t.FailNow()
+			}
+			return leader
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+			return ""
+		}
+	}
+
+	_, ok, err := e1.Leader(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.False(t, ok)
+	err = e1.Campaign(ctx, "foo")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = e1.Campaign(ctx, "foo")
+	assert.Equal(t, ErrHeld, err)
+	assert.Equal(t, "foo", nextLeader())
+	leader, ok, err := e2.Leader(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, ok)
+	assert.Equal(t, "foo", leader)
+
+	elected := make(chan error, 1)
+	go func() { elected <- e2.Campaign(ctx, "bar") }()
+	// Renewals of the TTL aren't reported as leader changes.
+	time.Sleep(time.Second)
+	select {
+	case leader := <-leaders:
+		t.Fatalf("unexpected leader: %q", leader)
+	case err := <-elected:
+		t.Fatalf("unexpected election: %v", err)
+	default:
+	}
+	err = e1.Resign(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = e1.Resign(ctx)
+	assert.Equal(t, ErrNotHeld, err)
+	select {
+	case err := <-elected:
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	assert.Equal(t, "bar", nextLeader())
+
+	cancel()
+	select {
+	case _, ok := <-leaders:
+		assert.False(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	err = e2.Resign(ctx)
+	assert.NoError(t, err)
+}
+
+func TestElection_MultiProcess(t *testing.T) {
+	const n = 3
+	baseDirName := makeBaseDir(t)
+	runHelpers(t, "election", baseDirName, n)
+	s := openStorage(t, baseDirName)
+	defer s.Close()
+	assert.Equal(t, n*5, readCounter(t, s, "terms"))
+}
@@ -0,0 +1,54 @@
+package recipes
+
+import (
+	"context"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/rs/xid"
+)
+
+// Mutex represents a mutual exclusion lock shared by processes, which is held by at most
+// one Mutex with the same key at a time.
+type Mutex struct {
+	id     string
+	holder holder
+}
+
+// NewMutex creates a new mutex for the given key.
+func NewMutex(storage fsstorage.Storage, key string, options Options) *Mutex {
+	var m Mutex
+	m.id = xid.New().String()
+	m.holder.Init(storage, key, options)
+	return &m
+}
+
+// ID returns the ID of the mutex, which is stored as the value for the key while the
+// mutex is locked.
+func (m *Mutex) ID() string { return m.id }
+
+// TryLock tries to lock the mutex. If the mutex is locked by others, false is returned.
+// If the mutex is locked already by itself, ErrHeld is returned.
+func (m *Mutex) TryLock(ctx context.Context) (bool, error) {
+	return m.holder.TryAcquire(ctx, m.id)
+}
+
+// Lock locks the mutex, blocking until the mutex is unlocked by others (or the holder
+// crashed and the TTL expired). If the mutex is locked already by itself, ErrHeld is
+// returned.
+func (m *Mutex) Lock(ctx context.Context) error {
+	return m.holder.Acquire(ctx, m.id)
+}
+
+// Unlock unlocks the mutex. If the mutex isn't locked, or has been lost, ErrNotHeld is
+// returned.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	return m.holder.Release(ctx)
+}
+
+// Lost returns a channel which is closed once the mutex is unlocked or lost, e.g. the
+// TTL couldn't be renewed in time and others locked the mutex. It returns nil if the
+// mutex has never been locked. Critical sections should stop as soon as possible once
+// the mutex is lost.
+func (m *Mutex) Lost() <-chan struct{} {
+	return m.holder.Lost()
+}
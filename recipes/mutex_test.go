@@ -0,0 +1,180 @@
+package recipes_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	. "github.com/go-tk/versionedkv-fs/recipes"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	helpers["mutex"] = func(baseDirName string) error {
+		s, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName})
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		ctx := context.Background()
+		m := NewMutex(s, "mutex", Options{TTL: 5 * time.Second})
+		for i := 0; i < 20; i++ {
+			if err := m.Lock(ctx); err != nil {
+				return err
+			}
+			// Increase the counter without any condition, so that lost updates show up
+			// if the mutex fails to exclude others.
+			value, _, err := s.GetValue(ctx, "counter")
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(value)
+			if _, err := s.CreateOrUpdateValue(ctx, "counter", strconv.Itoa(n+1), nil); err != nil {
+				return err
+			}
+			if err := m.Unlock(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	helpers["mutex-crash"] = func(baseDirName string) error {
+		s, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName})
+		if err != nil {
+			return err
+		}
+		m := NewMutex(s, "mutex", Options{TTL: time.Second})
+		if err := m.Lock(context.Background()); err != nil {
+			return err
+		}
+		fmt.Println(m.ID())
+		// Hold the mutex until killed.
+		select {}
+	}
+}
+
+func TestMutex(t *testing.T) {
+	s := openStorage(t, makeBaseDir(t))
+	defer s.Close()
+	ctx := context.Background()
+	m1 := NewMutex(s, "mutex", Options{})
+	m2 := NewMutex(s, "mutex", Options{})
+	assert.Nil(t, m1.Lost())
+
+	ok, err := m1.TryLock(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, ok)
+	_, err = m1.TryLock(ctx)
+	assert.Equal(t, ErrHeld, err)
+	value, _, err := s.GetValue(ctx, "mutex")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, m1.ID(), value)
+
+	ok, err = m2.TryLock(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.False(t, ok)
+	ctx2, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	err = m2.Lock(ctx2)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	locked := make(chan error, 1)
+	go func() { locked <- m2.Lock(ctx) }()
+	lost := m1.Lost()
+	err = m1.Unlock(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	select {
+	case <-lost:
+	default:
+		t.Fatal("not lost")
+	}
+	err = m1.Unlock(ctx)
+	assert.Equal(t, ErrNotHeld, err)
+	select {
+	case err := <-locked:
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	err = m2.Unlock(ctx)
+	assert.NoError(t, err)
+}
+
+func TestMutex_RenewTTL(t *testing.T) {
+	s := openStorage(t, makeBaseDir(t))
+	defer s.Close()
+	ctx := context.Background()
+	m1 := NewMutex(s, "mutex", Options{TTL: 300 * time.Millisecond})
+	m2 := NewMutex(s, "mutex", Options{TTL: 300 * time.Millisecond})
+	err := m1.Lock(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	time.Sleep(time.Second)
+	ok, err := m2.TryLock(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.False(t, ok)
+	err = m1.Unlock(ctx)
+	assert.NoError(t, err)
+}
+
+func TestMutex_MultiProcess(t *testing.T) {
+	const n = 4
+	baseDirName := makeBaseDir(t)
+	runHelpers(t, "mutex", baseDirName, n)
+	s := openStorage(t, baseDirName)
+	defer s.Close()
+	assert.Equal(t, n*20, readCounter(t, s, "counter"))
+}
+
+func TestMutex_HolderCrash(t *testing.T) {
+	baseDirName := makeBaseDir(t)
+	cmd := makeHelperCmd("mutex-crash", baseDirName)
+	stdout, err := cmd.StdoutPipe()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, cmd.Start()) {
+		t.FailNow()
+	}
+	id := readLine(t, bufio.NewReader(stdout))
+	assert.NotEmpty(t, id)
+	s := openStorage(t, baseDirName)
+	defer s.Close()
+	ctx := context.Background()
+	m := NewMutex(s, "mutex", Options{})
+	ok, err := m.TryLock(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.False(t, ok)
+
+	if !assert.NoError(t, cmd.Process.Kill()) {
+		t.FailNow()
+	}
+	cmd.Wait()
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = m.Lock(ctx2)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = m.Unlock(ctx)
+	assert.NoError(t, err)
+}
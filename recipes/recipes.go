@@ -0,0 +1,193 @@
+// Package recipes provides coordination primitives, i.e. mutexes and leader elections,
+// built on top of file system storages, which work across processes sharing the same
+// base directory.
+//
+// A holder of a primitive creates the value for a key with a TTL, and keeps renewing the
+// TTL while holding the primitive. If the holder crashes, the value expires after the
+// TTL, and the primitive becomes available to others.
+package recipes
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+var (
+	// ErrHeld is returned when acquiring a primitive which is already held by the
+	// caller.
+	ErrHeld error = errors.New("recipes: held")
+
+	// ErrNotHeld is returned when releasing a primitive which isn't held by the
+	// caller, or has been lost, e.g. the TTL expired before being renewed.
+	ErrNotHeld error = errors.New("recipes: not held")
+)
+
+// Options represents options for primitives.
+type Options struct {
+	// TTL is the time after which a primitive held by a crashed holder becomes
+	// available, 10 seconds by default. The TTL is renewed every third of the TTL
+	// while the primitive is held.
+	TTL time.Duration
+}
+
+func (o *Options) sanitize() {
+	if o.TTL < 1 {
+		o.TTL = defaultTTL
+	}
+}
+
+const defaultTTL = 10 * time.Second
+
+// holder holds the value for a key on behalf of a primitive, renewing the TTL of the
+// value in background.
+type holder struct {
+	storage fsstorage.Storage
+	key     string
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	value   string
+	version versionedkv.Version
+	stop    chan struct{}
+	lost    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (h *holder) Init(storage fsstorage.Storage, key string, options Options) {
+	options.sanitize()
+	h.storage = storage
+	h.key = key
+	h.ttl = options.TTL
+}
+
+// TryAcquire tries to create the value for the key. If the value already exists, false
+// is returned.
+func (h *holder) TryAcquire(ctx context.Context, value string) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.version != nil {
+		return false, ErrHeld
+	}
+	version, err := h.storage.CreateValueWithTTL(ctx, h.key, value, h.ttl)
+	if err != nil {
+		return false, err
+	}
+	if version == nil {
+		return false, nil
+	}
+	h.value = value
+	h.version = version
+	h.stop = make(chan struct{})
+	h.lost = make(chan struct{})
+	h.wg.Add(1)
+	go h.keepAlive(h.stop, h.lost)
+	return true, nil
+}
+
+// Acquire creates the value for the key, waiting for the value to be deleted (or to
+// expire) if it already exists.
+func (h *holder) Acquire(ctx context.Context, value string) error {
+	for {
+		ok, err := h.TryAcquire(ctx, value)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		_, version, err := h.storage.GetValue(ctx, h.key)
+		if err != nil {
+			return err
+		}
+		if version == nil {
+			continue
+		}
+		if _, _, err := h.storage.WaitForValue(ctx, h.key, version); err != nil {
+			return err
+		}
+	}
+}
+
+// Release stops renewing the TTL and deletes the value for the key. If the value has
+// been lost, ErrNotHeld is returned.
+func (h *holder) Release(ctx context.Context) error {
+	h.mu.Lock()
+	stop := h.stop
+	h.stop = nil
+	h.mu.Unlock()
+	if stop == nil {
+		return ErrNotHeld
+	}
+	close(stop)
+	h.wg.Wait()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	version := h.version
+	if version == nil {
+		return ErrNotHeld
+	}
+	h.version = nil
+	close(h.lost)
+	ok, err := h.storage.DeleteValue(ctx, h.key, version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// Lost returns a channel which is closed once the value of the latest acquisition is
+// lost or released, or nil if the value has never been acquired.
+func (h *holder) Lost() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lost
+}
+
+func (h *holder) keepAlive(stop <-chan struct{}, lost chan<- struct{}) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !h.renew(lost) {
+			return
+		}
+	}
+}
+
+func (h *holder) renew(lost chan<- struct{}) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), h.ttl/3)
+	defer cancel()
+	newVersion, err := h.storage.UpdateValueWithTTL(ctx, h.key, h.value, h.version, h.ttl)
+	if err != nil {
+		if err == versionedkv.ErrStorageClosed {
+			h.version = nil
+			close(lost)
+			return false
+		}
+		// Retry on the next tick, which is still within the TTL.
+		return true
+	}
+	if newVersion == nil {
+		// The value expired, and has been deleted or taken over by others.
+		h.version = nil
+		close(lost)
+		return false
+	}
+	h.version = newVersion
+	return true
+}
@@ -0,0 +1,104 @@
+package recipes_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests racing multiple processes re-run the test binary as helper processes, which run
+// the helper given in the environment instead of tests.
+const (
+	helperEnvName      = "RECIPES_TEST_HELPER"
+	baseDirNameEnvName = "RECIPES_TEST_BASE_DIR_NAME"
+)
+
+var helpers = map[string]func(baseDirName string) error{}
+
+func TestMain(m *testing.M) {
+	if helperName := os.Getenv(helperEnvName); helperName != "" {
+		if err := helpers[helperName](os.Getenv(baseDirNameEnvName)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func makeHelperCmd(helperName string, baseDirName string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), helperEnvName+"="+helperName, baseDirNameEnvName+"="+baseDirName)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// runHelpers runs the given number of helper processes concurrently, and waits for all of
+// them to exit successfully.
+func runHelpers(t *testing.T, helperName string, baseDirName string, n int) {
+	cmds := make([]*exec.Cmd, n)
+	for i := range cmds {
+		cmd := makeHelperCmd(helperName, baseDirName)
+		if !assert.NoError(t, cmd.Start()) {
+			t.FailNow()
+		}
+		cmds[i] = cmd
+	}
+	for _, cmd := range cmds {
+		assert.NoError(t, cmd.Wait())
+	}
+}
+
+// readLine reads a line from the standard output of the given helper process, failing if
+// it takes too long.
+func readLine(t *testing.T, reader *bufio.Reader) string {
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+		return ""
+	}
+}
+
+func makeBaseDir(t *testing.T) string {
+	baseDirName, err := ioutil.TempDir("", "testrecipes.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return baseDirName
+}
+
+func openStorage(t *testing.T, baseDirName string) fsstorage.Storage {
+	s, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return s
+}
+
+func readCounter(t *testing.T, s fsstorage.Storage, key string) int {
+	value, _, err := s.GetValue(context.Background(), key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	n, err := strconv.Atoi(value)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return n
+}
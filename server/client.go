@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/go-tk/versionedkv"
+)
+
+// ClientOptions represents options for clients.
+type ClientOptions struct {
+	// Network is the network of the server, either "tcp" or "unix", "tcp" by default.
+	Network string
+
+	// Address is the address of the server, i.e. host:port for "tcp", or the name of
+	// the socket file for "unix".
+	Address string
+}
+
+func (co *ClientOptions) sanitize() {
+	if co.Network == "" {
+		co.Network = "tcp"
+	}
+}
+
+// Client is a storage accessing values through a server, which implements
+// versionedkv.Storage.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	closeOnce  sync.Once
+	closure    chan struct{}
+}
+
+var _ versionedkv.Storage = (*Client)(nil)
+
+// NewClient creates a new client with the given options.
+func NewClient(options ClientOptions) *Client {
+	options.sanitize()
+	var dialer net.Dialer
+	host := options.Address
+	if options.Network == "unix" {
+		// The host is required but meaningless for Unix sockets.
+		host = "unix"
+	}
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, options.Network, options.Address)
+				},
+			},
+		},
+		baseURL: "http://" + host,
+		closure: make(chan struct{}),
+	}
+}
+
+func (c *Client) GetValue(ctx context.Context, key string) (string, versionedkv.Version, error) {
+	return c.getValue(ctx, key, false, nil)
+}
+
+func (c *Client) WaitForValue(ctx context.Context, key string, oldVersion versionedkv.Version) (string, versionedkv.Version, error) {
+	return c.getValue(ctx, key, true, oldVersion)
+}
+
+func (c *Client) getValue(ctx context.Context, key string, wait bool, oldVersion versionedkv.Version) (string, versionedkv.Version, error) {
+	query := url.Values{"key": {key}}
+	header := make(http.Header)
+	if wait {
+		query.Set("wait", "true")
+		if oldVersion != nil {
+			header.Set("If-None-Match", formatETag(oldVersion))
+		}
+	}
+	var value string
+	var version versionedkv.Version
+	err := c.do(ctx, http.MethodGet, "/v1/value", query, header, nil, func(response *http.Response) error {
+		if response.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		rawValue, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		value = string(rawValue)
+		version, err = getETag(response)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return value, version, nil
+}
+
+func (c *Client) CreateValue(ctx context.Context, key string, value string) (versionedkv.Version, error) {
+	newVersion, _, err := c.putValue(ctx, key, value, http.Header{"If-None-Match": {"*"}})
+	return newVersion, err
+}
+
+func (c *Client) UpdateValue(ctx context.Context, key string, value string, oldVersion versionedkv.Version) (versionedkv.Version, error) {
+	header := http.Header{"If-Match": {"*"}}
+	if oldVersion != nil {
+		header.Set("If-Match", formatETag(oldVersion))
+	}
+	newVersion, _, err := c.putValue(ctx, key, value, header)
+	return newVersion, err
+}
+
+func (c *Client) CreateOrUpdateValue(ctx context.Context, key string, value string, oldVersion versionedkv.Version) (versionedkv.Version, error) {
+	if oldVersion == nil {
+		newVersion, _, err := c.putValue(ctx, key, value, nil)
+		return newVersion, err
+	}
+	// There is no single request for this, but updating and then creating if the value
+	// doesn't exist is equivalent, as versions never repeat.
+	newVersion, notFound, err := c.putValue(ctx, key, value, http.Header{"If-Match": {formatETag(oldVersion)}})
+	if err != nil || !notFound {
+		return newVersion, err
+	}
+	return c.CreateValue(ctx, key, value)
+}
+
+// putValue writes the value for the given key with the preconditions given in the header.
+// If the value doesn't exist when it should, true is returned.
+func (c *Client) putValue(ctx context.Context, key string, value string, header http.Header) (versionedkv.Version, bool, error) {
+	query := url.Values{"key": {key}}
+	var newVersion versionedkv.Version
+	var notFound bool
+	err := c.do(ctx, http.MethodPut, "/v1/value", query, header, []byte(value), func(response *http.Response) error {
+		switch response.StatusCode {
+		case http.StatusNotFound:
+			notFound = true
+			return nil
+		case http.StatusPreconditionFailed:
+			return nil
+		}
+		var err error
+		newVersion, err = getETag(response)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return newVersion, notFound, nil
+}
+
+func (c *Client) DeleteValue(ctx context.Context, key string, version versionedkv.Version) (bool, error) {
+	query := url.Values{"key": {key}}
+	header := make(http.Header)
+	if version != nil {
+		header.Set("If-Match", formatETag(version))
+	}
+	var ok bool
+	err := c.do(ctx, http.MethodDelete, "/v1/value", query, header, nil, func(response *http.Response) error {
+		ok = response.StatusCode == http.StatusNoContent
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// Close closes the client, cancelling requests in progress. It doesn't affect the
+// server.
+func (c *Client) Close() error {
+	err := versionedkv.ErrStorageClosed
+	c.closeOnce.Do(func() {
+		close(c.closure)
+		c.httpClient.CloseIdleConnections()
+		err = nil
+	})
+	return err
+}
+
+func (c *Client) Inspect(ctx context.Context) (versionedkv.StorageDetails, error) {
+	if c.isClosed() {
+		return versionedkv.StorageDetails{IsClosed: true}, nil
+	}
+	var values valuesJSON
+	err := c.do(ctx, http.MethodGet, "/v1/values", nil, nil, nil, func(response *http.Response) error {
+		return json.NewDecoder(response.Body).Decode(&values)
+	})
+	if err != nil {
+		return versionedkv.StorageDetails{}, err
+	}
+	var valueDetails map[string]versionedkv.ValueDetails
+	for _, value := range values.Values {
+		if valueDetails == nil {
+			valueDetails = make(map[string]versionedkv.ValueDetails)
+		}
+		valueDetails[value.Key] = versionedkv.ValueDetails{
+			V:       value.Value,
+			Version: parseVersion(value.Version),
+		}
+	}
+	return versionedkv.StorageDetails{
+		Values: valueDetails,
+	}, nil
+}
+
+// do sends a request to the server, and passes the response to the given handler unless
+// the server returns an unexpected error. Requests are cancelled once the client is
+// closed.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	query url.Values,
+	header http.Header,
+	body []byte,
+	responseHandler func(*http.Response) error,
+) error {
+	if c.isClosed() {
+		return versionedkv.ErrStorageClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closure:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := func() error {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		request, err := http.NewRequest(method, c.baseURL+path+"?"+query.Encode(), bodyReader)
+		if err != nil {
+			return err
+		}
+		request = request.WithContext(ctx)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		response, err := c.httpClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		switch response.StatusCode {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent, http.StatusNotFound, http.StatusPreconditionFailed:
+			return responseHandler(response)
+		default:
+			return readError(response)
+		}
+	}()
+	if err != nil {
+		if c.isClosed() {
+			return versionedkv.ErrStorageClosed
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closure:
+		return true
+	default:
+		return false
+	}
+}
+
+func readError(response *http.Response) error {
+	var errorJSON errorJSON
+	if err := json.NewDecoder(response.Body).Decode(&errorJSON); err != nil {
+		return fmt.Errorf("server: unexpected status %q", response.Status)
+	}
+	if errorJSON.Code == errorCodeStorageClosed {
+		return versionedkv.ErrStorageClosed
+	}
+	return fmt.Errorf("server: %s (%s)", errorJSON.Error, errorJSON.Code)
+}
+
+func getETag(response *http.Response) (versionedkv.Version, error) {
+	version, ok := parseETag(response.Header.Get("ETag"))
+	if !ok || version == nil {
+		return nil, fmt.Errorf("server: malformed ETag %q", response.Header.Get("ETag"))
+	}
+	return version, nil
+}
@@ -0,0 +1,366 @@
+// Package server serves file system storages over HTTP, so that processes not written in
+// Go can share values with each other, and provides a client for Go.
+//
+// The API is as follows, where keys are always given in the query, so that any key can be
+// used, and versions are given as entity tags:
+//
+//	GET /v1/value?key=KEY
+//
+// Retrieves the value for the key as the response body, with the version in ETag. If the
+// value doesn't exist, 404 is returned.
+//
+//	GET /v1/value?key=KEY&wait=true
+//
+// Waits for the value for the key to differ from the version given in If-None-Match, as
+// WaitForValue does (long polling). If If-None-Match is not given, it waits for the value
+// to be created. If the value is deleted, 404 is returned.
+//
+//	PUT /v1/value?key=KEY
+//
+// Writes the request body as the value for the key, with the new version in ETag. With
+// "If-None-Match: *", it only creates the value. With "If-Match: *" or If-Match of a
+// version, it only updates the value, at any version or at the given version
+// respectively. Otherwise, it creates or updates the value. If the value doesn't exist
+// when it should, 404 is returned; if the precondition fails otherwise, 412 is returned.
+//
+//	DELETE /v1/value?key=KEY
+//
+// Deletes the value for the key. With If-Match of a version, it only deletes the value
+// at the given version. Status codes for failures are the same as PUT.
+//
+//	GET /v1/values?prefix=PREFIX
+//
+// Lists values with the prefix as JSON, i.e. {"values":[{"key":..., "value":...,
+// "version":...}, ...]}. Values are meant to be text in this case.
+//
+//	GET /v1/watch?prefix=PREFIX
+//
+// Streams changes to values with the prefix as server-sent events. The event name is the
+// type of the change, i.e. create, update, delete or gap, and the data is JSON, i.e.
+// {"key":..., "old_version":..., "new_version":...}.
+//
+// Errors are returned as JSON, i.e. {"code":..., "error":...}. If the storage has been
+// closed, 503 is returned with code "storage_closed".
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+)
+
+// NewHandler creates a new HTTP handler serving the given storage.
+func NewHandler(storage fsstorage.Storage) http.Handler {
+	return &handler{storage: storage}
+}
+
+type handler struct {
+	storage fsstorage.Storage
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/value":
+		switch r.Method {
+		case http.MethodGet:
+			h.getValue(w, r)
+		case http.MethodPut:
+			h.putValue(w, r)
+		case http.MethodDelete:
+			h.deleteValue(w, r)
+		default:
+			writeMethodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	case "/v1/values":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, "GET")
+			return
+		}
+		h.listValues(w, r)
+	case "/v1/watch":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, "GET")
+			return
+		}
+		h.watch(w, r)
+	default:
+		writeError(w, http.StatusNotFound, errorCodeNotFound, "no such endpoint")
+	}
+}
+
+func (h *handler) getValue(w http.ResponseWriter, r *http.Request) {
+	key, ok := getKey(w, r)
+	if !ok {
+		return
+	}
+	var value string
+	var version versionedkv.Version
+	var err error
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait {
+		oldVersion, ok := getVersion(w, r, "If-None-Match")
+		if !ok {
+			return
+		}
+		value, version, err = h.storage.WaitForValue(r.Context(), key, oldVersion)
+	} else {
+		value, version, err = h.storage.GetValue(r.Context(), key)
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if version == nil {
+		writeError(w, http.StatusNotFound, errorCodeValueNotFound, "value not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", formatETag(version))
+	w.Write([]byte(value))
+}
+
+func (h *handler) putValue(w http.ResponseWriter, r *http.Request) {
+	key, ok := getKey(w, r)
+	if !ok {
+		return
+	}
+	rawValue, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCodeBadRequest, err.Error())
+		return
+	}
+	value := string(rawValue)
+	var newVersion versionedkv.Version
+	var statusCode int
+	switch {
+	case r.Header.Get("If-None-Match") == "*":
+		newVersion, err = h.storage.CreateValue(r.Context(), key, value)
+		statusCode = http.StatusCreated
+	case r.Header.Get("If-Match") != "":
+		oldVersion, ok := getVersion(w, r, "If-Match")
+		if !ok {
+			return
+		}
+		newVersion, err = h.storage.UpdateValue(r.Context(), key, value, oldVersion)
+		statusCode = http.StatusOK
+	default:
+		newVersion, err = h.storage.CreateOrUpdateValue(r.Context(), key, value, nil)
+		statusCode = http.StatusOK
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if newVersion == nil {
+		h.writePreconditionFailed(w, r, key)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(newVersion))
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(versionJSON{Version: formatVersion(newVersion)})
+}
+
+func (h *handler) deleteValue(w http.ResponseWriter, r *http.Request) {
+	key, ok := getKey(w, r)
+	if !ok {
+		return
+	}
+	version, ok := getVersion(w, r, "If-Match")
+	if !ok {
+		return
+	}
+	ok, err := h.storage.DeleteValue(r.Context(), key, version)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if !ok {
+		h.writePreconditionFailed(w, r, key)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePreconditionFailed tells whether a write failed because the value doesn't exist
+// (404), or because the value exists but the precondition fails otherwise (412).
+func (h *handler) writePreconditionFailed(w http.ResponseWriter, r *http.Request, key string) {
+	_, version, err := h.storage.GetValue(r.Context(), key)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if version == nil {
+		writeError(w, http.StatusNotFound, errorCodeValueNotFound, "value not found")
+		return
+	}
+	writeError(w, http.StatusPreconditionFailed, errorCodePreconditionFailed, "precondition failed")
+}
+
+func (h *handler) listValues(w http.ResponseWriter, r *http.Request) {
+	iterator := h.storage.Iterate(r.Context(), fsstorage.IterateOptions{
+		Prefix:     r.URL.Query().Get("prefix"),
+		WithValues: true,
+	})
+	values := []valueJSON{}
+	for iterator.Next() {
+		values = append(values, valueJSON{
+			Key:     iterator.Key(),
+			Value:   iterator.Value(),
+			Version: formatVersion(iterator.Version()),
+		})
+	}
+	if err := iterator.Err(); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(valuesJSON{Values: values})
+}
+
+func (h *handler) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errorCodeInternal, "streaming unsupported")
+		return
+	}
+	events, err := h.storage.Watch(r.Context(), r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for event := range events {
+		data, err := json.Marshal(watchEventJSON{
+			Key:        event.Key,
+			OldVersion: formatVersion(event.OldVersion),
+			NewVersion: formatVersion(event.NewVersion),
+		})
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Type, data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func getKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	keys, ok := r.URL.Query()["key"]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errorCodeBadRequest, "missing key")
+		return "", false
+	}
+	return keys[0], true
+}
+
+// getVersion returns the version given in the header with the given name, which is nil if
+// the header is missing or is "*".
+func getVersion(w http.ResponseWriter, r *http.Request, headerName string) (versionedkv.Version, bool) {
+	eTag := r.Header.Get(headerName)
+	if eTag == "" || eTag == "*" {
+		return nil, true
+	}
+	version, ok := parseETag(eTag)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errorCodeBadRequest, fmt.Sprintf("malformed %s", headerName))
+		return nil, false
+	}
+	return version, true
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, versionedkv.ErrStorageClosed):
+		writeError(w, http.StatusServiceUnavailable, errorCodeStorageClosed, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The client has gone away.
+	default:
+		writeError(w, http.StatusInternalServerError, errorCodeInternal, err.Error())
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowedMethods string) {
+	w.Header().Set("Allow", allowedMethods)
+	writeError(w, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(errorJSON{
+		Code:  code,
+		Error: message,
+	})
+}
+
+const (
+	errorCodeBadRequest         = "bad_request"
+	errorCodeNotFound           = "not_found"
+	errorCodeMethodNotAllowed   = "method_not_allowed"
+	errorCodeValueNotFound      = "value_not_found"
+	errorCodePreconditionFailed = "precondition_failed"
+	errorCodeStorageClosed      = "storage_closed"
+	errorCodeInternal           = "internal"
+)
+
+type errorJSON struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+type versionJSON struct {
+	Version string `json:"version"`
+}
+
+type valueJSON struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version string `json:"version"`
+}
+
+type valuesJSON struct {
+	Values []valueJSON `json:"values"`
+}
+
+type watchEventJSON struct {
+	Key        string `json:"key,omitempty"`
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+}
+
+func formatVersion(version versionedkv.Version) string {
+	if version == nil {
+		return ""
+	}
+	return fmt.Sprint(version)
+}
+
+func parseVersion(rawVersion string) versionedkv.Version {
+	if rawVersion == "" {
+		return nil
+	}
+	return rawVersion
+}
+
+func formatETag(version versionedkv.Version) string {
+	return strconv.Quote(formatVersion(version))
+}
+
+func parseETag(eTag string) (versionedkv.Version, bool) {
+	if len(eTag) < 3 || !strings.HasPrefix(eTag, `"`) || !strings.HasSuffix(eTag, `"`) {
+		return nil, false
+	}
+	return parseVersion(eTag[1 : len(eTag)-1]), true
+}
@@ -0,0 +1,195 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-tk/versionedkv"
+	"github.com/go-tk/versionedkv-fs/fsstorage"
+	. "github.com/go-tk/versionedkv-fs/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+		return makeClient("tcp")
+	})
+}
+
+func TestClient_Unix(t *testing.T) {
+	versionedkv.DoTestStorage(t, func() (versionedkv.Storage, error) {
+		return makeClient("unix")
+	})
+}
+
+// testClient is a client which shuts down the server and the storage behind on close.
+type testClient struct {
+	*Client
+
+	server  *httptest.Server
+	storage fsstorage.Storage
+}
+
+func (tc testClient) Close() error {
+	if err := tc.Client.Close(); err != nil {
+		return err
+	}
+	tc.server.Close()
+	return tc.storage.Close()
+}
+
+func makeClient(network string) (versionedkv.Storage, error) {
+	baseDirName, err := ioutil.TempDir("", "testserver.*")
+	if err != nil {
+		return nil, err
+	}
+	storage, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName})
+	if err != nil {
+		return nil, err
+	}
+	server := httptest.NewUnstartedServer(NewHandler(storage))
+	if network == "unix" {
+		listener, err := net.Listen("unix", filepath.Join(baseDirName, "socket"))
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+		server.Listener.Close()
+		server.Listener = listener
+	}
+	server.Start()
+	client := NewClient(ClientOptions{
+		Network: network,
+		Address: server.Listener.Addr().String(),
+	})
+	return testClient{
+		Client:  client,
+		server:  server,
+		storage: storage,
+	}, nil
+}
+
+func TestHandler(t *testing.T) {
+	baseDirName, err := ioutil.TempDir("", "testserver.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := fsstorage.Open(fsstorage.Options{BaseDirName: baseDirName})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer storage.Close()
+	server := httptest.NewServer(NewHandler(storage))
+	defer server.Close()
+	do := func(method string, path string, header map[string]string, body string) *http.Response {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		for name, value := range header {
+			request.Header.Set(name, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return response
+	}
+
+	watchResponse := do("GET", "/v1/watch?prefix=f", nil, "")
+	defer watchResponse.Body.Close()
+	assert.Equal(t, http.StatusOK, watchResponse.StatusCode)
+	assert.Equal(t, "text/event-stream", watchResponse.Header.Get("Content-Type"))
+	reader := bufio.NewReader(watchResponse.Body)
+	readEvent := func() string {
+		lines := make(chan string, 1)
+		go func() {
+			var event string
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == "\n" {
+					break
+				}
+				event += line
+			}
+			lines <- event
+		}()
+		select {
+		case event := <-lines:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+			return ""
+		}
+	}
+
+	response := do("PUT", "/v1/value?key=foo", map[string]string{"If-None-Match": "*"}, "bar")
+	response.Body.Close()
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	eTag := response.Header.Get("ETag")
+	response = do("PUT", "/v1/value?key=foo", map[string]string{"If-None-Match": "*"}, "bar")
+	response.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+	response = do("PUT", "/v1/value?key=baz", map[string]string{"If-Match": "*"}, "bar")
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response = do("PUT", "/v1/value?key=foo", map[string]string{"If-Match": "bad"}, "bar")
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response = do("GET", "/v1/value", nil, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response = do("POST", "/v1/value?key=foo", nil, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+
+	response = do("GET", "/v1/value?key=foo", nil, "")
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "bar", string(body))
+	assert.Equal(t, eTag, response.Header.Get("ETag"))
+
+	assert.Equal(t, "event: create\ndata: {\"key\":\"foo\",\"new_version\":"+eTag+"}\n", readEvent())
+
+	waited := make(chan *http.Response, 1)
+	go func() {
+		waited <- do("GET", "/v1/value?key=foo&wait=true", map[string]string{"If-None-Match": eTag}, "")
+	}()
+	response = do("DELETE", "/v1/value?key=foo", map[string]string{"If-Match": `"x"`}, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+	response = do("DELETE", "/v1/value?key=foo", map[string]string{"If-Match": eTag}, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	select {
+	case response := <-waited:
+		response.Body.Close()
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	assert.Equal(t, "event: delete\ndata: {\"key\":\"foo\",\"old_version\":"+eTag+"}\n", readEvent())
+	response = do("DELETE", "/v1/value?key=foo", nil, "")
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	ctx := context.Background()
+	_, err = storage.CreateValue(ctx, "a", "1")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	response = do("GET", "/v1/values?prefix=a", nil, "")
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, string(body), `"key":"a","value":"1"`)
+}